@@ -1,9 +1,31 @@
 package xmlpath_test
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/fanirthuban/xmlpath"
 	. "gopkg.in/check.v1"
@@ -39,6 +61,18 @@ var htmlTable = []struct {
 	{"&lt;a&gt;", "/html/body", "<a>"},
 	{"<script>if(1<2||2>1){}</script>", "/html/head/script", "if(1<2||2>1){}"},
 	{"<!DOCTYPE HTML>\n<html><body>text", "/html/body", "text"},
+	{"<p><a href='/a'>a</a></p><div><a href='/b'>b</a></div>", "//@href", "/a"},
+	{"<p><a href='/a'>a</a></p><div><a href='/b'>b</a></div>", "//div//@href", "/b"},
+	{"<div><p data-testid='name'>Pen</p><p data-testid='price'>$5</p></div>", "//*[@data-testid='price']", "$5"},
+	{"<a class=' btn\t primary '>Go</a>", "//a[normalize-space(@class)='btn primary']", "Go"},
+	{"<table><tr><th>Price</th><td>5</td><td>6</td></tr></table>", "//th[.='Price']/following-sibling::td[1]", "5"},
+	{"<table><tr><td>a</td><td>b</td><td>c</td></tr></table>", "//td[.='c']/preceding-sibling::td[1]", "b"},
+	{"<dl><dt>Size</dt><dd>XL</dd><dt>Color</dt><dd>Red</dd></dl>", "//dt[.='Color']/following-sibling::dd[1]", "Red"},
+	{"<h2>A</h2><p>1</p><h2>B</h2><p>2</p>", "//p[.='2']/preceding-sibling::h2[1]", "B"},
+	{"<h2>b</h2><h1>a</h1><title>t</title>", "//body//h1 | //body//h2", "b"},
+	{"<h2>Intro</h2><ul><li>a</li></ul><h2>Changelog</h2><div><ul><li>b</li></ul></div>", "//h2[.='Changelog']/following::li", "b"},
+	{"<div><ul><li>a</li><li>b</li></ul></div><div><p>c</p></div>", "//p/preceding::li[1]", "b"},
+	{"<p id='x'><b>a</b></p><i>b</i>", "//p/@id/following::*", "a"},
 }
 
 func (s *BasicSuite) TestHTML(c *C) {
@@ -54,63 +88,3237 @@ func (s *BasicSuite) TestHTML(c *C) {
 	}
 }
 
+var parseAnyTable = []struct {
+	doc, contentType string
+	mode             xmlpath.ParseMode
+	path, result     string
+}{
+	{`<?xml version="1.0"?><rss><title>a</title></rss>`, "text/html", xmlpath.XMLMode, "/rss/title", "a"},
+	{"\ufeff  <!DOCTYPE html><title>a</title>", "", xmlpath.HTMLMode, "/html/head/title", "a"},
+	{`<feed><title>a</title></feed>`, "application/atom+xml; charset=utf-8", xmlpath.XMLMode, "/feed/title", "a"},
+	{`<p>a<br>b`, "text/html; charset=utf-8", xmlpath.HTMLMode, "/html/body/p", "ab"},
+	{`<body><p>a<br>b`, "", xmlpath.HTMLMode, "/html/body/p", "ab"},
+	{"<!-- page -->\n<head><title>a</title>", "", xmlpath.HTMLMode, "/html/head/title", "a"},
+	{`<feed xmlns="http://www.w3.org/2005/Atom"><title>a</title><link href="/"/><entry><title>b</title><content type="html">&lt;p&gt;c&lt;br&gt;</content></entry></feed>`, "", xmlpath.XMLMode, "/feed/entry/title", "b"},
+	{`<rss version="2.0"><channel><title>a</title><description><![CDATA[<a href="/">b</a><meta name="c">]]></description></channel></rss>`, "", xmlpath.XMLMode, "/rss/channel/title", "a"},
+	{`<HTML><body>a`, "application/octet-stream", xmlpath.HTMLMode, "/html/body", "a"},
+	{`<doc><item>a</item></doc>`, "", xmlpath.XMLMode, "/doc/item", "a"},
+	{`<doc><item>a</item></doc>`, "bogus", xmlpath.XMLMode, "/doc/item", "a"},
+}
+
+func (s *BasicSuite) TestParseAny(c *C) {
+	for _, test := range parseAnyTable {
+		c.Logf("Running test: %v", test)
+		node, mode, err := xmlpath.ParseAny(strings.NewReader(test.doc), test.contentType)
+		c.Assert(err, IsNil)
+		c.Assert(mode, Equals, test.mode)
+		result, ok := xmlpath.MustCompile(test.path).String(node)
+		c.Assert(ok, Equals, true)
+		c.Assert(result, Equals, test.result)
+	}
+	c.Assert(xmlpath.HTMLMode.String(), Equals, "html")
+	c.Assert(xmlpath.XMLMode.String(), Equals, "xml")
+
+	_, mode, err := xmlpath.ParseAny(strings.NewReader(`<?xml version="1.0"?><a>`), "")
+	c.Assert(err, NotNil)
+	c.Assert(mode, Equals, xmlpath.XMLMode)
+}
+
+func (s *BasicSuite) TestDecompress(c *C) {
+	var gz, zl, fl bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(libraryXml)
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write(libraryXml)
+	zw.Close()
+	fw, _ := flate.NewWriter(&fl, flate.DefaultCompression)
+	fw.Write(libraryXml)
+	fw.Close()
+
+	xmlpath.RegisterDecoder("X-Test", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) })
+
+	path := xmlpath.MustCompile("/library/book/isbn")
+	for _, test := range []struct {
+		data     []byte
+		encoding string
+	}{
+		{gz.Bytes(), ""},
+		{gz.Bytes(), "gzip"},
+		{gz.Bytes(), "x-test"},
+		{zl.Bytes(), ""},
+		{zl.Bytes(), "deflate"},
+		{fl.Bytes(), "deflate"},
+		{libraryXml, ""},
+		{libraryXml, "identity"},
+	} {
+		r, err := xmlpath.Decompress(bytes.NewReader(test.data), test.encoding, 1<<20)
+		c.Assert(err, IsNil)
+		node, err := xmlpath.Parse(r)
+		c.Assert(err, IsNil)
+		result, ok := path.String(node)
+		c.Assert(ok, Equals, true)
+		c.Assert(result, Equals, "0836217462")
+	}
+
+	// Identity data is left alone even if it looks compressed.
+	r, err := xmlpath.Decompress(bytes.NewReader(gz.Bytes()), "identity", 0)
+	c.Assert(err, IsNil)
+	data, err := io.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, gz.Bytes())
+
+	r, err = xmlpath.Decompress(bytes.NewReader(gz.Bytes()), "gzip", int64(len(libraryXml)))
+	c.Assert(err, IsNil)
+	data, err = io.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, libraryXml)
+
+	r, err = xmlpath.Decompress(bytes.NewReader(gz.Bytes()), "gzip", 100)
+	c.Assert(err, IsNil)
+	data, err = io.ReadAll(r)
+	c.Assert(err, Equals, xmlpath.ErrTooLarge)
+	c.Assert(data, HasLen, 100)
+
+	_, err = xmlpath.Decompress(bytes.NewReader(gz.Bytes()), "br", 0)
+	c.Assert(err, ErrorMatches, `xmlpath: unsupported content encoding "br"`)
+}
+
+func (s *BasicSuite) TestDebug(c *C) {
+	var buf bytes.Buffer
+	handler := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey || a.Key == "elapsed" {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	debug := &xmlpath.Debug{Logger: slog.New(handler).With("doc", "library")}
+
+	node, err := debug.Parse(bytes.NewReader(libraryXml))
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Matches, fmt.Sprintf(""+
+		"level=DEBUG msg=\"xmlpath: parse started\" doc=library mode=xml\n"+
+		"level=DEBUG msg=\"xmlpath: parse finished\" doc=library mode=xml bytes=%d nodes=[0-9]+\n", len(libraryXml)))
+
+	// Evaluations are only logged when slow.
+	buf.Reset()
+	c.Assert(debug.Find(xmlpath.MustCompile("//character"), node), HasLen, 7)
+	c.Assert(debug.Evaluate(xmlpath.MustCompileExpr("count(//book)"), node), Equals, 2.0)
+	c.Assert(buf.String(), Equals, "")
+	debug.SlowEval = time.Nanosecond
+	c.Assert(debug.Find(xmlpath.MustCompile("//character"), node), HasLen, 7)
+	c.Assert(debug.Evaluate(xmlpath.MustCompileExpr("count(//book)"), node), Equals, 2.0)
+	c.Assert(buf.String(), Equals, ""+
+		"level=DEBUG msg=\"xmlpath: slow evaluation\" doc=library expr=//character threshold=1ns nodes=7\n"+
+		"level=DEBUG msg=\"xmlpath: slow evaluation\" doc=library expr=count(//book) threshold=1ns\n")
+
+	buf.Reset()
+	_, err = debug.ParseHTML(strings.NewReader("<p>Hi"))
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Matches, `(?s).*msg="xmlpath: parse finished" doc=library mode=html bytes=5 nodes=[0-9]+\n`)
+
+	buf.Reset()
+	_, err = debug.Parse(strings.NewReader("<a><b></a>"))
+	c.Assert(err, NotNil)
+	c.Assert(buf.String(), Matches, `(?s).*msg="xmlpath: parse failed" doc=library mode=xml bytes=10 error=.*`)
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(libraryXml)
+	gw.Close()
+	buf.Reset()
+	r, err := debug.Decompress(&gz, "gzip", 100)
+	c.Assert(err, IsNil)
+	_, err = debug.Parse(r)
+	c.Assert(err, NotNil)
+	c.Assert(buf.String(), Matches, `(?s).*msg="xmlpath: size limit exceeded" doc=library encoding=gzip limit=100\n.*msg="xmlpath: parse failed".*`)
+
+	// Nothing is logged unless the debug level is enabled.
+	buf.Reset()
+	debug.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+	_, err = debug.Parse(bytes.NewReader(libraryXml))
+	c.Assert(err, IsNil)
+	debug.Find(xmlpath.MustCompile("//character"), node)
+	c.Assert(buf.String(), Equals, "")
+}
+
+func (s *BasicSuite) TestContainer(c *C) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, part := range []struct{ name, data string }{
+		{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"/>`},
+		{"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+			<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/>
+		</Relationships>`},
+		{"word/", ""},
+		{"word/document.xml", `<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body><w:p><w:r><w:t>Hello</w:t></w:r></w:p></w:body></w:document>`},
+		{"word/_rels/document.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+			<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+			<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/image" Target="../media/image1.png"/>
+			<Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/hyperlink" Target="http://example.com/" TargetMode="External"/>
+		</Relationships>`},
+		{"word/styles.xml", `<w:styles xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"/>`},
+	} {
+		w, err := zw.Create(part.name)
+		c.Assert(err, IsNil)
+		w.Write([]byte(part.data))
+	}
+	c.Assert(zw.Close(), IsNil)
+
+	container, err := xmlpath.OpenContainer(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	c.Assert(err, IsNil)
+	c.Assert(container.Parts(), DeepEquals, []string{"[Content_Types].xml", "_rels/.rels", "word/document.xml", "word/_rels/document.xml.rels", "word/styles.xml"})
+
+	rels, err := container.Relationships("")
+	c.Assert(err, IsNil)
+	c.Assert(rels, DeepEquals, []xmlpath.Relationship{
+		{ID: "rId1", Type: "http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument", Target: "word/document.xml"},
+	})
+
+	node, err := container.Parse("/" + rels[0].Target)
+	c.Assert(err, IsNil)
+	text, ok := xmlpath.MustCompile("//t").String(node)
+	c.Assert(ok, Equals, true)
+	c.Assert(text, Equals, "Hello")
+
+	rels, err = container.Relationships("word/document.xml")
+	c.Assert(err, IsNil)
+	c.Assert(rels, HasLen, 3)
+	c.Assert(rels[0].Target, Equals, "word/styles.xml")
+	c.Assert(rels[1].Target, Equals, "media/image1.png")
+	c.Assert(rels[2].Target, Equals, "http://example.com/")
+	c.Assert(rels[2].External, Equals, true)
+
+	rels, err = container.Relationships("word/styles.xml")
+	c.Assert(err, IsNil)
+	c.Assert(rels, HasLen, 0)
+
+	_, err = container.Parse("word/missing.xml")
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(container.Close(), IsNil)
+}
+
+func (s *BasicSuite) TestParseMultipartRelated(c *C) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	root, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {`application/xop+xml; charset=UTF-8; type="text/xml"`},
+		"Content-Id":   {"<root.message@example.com>"},
+	})
+	c.Assert(err, IsNil)
+	root.Write([]byte(`<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:xop="http://www.w3.org/2004/08/xop/include">` +
+		`<soap:Body><upload><name>logo.png</name><data><xop:Include href="cid:logo%40example.com"/></data></upload></soap:Body>` +
+		`</soap:Envelope>`))
+	logo, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"image/png"},
+		"Content-Id":   {"<logo@example.com>"},
+	})
+	c.Assert(err, IsNil)
+	logo.Write([]byte("PNG..."))
+	c.Assert(mw.Close(), IsNil)
+	contentType := `multipart/related; type="application/xop+xml"; start="<root.message@example.com>"; boundary="` + mw.Boundary() + `"`
+
+	node, attachments, err := xmlpath.ParseMultipartRelated(bytes.NewReader(buf.Bytes()), contentType, true)
+	c.Assert(err, IsNil)
+	c.Assert(attachments, HasLen, 1)
+	c.Assert(attachments["logo@example.com"].ContentType, Equals, "image/png")
+	c.Assert(string(attachments["logo@example.com"].Data), Equals, "PNG...")
+	data, ok := xmlpath.MustCompile("//upload/data").String(node)
+	c.Assert(ok, Equals, true)
+	c.Assert(data, Equals, base64.StdEncoding.EncodeToString([]byte("PNG...")))
+	name, ok := xmlpath.MustCompile("//upload/name").String(node)
+	c.Assert(ok, Equals, true)
+	c.Assert(name, Equals, "logo.png")
+
+	node, _, err = xmlpath.ParseMultipartRelated(bytes.NewReader(buf.Bytes()), contentType, false)
+	c.Assert(err, IsNil)
+	href, ok := xmlpath.MustCompile("//upload/data/Include/@href").String(node)
+	c.Assert(ok, Equals, true)
+	c.Assert(href, Equals, "cid:logo%40example.com")
+
+	_, _, err = xmlpath.ParseMultipartRelated(bytes.NewReader(buf.Bytes()), "text/xml", true)
+	c.Assert(err, ErrorMatches, `expected multipart/related content, got "text/xml"`)
+}
+
+func (s *BasicSuite) TestParseElement(c *C) {
+	d := xml.NewDecoder(bytes.NewBuffer(libraryXml))
+	path := xmlpath.MustCompile("/book/isbn")
+	var isbns []string
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		if start, ok := t.(xml.StartElement); ok && start.Name.Local == "book" {
+			node, err := xmlpath.ParseElement(d, start)
+			c.Assert(err, IsNil)
+			isbn, ok := path.String(node)
+			c.Assert(ok, Equals, true)
+			isbns = append(isbns, isbn)
+		}
+	}
+	c.Assert(isbns, DeepEquals, []string{"0836217462", "0883556316"})
+}
+
+var dtdXml = `<?xml version="1.0"?>
+<!DOCTYPE catalog SYSTEM "catalog.dtd" [
+  <!-- Defaults for items. -->
+  <!ATTLIST item
+      status (draft|final) "draft"
+      lang   CDATA         #IMPLIED
+      code   NMTOKEN       #FIXED "  x1  "
+      note   CDATA         'a &amp; b'>
+  <!ATTLIST item status CDATA "ignored">
+  <!ATTLIST p:entry xml:lang CDATA "en" p:rank CDATA "1">
+  <!ELEMENT catalog (item|p:entry)*>
+]>
+<catalog xmlns:p="urn:p"><item status="final"/><item lang="pt"/><p:entry/><entry/></catalog>`
+
+func (s *BasicSuite) TestParseOptionsDefaults(c *C) {
+	attrs := func(root *xmlpath.Node, path string) []string {
+		var result []string
+		iter := xmlpath.MustCompile(path).Iter(root)
+		for iter.Next() {
+			result = append(result, iter.Node().Name().Local+"="+iter.Node().String())
+		}
+		return result
+	}
+
+	root, err := xmlpath.Parse(strings.NewReader(dtdXml))
+	c.Assert(err, IsNil)
+	c.Assert(attrs(root, "//item/@*"), DeepEquals, []string{"status=final", "lang=pt"})
+
+	opts := &xmlpath.ParseOptions{DTDDefaults: true}
+	root, err = opts.Parse(strings.NewReader(dtdXml))
+	c.Assert(err, IsNil)
+	c.Assert(attrs(root, "//item[1]/@*"), DeepEquals, []string{"status=final", "code=x1", "note=a & b"})
+	c.Assert(attrs(root, "//item[2]/@*"), DeepEquals, []string{"lang=pt", "status=draft", "code=x1", "note=a & b"})
+	c.Assert(attrs(root, "/catalog/*[4]/@*"), IsNil)
+	c.Assert(xmlpath.MustCompile("//*[lang('en')]/@*[local-name() = 'rank']").Exists(root), Equals, true)
+	entry := &xmlpath.CompileOptions{Namespaces: map[string]string{"p": "urn:p"}}
+	str, ok := entry.MustCompile("//p:entry/@p:rank").String(root)
+	c.Assert(ok, Equals, true)
+	c.Assert(str, Equals, "1")
+
+	// External declarations are overridden by the internal subset.
+	opts.DTD = `<!ATTLIST item status CDATA "external" kind CDATA "book"><!ATTLIST catalog version CDATA "2">`
+	root, err = opts.Parse(strings.NewReader(dtdXml))
+	c.Assert(err, IsNil)
+	c.Assert(attrs(root, "/catalog/@*"), DeepEquals, []string{"version=2"})
+	c.Assert(attrs(root, "//item[2]/@*"), DeepEquals, []string{"lang=pt", "status=draft", "code=x1", "note=a & b", "kind=book"})
+
+	schema, err := xmlpath.Parse(strings.NewReader(`<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" targetNamespace="urn:c" xmlns:c="urn:c">
+  <xs:attributeGroup name="common"><xs:attribute name="lang" default="en"/></xs:attributeGroup>
+  <xs:complexType name="base"><xs:attribute name="status" default="draft"/></xs:complexType>
+  <xs:complexType name="item">
+    <xs:complexContent><xs:extension base="c:base">
+      <xs:attributeGroup ref="c:common"/>
+      <xs:attribute name="code" fixed="x1"/>
+      <xs:attribute name="label"/>
+    </xs:extension></xs:complexContent>
+  </xs:complexType>
+  <xs:element name="catalog">
+    <xs:complexType>
+      <xs:sequence><xs:element name="item" type="c:item"/></xs:sequence>
+      <xs:attribute name="version" type="xs:string" default="1"/>
+    </xs:complexType>
+  </xs:element>
+</xs:schema>`))
+	c.Assert(err, IsNil)
+	defaults := xmlpath.SchemaDefaults(schema)
+	c.Assert(defaults, DeepEquals, xmlpath.AttrDefaults{
+		{Space: "urn:c", Local: "catalog"}: {{Name: xml.Name{Local: "version"}, Value: "1"}},
+		{Local: "item"}: {
+			{Name: xml.Name{Local: "status"}, Value: "draft"},
+			{Name: xml.Name{Local: "lang"}, Value: "en"},
+			{Name: xml.Name{Local: "code"}, Value: "x1"},
+		},
+	})
+	opts = &xmlpath.ParseOptions{Defaults: defaults}
+	root, err = opts.Parse(strings.NewReader(`<catalog xmlns="urn:c" version="3"><item xmlns="" status="final"/></catalog>`))
+	c.Assert(err, IsNil)
+	c.Assert(attrs(root, "//@*"), DeepEquals, []string{"version=3", "status=final", "lang=en", "code=x1"})
+}
+
+var dirtyHtml = `<div class="post" onclick="steal()">
+<p>Hello <b>world</b><script>alert(1)</script></p>
+<a href="javascript:alert(1)" title="bad">x</a>
+<a href=" Java&#9;Script:alert(1)">y</a>
+<a href="https://example.com/" target="_blank" title="good">z</a>
+<a href="/relative">r</a>
+<img src="data:image/png;base64,AAAA"><!-- note --><style>p{}</style>
+<iframe src="https://evil.example/"><p>frame</p></iframe>
+</div>`
+
+func (s *BasicSuite) TestSanitize(c *C) {
+	node, err := xmlpath.ParseHTML(strings.NewReader(dirtyHtml))
+	c.Assert(err, IsNil)
+	paths := func(paths ...string) []*xmlpath.Path {
+		var result []*xmlpath.Path
+		for _, path := range paths {
+			result = append(result, xmlpath.MustCompile(path))
+		}
+		return result
+	}
+	sanitizer := &xmlpath.Sanitizer{
+		DenyElements:  paths("script", "style", "iframe"),
+		AllowElements: paths("p", "a", "b", "img", "div"),
+		AllowAttrs:    paths("a/@href", "@title", "img/@src", "div/@class"),
+	}
+	clean := sanitizer.Sanitize(node)
+
+	strings := func(path string) []string {
+		var result []string
+		iter := xmlpath.MustCompile(path).Iter(clean)
+		for iter.Next() {
+			result = append(result, iter.Node().String())
+		}
+		return result
+	}
+	c.Assert(strings("/div/@class"), DeepEquals, []string{"post"})
+	c.Assert(strings("/div/@onclick"), HasLen, 0)
+	c.Assert(strings("/div/p"), DeepEquals, []string{"Hello world"})
+	for _, name := range []string{"script", "style", "iframe", "html", "body"} {
+		c.Assert(strings("//"+name), HasLen, 0)
+	}
+	c.Assert(strings("//a"), DeepEquals, []string{"x", "y", "z", "r"})
+	c.Assert(strings("//a/@href"), DeepEquals, []string{"https://example.com/", "/relative"})
+	c.Assert(strings("//a/@title"), DeepEquals, []string{"bad", "good"})
+	c.Assert(strings("//a/@target"), HasLen, 0)
+	c.Assert(strings("//img/@src"), HasLen, 0)
+	c.Assert(strings("//comment()"), HasLen, 0)
+
+	// The original tree is untouched.
+	c.Assert(xmlpath.MustCompile("//script").Exists(node), Equals, true)
+
+	sanitizer.AllowSchemes = []string{"https", "data"}
+	sanitizer.KeepComments = true
+	clean = sanitizer.Sanitize(node)
+	c.Assert(strings("//img/@src"), DeepEquals, []string{"data:image/png;base64,AAAA"})
+	c.Assert(strings("//comment()"), DeepEquals, []string{" note "})
+
+	// Sanitizing an element keeps the element itself.
+	iter := xmlpath.MustCompile("//p").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	clean = (&xmlpath.Sanitizer{DenyElements: paths("b")}).Sanitize(iter.Node())
+	c.Assert(strings("/p"), DeepEquals, []string{"Hello "})
+
+	// Scripts don't get through attributes by default.
+	node, err = xmlpath.ParseHTML(bytes.NewBufferString(`<div onclick="x()" style="position:fixed" class="c"><img src="a.png" OnError="x()"><iframe srcdoc="&lt;script&gt;x()&lt;/script&gt;" title="t"></iframe></div>`))
+	c.Assert(err, IsNil)
+	clean = (&xmlpath.Sanitizer{}).Sanitize(node)
+	c.Assert(strings("//div/@*"), DeepEquals, []string{"c"})
+	c.Assert(strings("//img/@*"), DeepEquals, []string{"a.png"})
+	c.Assert(strings("//iframe"), HasLen, 0)
+	clean = (&xmlpath.Sanitizer{AllowAttrs: paths("@style", "@onclick", "@class")}).Sanitize(node)
+	c.Assert(strings("//div/@*"), DeepEquals, []string{"position:fixed", "c"})
+
+	// Nor through elements, or URLs in lists and foreign attributes.
+	node, err = xmlpath.ParseHTML(bytes.NewBufferString(`<div><script>x()</script><style>p{}</style><object data="javascript:x()"></object><embed src="a.swf"><base href="https://example.com/"><img srcset="a.png 1x, javascript:x() 2x"><img srcset="a.png 1x, b.png 2x"><a ping="/p javascript:x()">p</a><a ping="/p /q">q</a><svg><a xlink:href="javascript:x()">s</a></svg></div>`))
+	c.Assert(err, IsNil)
+	clean = (&xmlpath.Sanitizer{}).Sanitize(node)
+	for _, name := range []string{"script", "style", "object", "embed", "base"} {
+		c.Assert(strings("//"+name), HasLen, 0)
+	}
+	c.Assert(strings("//img/@srcset"), DeepEquals, []string{"a.png 1x, b.png 2x"})
+	c.Assert(strings("//a/@ping"), DeepEquals, []string{"/p /q"})
+	c.Assert(strings("//svg//@*"), HasLen, 0)
+	c.Assert(strings("//svg//text()"), DeepEquals, []string{"s"})
+	clean = (&xmlpath.Sanitizer{AllowElements: paths("div", "script")}).Sanitize(node)
+	c.Assert(strings("//script"), HasLen, 0)
+
+	// Rules match as done by Path.Matches.
+	node, err = xmlpath.Parse(bytes.NewBufferString(`<r><p><b/><i/></p><p><i/><b/></p><q b="1"/></r>`))
+	c.Assert(err, IsNil)
+	for _, rule := range []string{"p/*[1]", "i/..", "self::b", "*[@b] | p[2]/b", "(//i)[1]", "@b/.."} {
+		path := xmlpath.MustCompile(rule)
+		var want []string
+		iter := xmlpath.MustCompile("//*").Iter(node)
+		for iter.Next() {
+			// Denied elements go along with their content.
+			denied := xmlpath.MustCompile("ancestor-or-self::*").IterFunc(iter.Node(), path.Matches)
+			if !denied.Next() {
+				want = append(want, iter.Node().Name().Local)
+			}
+		}
+		clean = (&xmlpath.Sanitizer{DenyElements: []*xmlpath.Path{path}}).Sanitize(node)
+		var got []string
+		iter = xmlpath.MustCompile("//*").Iter(clean)
+		for iter.Next() {
+			got = append(got, iter.Node().Name().Local)
+		}
+		c.Assert(got, DeepEquals, want, Commentf("Rule: %s", rule))
+	}
+}
+
+func (s *BasicSuite) TestRename(c *C) {
+	node, err := xmlpath.Parse(strings.NewReader(`<feed xmlns:a="urn:a"><entry updated="2020" id="1"><link href="x" rel="self"/><title>T</title></entry><a:entry a:id="2"/><!--c--></feed>`))
+	c.Assert(err, IsNil)
+	renamer := &xmlpath.Renamer{Rules: []xmlpath.RenameRule{
+		{Path: xmlpath.MustCompile("entry[@id='1']/@updated"), Name: xml.Name{Local: "modified"}},
+		{Path: xmlpath.MustCompile("entry"), Name: xml.Name{Local: "item"}},
+		{Path: xmlpath.MustCompile("@updated"), Name: xml.Name{Local: "never"}},
+		{Path: xmlpath.MustCompile("link/@href"), To: xmlpath.MustCompile("..")},
+		{Path: xmlpath.MustCompile("link/@rel"), To: xmlpath.MustCompile("nope")},
+		{Path: xmlpath.MustCompile("title"), Name: xml.Name{Space: "urn:a", Local: "name"}},
+	}}
+	renamed := renamer.Rename(node)
+	var buf bytes.Buffer
+	c.Assert(renamed.WriteXML(&buf, nil), IsNil)
+	c.Assert(buf.String(), Equals, `<feed xmlns:a="urn:a"><item modified="2020" id="1" href="x"><link rel="self"/><a:name>T</a:name></item><item a:id="2"/><!--c--></feed>`)
+
+	iter := xmlpath.MustCompile("//name").Iter(renamed)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node().Name(), Equals, xml.Name{Space: "urn:a", Local: "name"})
+
+	// The original tree is untouched, and renaming an element keeps it.
+	c.Assert(xmlpath.MustCompile("//item").Exists(node), Equals, false)
+	iter = xmlpath.MustCompile("//link").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	buf.Reset()
+	c.Assert(renamer.Rename(iter.Node()).WriteXML(&buf, nil), IsNil)
+	c.Assert(buf.String(), Equals, `<link href="x" rel="self"/>`)
+
+	// Namespaces not in scope are declared where needed, so that
+	// names survive being written out and parsed again.
+	renamer = &xmlpath.Renamer{Rules: []xmlpath.RenameRule{
+		{Path: xmlpath.MustCompile("entry"), Name: xml.Name{Space: "urn:new", Local: "item"}},
+		{Path: xmlpath.MustCompile("@id"), Name: xml.Name{Space: "urn:new", Local: "key"}},
+		{Path: xmlpath.MustCompile("title"), Name: xml.Name{Space: "urn:t", Local: "name"}},
+		{Path: xmlpath.MustCompile("link"), Name: xml.Name{Space: "urn:a", Local: "link"}},
+	}}
+	buf.Reset()
+	c.Assert(renamer.Rename(node).WriteXML(&buf, nil), IsNil)
+	c.Assert(buf.String(), Equals, `<feed xmlns:a="urn:a"><ns:item updated="2020" ns:key="1" xmlns:ns="urn:new"><a:link href="x" rel="self"/><ns1:name xmlns:ns1="urn:t">T</ns1:name></ns:item><ns:item ns:key="2" xmlns:ns="urn:new"/><!--c--></feed>`)
+	reparsed, err := xmlpath.Parse(&buf)
+	c.Assert(err, IsNil)
+	var names []xml.Name
+	iter = xmlpath.MustCompile("//* | //@*").Iter(reparsed)
+	for iter.Next() {
+		names = append(names, iter.Node().Name())
+	}
+	c.Assert(names, DeepEquals, []xml.Name{
+		{Local: "feed"}, {Space: "urn:new", Local: "item"}, {Local: "updated"}, {Space: "urn:new", Local: "key"},
+		{Space: "urn:a", Local: "link"}, {Local: "href"}, {Local: "rel"}, {Space: "urn:t", Local: "name"},
+		{Space: "urn:new", Local: "item"}, {Space: "urn:new", Local: "key"},
+	})
+}
+
+func (s *BasicSuite) TestMigrateNamespace(c *C) {
+	node, err := xmlpath.Parse(strings.NewReader(`<r xmlns="urn:v1" xmlns:x="urn:v1" xmlns:o="urn:o"><a x:k="1" o:k="2" k="3"><o:b/>t</a></r>`))
+	c.Assert(err, IsNil)
+	written := func(node *xmlpath.Node) string {
+		var buf bytes.Buffer
+		c.Assert(node.WriteXML(&buf, nil), IsNil)
+		return buf.String()
+	}
+	migrated := xmlpath.MigrateNamespace(node, "urn:v1", "urn:v2")
+	c.Assert(written(migrated), Equals, `<r xmlns="urn:v2" xmlns:x="urn:v2" xmlns:o="urn:o"><a x:k="1" o:k="2" k="3"><o:b/>t</a></r>`)
+	iter := xmlpath.MustCompile("//@k").Iter(migrated)
+	var names []xml.Name
+	for iter.Next() {
+		names = append(names, iter.Node().Name())
+	}
+	c.Assert(names, DeepEquals, []xml.Name{{Space: "urn:v2", Local: "k"}, {Space: "urn:o", Local: "k"}, {Local: "k"}})
+
+	// Migrating an element declares the namespaces in scope of it.
+	iter = xmlpath.MustCompile("/r/a").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(written(xmlpath.MigrateNamespace(iter.Node(), "urn:v1", "urn:v2")), Equals, `<a x:k="1" o:k="2" k="3" xmlns="urn:v2" xmlns:x="urn:v2" xmlns:o="urn:o"><o:b/>t</a>`)
+
+	// The original tree is untouched.
+	c.Assert(written(node), Equals, `<r xmlns="urn:v1" xmlns:x="urn:v1" xmlns:o="urn:o"><a x:k="1" o:k="2" k="3"><o:b/>t</a></r>`)
+}
+
+func (s *BasicSuite) TestScrubText(c *C) {
+	doc := `<users><user email="a@x.com"><name>Ann Lee</name><ssn>123-45-6789</ssn><card><number>4111</number></card></user><note>Call Ann</note></users>`
+	node, err := xmlpath.Parse(strings.NewReader(doc))
+	c.Assert(err, IsNil)
+	mask := func(s string) string { return strings.Repeat("*", len(s)) }
+	node.ScrubText(xmlpath.MustCompile("ssn | card | @email"), mask)
+	var buf bytes.Buffer
+	c.Assert(node.WriteXML(&buf, nil), IsNil)
+	c.Assert(buf.String(), Equals, `<users><user email="*******"><name>Ann Lee</name><ssn>***********</ssn><card><number>****</number></card></user><note>Call Ann</note></users>`)
+
+	// Without a path, all text within the node is scrubbed.
+	iter := xmlpath.MustCompile("//user").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	iter.Node().ScrubText(nil, strings.ToUpper)
+	buf.Reset()
+	c.Assert(node.WriteXML(&buf, nil), IsNil)
+	c.Assert(buf.String(), Equals, `<users><user email="*******"><name>ANN LEE</name><ssn>***********</ssn><card><number>****</number></card></user><note>Call Ann</note></users>`)
+	c.Assert(xmlpath.MustCompile("//user[name='ANN LEE']").Exists(node), Equals, true)
+}
+
+func (s *BasicSuite) TestReplaceAll(c *C) {
+	tmpl, err := xmlpath.Parse(strings.NewReader(`<page lang="xx"><title><slot name="title"/></title><body><slot name="body"/><slot name="nope"/></body></page>`))
+	c.Assert(err, IsNil)
+	fragment, err := xmlpath.Parse(strings.NewReader(`<p>Hello</p><p>World</p>`))
+	c.Assert(err, IsNil)
+	title, err := xmlpath.Parse(strings.NewReader(`<title>Greetings</title>`))
+	c.Assert(err, IsNil)
+	lang, err := xmlpath.Parse(strings.NewReader(`<x lang="en"/>`))
+	c.Assert(err, IsNil)
+	first := func(path string, context *xmlpath.Node) *xmlpath.Node {
+		iter := xmlpath.MustCompile(path).Iter(context)
+		c.Assert(iter.Next(), Equals, true)
+		return iter.Node()
+	}
+	written := func(node *xmlpath.Node) string {
+		var buf bytes.Buffer
+		c.Assert(node.WriteXML(&buf, nil), IsNil)
+		return buf.String()
+	}
+
+	var replaced []string
+	filled := tmpl.ReplaceAll(xmlpath.MustCompile("//slot | //title | /page/@lang"), func(node *xmlpath.Node) *xmlpath.Node {
+		replaced = append(replaced, node.Name().Local)
+		switch node.Name().Local {
+		case "lang":
+			return first("/x/@lang", lang)
+		case "title":
+			return first("/title", title)
+		}
+		if name, _ := xmlpath.MustCompile("@name").String(node); name == "body" {
+			return fragment
+		}
+		return nil
+	})
+	c.Assert(replaced, DeepEquals, []string{"lang", "title", "slot", "slot"})
+	c.Assert(written(filled), Equals, `<page lang="en"><title>Greetings</title><body><p>Hello</p><p>World</p></body></page>`)
+
+	// The original tree is untouched.
+	c.Assert(written(tmpl), Equals, `<page lang="xx"><title><slot name="title"/></title><body><slot name="body"/><slot name="nope"/></body></page>`)
+
+	// Replacing the node itself.
+	c.Assert(written(first("/page/body", tmpl).ReplaceAll(xmlpath.MustCompile("."), func(*xmlpath.Node) *xmlpath.Node {
+		return fragment
+	})), Equals, `<p>Hello</p><p>World</p>`)
+
+	// Replacements of the wrong kind leave nodes as they are.
+	for _, path := range []string{"//slot | //@lang | //@name", "."} {
+		wrong := tmpl.ReplaceAll(xmlpath.MustCompile(path), func(node *xmlpath.Node) *xmlpath.Node {
+			if node.Kind() == xmlpath.AttrNode {
+				return fragment
+			}
+			return first("/x/@lang", lang)
+		})
+		c.Assert(xmlpath.ValidateTree(wrong), IsNil)
+		c.Assert(written(wrong), Equals, written(tmpl))
+	}
+}
+
+func (s *BasicSuite) TestWrapUnwrap(c *C) {
+	root, err := xmlpath.ParseHTML(strings.NewReader(`<div><p><font color="red">Hot <span>deal</span></font> today</p><table><tr><td>1</td></tr></table></div>`))
+	c.Assert(err, IsNil)
+	body := xmlpath.MustCompile("/html/body/div").Iter(root)
+	c.Assert(body.Next(), Equals, true)
+	div := body.Node()
+	written := func(node *xmlpath.Node) string {
+		var buf bytes.Buffer
+		c.Assert(node.WriteXML(&buf, nil), IsNil)
+		return buf.String()
+	}
+
+	c.Assert(written(div.Unwrap(xmlpath.MustCompile("//font | //span | //td/@class"))), Equals,
+		`<div><p>Hot deal today</p><table><tbody><tr><td>1</td></tr></tbody></table></div>`)
+	c.Assert(written(div.Wrap(xmlpath.MustCompile("//table | //p/text() | //@color"), xml.Name{Local: "x"})), Equals,
+		`<div><p><font color="red">Hot <span>deal</span></font><x> today</x></p><x><table><tbody><tr><td>1</td></tr></tbody></table></x></div>`)
+	c.Assert(written(div.Wrap(xmlpath.MustCompile("."), xml.Name{Local: "x"})), Equals,
+		`<x><div><p><font color="red">Hot <span>deal</span></font> today</p><table><tbody><tr><td>1</td></tr></tbody></table></div></x>`)
+
+	// Unwrapping the top element leaves its content alone.
+	c.Assert(written(div.Unwrap(xmlpath.MustCompile("/html/body/div/p"))), Equals,
+		`<div><font color="red">Hot <span>deal</span></font> today<table><tbody><tr><td>1</td></tr></tbody></table></div>`)
+	c.Assert(written(div.Unwrap(xmlpath.MustCompile("."))), Equals,
+		`<p><font color="red">Hot <span>deal</span></font> today</p><table><tbody><tr><td>1</td></tr></tbody></table>`)
+
+	// Namespaces declared by unwrapped elements move into their content.
+	doc, err := xmlpath.Parse(strings.NewReader(`<a><b xmlns:n="urn:n" xmlns="urn:d"><n:c/><d xmlns:n="urn:m"><n:e/></d><n:f/></b></a>`))
+	c.Assert(err, IsNil)
+	c.Assert(written(doc.Unwrap(xmlpath.MustCompile("//*[local-name()='b']"))), Equals,
+		`<a><n:c xmlns:n="urn:n" xmlns="urn:d"/><d xmlns:n="urn:m" xmlns="urn:d"><n:e/></d><n:f xmlns:n="urn:n" xmlns="urn:d"/></a>`)
+}
+
+type splitRecord struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (r *splitRecord) Close() error {
+	r.closed = true
+	return nil
+}
+
+func (s *BasicSuite) TestSplit(c *C) {
+	root, err := xmlpath.Parse(strings.NewReader(`<export xmlns="urn:e" xmlns:c="urn:c"><c:customer id="1"><name>Ann</name></c:customer><note/><c:customer id="2"/></export>`))
+	c.Assert(err, IsNil)
+	path := xmlpath.MustCompile("//*[local-name()='customer']")
+
+	var records []*splitRecord
+	n, err := xmlpath.Split(path, root, func(i int, record *xmlpath.Node) (io.WriteCloser, error) {
+		c.Assert(i, Equals, len(records))
+		records = append(records, &splitRecord{})
+		return records[i], nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	c.Assert(records, HasLen, 2)
+	c.Assert(records[0].closed, Equals, true)
+	c.Assert(records[0].String(), Equals, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+`<c:customer id="1" xmlns="urn:e" xmlns:c="urn:c"><name>Ann</name></c:customer>`+"\n")
+	c.Assert(records[1].String(), Equals, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+`<c:customer id="2" xmlns="urn:e" xmlns:c="urn:c"/>`+"\n")
+
+	// Errors stop splitting.
+	n, err = xmlpath.Split(path, root, func(i int, record *xmlpath.Node) (io.WriteCloser, error) {
+		if i == 1 {
+			return nil, fmt.Errorf("disk full")
+		}
+		return &splitRecord{}, nil
+	})
+	c.Assert(err, ErrorMatches, "disk full")
+	c.Assert(n, Equals, 1)
+
+	_, err = xmlpath.Split(xmlpath.MustCompile("//@id"), root, func(i int, record *xmlpath.Node) (io.WriteCloser, error) {
+		return &splitRecord{}, nil
+	})
+	c.Assert(err, ErrorMatches, "xmlpath: split record 0 is not an element")
+
+	dir := c.MkDir()
+	n, err = xmlpath.SplitFiles(path, root, filepath.Join(dir, "customer-%03d.xml"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	data, err := os.ReadFile(filepath.Join(dir, "customer-001.xml"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, records[1].String())
+}
+
+func (s *BasicSuite) TestMerge(c *C) {
+	parse := func(doc string) *xmlpath.Node {
+		root, err := xmlpath.Parse(strings.NewReader(doc))
+		c.Assert(err, IsNil)
+		return root
+	}
+	written := func(node *xmlpath.Node) string {
+		var buf bytes.Buffer
+		c.Assert(node.WriteXML(&buf, nil), IsNil)
+		return buf.String()
+	}
+	order := parse(`<o:order xmlns:o="urn:o" xmlns:t="urn:t"><o:id t:type="n">1</o:id></o:order>`)
+	other := parse(`<order xmlns="urn:x" xmlns:o="urn:other"><o:note/></order>`)
+	plain := parse(`<plain><!-- c --></plain>`)
+	iter := xmlpath.MustCompile("//*[local-name()='id']").Iter(order)
+	c.Assert(iter.Next(), Equals, true)
+	id := iter.Node()
+
+	merged := xmlpath.Merge(xml.Name{Local: "batch"}, order, id, plain)
+	c.Assert(written(merged), Equals,
+		`<batch xmlns:o="urn:o" xmlns:t="urn:t"><o:order><o:id t:type="n">1</o:id></o:order><o:id t:type="n">1</o:id><plain><!-- c --></plain></batch>`)
+
+	merged = xmlpath.Merge(xml.Name{Space: "urn:b", Local: "batch"}, order, other, plain)
+	c.Assert(written(merged), Equals,
+		`<batch xmlns="urn:b" xmlns:t="urn:t"><o:order xmlns:o="urn:o" xmlns=""><o:id t:type="n">1</o:id></o:order>`+
+			`<order xmlns="urn:x" xmlns:o="urn:other"><o:note/></order><plain xmlns=""><!-- c --></plain></batch>`)
+
+	// Names survive a round trip.
+	var buf bytes.Buffer
+	c.Assert(merged.WriteXML(&buf, nil), IsNil)
+	reparsed := parse(buf.String())
+	names := xmlpath.Map(xmlpath.MustCompile("//*"), reparsed, func(node *xmlpath.Node) string {
+		return node.Name().Space + " " + node.Name().Local
+	})
+	c.Assert(names, DeepEquals, []string{"urn:b batch", "urn:o order", "urn:o id", "urn:x order", "urn:other note", " plain"})
+}
+
+func (s *BasicSuite) TestCSVExport(c *C) {
+	root, err := xmlpath.Parse(strings.NewReader(`<catalog><product sku="a1"><name>Tea, green</name><price>3.5</price></product><product sku="b2"><name>Mug "XL"</name></product><product/></catalog>`))
+	c.Assert(err, IsNil)
+	export := &xmlpath.CSVExport{
+		Rows: xmlpath.MustCompile("//product"),
+		Columns: []xmlpath.CSVColumn{
+			{Name: "sku", Path: xmlpath.MustCompile("@sku")},
+			{Name: "name", Path: xmlpath.MustCompile("name")},
+			{Name: "price", Path: xmlpath.MustCompile("price")},
+		},
+	}
+	var buf bytes.Buffer
+	n, err := export.Write(&buf, root)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	c.Assert(buf.String(), Equals, "sku,name,price\na1,\"Tea, green\",3.5\nb2,\"Mug \"\"XL\"\"\",\n,,\n")
+
+	export.Comma = '\t'
+	export.NoHeader = true
+	buf.Reset()
+	n, err = export.Write(&buf, root)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	c.Assert(buf.String(), Equals, "a1\tTea, green\t3.5\nb2\t\"Mug \"\"XL\"\"\"\t\n\t\t\n")
+
+	// Columns follow the text mode of their paths.
+	root, err = xmlpath.Parse(strings.NewReader(`<catalog><product>Tea <i>green</i></product></catalog>`))
+	c.Assert(err, IsNil)
+	export = &xmlpath.CSVExport{
+		Rows: xmlpath.MustCompile("//product"),
+		Columns: []xmlpath.CSVColumn{
+			{Name: "deep", Path: xmlpath.MustCompile(".")},
+			{Name: "shallow", Path: (&xmlpath.CompileOptions{ShallowText: true}).MustCompile(".")},
+		},
+	}
+	buf.Reset()
+	_, err = export.Write(&buf, root)
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, "deep,shallow\nTea green,Tea \n")
+}
+
+func (s *BasicSuite) TestRowExtractor(c *C) {
+	root, err := xmlpath.Parse(strings.NewReader(`<trades><trade symbol="ACME" open="true"><price>10.5</price></trade><trade symbol="INIT"/><trade symbol="STOP"><price>x</price></trade></trades>`))
+	c.Assert(err, IsNil)
+	x := &xmlpath.RowExtractor{
+		Rows: xmlpath.MustCompile("//trade"),
+		Columns: []xmlpath.Column{
+			{Name: "symbol", Expr: xmlpath.MustCompileExpr("@symbol")},
+			{Name: "price", Expr: xmlpath.MustCompileExpr("price"), Kind: xmlpath.NumberColumn},
+			{Name: "open", Expr: xmlpath.MustCompileExpr("@open = 'true'"), Kind: xmlpath.BoolColumn},
+			{Name: "cents", Expr: xmlpath.MustCompileExpr("price * 100"), Kind: xmlpath.NumberColumn},
+		},
+	}
+	var rows [][]interface{}
+	n, err := x.Extract(root, func(row *xmlpath.Row) error {
+		c.Assert(row.Len(), Equals, 4)
+		c.Assert(row.Node.Name().Local, Equals, "trade")
+		values := make([]interface{}, row.Len())
+		for i := range values {
+			values[i] = row.Value(i)
+		}
+		rows = append(rows, values)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	c.Assert(rows[0], DeepEquals, []interface{}{"ACME", 10.5, true, 1050.0})
+	c.Assert(rows[1][:3], DeepEquals, []interface{}{"INIT", nil, false})
+	c.Assert(math.IsNaN(rows[1][3].(float64)), Equals, true)
+	c.Assert(math.IsNaN(rows[2][1].(float64)), Equals, true)
+
+	var symbols []string
+	n, err = x.Extract(root, func(row *xmlpath.Row) error {
+		symbols = append(symbols, row.String(0))
+		if row.Null(1) {
+			return fmt.Errorf("no price for %s", row.String(0))
+		}
+		return nil
+	})
+	c.Assert(err, ErrorMatches, "no price for INIT")
+	c.Assert(n, Equals, 2)
+	c.Assert(symbols, DeepEquals, []string{"ACME", "INIT"})
+}
+
+func (s *BasicSuite) TestRowDiff(c *C) {
+	parse := func(doc string) *xmlpath.Node {
+		root, err := xmlpath.Parse(strings.NewReader(doc))
+		c.Assert(err, IsNil)
+		return root
+	}
+	before := parse(`<shop><item><name>pen</name><price>2</price></item><item><name>ink</name><price>5</price><sale/></item>` +
+		`<item><name>pad</name><price>3</price></item><item><name>nib</name><price>x</price></item></shop>`)
+	after := parse(`<shop><item><name>cap</name><price>1</price></item><item><name>ink</name><price>4</price></item>` +
+		`<item><name>pen</name><price>2</price><stock>7</stock></item><item><name>nib</name><price>y</price></item></shop>`)
+	x := &xmlpath.RowExtractor{
+		Rows: xmlpath.MustCompile("//item"),
+		Columns: []xmlpath.Column{
+			{Name: "name", Expr: xmlpath.MustCompileExpr("name")},
+			{Name: "price", Expr: xmlpath.MustCompileExpr("price"), Kind: xmlpath.NumberColumn},
+			{Name: "stock", Expr: xmlpath.MustCompileExpr("stock"), Kind: xmlpath.NumberColumn},
+			{Name: "sale", Expr: xmlpath.MustCompileExpr("boolean(sale)"), Kind: xmlpath.BoolColumn},
+		},
+	}
+	var result []string
+	for _, change := range x.Diff(before, after, 0) {
+		result = append(result, fmt.Sprintf("%s %s.%s: %v -> %v", change.Kind, change.Key, change.Name, change.Old, change.New))
+	}
+	c.Assert(result, DeepEquals, []string{
+		"added cap.name: <nil> -> cap",
+		"added cap.price: <nil> -> 1",
+		"added cap.sale: <nil> -> false",
+		"changed ink.price: 5 -> 4",
+		"changed ink.sale: true -> false",
+		"added pen.stock: <nil> -> 7",
+		"removed pad.name: pad -> <nil>",
+		"removed pad.price: 3 -> <nil>",
+		"removed pad.sale: false -> <nil>",
+	})
+	c.Assert(x.Diff(before, before, 0), HasLen, 0)
+}
+
+func (s *BasicSuite) TestIterWithVars(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	path := xmlpath.MustCompile("//book[character[@id=$who]]/@id | //character[substring(born, 1, 4) < $before]/@id | //book/character[$n]/@id")
+	ids := func(vars xmlpath.Vars) []string {
+		var result []string
+		iter := path.IterWithVars(node, vars)
+		for iter.Next() {
+			result = append(result, iter.Node().String())
+		}
+		return result
+	}
+	c.Assert(ids(xmlpath.Vars{"who": "Snoopy"}), DeepEquals, []string{"b0836217462"})
+	c.Assert(ids(xmlpath.Vars{"who": "Barney"}), DeepEquals, []string{"b0883556316"})
+	c.Assert(ids(xmlpath.Vars{"who": "Barney", "before": 1930}), DeepEquals, []string{"b0883556316", "Barney", "Spark"})
+	c.Assert(ids(xmlpath.Vars{"before": 1930.0, "n": int64(2)}), DeepEquals, []string{"Snoopy", "Barney", "Spark"})
+	c.Assert(ids(xmlpath.Vars{"n": true}), HasLen, 7)
+	c.Assert(ids(nil), IsNil)
+
+	// Node sets.
+	iter := xmlpath.MustCompile("//character[@id = 'Lucy']/name").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	lucy := iter.Node()
+	sameName := xmlpath.MustCompile("//character[name = $other]/@id")
+	iter = sameName.IterWithVars(node, xmlpath.Vars{"other": lucy})
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node().String(), Equals, "Lucy")
+	iter = sameName.IterWithVars(node, xmlpath.Vars{"other": []*xmlpath.Node{}})
+	c.Assert(iter.Next(), Equals, false)
+
+	// Variables reach nested paths and iterator copies.
+	iter = xmlpath.MustCompile("/library[book[count(character[qualification = $q]) > 0]]").IterWithVars(node, xmlpath.Vars{"q": "extroverted beagle"})
+	c.Assert(iter.Clone().Next(), Equals, true)
+	c.Assert(iter.Next(), Equals, true)
+
+	c.Assert(func() { path.IterWithVars(node, xmlpath.Vars{"who": struct{}{}}) }, PanicMatches, `xmlpath: unsupported type struct {} for variable \$who`)
+	_, err = xmlpath.Compile("//book[@id=$]")
+	c.Assert(err, ErrorMatches, `compiling xml path "//book\[@id=\$\]":12: missing variable name`)
+}
+
+type scanLevel int
+
+func (l *scanLevel) UnmarshalText(text []byte) error {
+	*l = scanLevel(len(text))
+	return nil
+}
+
+func (s *BasicSuite) TestQueryRow(c *C) {
+	root, err := xmlpath.Parse(strings.NewReader(`<users><user id="42" admin=" true "><name>Ann</name><age> 37 </age><score>9.5</score><level>high</level></user></users>`))
+	c.Assert(err, IsNil)
+	row := xmlpath.MustCompile("//user").QueryRow(root,
+		xmlpath.MustCompile("name"),
+		xmlpath.MustCompile("age"),
+		xmlpath.MustCompile("@admin"),
+		xmlpath.MustCompile("score"),
+		xmlpath.MustCompile("@id"),
+		xmlpath.MustCompile("level"),
+		xmlpath.MustCompile("name"),
+		xmlpath.MustCompile("."),
+	)
+	var name string
+	var age int
+	var admin bool
+	var score float32
+	var id uint64
+	var level scanLevel
+	var raw []byte
+	var node *xmlpath.Node
+	c.Assert(row.Scan(&name, &age, &admin, &score, &id, &level, &raw, &node), IsNil)
+	c.Assert(name, Equals, "Ann")
+	c.Assert(age, Equals, 37)
+	c.Assert(admin, Equals, true)
+	c.Assert(score, Equals, float32(9.5))
+	c.Assert(id, Equals, uint64(42))
+	c.Assert(level, Equals, scanLevel(4))
+	c.Assert(string(raw), Equals, "Ann")
+	c.Assert(node.Name().Local, Equals, "user")
+
+	c.Assert(row.Scan(&name), ErrorMatches, "xmlpath: expected 8 destination arguments in Scan, not 1")
+
+	row = xmlpath.MustCompile("//user/name").QueryRow(root)
+	c.Assert(row.Scan(&name), IsNil)
+	c.Assert(name, Equals, "Ann")
+	c.Assert(row.Scan(&age), ErrorMatches, `xmlpath: scanning field 0: converting "Ann" to int: .*invalid syntax`)
+	c.Assert(row.Scan(name), ErrorMatches, "xmlpath: scanning field 0: destination not a pointer: string")
+	c.Assert(row.Scan(&[]int{}), ErrorMatches, `xmlpath: scanning field 0: unsupported destination type \*\[\]int`)
+
+	c.Assert(xmlpath.MustCompile("//nope").QueryRow(root).Scan(&name), Equals, xmlpath.ErrNoRows)
+	c.Assert(xmlpath.MustCompile("//user").QueryRow(root, xmlpath.MustCompile("email")).Scan(&name), ErrorMatches,
+		"xmlpath: scanning field 0: email matched no nodes")
+
+	// Fields follow the text mode of their paths, as does the row.
+	root, err = xmlpath.Parse(strings.NewReader(`<order>12<note>3</note></order>`))
+	c.Assert(err, IsNil)
+	shallow := &xmlpath.CompileOptions{ShallowText: true}
+	c.Assert(xmlpath.MustCompile("/order").QueryRow(root, shallow.MustCompile("."), xmlpath.MustCompile(".")).Scan(&age, &raw), IsNil)
+	c.Assert(age, Equals, 12)
+	c.Assert(string(raw), Equals, "123")
+	c.Assert(shallow.MustCompile("order").QueryRow(root).Scan(&name), IsNil)
+	c.Assert(name, Equals, "12")
+}
+
+func (s *BasicSuite) TestCompileWithNamespaces(c *C) {
+	root, err := xmlpath.Parse(strings.NewReader(`<feed xmlns="http://www.w3.org/2005/Atom" xmlns:x="urn:x"><entry x:id="1"><title>A</title></entry>` +
+		`<atom:entry xmlns:atom="http://www.w3.org/2005/Atom" xmlns:y="urn:x" y:id="2"><atom:title>B</atom:title></atom:entry><x:entry x:id="3"><x:title>C</x:title></x:entry></feed>`))
+	c.Assert(err, IsNil)
+	ns := map[string]string{"a": "http://www.w3.org/2005/Atom", "ext": "urn:x"}
+	for _, test := range []struct {
+		path   string
+		result []string
+	}{
+		{"//a:entry/a:title", []string{"A", "B"}},
+		{"//ext:entry/ext:title", []string{"C"}},
+		{"//entry/title", []string{"A", "B", "C"}},
+		{"/a:feed/a:*/@ext:id", []string{"1", "2"}},
+		{"//a:entry[@ext:id='2']/child::a:title", []string{"B"}},
+		{"//ext:*[ext:title = 'C']/@ext:id", []string{"3"}},
+		{"//a:title/text() | //ext:title", []string{"A", "B", "C"}},
+		{"//a:title[ancestor::ext:entry]", nil},
+	} {
+		c.Logf("Path: %s", test.path)
+		path := xmlpath.MustCompileWithNamespaces(test.path, ns)
+		c.Assert(xmlpath.Map(path, root, (*xmlpath.Node).String), DeepEquals, test.result)
+	}
+
+	_, err = xmlpath.CompileWithNamespaces("//z:entry", ns)
+	c.Assert(err, ErrorMatches, `compiling xml path "//z:entry":3: unknown namespace prefix "z"`)
+	_, err = xmlpath.CompileWithNamespaces("//a:", ns)
+	c.Assert(err, ErrorMatches, `compiling xml path "//a:":4: missing name after "a:"`)
+	_, err = xmlpath.CompileWithNamespaces("//a:text()", ns)
+	c.Assert(err, ErrorMatches, `compiling xml path "//a:text\(\)":8: unexpected '\('`)
+	_, err = xmlpath.Compile("//a:entry")
+	c.Assert(err, ErrorMatches, `compiling xml path "//a:entry":4: missing ':'`)
+}
+
+func (s *BasicSuite) TestShallowText(c *C) {
+	root, err := xmlpath.Parse(strings.NewReader(`<doc><div id="1">Price: <b>10</b></div><div id="2"> x <p>y</p></div><div id="3">7<i>1</i></div><div id="4"><p>z</p></div></doc>`))
+	c.Assert(err, IsNil)
+	shallow := &xmlpath.CompileOptions{ShallowText: true}
+	for _, test := range []struct {
+		path          string
+		deep, shallow []string
+	}{
+		{"//div[. = 'Price: ']/@id", nil, []string{"1"}},
+		{"//div[. = 'Price: 10']/@id", []string{"1"}, nil},
+		{"//div[normalize-space() = 'x']/@id", nil, []string{"2"}},
+		{"//div[normalize-space(.) = 'x']/@id", nil, []string{"2"}},
+		{"//div[contains(., 'y')]/@id", []string{"2"}, nil},
+		{"//div[starts-with(., ' x')]/@id", []string{"2"}, []string{"2"}},
+		{"//div[. = 7]/@id", nil, []string{"3"}},
+		{"//div[number(.) = 71]/@id", []string{"3"}, nil},
+		{"//div[string-length() = 0]/@id", nil, []string{"4"}},
+		{"/doc[sum(div[@id = 3]) = 7]", nil, []string{"Price: 10 x y71z"}},
+		{"//div[string-join(../div, '|') = 'Price: | x |7|']/@id", nil, []string{"1", "2", "3", "4"}},
+		{"//div[p = 'y']/@id", []string{"2"}, []string{"2"}},
+	} {
+		c.Logf("Path: %s", test.path)
+		c.Assert(xmlpath.Map(xmlpath.MustCompile(test.path), root, (*xmlpath.Node).String), DeepEquals, test.deep)
+		c.Assert(xmlpath.Map(shallow.MustCompile(test.path), root, (*xmlpath.Node).String), DeepEquals, test.shallow)
+	}
+
+	str, ok := shallow.MustCompile("//div").String(root)
+	c.Assert(ok, Equals, true)
+	c.Assert(str, Equals, "Price: ")
+	b, ok := shallow.MustCompile("//div[3]").Bytes(root)
+	c.Assert(ok, Equals, true)
+	c.Assert(string(b), Equals, "7")
+	str, ok = xmlpath.MustCompile("//div").String(root)
+	c.Assert(str, Equals, "Price: 10")
+
+	ns := &xmlpath.CompileOptions{Namespaces: map[string]string{"d": ""}, ShallowText: true}
+	c.Assert(xmlpath.Map(ns.MustCompile("//d:div[. = ' x ']/@id"), root, (*xmlpath.Node).String), DeepEquals, []string{"2"})
+}
+
+func (s *BasicSuite) TestDefaultNamespace(c *C) {
+	root, err := xmlpath.Parse(strings.NewReader(`<feed xmlns="http://www.w3.org/2005/Atom"><entry id="1"><title>A</title></entry>` +
+		`<entry xmlns="urn:other" id="2"><title>B</title></entry><x:entry xmlns:x="http://www.w3.org/2005/Atom" id="3"><title>C</title></x:entry></feed>`))
+	c.Assert(err, IsNil)
+	atom := &xmlpath.CompileOptions{DefaultNamespace: "http://www.w3.org/2005/Atom", Namespaces: map[string]string{"o": "urn:other"}}
+	for _, test := range []struct {
+		path         string
+		local, bound []string
+	}{
+		{"/feed/entry/title", []string{"A", "B", "C"}, []string{"A", "C"}},
+		{"//entry/@id", []string{"1", "2", "3"}, []string{"1", "3"}},
+		{"//o:entry/o:title", []string{"B"}, []string{"B"}},
+		{"//*[title = 'B']/@id", []string{"2"}, nil},
+		{"//title[ancestor::entry/@id = 2]", []string{"B"}, nil},
+		{"//title[ancestor::entry/@id = 3]", []string{"C"}, []string{"C"}},
+		{"//entry/title/text()", []string{"A", "B", "C"}, []string{"A", "C"}},
+		{"/feed/*/@id", []string{"1", "2", "3"}, []string{"1", "2", "3"}},
+	} {
+		c.Logf("Path: %s", test.path)
+		local, err := (&xmlpath.CompileOptions{Namespaces: atom.Namespaces}).Compile(test.path)
+		c.Assert(err, IsNil)
+		c.Assert(xmlpath.Map(local, root, (*xmlpath.Node).String), DeepEquals, test.local)
+		c.Assert(xmlpath.Map(atom.MustCompile(test.path), root, (*xmlpath.Node).String), DeepEquals, test.bound)
+	}
+}
+
+func (s *BasicSuite) TestHTMLText(c *C) {
+	root, err := xmlpath.ParseHTML(strings.NewReader(`<div id="a">Buy <script>var keyword = 1;</script><style>.keyword{}</style>now<template><p>keyword</p></template></div>` +
+		`<div id="b"><p>The keyword</p></div><script id="c">keyword()</script>`))
+	c.Assert(err, IsNil)
+	html := &xmlpath.CompileOptions{HTMLText: true}
+	for _, test := range []struct {
+		path       string
+		deep, html []string
+	}{
+		{"//div[contains(., 'keyword')]/@id", []string{"a", "b"}, []string{"b"}},
+		{"//div[. = 'Buy now']/@id", nil, []string{"a"}},
+		{"//div[normalize-space() = 'Buy now']/@id", nil, []string{"a"}},
+		{"//script[contains(., 'keyword')]/@id", []string{"c"}, []string{"c"}},
+		{"//div[string-length() = 7]/@id", nil, []string{"a"}},
+	} {
+		c.Logf("Path: %s", test.path)
+		c.Assert(xmlpath.Map(xmlpath.MustCompile(test.path), root, (*xmlpath.Node).String), DeepEquals, test.deep)
+		c.Assert(xmlpath.Map(html.MustCompile(test.path), root, (*xmlpath.Node).String), DeepEquals, test.html)
+	}
+	str, ok := html.MustCompile("//body").String(root)
+	c.Assert(ok, Equals, true)
+	c.Assert(str, Equals, "Buy nowThe keyword")
+	b, ok := html.MustCompile("//body").Bytes(root)
+	c.Assert(ok, Equals, true)
+	c.Assert(string(b), Equals, "Buy nowThe keyword")
+
+	// Shallow text prevails.
+	both := &xmlpath.CompileOptions{HTMLText: true, ShallowText: true}
+	str, ok = both.MustCompile("//div").String(root)
+	c.Assert(ok, Equals, true)
+	c.Assert(str, Equals, "Buy now")
+}
+
+func (s *BasicSuite) TestHTMLTemplates(c *C) {
+	doc := `<my-card id="card"><template shadowrootmode="open"><h2>Shadow</h2><slot></slot></template><p>Light</p></my-card>` +
+		`<template id="row"><tr><td>Row</td></tr></template>`
+	written := func(opts *xmlpath.HTMLOptions) string {
+		root, err := opts.Parse(strings.NewReader(doc))
+		c.Assert(err, IsNil)
+		iter := xmlpath.MustCompile("//body").Iter(root)
+		c.Assert(iter.Next(), Equals, true)
+		var buf bytes.Buffer
+		c.Assert(iter.Node().WriteXML(&buf, nil), IsNil)
+		return buf.String()
+	}
+	root, err := xmlpath.ParseHTML(strings.NewReader(doc))
+	c.Assert(err, IsNil)
+	c.Assert(xmlpath.MustCompile("//template/h2").Exists(root), Equals, true)
+
+	c.Assert(written(&xmlpath.HTMLOptions{}), Equals,
+		`<body><my-card id="card"><template shadowrootmode="open"><h2>Shadow</h2><slot/></template><p>Light</p></my-card>`+
+			`<template id="row"><tr><td>Row</td></tr></template></body>`)
+	c.Assert(written(&xmlpath.HTMLOptions{Templates: xmlpath.SkipTemplates}), Equals,
+		`<body><my-card id="card"><template shadowrootmode="open"/><p>Light</p></my-card><template id="row"/></body>`)
+	c.Assert(written(&xmlpath.HTMLOptions{Templates: xmlpath.ShadowRootTemplates}), Equals,
+		`<body><my-card id="card"><h2>Shadow</h2><slot/><p>Light</p></my-card><template id="row"/></body>`)
+}
+
+func (s *BasicSuite) TestWildcardNames(c *C) {
+	root, err := xmlpath.Parse(strings.NewReader(`<doc xmlns="urn:d" xmlns:svg="http://www.w3.org/2000/svg"><title>A</title><svg:svg><svg:title>B</svg:title><svg:rect svg:id="r"/></svg:svg><title xmlns="">C</title></doc>`))
+	c.Assert(err, IsNil)
+	opts := &xmlpath.CompileOptions{
+		Namespaces:       map[string]string{"svg": "http://www.w3.org/2000/svg"},
+		DefaultNamespace: "urn:d",
+	}
+	for _, test := range []struct {
+		path   string
+		result []string
+	}{
+		{"//*:title", []string{"A", "B", "C"}},
+		{"//title", []string{"A"}},
+		{"//svg:*", []string{"B", "B", ""}},
+		{"//svg:svg/svg:*/@svg:*", []string{"r"}},
+		{"/doc/*:*", []string{"A", "B", "C"}},
+		{"//*[*:title = 'B']/svg:rect/@*:id", []string{"r"}},
+		{"//descendant::*:title[. = 'C']", []string{"C"}},
+	} {
+		c.Logf("Path: %s", test.path)
+		c.Assert(xmlpath.Map(opts.MustCompile(test.path), root, (*xmlpath.Node).String), DeepEquals, test.result)
+	}
+	c.Assert(xmlpath.Map(xmlpath.MustCompile("//*:title"), root, (*xmlpath.Node).String), DeepEquals, []string{"A", "B", "C"})
+
+	_, err = xmlpath.Compile("//*:")
+	c.Assert(err, ErrorMatches, `compiling xml path "//\*:":4: missing name after "\*:"`)
+	_, err = xmlpath.Compile("//*:text()")
+	c.Assert(err, ErrorMatches, `compiling xml path "//\*:text\(\)":8: unexpected '\('`)
+	_, err = xmlpath.Compile("//svg:*")
+	c.Assert(err, ErrorMatches, `compiling xml path "//svg:\*":6: missing ':'`)
+}
+
+func (s *BasicSuite) TestMixedContentNodes(c *C) {
+	node, err := xmlpath.Parse(strings.NewReader(`<?pi top?><p a="1">Hi <b>there</b><!--c--><?x y?> end</p>`))
+	c.Assert(err, IsNil)
+	kinds := map[xmlpath.NodeKind]string{
+		xmlpath.StartNode:    "elem",
+		xmlpath.TextNode:     "text",
+		xmlpath.CommentNode:  "comment",
+		xmlpath.ProcInstNode: "pi",
+	}
+	for _, test := range []struct {
+		path   string
+		result []string
+	}{
+		{`/p/child::node()`, []string{"text:Hi ", "elem:there", "comment:c", "pi:y", "text: end"}},
+		{`/p/node()`, []string{"text:Hi ", "elem:there", "comment:c", "pi:y", "text: end"}},
+		{`/node()`, []string{"pi:top", "elem:Hi there end"}},
+		{`//node()`, []string{"pi:top", "elem:Hi there end", "text:Hi ", "elem:there", "text:there", "comment:c", "pi:y", "text: end"}},
+		{`/p/node()[2]`, []string{"elem:there"}},
+		{`/p/node()[last()]`, []string{"text: end"}},
+		{`/p/@a/node()`, nil},
+	} {
+		c.Logf("Path: %s", test.path)
+		var result []string
+		iter := xmlpath.MustCompile(test.path).Iter(node)
+		for iter.Next() {
+			result = append(result, kinds[iter.Node().Kind()]+":"+iter.Node().String())
+		}
+		c.Assert(result, DeepEquals, test.result)
+	}
+}
+
+func (s *BasicSuite) TestProcInstTarget(c *C) {
+	node, err := xmlpath.Parse(strings.NewReader(`<?xml version="1.0"?>
+<?xml-stylesheet href="feed.xsl" type="text/xsl"?>
+<feed><?editor fold="on"?><entry/><?editor fold="off"?></feed>`))
+	c.Assert(err, IsNil)
+	for _, test := range []struct {
+		path   string
+		result []string
+	}{
+		{`/processing-instruction('xml-stylesheet')`, []string{`href="feed.xsl" type="text/xsl"`}},
+		{`/processing-instruction( "xml-stylesheet" )`, []string{`href="feed.xsl" type="text/xsl"`}},
+		{`//processing-instruction('editor')`, []string{`fold="on"`, `fold="off"`}},
+		{`/feed/entry/preceding-sibling::processing-instruction('editor')`, []string{`fold="on"`}},
+		{`/processing-instruction('editor')`, nil},
+	} {
+		c.Logf("Path: %s", test.path)
+		var result []string
+		iter := xmlpath.MustCompile(test.path).Iter(node)
+		for iter.Next() {
+			result = append(result, iter.Node().String())
+		}
+		c.Assert(result, DeepEquals, test.result)
+	}
+}
+
+type mapLoader map[string]string
+
+func (l mapLoader) Load(ctx context.Context, url string) (*xmlpath.Node, error) {
+	doc, ok := l[url]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", url)
+	}
+	return xmlpath.Parse(strings.NewReader(doc))
+}
+
+// waitLoader loads documents once ctx is done, failing with its error.
+type waitLoader struct{}
+
+func (waitLoader) Load(ctx context.Context, url string) (*xmlpath.Node, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *BasicSuite) TestDocumentSet(c *C) {
+	loader := mapLoader{
+		"a.xml": `<feed><item id="1"/><item id="2"><date/></item></feed>`,
+		"b.xml": `<feed/>`,
+		"c.xml": `<feed><item id="3"/></feed>`,
+	}
+	var set xmlpath.DocumentSet
+	c.Assert(set.Load(context.Background(), loader, "a.xml", "b.xml"), IsNil)
+	root, err := loader.Load(context.Background(), "c.xml")
+	c.Assert(err, IsNil)
+	set.Add("local", root)
+	c.Assert(set.Len(), Equals, 3)
+	c.Assert(set.Name(2), Equals, "local")
+	c.Assert(set.Root(2), Equals, root)
+
+	var result []string
+	iter := set.Iter(xmlpath.MustCompile("//item[not(date)]/@id"))
+	for iter.Next() {
+		result = append(result, fmt.Sprintf("%s#%d:%s", iter.Source(), iter.Index(), iter.Node()))
+	}
+	c.Assert(result, DeepEquals, []string{"a.xml#0:1", "local#2:3"})
+	c.Assert(iter.Next(), Equals, false)
+
+	c.Assert(iter.Err(), IsNil)
+	c.Assert(set.Iter(xmlpath.MustCompile("//missing")).Next(), Equals, false)
+	c.Assert((&xmlpath.DocumentSet{}).Iter(xmlpath.MustCompile("//item")).Next(), Equals, false)
+
+	// Iteration stops at the first document failing.
+	opts := &xmlpath.CompileOptions{Loader: loader}
+	result = nil
+	iter = set.Iter(opts.MustCompile("//item[@id != '3' or document('missing.xml')]/@id"))
+	for iter.Next() {
+		result = append(result, iter.Node().String())
+	}
+	c.Assert(result, DeepEquals, []string{"1", "2"})
+	c.Assert(iter.Err(), ErrorMatches, "missing.xml not found")
+	c.Assert(iter.Source(), Equals, "local")
+	c.Assert(iter.Next(), Equals, false)
+
+	err = set.Load(context.Background(), loader, "c.xml", "d.xml", "a.xml")
+	c.Assert(err, ErrorMatches, "xmlpath: loading d.xml: d.xml not found")
+	c.Assert(set.Len(), Equals, 4)
+	c.Assert(set.Name(3), Equals, "c.xml")
+}
+
+func (s *BasicSuite) TestLoadPaths(c *C) {
+	feed := `<feed xmlns="http://www.w3.org/2005/Atom"><title>News</title>` +
+		`<entry><link href="/a"/></entry><entry><link href="/b"/></entry></feed>`
+	root, err := xmlpath.Parse(strings.NewReader(feed))
+	c.Assert(err, IsNil)
+
+	set, err := xmlpath.LoadPaths(strings.NewReader(`{
+		"namespaces": {"a": "http://www.w3.org/2005/Atom"},
+		"paths": {
+			"title": "/a:feed/a:title",
+			"links": "//a:entry/a:link/@href"
+		}
+	}`))
+	c.Assert(err, IsNil)
+	c.Assert(set.Names(), DeepEquals, []string{"links", "title"})
+	title, ok := set.MustPath("title").String(root)
+	c.Assert(ok, Equals, true)
+	c.Assert(title, Equals, "News")
+	c.Assert(xmlpath.Map(set.Path("links"), root, (*xmlpath.Node).String), DeepEquals, []string{"/a", "/b"})
+	c.Assert(set.Path("missing"), IsNil)
+	c.Assert(func() { set.MustPath("missing") }, PanicMatches, `xmlpath: no path named "missing" in set`)
+
+	config := xmlpath.PathConfig{
+		DefaultNamespace: "http://www.w3.org/2005/Atom",
+		Paths:            map[string]string{"entries": "//entry"},
+	}
+	set, err = config.Compile()
+	c.Assert(err, IsNil)
+	c.Assert(xmlpath.Map(set.Path("entries"), root, (*xmlpath.Node).String), HasLen, 2)
+
+	// Every path failing to compile is reported.
+	_, err = xmlpath.LoadPaths(strings.NewReader(`{
+		"namespaces": {"a": "http://www.w3.org/2005/Atom"},
+		"paths": {"title": "/a:feed/a:title", "links": "//z:link", "entries": "//a:entry["}
+	}`))
+	c.Assert(err.Error(), Equals, "xmlpath: 2 paths failed to compile:\n"+
+		"\tentries: "+`compiling xml path "//a:entry[":10: missing name`+"\n"+
+		"\tlinks: "+`compiling xml path "//z:link":3: unknown namespace prefix "z"`)
+	serr, ok := err.(*xmlpath.PathSetError)
+	c.Assert(ok, Equals, true)
+	c.Assert(serr.Names, DeepEquals, []string{"entries", "links"})
+	c.Assert(*serr.Errors[1], Equals, xmlpath.CompileError{Path: "//z:link", Offset: 3, Msg: `unknown namespace prefix "z"`})
+	var cerr *xmlpath.CompileError
+	c.Assert(errors.As(err, &cerr), Equals, true)
+	c.Assert(cerr.Path, Equals, "//a:entry[")
+
+	_, err = xmlpath.LoadPaths(strings.NewReader(`{"path": {"title": "/feed/title"}}`))
+	c.Assert(err, ErrorMatches, `xmlpath: reading paths: json: unknown field "path"`)
+}
+
+var markdownHtml = `<html><head><title>Notes</title><style>p{}</style></head><body>
+<h1>Release <em>notes</em></h1>
+<p>Read the <a href="https://example.com/docs" title="Docs">manual</a>, or *not*.<br>Then run <code>go get</code>.</p>
+<script>alert(1)</script>
+<ul>
+  <li>Faster <b>paths</b></li>
+  <li>Fixes
+    <ol start="3"><li>one</li><li>two</li></ol>
+  </li>
+</ul>
+<blockquote><p>Quoted</p><p>twice</p></blockquote>
+<pre><code class="language-go">if a < b {
+	return
+}</code></pre>
+<table>
+  <thead><tr><th>Name</th><th>Value</th></tr></thead>
+  <tbody><tr><td>a|b</td><td><img src="x.png" alt="X"></td></tr><tr><td>c</td></tr></tbody>
+</table>
+<hr>
+<p>1. Not a list</p>
+</body></html>`
+
+var markdownText = "" +
+	"# Release *notes*\n\n" +
+	"Read the [manual](https://example.com/docs \"Docs\"), or \\*not\\*.\\\nThen run `go get`.\n\n" +
+	"- Faster **paths**\n" +
+	"- Fixes\n" +
+	"  3. one\n" +
+	"  4. two\n\n" +
+	"> Quoted\n" +
+	">\n" +
+	"> twice\n\n" +
+	"```go\nif a < b {\n\treturn\n}\n```\n\n" +
+	"| Name | Value |\n" +
+	"| --- | --- |\n" +
+	"| a\\|b | ![X](x.png) |\n" +
+	"| c |  |\n\n" +
+	"---\n\n" +
+	"1\\. Not a list"
+
+func (s *BasicSuite) TestMarkdown(c *C) {
+	node, err := xmlpath.ParseHTML(strings.NewReader(markdownHtml))
+	c.Assert(err, IsNil)
+	c.Assert(node.Markdown(), Equals, markdownText)
+
+	iter := xmlpath.MustCompile("//h1").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node().Markdown(), Equals, "# Release *notes*")
+}
+
+var namespaceXml = `<a xmlns="urn:default" xmlns:p="urn:p" id="1">
+  <b xmlns:q="urn:q" xmlns:p="urn:p2"><c xmlns="">text</c></b>
+  <d/>
+</a>`
+
+var namespaceTable = []struct{ path, result string }{
+	{"/a/namespace::*", "urn:default urn:p http://www.w3.org/XML/1998/namespace"},
+	{"/a/namespace::p", "urn:p"},
+	{"/a/b/namespace::*", "urn:q urn:p2 urn:default http://www.w3.org/XML/1998/namespace"},
+	{"/a/b/c/namespace::*", "urn:q urn:p2 http://www.w3.org/XML/1998/namespace"},
+	{"/a/d/namespace::*", "urn:default urn:p http://www.w3.org/XML/1998/namespace"},
+	{"/a/b/c/namespace::p", "urn:p2"},
+	{"/a/b/c/namespace::q/..", "text"},
+	{"//*/namespace::*", "urn:default urn:p http://www.w3.org/XML/1998/namespace urn:q urn:p2"},
+	{"/a/@*", "1"},
+	{"/a/b/c/namespace::xml", "http://www.w3.org/XML/1998/namespace"},
+	{"/a/b/c/namespace::xml/../@id", "1"},
+	{"/a/b/c/namespace::xml/following::*[.!='']", "text text"},
+	{"/a/b/c/namespace::xml/preceding::node()", ""},
+	{"/a/b/@*", ""},
+	{"/a/namespace::*[.='urn:p']", "urn:p"},
+	{"/a/namespace::*[2]", "urn:p"},
+	{"/a/@id/namespace::*", ""},
+	{"/a/b/descendant::node()", "text text"},
+	{"/a/b/c/preceding::*", ""},
+	{"/a/d/preceding::node()[.!='\n  ']", "text text text"},
+}
+
+func (s *BasicSuite) TestNamespaceAxis(c *C) {
+	node, err := xmlpath.Parse(strings.NewReader(namespaceXml))
+	c.Assert(err, IsNil)
+	for _, test := range namespaceTable {
+		c.Logf("Path: %s", test.path)
+		var result []string
+		iter := xmlpath.MustCompile(test.path).Iter(node)
+		for iter.Next() {
+			result = append(result, iter.Node().String())
+		}
+		c.Assert(strings.Join(result, " "), Equals, test.result)
+	}
+
+	iter := xmlpath.MustCompile("/a/namespace::*").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node().Kind(), Equals, xmlpath.NamespaceNode)
+	c.Assert(iter.Node().Name(), Equals, xml.Name{Local: ""})
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node().Name(), Equals, xml.Name{Local: "p"})
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node().Name(), Equals, xml.Name{Local: "xml"})
+	c.Assert(iter.Node().String(), Equals, "http://www.w3.org/XML/1998/namespace")
+	c.Assert(xmlpath.ValidateTree(iter.Node()), IsNil)
+	c.Assert(iter.Next(), Equals, false)
+
+	// The xml prefix is only listed once when declared explicitly.
+	node, err = xmlpath.Parse(strings.NewReader(`<a xmlns:xml="http://www.w3.org/XML/1998/namespace"><b/></a>`))
+	c.Assert(err, IsNil)
+	c.Assert(xmlpath.MustCompileExpr("count(/a/b/namespace::xml)").Number(node), Equals, 1.0)
+	c.Assert(xmlpath.MustCompileExpr("count(/a/namespace::*)").Number(node), Equals, 1.0)
+
+	// Namespace declarations are not attributes.
+	node, err = xmlpath.Parse(strings.NewReader(`<a xmlns="urn:a" xmlns:p="urn:p" p:x="1" y="2"/>`))
+	c.Assert(err, IsNil)
+	c.Assert(xmlpath.MustCompileExpr("count(/a/@*)").Number(node), Equals, 2.0)
+	c.Assert(xmlpath.MustCompileExpr("count(/a/attribute::*[name() = 'xmlns' or starts-with(name(), 'xmlns:')])").Number(node), Equals, 0.0)
+	c.Assert(xmlpath.MustCompileExpr("count(/a/namespace::*)").Number(node), Equals, 3.0)
+}
+
+var detectCharsetTable = []struct {
+	content     string
+	contentType string
+	charset     string
+	certain     bool
+}{
+	{"\xef\xbb\xbf<p>a", "text/html; charset=iso-8859-1", "utf-8", true},
+	{"\xff\xfe<\x00p\x00", "", "utf-16le", true},
+	{"\xfe\xff\x00<\x00p", "", "utf-16be", true},
+	{"<p>a", "text/html; charset=ISO-8859-1", "windows-1252", true},
+	{"<p>a", "text/html; charset=\"Shift_JIS\"", "shift_jis", true},
+	{"<meta charset='euc-jp'><p>a", "text/html", "euc-jp", false},
+	{"<meta charset=latin1><p>a", "", "windows-1252", false},
+	{"<!-- <meta charset=koi8-r> --><meta http-equiv=Content-Type content='text/html; charset=\"gb2312\"'>", "", "gbk", false},
+	{"<meta http-equiv=refresh content='charset=big5'><meta charset=utf-8>", "", "utf-8", false},
+	{"<meta charset=utf-16>", "", "utf-8", false},
+	{"<\x00p\x00>\x00", "", "utf-16le", false},
+	{"\x00<\x00p\x00>", "", "utf-16be", false},
+	{"<p>caf\xc3\xa9", "", "utf-8", false},
+	{"<p>caf\xe9", "", "windows-1252", false},
+	{"<p>plain", "", "utf-8", false},
+	{"<p>plain", "text/html; charset=bogus", "utf-8", false},
+	{"<p>caf\xe9", "text/html; charset=utf-9", "windows-1252", false},
+	{"<meta charset=bogus><p>caf\xe9", "", "windows-1252", false},
+	{"<meta charset=nonsense><meta charset=csKOI8R>", "", "koi8-r", false},
+	{strings.Repeat(" ", 1024) + "<meta charset=euc-kr>", "", "utf-8", false},
+	{strings.Repeat("a", 4095) + "\xc3\xa9", "", "utf-8", false},
+}
+
+func (s *BasicSuite) TestDetectCharset(c *C) {
+	for _, test := range detectCharsetTable {
+		c.Logf("Content: %q, content type: %q", test.content, test.contentType)
+		charset, certain := xmlpath.DetectCharset([]byte(test.content), test.contentType)
+		c.Assert(charset, Equals, test.charset)
+		c.Assert(certain, Equals, test.certain)
+	}
+}
+
+var robotsTxt = `# Test rules.
+User-agent: *
+Disallow: /private
+Allow: /private/ok$
+
+User-agent: testbot
+Disallow: /bot
+Disallow: /*.php$
+Crawl-delay: 0.05
+`
+
+func (s *BasicSuite) TestHTTPLoader(c *C) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	version := "v1"
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		etag := `"` + version + `"`
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/etag.xml":
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write([]byte("<doc>" + etag + "</doc>"))
+		case r.URL.Path == "/modified.xml":
+			http.ServeContent(w, r, "modified.xml", modified, strings.NewReader("<doc>modified</doc>"))
+		case r.URL.Path == "/robots.txt":
+			w.Write([]byte(robotsTxt))
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case strings.HasSuffix(r.URL.Path, ".xml"):
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write([]byte("<doc>" + r.URL.Path + "</doc>"))
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<title>" + r.URL.Path + "</title>"))
+		}
+	}))
+	defer server.Close()
+
+	load := func(loader *xmlpath.HTTPLoader, path string) (string, error) {
+		node, err := loader.Load(context.Background(), server.URL+path)
+		if err != nil {
+			return "", err
+		}
+		return node.String(), nil
+	}
+
+	other := &xmlpath.HTTPLoader{UserAgent: "other", RespectRobots: true}
+	_, err := load(other, "/private/a")
+	c.Assert(err, Equals, xmlpath.ErrDisallowed)
+	_, err = load(other, "/private/ok/more")
+	c.Assert(err, Equals, xmlpath.ErrDisallowed)
+	result, err := load(other, "/private/ok")
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "/private/ok")
+	result, err = load(other, "/bot/a.xml")
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "/bot/a.xml")
+
+	bot := &xmlpath.HTTPLoader{UserAgent: "TestBot/1.0", RespectRobots: true}
+	_, err = load(bot, "/bot/a.xml")
+	c.Assert(err, Equals, xmlpath.ErrDisallowed)
+	_, err = load(bot, "/index.php")
+	c.Assert(err, Equals, xmlpath.ErrDisallowed)
+	start := time.Now()
+	result, err = load(bot, "/private/a")
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "/private/a")
+	result, err = load(bot, "/index.php?x=1")
+	c.Assert(err, IsNil)
+	// The Crawl-delay of the bot group applies between requests.
+	c.Assert(time.Since(start) >= 50*time.Millisecond, Equals, true)
+
+	_, err = load(bot, "/missing")
+	c.Assert(err, ErrorMatches, `xmlpath: fetching .*/missing: 404 Not Found`)
+
+	mu.Lock()
+	c.Assert(hits["/robots.txt"], Equals, 2)
+	c.Assert(hits["/private/a"], Equals, 1)
+	mu.Unlock()
+
+	cached := &xmlpath.HTTPLoader{CacheTTL: time.Hour}
+	for i := 0; i < 3; i++ {
+		result, err = load(cached, "/cached.xml")
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, "/cached.xml")
+	}
+	mu.Lock()
+	c.Assert(hits["/cached.xml"], Equals, 1)
+	c.Assert(hits["/robots.txt"], Equals, 2)
+	mu.Unlock()
+
+	// Changes to cached trees are not seen by later callers.
+	node, err := cached.Load(context.Background(), server.URL+"/cached.xml")
+	c.Assert(err, IsNil)
+	node.ScrubText(nil, strings.ToUpper)
+	c.Assert(node.String(), Equals, "/CACHED.XML")
+	result, err = load(cached, "/cached.xml")
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "/cached.xml")
+
+	revalidated := &xmlpath.HTTPLoader{Revalidate: true}
+	var first *xmlpath.Node
+	for i := 0; i < 3; i++ {
+		node, err := revalidated.Load(context.Background(), server.URL+"/etag.xml")
+		c.Assert(err, IsNil)
+		c.Assert(node.String(), Equals, `"v1"`)
+		c.Assert(node == first, Equals, false)
+		first = node
+		node.ScrubText(nil, strings.ToUpper)
+	}
+	mu.Lock()
+	version = "v2"
+	mu.Unlock()
+	result, err = load(revalidated, "/etag.xml")
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, `"v2"`)
+	first = nil
+	for i := 0; i < 2; i++ {
+		node, err := revalidated.Load(context.Background(), server.URL+"/modified.xml")
+		c.Assert(err, IsNil)
+		c.Assert(node.String(), Equals, "modified")
+		c.Assert(node == first, Equals, false)
+		first = node
+		node.ScrubText(nil, strings.ToUpper)
+	}
+	mu.Lock()
+	c.Assert(hits["/etag.xml"], Equals, 4)
+	c.Assert(hits["/modified.xml"], Equals, 2)
+	mu.Unlock()
+
+	_, err = load(&xmlpath.HTTPLoader{MaxSize: 5}, "/large.xml")
+	c.Assert(err, Equals, xmlpath.ErrTooLarge)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = (&xmlpath.HTTPLoader{RespectRobots: true}).Load(ctx, server.URL+"/a.xml")
+	c.Assert(err, Equals, context.Canceled)
+
+	node, err = xmlpath.ParseURL(server.URL + "/parsed.xml")
+	c.Assert(err, IsNil)
+	c.Assert(node.String(), Equals, "/parsed.xml")
+
+	_, err = xmlpath.ParseURL("file:///etc/passwd")
+	c.Assert(err, ErrorMatches, `xmlpath: unsupported URL scheme in "file:///etc/passwd"`)
+}
+
+func (s *BasicSuite) TestDocumentFunc(c *C) {
+	loader := mapLoader{
+		"http://example.com/lists/blocked.xml": `<blocked><sku>b</sku><sku>d</sku></blocked>`,
+		"http://example.com/lists/extra.xml":   `<blocked><sku>a</sku></blocked>`,
+	}
+	node, err := xmlpath.Parse(strings.NewReader(`<orders><order id="1" sku="a"/><order id="2" sku="b"/><order id="3" sku="c"/><list>extra.xml</list></orders>`))
+	c.Assert(err, IsNil)
+	opts := &xmlpath.CompileOptions{Loader: loader, BaseURL: "http://example.com/lists/index.xml"}
+	ids := func(path string) []string {
+		var result []string
+		iter := opts.MustCompile(path).Iter(node)
+		for iter.Next() {
+			result = append(result, iter.Node().String())
+		}
+		return result
+	}
+	c.Assert(ids("//order[@sku = document('blocked.xml')//sku]/@id"), DeepEquals, []string{"2"})
+	c.Assert(ids("//order[@sku = document(//list)/blocked/sku]/@id"), DeepEquals, []string{"1"})
+	c.Assert(ids("document('blocked.xml')//sku[last()]"), DeepEquals, []string{"d"})
+	c.Assert(ids("//order[count(document('/lists/blocked.xml')/*/sku) = @id]/@id"), DeepEquals, []string{"2"})
+
+	// Documents failing to load stop evaluation with their error.
+	for _, path := range []string{"//order[not(document('missing.xml'))]/@id", "document('missing.xml')//sku", "//order[@sku = document('missing.xml')//sku]"} {
+		iter := opts.MustCompile(path).Iter(node)
+		c.Assert(iter.Next(), Equals, false)
+		c.Assert(iter.Err(), ErrorMatches, "http://example.com/lists/missing.xml not found")
+	}
+
+	// Loading is bound by the timeout of the path.
+	slow := &xmlpath.CompileOptions{Loader: waitLoader{}}
+	iter := slow.MustCompile("//order[document('slow.xml')]").WithTimeout(10 * time.Millisecond).Iter(node)
+	c.Assert(iter.Next(), Equals, false)
+	c.Assert(iter.Err(), Equals, xmlpath.ErrTimeout)
+
+	// Trees cached by an HTTPLoader are shared, rather than copied
+	// whenever document() is evaluated.
+	hits := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(`<blocked><sku>b</sku></blocked>`))
+	}))
+	defer server.Close()
+	cached := &xmlpath.CompileOptions{Loader: &xmlpath.HTTPLoader{CacheTTL: time.Hour}, BaseURL: server.URL}
+	path := cached.MustCompile("//order[@sku = document('/blocked.xml')//sku]/@id")
+	var roots []*xmlpath.Node
+	for i := 0; i < 2; i++ {
+		iter := path.Iter(node)
+		c.Assert(iter.Next(), Equals, true)
+		c.Assert(iter.Node().String(), Equals, "2")
+		c.Assert(iter.Next(), Equals, false)
+		iter = cached.MustCompile("document('/blocked.xml')").Iter(node)
+		c.Assert(iter.Next(), Equals, true)
+		roots = append(roots, iter.Node())
+	}
+	c.Assert(roots[0] == roots[1], Equals, true)
+	c.Assert(hits, Equals, 1)
+
+	_, err = xmlpath.Compile("document('blocked.xml')//sku")
+	c.Assert(err, ErrorMatches, `.*document\(\) requires a loader set via CompileOptions.Loader`)
+	_, err = xmlpath.Compile("count(//a)/b")
+	c.Assert(err, ErrorMatches, `.*:0: count\(//a\) does not select nodes`)
+}
+
+func (s *BasicSuite) TestXInclude(c *C) {
+	loader := mapLoader{
+		"http://example.com/book/ch1.xml":        `<chapter id="ch1"><title>One</title><xi:include xmlns:xi="http://www.w3.org/2001/XInclude" href="parts/note.xml"/></chapter>`,
+		"http://example.com/book/parts/note.xml": `<!--n--><note>Note</note>`,
+		"http://example.com/book/terms.xml":      `<terms><term id="go">Go</term><term id="xml">XML</term></terms>`,
+		"http://example.com/book/loop.xml":       `<loop><xi:include xmlns:xi="http://www.w3.org/2001/XInclude" href="loop.xml"/></loop>`,
+	}
+	written := func(node *xmlpath.Node) string {
+		var buf bytes.Buffer
+		c.Assert(node.WriteXML(&buf, nil), IsNil)
+		return buf.String()
+	}
+	doc, err := xmlpath.Parse(strings.NewReader(`<book xmlns:xi="http://www.w3.org/2001/XInclude">` +
+		`<xi:include href="ch1.xml"/>` +
+		`<xi:include href="terms.xml" xpointer="xml"/>` +
+		`<xi:include href="missing.xml"><xi:fallback><p>Missing</p></xi:fallback></xi:include>` +
+		`<p id="self">Self</p><xi:include xpointer="self"/>` +
+		`</book>`))
+	c.Assert(err, IsNil)
+	included, err := doc.ResolveXIncludes(context.Background(), "http://example.com/book/index.xml", loader)
+	c.Assert(err, IsNil)
+	c.Assert(written(included), Equals, `<book xmlns:xi="http://www.w3.org/2001/XInclude">`+
+		`<chapter id="ch1"><title>One</title><!--n--><note>Note</note></chapter>`+
+		`<term id="xml">XML</term><p>Missing</p><p id="self">Self</p><p id="self">Self</p></book>`)
+	c.Assert(xmlpath.MustCompile("//include").Exists(doc), Equals, true)
+
+	for _, test := range []struct{ doc, err string }{
+		{`<xi:include xmlns:xi="http://www.w3.org/2001/XInclude" href="missing.xml"/>`, `xmlpath: including http://example.com/book/missing.xml: .* not found`},
+		{`<xi:include xmlns:xi="http://www.w3.org/2001/XInclude" href="terms.xml" xpointer="nope"/>`, `xmlpath: including http://example.com/book/terms.xml: no element with id "nope"`},
+		{`<xi:include xmlns:xi="http://www.w3.org/2001/XInclude" href="terms.xml" xpointer="element(/1)"/>`, `xmlpath: /include: unsupported xpointer "element\(/1\)"`},
+		{`<xi:include xmlns:xi="http://www.w3.org/2001/XInclude" href="terms.xml" parse="text"/>`, `xmlpath: /include: unsupported inclusion with parse="text"`},
+		{`<xi:include xmlns:xi="http://www.w3.org/2001/XInclude" href="loop.xml"/>`, `xmlpath: /loop/include\[1\]: inclusion loop including http://example.com/book/loop.xml#`},
+	} {
+		doc, err := xmlpath.Parse(strings.NewReader(test.doc))
+		c.Assert(err, IsNil)
+		_, err = doc.ResolveXIncludes(context.Background(), "http://example.com/book/", loader)
+		c.Assert(err, ErrorMatches, test.err)
+	}
+}
+
+func (s *BasicSuite) TestUnion(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	path := xmlpath.MustCompile("//character[@id='Lucy']/name | //isbn")
+
+	iter := path.Iter(node)
+	var steps []string
+	for iter.Next() {
+		match := iter.Match()
+		steps = append(steps, fmt.Sprintf("%d %s %s", match.Position, match.Step, match.Node))
+	}
+	c.Assert(steps, DeepEquals, []string{"1 isbn 0836217462", "2 name Lucy", "3 isbn 0883556316"})
+	c.Assert(func() { iter.Node() }, PanicMatches, "Iter.Node called after Iter.Next false")
+	c.Assert(iter.Next(), Equals, false)
+
+	iter.Reset()
+	c.Assert(func() { iter.Node() }, PanicMatches, "Iter.Node called before Iter.Next")
+	c.Assert(iter.Next(), Equals, true)
+	clone := iter.Clone()
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node().String(), Equals, "Lucy")
+	c.Assert(clone.Node().String(), Equals, "0836217462")
+
+	name := xmlpath.MustCompile("//character/name")
+	iter = name.Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(xmlpath.MustCompile("isbn | character/name").Matches(iter.Node()), Equals, true)
+	c.Assert(xmlpath.MustCompile("isbn | author/name").Matches(iter.Node()), Equals, false)
+	c.Assert(xmlpath.MustCompile("/nope | //character/name").Matches(iter.Node()), Equals, true)
+}
+
+func (s *BasicSuite) TestValidateTree(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	c.Assert(xmlpath.ValidateTree(node), IsNil)
+	iter := xmlpath.MustCompile("//character[@id='Lucy']/@id").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(xmlpath.ValidateTree(iter.Node()), IsNil)
+	html, err := xmlpath.ParseHTML(strings.NewReader(`<p>a<br>b<!-- c --></p>`))
+	c.Assert(err, IsNil)
+	c.Assert(xmlpath.ValidateTree(html), IsNil)
+	merged := xmlpath.Merge(xml.Name{Local: "all"}, node, html)
+	c.Assert(xmlpath.ValidateTree(merged), IsNil)
+	c.Assert(xmlpath.ValidateTree(nil), ErrorMatches, "xmlpath: invalid tree: no nodes")
+
+	// Binary documents are decoded without checking the relationship
+	// between nodes, which is what ValidateTree is for.
+	binaryDoc := func(count int, body ...byte) []byte {
+		data := []byte("xmlpath\x00\x01")
+		data = append(data, byte(count), 3, 0, 1, 'a', 1, 'x')
+		return append(data, body...)
+	}
+	for _, test := range []struct {
+		data []byte
+		err  string
+	}{
+		{binaryDoc(5, 1, 0, 1, 3, 0, 2, 1, '1', 2), ""},
+		{binaryDoc(6, 1, 0, 1, 4, 1, 't', 3, 0, 2, 1, '1', 2), "xmlpath: invalid tree: node 3: attribute node doesn't follow the element holding it"},
+		{binaryDoc(6, 1, 0, 1, 7, 0, 2, 1, 'u', 3, 0, 2, 1, '1', 2), "xmlpath: invalid tree: node 3: attribute node doesn't follow the element holding it"},
+		{binaryDoc(3, 3, 0, 2, 1, '1'), "xmlpath: invalid tree: node 1: attribute node doesn't follow the element holding it"},
+		{binaryDoc(4, 1, 0, 0, 2), "xmlpath: invalid tree: node 1: element has no name"},
+		{binaryDoc(3, 6, 0, 0, 0), "xmlpath: invalid tree: node 1: processing instruction has no target"},
+	} {
+		root, err := xmlpath.LoadBinary(test.data)
+		c.Assert(err, IsNil)
+		if test.err == "" {
+			c.Assert(xmlpath.ValidateTree(root), IsNil)
+		} else {
+			c.Assert(xmlpath.ValidateTree(root), ErrorMatches, test.err)
+		}
+	}
+}
+
+func (s *BasicSuite) TestBinary(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	data, err := node.MarshalBinary()
+	c.Assert(err, IsNil)
+	loaded, err := xmlpath.LoadBinary(data)
+	c.Assert(err, IsNil)
+
+	results := func(root *xmlpath.Node, path *xmlpath.Path) []string {
+		var result []string
+		iter := path.Iter(root)
+		for iter.Next() {
+			n := iter.Node()
+			result = append(result, fmt.Sprintf("%d %v %s", n.Kind(), n.Name(), n.String()))
+		}
+		return result
+	}
+	for _, test := range libraryTable {
+		if _, ok := test.result.(cerror); ok {
+			continue
+		}
+		path := xmlpath.MustCompile(test.path)
+		c.Assert(results(loaded, path), DeepEquals, results(node, path), Commentf("xml path: %s", test.path))
+	}
+
+	// An element is marshalled alone.
+	iter := xmlpath.MustCompile("//character[@id='Lucy']").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	data, err = iter.Node().MarshalBinary()
+	c.Assert(err, IsNil)
+	loaded, err = xmlpath.LoadBinary(data)
+	c.Assert(err, IsNil)
+	c.Assert(results(loaded, xmlpath.MustCompile("/*/@id | //name | /*/comment()")), DeepEquals, []string{
+		"3 { id} Lucy",
+		"1 { name} Lucy",
+	})
+
+	// Namespaces are preserved.
+	node, err = xmlpath.Parse(strings.NewReader(namespaceXml))
+	c.Assert(err, IsNil)
+	data, err = node.MarshalBinary()
+	c.Assert(err, IsNil)
+	loaded, err = xmlpath.LoadBinary(data)
+	c.Assert(err, IsNil)
+	path := xmlpath.MustCompile("//*/namespace::* | //*")
+	c.Assert(results(loaded, path), DeepEquals, results(node, path))
+
+	attr := xmlpath.MustCompile("/a/@id").Iter(node)
+	c.Assert(attr.Next(), Equals, true)
+	_, err = attr.Node().MarshalBinary()
+	c.Assert(err, ErrorMatches, "xmlpath: cannot marshal node of kind 3")
+
+	// Broken data is reported rather than loaded.
+	for i := 0; i < len(data); i++ {
+		_, err = xmlpath.LoadBinary(data[:i])
+		c.Assert(err, NotNil, Commentf("truncated at %d", i))
+	}
+	_, err = xmlpath.LoadBinary(append(data[:len(data):len(data)], 0))
+	c.Assert(err, ErrorMatches, "xmlpath: invalid binary document: trailing data")
+	for i := 9; i < len(data); i++ {
+		corrupt := append([]byte(nil), data...)
+		corrupt[i] ^= 0xff
+		xmlpath.LoadBinary(corrupt) // Must not panic.
+	}
+	_, err = xmlpath.LoadBinary([]byte("xmlpath\x00\x09"))
+	c.Assert(err, ErrorMatches, "xmlpath: unsupported binary document version 9")
+	_, err = xmlpath.LoadBinary([]byte("<a/>"))
+	c.Assert(err, ErrorMatches, "xmlpath: invalid binary document: bad header")
+}
+
+var hashTable = []struct {
+	a, b  string
+	opts  *xmlpath.HashOptions
+	equal bool
+}{
+	{`<r a="1" b="2">x</r>`, `<r b="2" a="1">x</r>`, nil, true},
+	{`<p:r xmlns:p="urn:x" p:a="1"/>`, `<q:r xmlns:q="urn:x" q:a="1"/>`, nil, true},
+	{`<r xmlns="urn:x"/>`, `<r xmlns="urn:y"/>`, nil, false},
+	{`<r xmlns="urn:x"/>`, `<r xmlns="urn:y"/>`, &xmlpath.HashOptions{IgnoreNamespaces: true}, true},
+	{`<r>ab</r>`, `<r>a<![CDATA[b]]></r>`, nil, true},
+	{`<r>ab</r>`, `<r>a<!--c-->b</r>`, nil, false},
+	{`<r>ab</r>`, `<r>a<!--c-->b</r>`, &xmlpath.HashOptions{IgnoreComments: true}, true},
+	{`<r><?pi x?></r>`, `<r/>`, nil, false},
+	{`<r><?pi x?></r>`, `<r/>`, &xmlpath.HashOptions{IgnoreProcInsts: true}, true},
+	{`<r>a</r>`, `<r>b</r>`, nil, false},
+	{`<r><p>ab</p></r>`, `<r><p>a</p><p>b</p></r>`, nil, false},
+	{`<r><p>ab</p></r>`, `<r><p>a</p>b</r>`, nil, false},
+	{`<r a="b"/>`, `<r><a>b</a></r>`, nil, false},
+	{`<r a="bc"/>`, `<r ab="c"/>`, nil, false},
+	{"<r>\n  <p> a  b </p>\n</r>", "<r><p>a b</p></r>", nil, false},
+	{"<r>\n  <p> a  b </p>\n</r>", "<r><p>a b</p></r>", &xmlpath.HashOptions{IgnoreWhitespace: true}, true},
+	{"<r><p>a\u00a0b</p></r>", "<r><p>a b</p></r>", &xmlpath.HashOptions{IgnoreWhitespace: true}, false},
+	{`<r ts="1" id="x"/>`, `<r ts="2" id="x"/>`, nil, false},
+	{`<r ts="1" id="x"/>`, `<r ts="2" id="x"/>`, &xmlpath.HashOptions{IgnoreAttrs: []string{"ts"}}, true},
+	{`<r ts="1" id="x"/>`, `<r ts="2" id="y"/>`, &xmlpath.HashOptions{IgnoreAttrs: []string{"ts"}}, false},
+}
+
+func (s *BasicSuite) TestHash(c *C) {
+	hash := func(doc string, opts *xmlpath.HashOptions) []byte {
+		node, err := xmlpath.Parse(strings.NewReader(doc))
+		c.Assert(err, IsNil)
+		return node.Hash(sha256.New(), opts)
+	}
+	for _, test := range hashTable {
+		c.Logf("Documents: %s and %s, options: %+v", test.a, test.b, test.opts)
+		c.Assert(bytes.Equal(hash(test.a, test.opts), hash(test.b, test.opts)), Equals, test.equal)
+	}
+
+	// Equal records within distinct documents hash the same.
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	var sums [][]byte
+	iter := xmlpath.MustCompile("//author").Iter(node)
+	for iter.Next() {
+		sums = append(sums, iter.Node().Hash(sha256.New(), &xmlpath.HashOptions{IgnoreProcInsts: true, IgnoreWhitespace: true}))
+	}
+	c.Assert(sums, HasLen, 2)
+	c.Assert(sums[0], DeepEquals, sums[1])
+	c.Assert(sums[0], Not(DeepEquals), hash(`<author id="CMS"><name>Charles M Schulz</name></author>`, nil))
+	c.Assert(sums[0], DeepEquals, hash(`<author id="CMS"><name>Charles M Schulz</name><born>1922-11-26</born><dead>2000-02-12</dead></author>`, nil))
+}
+
+func (s *BasicSuite) TestElementByID(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	ids := func(result interface{}) []string {
+		var ids []string
+		for _, node := range result.([]*xmlpath.Node) {
+			id, _ := xmlpath.MustCompile("@id").String(node)
+			ids = append(ids, id)
+		}
+		return ids
+	}
+	c.Assert(ids(xmlpath.MustCompileExpr("id('Lucy\tSnoopy  b0883556316')").Evaluate(node)), DeepEquals, []string{"Snoopy", "Lucy", "b0883556316"})
+	c.Assert(ids(xmlpath.MustCompileExpr("id('nope')").Evaluate(node)), HasLen, 0)
+	c.Assert(node.ElementByID("Lucy").Name().Local, Equals, "character")
+	c.Assert(node.ElementByID("nope"), IsNil)
+
+	node, err = xmlpath.Parse(strings.NewReader(`<r><a xml:id="x"/><b id="y"/><c key="z"/></r>`))
+	c.Assert(err, IsNil)
+	c.Assert(node.ElementByID("x").Name().Local, Equals, "a")
+	c.Assert(node.ElementByID("y").Name().Local, Equals, "b")
+	c.Assert(node.ElementByID("z"), IsNil)
+	iter := xmlpath.MustCompile("/r/c").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	iter.Node().IndexIDs(xml.Name{Local: "key"})
+	c.Assert(node.ElementByID("y"), IsNil)
+	c.Assert(iter.Node().ElementByID("z").Name().Local, Equals, "c")
+	c.Assert(xmlpath.MustCompile("/r[id('z')]").Exists(node), Equals, true)
+
+	// Sources keep their index up to date when edited.
+	source, err := xmlpath.ParseSource([]byte(`<r><a key="x"/><b key="y"/></r>`))
+	c.Assert(err, IsNil)
+	source.Root().IndexIDs(xml.Name{Local: "key"})
+	c.Assert(source.Edit(11, 12, []byte("z")), IsNil)
+	c.Assert(source.Root().ElementByID("x"), IsNil)
+	c.Assert(source.Root().ElementByID("z").Name().Local, Equals, "a")
+	c.Assert(source.Edit(27, 27, []byte(`<c key="w"/>`)), IsNil)
+	c.Assert(source.Root().ElementByID("w").Name().Local, Equals, "c")
+	c.Assert(source.Root().ElementByID("y").Name().Local, Equals, "b")
+}
+
+func (s *BasicSuite) TestIDREFs(c *C) {
+	doc := `<book>
+  <chapter id="intro"><xref linkend="setup"/></chapter>
+  <chapter id="setup"><xref linkend="intro  nope setup intro"/>
+    <xref linkend="gone"/></chapter>
+</book>`
+	linkend := xml.Name{Local: "linkend"}
+	node, err := xmlpath.Parse(strings.NewReader(doc))
+	c.Assert(err, IsNil)
+	xrefs := xmlpath.MustCompile("//xref").Iter(node)
+	var resolved [][]string
+	for xrefs.Next() {
+		var ids []string
+		for _, elem := range xrefs.Node().ResolveIDREF(linkend) {
+			id, _ := xmlpath.MustCompile("@id").String(elem)
+			ids = append(ids, id)
+		}
+		resolved = append(resolved, ids)
+	}
+	c.Assert(resolved, DeepEquals, [][]string{{"setup"}, {"intro", "setup"}, nil})
+	c.Assert(node.ResolveIDREF(linkend), IsNil)
+
+	errs := node.CheckIDREFs(linkend, xml.Name{Local: "endterm"})
+	c.Assert(errs, HasLen, 2)
+	c.Assert(errs[0].ID, Equals, "nope")
+	c.Assert(errs[0].Attr.String(), Equals, "intro  nope setup intro")
+	c.Assert(errs[0].Error(), Equals, `xmlpath: /book/chapter[2]/xref[1]/@linkend: no element with id "nope"`)
+	c.Assert(errs[1].Error(), Equals, `xmlpath: /book/chapter[2]/xref[2]/@linkend: no element with id "gone"`)
+	c.Assert(node.CheckIDREFs(xml.Name{Local: "endterm"}), IsNil)
+
+	source, err := xmlpath.ParseSource([]byte(doc))
+	c.Assert(err, IsNil)
+	errs = source.CheckIDREFs(linkend)
+	c.Assert(errs, HasLen, 2)
+	c.Assert(errs[1].Start, Equals, xmlpath.Position{Line: 4, Column: 11})
+	c.Assert(errs[1].Error(), Equals, `xmlpath: line 4, column 11: /book/chapter[2]/xref[2]/@linkend: no element with id "gone"`)
+	c.Assert(source.Edit(errs[1].Span.Start+9, errs[1].Span.End-1, []byte("intro")), IsNil)
+	c.Assert(source.CheckIDREFs(linkend), HasLen, 1)
+}
+
+func (s *BasicSuite) TestNameFunctions(c *C) {
+	node, err := xmlpath.Parse(strings.NewReader(`<r xmlns="urn:d" xmlns:svg="http://www.w3.org/2000/svg"><svg:svg svg:w="1" h="2"/><a/><?pi x?></r>`))
+	c.Assert(err, IsNil)
+	for _, test := range []struct{ expr, result string }{
+		{"name(//*[local-name() = 'svg'])", "svg:svg"},
+		{"local-name(//*[namespace-uri() = 'http://www.w3.org/2000/svg'])", "svg"},
+		{"namespace-uri(//*[local-name() = 'a'])", "urn:d"},
+		{"name(//*[local-name() = 'a'])", "a"},
+		{"name(//@*[namespace-uri() != ''])", "svg:w"},
+		{"name(//@*[namespace-uri() = ''])", "h"},
+		{"name(//processing-instruction())", "pi"},
+		{"count(//*[namespace-uri() = 'urn:d'])", "2"},
+	} {
+		c.Logf("Expression: %s", test.expr)
+		c.Assert(xmlpath.MustCompileExpr(test.expr).String(node), Equals, test.result)
+	}
+}
+
+func (s *BasicSuite) TestLang(c *C) {
+	node, err := xmlpath.Parse(strings.NewReader(`<doc xml:lang="en"><p id="1">a</p><p id="2" xml:lang="en-US">b<q id="3">c</q></p><p id="4" xml:lang="DE">d</p><p id="5" xml:lang="">e</p></doc>`))
+	c.Assert(err, IsNil)
+	for _, test := range []struct {
+		path   string
+		result []string
+	}{
+		{"//*[lang('en')]/@id", []string{"1", "2", "3"}},
+		{"//*[lang('EN')]/@id", []string{"1", "2", "3"}},
+		{"//*[lang('en-us')]/@id", []string{"2", "3"}},
+		{"//*[lang('e')]/@id", nil},
+		{"//*[lang('de')]/@id", []string{"4"}},
+		{"//@id[lang('en')]", []string{"1", "2", "3"}},
+		{"//text()[lang('de')]", []string{"d"}},
+		{"//p[not(lang('en') or lang('de'))]/@id", []string{"5"}},
+	} {
+		c.Logf("Path: %s", test.path)
+		c.Assert(xmlpath.Map(xmlpath.MustCompile(test.path), node, (*xmlpath.Node).String), DeepEquals, test.result)
+	}
+	c.Assert(xmlpath.MustCompileExpr("lang('en')").Bool(node), Equals, false)
+}
+
+func (s *BasicSuite) TestStats(c *C) {
+	node, err := xmlpath.Parse(strings.NewReader(`<a x="1" xmlns:p="u"><b>hi</b><!--c--><?p i?><c><d/></c></a>`))
+	c.Assert(err, IsNil)
+	stats := node.Stats()
+	memory := stats.Memory
+	stats.Memory = 0
+	c.Assert(stats, Equals, xmlpath.Stats{
+		Elements:   4,
+		Attrs:      1,
+		Namespaces: 1,
+		Texts:      1,
+		Comments:   1,
+		ProcInsts:  1,
+		TextBytes:  4,
+		AttrBytes:  2,
+		Depth:      3,
+	})
+	c.Assert(stats.Nodes(), Equals, 9)
+
+	iter := xmlpath.MustCompile("/a/b").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	stats = iter.Node().Stats()
+	c.Assert(stats.Elements, Equals, 1)
+	c.Assert(stats.Texts, Equals, 1)
+	c.Assert(stats.TextBytes, Equals, 2)
+	c.Assert(stats.Depth, Equals, 1)
+	c.Assert(stats.Memory > 0 && stats.Memory < memory, Equals, true)
+
+	iter = xmlpath.MustCompile("/a/@x").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	stats = iter.Node().Stats()
+	c.Assert(stats.Nodes(), Equals, 1)
+	c.Assert(stats.AttrBytes, Equals, 1)
+	c.Assert(stats.Depth, Equals, 0)
+
+	// The memory footprint grows along with the document.
+	node, err = xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	c.Assert(node.Stats().Memory > memory+len(libraryXml)/2, Equals, true)
+}
+
+func (s *BasicSuite) TestEstimateCost(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	stats := node.NameStats()
+	c.Assert(stats.Stats, Equals, node.Stats())
+	c.Assert(stats.ElementsByName["book"], Equals, 2)
+	c.Assert(stats.ElementsByName["character"], Equals, 7)
+	c.Assert(stats.AttrsByName["id"], Equals, 11)
+	c.Assert(xmlpath.MustCompile("//book").EstimateCost(node), Equals, stats.EstimateCost(xmlpath.MustCompile("//book")))
+
+	// All kinds of paths may be estimated.
+	for _, path := range []string{
+		"/library/book/title", "//character[@id='Lucy']/name", "//@id", "//book/@*", "//comment()",
+		"//book[1]/character[last()]", "//character/ancestor::book", "//name/preceding::isbn",
+		"(//character)[2]/born", "//isbn | //title", "//book[count(character) > 3][contains(title, 'Dog')]",
+		"//character[name = $name]", "//book[not(@available)]/namespace::*", "//text()[normalize-space(.)]",
+	} {
+		c.Logf("Path: %s", path)
+		c.Assert(xmlpath.MustCompile(path).EstimateCost(node) > 0, Equals, true)
+	}
+
+	doc := "<list>" + strings.Repeat(`<item id="x"><name>text</name><price>1</price></item>`, 1000) + "</list>"
+	node, err = xmlpath.Parse(strings.NewReader(doc))
+	c.Assert(err, IsNil)
+	stats = node.NameStats()
+	nodes := stats.Nodes()
+	cost := func(path string) int {
+		return stats.EstimateCost(xmlpath.MustCompile(path))
+	}
+
+	// Scanning the document once costs about as many nodes as it has.
+	for _, path := range []string{"/list/item/name", "//name", "//item[@id='x']", "//item//name", "//@id", "//name | //price"} {
+		c.Logf("Path: %s", path)
+		c.Assert(cost(path) > nodes/4 && cost(path) <= 2*nodes, Equals, true)
+	}
+
+	// Positional predicates cut scans short.
+	c.Assert(cost("/list/item[1]/name") < 10, Equals, true)
+	c.Assert(cost("/list/item[position() <= 10]/name") < 100, Equals, true)
+
+	// Scanning the document for each of many nodes stands out.
+	c.Assert(cost("//item[name = //name]") > 100*nodes, Equals, true)
+	c.Assert(cost("//item/following::name") > 100*nodes, Equals, true)
+	c.Assert(cost("//item[last()]/following::name") < 10*nodes, Equals, true)
+	c.Assert(cost("//*[.//*[.//*]]") > cost("//*[.//*]"), Equals, true)
+
+	// Calls cost as well, with loading documents standing out.
+	c.Assert(cost("id('x')/name") > 0, Equals, true)
+	opts := &xmlpath.CompileOptions{Loader: mapLoader{}}
+	c.Assert(stats.EstimateCost(opts.MustCompile("document('a.xml')/list")) > 100*nodes, Equals, true)
+	c.Assert(stats.EstimateCost(opts.MustCompile("//item[@id = document('a.xml')//id]")) > 1000*cost("//item[@id = 'x']"), Equals, true)
+}
+
+var writeXMLTable = []struct {
+	doc    string
+	path   string
+	opts   *xmlpath.XMLOptions
+	result string
+}{
+	{`<r a="1" b="x&amp;&quot;y">t&lt;<!--c--><?pi x?><e/></r>`, "/", nil, `<r a="1" b="x&amp;&quot;y">t&lt;<!--c--><?pi x?><e/></r>`},
+	{`<r><p:e xmlns:p="urn:p" xmlns="urn:d" p:a="1"><f xml:lang="en"/></p:e></r>`, "/", nil, `<r><p:e p:a="1" xmlns:p="urn:p" xmlns="urn:d"><f xml:lang="en"/></p:e></r>`},
+	{`<r xmlns="urn:d" xmlns:p="urn:p"><e><p:f/></e></r>`, "/r/e", nil, `<e xmlns="urn:d" xmlns:p="urn:p"><p:f/></e>`},
+	{`<r a="1"><e/></r>`, "/r/@a", nil, `a="1"`},
+	{`<r>t</r>`, "/r/text()", nil, `t`},
+	{`<r><a><b><c/></b>x</a><d/></r>`, "/r", &xmlpath.XMLOptions{MaxDepth: 1}, `<r><a><!-- 3 nodes elided --></a><d/></r>`},
+	{`<r><a><b><c/></b>x</a><d/></r>`, "/r", &xmlpath.XMLOptions{MaxDepth: 2}, `<r><a><b><!-- 1 node elided --></b>x</a><d/></r>`},
+	{`<r><a><b><c/></b>x</a><d/></r>`, "/r", &xmlpath.XMLOptions{MaxNodes: 3}, `<r><a><b><!-- 1 node elided --></b><!-- 1 node elided --></a><!-- 1 node elided --></r>`},
+	{`<r><a/><b/><c>x</c></r>`, "/r", &xmlpath.XMLOptions{MaxNodes: 2}, `<r><a/><!-- 3 nodes elided --></r>`},
+	{`<r><a/><b/><c>x</c></r>`, "/r", &xmlpath.XMLOptions{MaxNodes: 5}, `<r><a/><b/><c>x</c></r>`},
+}
+
+func (s *BasicSuite) TestWriteXML(c *C) {
+	for _, test := range writeXMLTable {
+		c.Logf("Document: %s, path: %s, options: %+v", test.doc, test.path, test.opts)
+		node, err := xmlpath.Parse(strings.NewReader(test.doc))
+		c.Assert(err, IsNil)
+		iter := xmlpath.MustCompile(test.path).Iter(node)
+		c.Assert(iter.Next(), Equals, true)
+		var buf bytes.Buffer
+		c.Assert(iter.Node().WriteXML(&buf, test.opts), IsNil)
+		c.Assert(buf.String(), Equals, test.result)
+	}
+}
+
+// shortWriter accepts up to n bytes, failing to write any more.
+type shortWriter struct {
+	n int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, io.ErrShortWrite
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func (s *BasicSuite) TestWriteTo(c *C) {
+	for _, test := range writeXMLTable {
+		if test.opts != nil {
+			continue
+		}
+		node, err := xmlpath.Parse(strings.NewReader(test.doc))
+		c.Assert(err, IsNil)
+		iter := xmlpath.MustCompile(test.path).Iter(node)
+		c.Assert(iter.Next(), Equals, true)
+		var buf bytes.Buffer
+		n, err := iter.Node().WriteTo(&buf)
+		c.Assert(err, IsNil)
+		c.Assert(buf.String(), Equals, test.result)
+		c.Assert(n, Equals, int64(len(test.result)))
+	}
+
+	// Large subtrees go through the buffer in several writes.
+	doc := "<list>" + strings.Repeat("<item>text</item>", 1000) + "</list>"
+	node, err := xmlpath.Parse(strings.NewReader(doc))
+	c.Assert(err, IsNil)
+	var w io.WriterTo = node
+	var buf bytes.Buffer
+	n, err := w.WriteTo(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, doc)
+	c.Assert(n, Equals, int64(len(doc)))
+
+	n, err = node.WriteTo(&shortWriter{n: 5000})
+	c.Assert(err, Equals, io.ErrShortWrite)
+	c.Assert(n, Equals, int64(5000))
+}
+
 func (s *BasicSuite) TestLibraryTable(c *C) {
 	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
 	c.Assert(err, IsNil)
-	for _, test := range libraryTable {
-		cmt := Commentf("xml path: %s", test.path)
-		path, err := xmlpath.Compile(test.path)
-		if want, ok := test.result.(cerror); ok {
-			if !strings.Contains(err.Error(), string(want)) {
-				c.Fatalf("error should contain `%s` but got `%s`", want, err.Error())
-			}
-			c.Assert(path, IsNil, cmt)
-			continue
+	for _, test := range libraryTable {
+		cmt := Commentf("xml path: %s", test.path)
+		path, err := xmlpath.Compile(test.path)
+		if want, ok := test.result.(cerror); ok {
+			if !strings.Contains(err.Error(), string(want)) {
+				c.Fatalf("error should contain `%s` but got `%s`", want, err.Error())
+			}
+			c.Assert(path, IsNil, cmt)
+			continue
+		}
+		c.Assert(err, IsNil)
+		switch want := test.result.(type) {
+		case string:
+			got, ok := path.String(node)
+			c.Assert(ok, Equals, true, cmt)
+			c.Assert(got, Equals, want, cmt)
+			c.Assert(path.Exists(node), Equals, true, cmt)
+			iter := path.Iter(node)
+			iter.Next()
+			node := iter.Node()
+			c.Assert(node.String(), Equals, want, cmt)
+			c.Assert(string(node.Bytes()), Equals, want, cmt)
+		case []string:
+			var alls []string
+			var allb []string
+			iter := path.Iter(node)
+			for iter.Next() {
+				alls = append(alls, iter.Node().String())
+				allb = append(allb, string(iter.Node().Bytes()))
+			}
+			c.Assert(alls, DeepEquals, want, cmt)
+			c.Assert(allb, DeepEquals, want, cmt)
+			s, sok := path.String(node)
+			b, bok := path.Bytes(node)
+			if len(want) == 0 {
+				c.Assert(sok, Equals, false, cmt)
+				c.Assert(bok, Equals, false, cmt)
+				c.Assert(s, Equals, "")
+				c.Assert(b, IsNil)
+			} else {
+				c.Assert(sok, Equals, true, cmt)
+				c.Assert(bok, Equals, true, cmt)
+				c.Assert(s, Equals, alls[0], cmt)
+				c.Assert(string(b), Equals, alls[0], cmt)
+				c.Assert(path.Exists(node), Equals, true, cmt)
+			}
+		case exists:
+			wantb := bool(want)
+			ok := path.Exists(node)
+			c.Assert(ok, Equals, wantb, cmt)
+			_, ok = path.String(node)
+			c.Assert(ok, Equals, wantb, cmt)
+		}
+	}
+}
+
+func (s *BasicSuite) TestExprTable(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	for _, test := range exprTable {
+		cmt := Commentf("expression: %s", test.expr)
+		e, err := xmlpath.CompileExpr(test.expr)
+		if want, ok := test.result.(cerror); ok {
+			c.Assert(err, ErrorMatches, ".*"+regexp.QuoteMeta(string(want)), cmt)
+			c.Assert(e, IsNil, cmt)
+			continue
+		}
+		c.Assert(err, IsNil, cmt)
+		switch want := test.result.(type) {
+		case float64:
+			c.Assert(e.Evaluate(node), Equals, want, cmt)
+			c.Assert(e.Number(node), Equals, want, cmt)
+		case string:
+			c.Assert(e.String(node), Equals, want, cmt)
+		case bool:
+			c.Assert(e.Evaluate(node), Equals, want, cmt)
+			c.Assert(e.Bool(node), Equals, want, cmt)
+		}
+	}
+}
+
+var sourceXml = `<?xml version="1.0"?>
+<library xmlns:x="urn:x">
+  <book id="b1" x:shelf='3'><title>One</title><x:note>a</x:note></book>
+  <book id="b2"><title>Two</title><empty/></book>
+</library>`
+
+// sourceNodes describes every node in the tree of source along with
+// its span, for comparing the outcome of edits against a full parse.
+func sourceNodes(source *xmlpath.Source) []string {
+	var nodes []string
+	iter := xmlpath.MustCompile("//node() | //@* | //namespace::*").Iter(source.Root())
+	for iter.Next() {
+		node := iter.Node()
+		span := source.Span(node)
+		nodes = append(nodes, fmt.Sprintf("%d %v %q %v %q", node.Kind(), node.Name(), node.String(), span, source.Bytes()[span.Start:span.End]))
+	}
+	return nodes
+}
+
+func (s *BasicSuite) TestSource(c *C) {
+	source, err := xmlpath.ParseSource([]byte(sourceXml))
+	c.Assert(err, IsNil)
+	c.Assert(string(source.Bytes()), Equals, sourceXml)
+
+	span := func(path string) string {
+		iter := xmlpath.MustCompile(path).Iter(source.Root())
+		c.Assert(iter.Next(), Equals, true, Commentf("path: %s", path))
+		span := source.Span(iter.Node())
+		return string(source.Bytes()[span.Start:span.End])
+	}
+	c.Assert(span("//book[1]/title"), Equals, "<title>One</title>")
+	c.Assert(span("//book[1]/title/text()"), Equals, "One")
+	c.Assert(span("//book[1]/@shelf"), Equals, "x:shelf='3'")
+	c.Assert(span("//book[2]/@id"), Equals, `id="b2"`)
+	c.Assert(span("/library/namespace::x"), Equals, `xmlns:x="urn:x"`)
+	c.Assert(span("//empty"), Equals, "<empty/>")
+	c.Assert(source.Span(source.Root()), Equals, xmlpath.Span{0, len(sourceXml)})
+
+	edit := func(old, new string) error {
+		i := strings.Index(string(source.Bytes()), old)
+		c.Assert(i >= 0, Equals, true, Commentf("text: %q", old))
+		return source.Edit(i, i+len(old), []byte(new))
+	}
+	check := func() {
+		c.Assert(xmlpath.ValidateTree(source.Root()), IsNil)
+		fresh, err := xmlpath.ParseSource(source.Bytes())
+		c.Assert(err, IsNil)
+		c.Assert(sourceNodes(source), DeepEquals, sourceNodes(fresh))
+	}
+
+	// Editing text updates the nodes in place.
+	book := xmlpath.MustCompile("//book[2]")
+	iter := book.Iter(source.Root())
+	c.Assert(iter.Next(), Equals, true)
+	before := iter.Node()
+	c.Assert(edit("One", "Uno"), IsNil)
+	check()
+	iter = book.Iter(source.Root())
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node(), Equals, before)
+	c.Assert(span("//book[1]/title"), Equals, "<title>Uno</title>")
+
+	// Adding elements, using prefixes declared outside the content.
+	// Nodes outside the reparsed element are kept.
+	first := xmlpath.MustCompile("//book[1]/title/text()")
+	iter = first.Iter(source.Root())
+	c.Assert(iter.Next(), Equals, true)
+	text := iter.Node()
+	root := source.Root()
+	c.Assert(edit("<empty/>", "<author>Ann</author><x:note>b</x:note>"), IsNil)
+	check()
+	c.Assert(span("//book[2]/note"), Equals, "<x:note>b</x:note>")
+	iter = xmlpath.MustCompile("//book[2]/note").Iter(source.Root())
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node().Name().Space, Equals, "urn:x")
+	c.Assert(source.Root() == root, Equals, true)
+	iter = book.Iter(source.Root())
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node() == before, Equals, true)
+	iter = first.Iter(source.Root())
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node() == text, Equals, true)
+
+	// Removing elements keeps them too, and moves the nodes after.
+	c.Assert(edit("<author>Ann</author>", ""), IsNil)
+	check()
+	c.Assert(edit("<title>Uno</title>", "Uno"), IsNil)
+	check()
+	c.Assert(source.Root() == root, Equals, true)
+	iter = book.Iter(source.Root())
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node() == before, Equals, true)
+	c.Assert(string(source.Bytes()[source.Span(before).Start:source.Span(before).End]), Equals, `<book id="b2"><title>Two</title><x:note>b</x:note></book>`)
+	c.Assert(edit("Uno<x:note>a", "<title>Uno</title><x:note>a"), IsNil)
+	check()
+
+	// Removed nodes are no longer part of the tree.
+	removed, err := xmlpath.ParseSource([]byte(`<a><b><c/><d/></b><e/></a>`))
+	c.Assert(err, IsNil)
+	iter = xmlpath.MustCompile("//d").Iter(removed.Root())
+	c.Assert(iter.Next(), Equals, true)
+	d := iter.Node()
+	c.Assert(removed.Edit(6, 14, nil), IsNil)
+	c.Assert(string(removed.Bytes()), Equals, `<a><b></b><e/></a>`)
+	c.Assert(func() { removed.Span(d) }, PanicMatches, "xmlpath: node is not part of the current source tree")
+	c.Assert(func() { source.Span(d) }, PanicMatches, "xmlpath: node is not part of the current source tree")
+
+	// Edits changing the structure beyond the edited element.
+	c.Assert(edit("</title><x:note>a", `</title></book><book id="b3"><title>Three</title><x:note>a`), IsNil)
+	check()
+	c.Assert(span("//book[2]/@id"), Equals, `id="b3"`)
+	c.Assert(edit(`<library xmlns:x="urn:x">`, `<library xmlns:x="urn:y">`), IsNil)
+	check()
+
+	// Errors leave the source unchanged.
+	current := string(source.Bytes())
+	c.Assert(edit("<title>Two", "<title>Two<"), ErrorMatches, ".*syntax error.*")
+	c.Assert(edit("</book>", "</b>"), ErrorMatches, ".*syntax error.*")
+	c.Assert(source.Edit(10, 5, nil), ErrorMatches, "xmlpath: edit range 10-5 is out of bounds")
+	c.Assert(source.Edit(0, len(current)+1, nil), ErrorMatches, "xmlpath: edit range .* is out of bounds")
+	c.Assert(string(source.Bytes()), Equals, current)
+	check()
+}
+
+var sourceErrorTable = []struct {
+	doc   string
+	start xmlpath.Position
+	text  string
+	path  string
+}{
+	{"<a>\n  <b>x</c>\n</a>", xmlpath.Position{2, 7}, "</c>", "/a/b[1]"},
+	{"<a><b/>\n  <b>é&bogus;</b></a>", xmlpath.Position{2, 6}, "é&bogus;", "/a/b[2]"},
+	{"<a>\n  <b>", xmlpath.Position{2, 6}, "", "/a/b[1]"},
+	{"<a x=1/>", xmlpath.Position{1, 1}, "<a x=1", "/"},
+}
+
+func (s *BasicSuite) TestSourceError(c *C) {
+	for _, test := range sourceErrorTable {
+		cmt := Commentf("document: %q", test.doc)
+		_, err := xmlpath.ParseSource([]byte(test.doc))
+		serr, ok := err.(*xmlpath.SourceError)
+		c.Assert(ok, Equals, true, cmt)
+		c.Assert(serr.Start, Equals, test.start, cmt)
+		c.Assert(test.doc[serr.Span.Start:serr.Span.End], Equals, test.text, cmt)
+		c.Assert(serr.Path, Equals, test.path, cmt)
+		_, ok = serr.Unwrap().(*xml.SyntaxError)
+		c.Assert(ok, Equals, true, cmt)
+		c.Assert(err, ErrorMatches, fmt.Sprintf("xmlpath: line %d, column %d: XML syntax error .*", test.start.Line, test.start.Column), cmt)
+	}
+
+	// Errors from edits are located in the edited document.
+	source, err := xmlpath.ParseSource([]byte(sourceXml))
+	c.Assert(err, IsNil)
+	i := strings.Index(sourceXml, "<empty/>")
+	err = source.Edit(i, i+len("<empty/>"), []byte("<empty>"))
+	c.Assert(err, FitsTypeOf, &xmlpath.SourceError{})
+	c.Assert(err.(*xmlpath.SourceError).Start, Equals, xmlpath.Position{4, 42})
+	c.Assert(err.(*xmlpath.SourceError).Path, Equals, "/library/book[2]/empty[1]")
+}
+
+func (s *BasicSuite) TestSourceLocate(c *C) {
+	source, err := xmlpath.ParseSource([]byte(sourceXml))
+	c.Assert(err, IsNil)
+	for _, test := range []struct {
+		path     string
+		location xmlpath.Location
+	}{
+		{"/library", xmlpath.Location{xmlpath.Span{22, 180}, xmlpath.Position{2, 1}, xmlpath.Position{5, 11}, "/library"}},
+		{"//book[2]/title", xmlpath.Location{xmlpath.Span{136, 154}, xmlpath.Position{4, 17}, xmlpath.Position{4, 35}, "/library/book[2]/title[1]"}},
+		{"//book[1]/@shelf", xmlpath.Location{xmlpath.Span{64, 75}, xmlpath.Position{3, 17}, xmlpath.Position{3, 28}, "/library/book[1]/@shelf"}},
+		{"//book[1]/title/text()", xmlpath.Location{xmlpath.Span{83, 86}, xmlpath.Position{3, 36}, xmlpath.Position{3, 39}, "/library/book[1]/title[1]"}},
+	} {
+		iter := xmlpath.MustCompile(test.path).Iter(source.Root())
+		c.Assert(iter.Next(), Equals, true)
+		c.Assert(source.Locate(iter.Node()), Equals, test.location, Commentf("path: %s", test.path))
+	}
+}
+
+func (s *BasicSuite) TestDocument(c *C) {
+	doc := xmlpath.OpenDocument(1, []byte(sourceXml))
+	c.Assert(doc.Err(), IsNil)
+	c.Assert(doc.Version(), Equals, 1)
+
+	info, ok := doc.Hover(xmlpath.Position{3, 20})
+	c.Assert(ok, Equals, true)
+	c.Assert(info.Kind, Equals, xmlpath.AttrNode)
+	c.Assert(info.Name, Equals, xml.Name{Space: "urn:x", Local: "shelf"})
+	c.Assert(info.Value, Equals, "3")
+	c.Assert(info.Path, Equals, "/library/book[1]/@shelf")
+
+	info, ok = doc.Hover(xmlpath.Position{3, 37})
+	c.Assert(ok, Equals, true)
+	c.Assert(info.Kind, Equals, xmlpath.TextNode)
+	c.Assert(info.Value, Equals, "One")
+	c.Assert(info.Span, Equals, xmlpath.Span{83, 86})
+
+	for _, test := range []struct {
+		pos  xmlpath.Position
+		path string
+	}{
+		{xmlpath.Position{1, 1}, "/"},
+		{xmlpath.Position{2, 3}, "/library"},
+		{xmlpath.Position{3, 30}, "/library/book[1]/title[1]"},
+		{xmlpath.Position{4, 9}, "/library/book[2]/@id"},
+		{xmlpath.Position{4, 8}, "/library/book[2]"},
+		{xmlpath.Position{4, 40}, "/library/book[2]/empty[1]"},
+		{xmlpath.Position{4, 47}, "/library/book[2]"},
+	} {
+		path, ok := doc.PathAt(test.pos)
+		c.Assert(ok, Equals, true, Commentf("position: %v", test.pos))
+		c.Assert(path, Equals, test.path, Commentf("position: %v", test.pos))
+	}
+	_, ok = doc.PathAt(xmlpath.Position{9, 1})
+	c.Assert(ok, Equals, false)
+	_, ok = doc.PathAt(xmlpath.Position{2, 50})
+	c.Assert(ok, Equals, false)
+
+	infos, err := doc.Query("//title")
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 2)
+	c.Assert(infos[1].Value, Equals, "Two")
+	c.Assert(infos[1].Start, Equals, xmlpath.Position{4, 17})
+	_, err = doc.Query("//title[")
+	c.Assert(err, ErrorMatches, "compiling xml path .*")
+
+	// Edits in progress leave the last well formed version queryable.
+	i, ok := doc.Offset(xmlpath.Position{4, 24})
+	c.Assert(ok, Equals, true)
+	c.Assert(sourceXml[i:i+3], Equals, "Two")
+	c.Assert(doc.Update(2, xmlpath.TextEdit{xmlpath.Span{i, i + 3}, "<b>Tw"}), IsNil)
+	c.Assert(doc.Version(), Equals, 2)
+	c.Assert(doc.Err(), FitsTypeOf, &xmlpath.SourceError{})
+	infos, err = doc.Query("//title")
+	c.Assert(err, IsNil)
+	c.Assert(infos[1].Value, Equals, "Two")
+	c.Assert(doc.Update(3, xmlpath.TextEdit{xmlpath.Span{i + 5, i + 5}, "o</b>"}), IsNil)
+	c.Assert(doc.Err(), IsNil)
+	c.Assert(string(doc.Text()[i:i+10]), Equals, "<b>Two</b>")
+	infos, err = doc.Query("//title/b")
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 1)
+	c.Assert(infos[0].Path, Equals, "/library/book[2]/title[1]/b[1]")
+
+	// Several edits apply in order.
+	c.Assert(doc.Update(4, xmlpath.TextEdit{xmlpath.Span{i, i + 3}, ""}, xmlpath.TextEdit{xmlpath.Span{i + 3, i + 7}, ""}), IsNil)
+	c.Assert(doc.Err(), IsNil)
+	infos, err = doc.Query("//book[2]/title")
+	c.Assert(err, IsNil)
+	c.Assert(infos[0].Value, Equals, "Two")
+
+	c.Assert(doc.Update(5, xmlpath.TextEdit{xmlpath.Span{0, len(sourceXml) + 1}, ""}), ErrorMatches, "xmlpath: edit range .* is out of bounds")
+	c.Assert(doc.Version(), Equals, 4)
+
+	// Columns count characters.
+	doc = xmlpath.OpenDocument(1, []byte("<a>\né<b/></a>"))
+	i, ok = doc.Offset(xmlpath.Position{2, 2})
+	c.Assert(ok, Equals, true)
+	c.Assert(i, Equals, 6)
+	path, ok := doc.PathAt(xmlpath.Position{2, 3})
+	c.Assert(ok, Equals, true)
+	c.Assert(path, Equals, "/a/b[1]")
+
+	doc = xmlpath.OpenDocument(1, []byte("<a>"))
+	c.Assert(doc.Err(), ErrorMatches, "xmlpath: line 1, column 4: .*")
+	infos, err = doc.Query("//a")
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 0)
+}
+
+func (s *BasicSuite) TestAttrPredicateAnyDepth(c *C) {
+	node, err := xmlpath.ParseHTML(bytes.NewBufferString(`<ul><li data-testid="item"><span data-testid="price">1</span></li><li><div><b data-testid="price">2</b></div></li></ul>`))
+	c.Assert(err, IsNil)
+	iter := xmlpath.MustCompile("//*[@data-testid='price']").Iter(node)
+	var names, values []string
+	for iter.Next() {
+		c.Assert(iter.Node().Kind(), Equals, xmlpath.StartNode)
+		names = append(names, iter.Node().Name().Local)
+		values = append(values, iter.Node().String())
+	}
+	c.Assert(names, DeepEquals, []string{"span", "b"})
+	c.Assert(values, DeepEquals, []string{"1", "2"})
+}
+
+func (s *BasicSuite) TestSlice(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	path := xmlpath.MustCompile("//character/@id")
+	strings := func(nodes []*xmlpath.Node) []string {
+		var result []string
+		for _, node := range nodes {
+			result = append(result, node.String())
+		}
+		return result
+	}
+	c.Assert(strings(path.Slice(node, 1, 3)), DeepEquals, []string{"Snoopy", "Schroeder"})
+	c.Assert(strings(path.Slice(node, 0, 1)), DeepEquals, []string{"PP"})
+	c.Assert(strings(path.Slice(node, 5, 100)), DeepEquals, []string{"Spark", "Snuffy"})
+	c.Assert(path.Slice(node, 2, 2), HasLen, 0)
+	c.Assert(path.Slice(node, 100, 200), HasLen, 0)
+	c.Assert(func() { path.Slice(node, 2, 1) }, PanicMatches, `xmlpath: invalid slice indexes 2:1`)
+}
+
+func (s *BasicSuite) TestFindText(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	names := func(nodes []*xmlpath.Node) []string {
+		var result []string
+		for _, node := range nodes {
+			result = append(result, node.Name().Local+":"+node.String())
+		}
+		return result
+	}
+	c.Assert(names(node.FindText("Snoopy")), DeepEquals, []string{"name:Snoopy"})
+	c.Assert(names(node.FindText("Schulz")), DeepEquals, []string{"name:Charles M Schulz", "name:Charles M Schulz"})
+	c.Assert(names(node.FindText("Barney Google")), DeepEquals, []string{"title:Barney Google and Snuffy Smith", "name:Barney Google"})
+	c.Assert(names(node.FindText("Google")), DeepEquals, []string{"i:Google", "name:Barney Google"})
+	c.Assert(node.FindText("Linus"), HasLen, 0)
+
+	book := xmlpath.MustCompile("/library/book[2]")
+	iter := book.Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(names(iter.Node().FindText("Charles")), DeepEquals, []string{"name:Charles M Schulz"})
+
+	node, err = xmlpath.Parse(bytes.NewBufferString(`<p>foo <b>foo</b></p>`))
+	c.Assert(err, IsNil)
+	c.Assert(names(node.FindText("foo")), DeepEquals, []string{"p:foo foo", "b:foo"})
+}
+
+func (s *BasicSuite) TestFindRegexp(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	type match struct {
+		name, text string
+		start, end int
+	}
+	find := func(node *xmlpath.Node, re string) []match {
+		var result []match
+		for _, m := range node.FindRegexp(regexp.MustCompile(re)) {
+			result = append(result, match{m.Node.Name().Local, m.Node.String()[m.Start:m.End], m.Start, m.End})
+		}
+		return result
+	}
+	c.Assert(find(node, `Goo\w+`), DeepEquals, []match{
+		{"i", "Google", 0, 6},
+		{"name", "Google", 7, 13},
+	})
+	c.Assert(find(node, `Barney Goo`), DeepEquals, []match{
+		{"title", "Barney Goo", 0, 10},
+		{"name", "Barney Goo", 0, 10},
+	})
+	c.Assert(find(node, `Full-Time Job\s+I'd`), DeepEquals, []match{
+		{"book", "Full-Time Job\n    I'd", 37, 58},
+	})
+	c.Assert(find(node, `#*`), HasLen, 0)
+
+	iter := xmlpath.MustCompile("//author").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(find(iter.Node(), `\d{4}`), DeepEquals, []match{
+		{"born", "1922", 0, 4},
+		{"dead", "2000", 0, 4},
+	})
+}
+
+func (s *BasicSuite) TestAttrs(c *C) {
+	node, err := xmlpath.ParseHTML(bytes.NewBufferString(`<div id="p1" data-sku="A12" class="item" data-price="5"></div>`))
+	c.Assert(err, IsNil)
+	iter := xmlpath.MustCompile("//div").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	div := iter.Node()
+
+	attrs, err := div.Attrs("data-*")
+	c.Assert(err, IsNil)
+	c.Assert(attrs, DeepEquals, []xml.Attr{
+		{Name: xml.Name{Local: "data-sku"}, Value: "A12"},
+		{Name: xml.Name{Local: "data-price"}, Value: "5"},
+	})
+
+	attrs, err = div.Attrs("*")
+	c.Assert(err, IsNil)
+	c.Assert(attrs, HasLen, 4)
+
+	attrs, err = div.Attrs("title")
+	c.Assert(err, IsNil)
+	c.Assert(attrs, HasLen, 0)
+
+	_, err = div.Attrs("[")
+	c.Assert(err, ErrorMatches, "syntax error in pattern")
+}
+
+var siblingsHtml = `<h2>Intro</h2><p>1</p>text<p>2</p><h2>Usage</h2><p>3</p><!-- end -->`
+
+func (s *BasicSuite) TestPathMatches(c *C) {
+	node, err := xmlpath.ParseHTML(bytes.NewBufferString(siblingsHtml))
+	c.Assert(err, IsNil)
+	iter := xmlpath.MustCompile("//p[2]").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	p := iter.Node()
+	for _, test := range []struct {
+		path string
+		want bool
+	}{
+		{"p", true},
+		{"*", true},
+		{"node()", true},
+		{"self::p", true},
+		{"body/p", true},
+		{"/html/body/p", true},
+		{"//p", true},
+		{"p[2]", true},
+		{"p[.='2']", true},
+		{"p[1]", false},
+		{"h2", false},
+		{"head/p", false},
+		{"/p", false},
+		{"@id", false},
+	} {
+		c.Assert(xmlpath.MustCompile(test.path).Matches(p), Equals, test.want, Commentf("path: %s", test.path))
+	}
+}
+
+func (s *BasicSuite) TestSiblingsUntil(c *C) {
+	node, err := xmlpath.ParseHTML(bytes.NewBufferString(siblingsHtml))
+	c.Assert(err, IsNil)
+	values := func(nodes []*xmlpath.Node) []string {
+		var result []string
+		for _, node := range nodes {
+			result = append(result, node.String())
+		}
+		return result
+	}
+	heading := func(name string) *xmlpath.Node {
+		iter := xmlpath.MustCompile("//h2[.='" + name + "']").Iter(node)
+		c.Assert(iter.Next(), Equals, true)
+		return iter.Node()
+	}
+	h2 := xmlpath.MustCompile("h2")
+	c.Assert(values(heading("Intro").SiblingsUntil(h2)), DeepEquals, []string{"1", "text", "2"})
+	c.Assert(values(heading("Usage").SiblingsUntil(h2)), DeepEquals, []string{"3", " end "})
+	c.Assert(values(heading("Intro").SiblingsUntil(xmlpath.MustCompile("comment()"))), DeepEquals, []string{"1", "text", "2", "Usage", "3"})
+	c.Assert(values(heading("Intro").SiblingsUntil(nil)), DeepEquals, []string{"1", "text", "2", "Usage", "3", " end "})
+	c.Assert(node.SiblingsUntil(h2), HasLen, 0)
+}
+
+func (s *BasicSuite) TestClosest(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	iter := xmlpath.MustCompile("//character[@id='Lucy']/born").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	born := iter.Node()
+
+	closest := func(path string) string {
+		n := born.Closest(xmlpath.MustCompile(path))
+		if n == nil {
+			return "<nil>"
+		}
+		return n.Name().Local
+	}
+	c.Assert(closest("born"), Equals, "born")
+	c.Assert(closest("character"), Equals, "character")
+	c.Assert(closest("*[@id]"), Equals, "character")
+	c.Assert(closest("*[@available]"), Equals, "book")
+	c.Assert(closest("book[isbn='0836217462']"), Equals, "book")
+	c.Assert(closest("book[isbn='0883556316']"), Equals, "<nil>")
+	c.Assert(closest("/library"), Equals, "library")
+	c.Assert(closest("author"), Equals, "<nil>")
+}
+
+func (s *BasicSuite) TestIterMatch(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	iter := xmlpath.MustCompile("/library/book/character[starts-with(born, '195')] ").Iter(node)
+	var matches []xmlpath.Match
+	for iter.Next() {
+		matches = append(matches, iter.Match())
+	}
+	c.Assert(matches, HasLen, 3)
+	for i, m := range matches {
+		c.Assert(m.Position, Equals, i+1)
+		c.Assert(m.Step, Equals, "character[starts-with(born, '195')]")
+	}
+	c.Assert(matches[0].Node.String(), Matches, "(?s).*Snoopy.*")
+	c.Assert(matches[2].Node.String(), Matches, "(?s).*Lucy.*")
+
+	iter = xmlpath.MustCompile("//@id[.='CMS']/../name").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Next(), Equals, true)
+	m := iter.Match()
+	c.Assert(m.Position, Equals, 2)
+	c.Assert(m.Step, Equals, "name")
+	iter.Reset()
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Match().Position, Equals, 1)
+
+	iter = xmlpath.MustCompile("(//character)[position() > 5]").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Next(), Equals, true)
+	m = iter.Match()
+	c.Assert(m.Position, Equals, 2)
+	c.Assert(m.Step, Equals, "(//character)[position() > 5]")
+	iter = xmlpath.MustCompile("(//book)[2]/character/@id").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Match().Step, Equals, "@id")
+}
+
+func (s *BasicSuite) TestIterReset(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	iter := xmlpath.MustCompile("//book/isbn").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Next(), Equals, false)
+	iter.Reset()
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node().String(), Equals, "0836217462")
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node().String(), Equals, "0883556316")
+	c.Assert(iter.Next(), Equals, false)
+}
+
+func (s *BasicSuite) TestIterClone(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	iter := xmlpath.MustCompile("/library/book/character/@id").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node().String(), Equals, "PP")
+
+	peek := iter.Clone()
+	c.Assert(peek.Next(), Equals, true)
+	c.Assert(peek.Node().String(), Equals, "Snoopy")
+	c.Assert(iter.Node().String(), Equals, "PP")
+
+	var rest []string
+	for iter.Next() {
+		rest = append(rest, iter.Node().String())
+	}
+	c.Assert(rest, DeepEquals, []string{"Snoopy", "Schroeder", "Lucy", "Barney", "Spark", "Snuffy"})
+	c.Assert(peek.Next(), Equals, true)
+	c.Assert(peek.Node().String(), Equals, "Schroeder")
+}
+
+func (s *BasicSuite) TestIterFilter(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	re := regexp.MustCompile("^S")
+	visited := 0
+	startsWithS := func(node *xmlpath.Node) bool {
+		visited++
+		return re.MatchString(node.String())
+	}
+
+	var ids []string
+	var positions []int
+	iter := xmlpath.MustCompile("/library/book/character/@id").IterFunc(node, startsWithS)
+	for iter.Next() {
+		ids = append(ids, iter.Node().String())
+		positions = append(positions, iter.Match().Position)
+	}
+	c.Assert(ids, DeepEquals, []string{"Snoopy", "Schroeder", "Spark", "Snuffy"})
+	c.Assert(positions, DeepEquals, []int{1, 2, 3, 4})
+	c.Assert(visited, Equals, 7)
+
+	// Iteration stops as soon as the caller does.
+	visited = 0
+	iter = xmlpath.MustCompile("//character/@id").Iter(node).Filter(startsWithS)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node().String(), Equals, "Snoopy")
+	c.Assert(visited, Equals, 2)
+
+	// Clones and resets keep the filter.
+	peek := iter.Clone()
+	c.Assert(peek.Next(), Equals, true)
+	c.Assert(peek.Node().String(), Equals, "Schroeder")
+	iter.Reset()
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node().String(), Equals, "Snoopy")
+
+	// Unions are filtered too.
+	ids = nil
+	positions = nil
+	iter = xmlpath.MustCompile("//character[1]/@id | //character[2]/@id").IterFunc(node, startsWithS)
+	for iter.Next() {
+		ids = append(ids, iter.Node().String())
+		positions = append(positions, iter.Match().Position)
+	}
+	c.Assert(ids, DeepEquals, []string{"Snoopy", "Spark"})
+	c.Assert(positions, DeepEquals, []int{1, 2})
+	c.Assert(iter.Next(), Equals, false)
+	iter.Reset()
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node().String(), Equals, "Snoopy")
+}
+
+func (s *BasicSuite) TestIterLimit(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	ids := func(iter *xmlpath.Iter) []string {
+		var ids []string
+		for iter.Next() {
+			ids = append(ids, iter.Node().String())
+		}
+		return ids
+	}
+
+	iter := xmlpath.MustCompile("//character/@id").Iter(node).Limit(3)
+	c.Assert(ids(iter), DeepEquals, []string{"PP", "Snoopy", "Schroeder"})
+	c.Assert(iter.Err(), Equals, xmlpath.ErrLimitExceeded)
+	c.Assert(iter.Next(), Equals, false)
+
+	// Reaching the limit exactly is fine.
+	iter = xmlpath.MustCompile("//character/@id").Iter(node).Limit(7)
+	c.Assert(ids(iter), HasLen, 7)
+	c.Assert(iter.Err(), IsNil)
+
+	// Resetting clears the error.
+	iter = xmlpath.MustCompile("//book").Iter(node).Limit(1)
+	c.Assert(ids(iter), HasLen, 1)
+	c.Assert(iter.Err(), Equals, xmlpath.ErrLimitExceeded)
+	iter.Reset()
+	c.Assert(iter.Err(), IsNil)
+	c.Assert(iter.Next(), Equals, true)
+
+	// Filtered out nodes don't count.
+	iter = xmlpath.MustCompile("//character/@id").IterFunc(node, func(node *xmlpath.Node) bool {
+		return strings.HasPrefix(node.String(), "S")
+	}).Limit(4)
+	c.Assert(ids(iter), DeepEquals, []string{"Snoopy", "Schroeder", "Spark", "Snuffy"})
+	c.Assert(iter.Err(), IsNil)
+
+	// Unions are limited too.
+	iter = xmlpath.MustCompile("//character[1]/@id | //character[last()]/@id").Iter(node).Limit(3)
+	c.Assert(ids(iter), DeepEquals, []string{"PP", "Lucy", "Barney"})
+	c.Assert(iter.Err(), Equals, xmlpath.ErrLimitExceeded)
+	iter = xmlpath.MustCompile("//character/@id | //book/@id").Iter(node).Limit(2)
+	c.Assert(ids(iter), DeepEquals, []string{"b0836217462", "PP"})
+	c.Assert(iter.Err(), Equals, xmlpath.ErrLimitExceeded)
+	iter = xmlpath.MustCompile("//book/@id | //book/@id").Iter(node).Limit(2)
+	c.Assert(ids(iter), HasLen, 2)
+	c.Assert(iter.Err(), IsNil)
+
+	// So are the paths within filter expressions.
+	iter = xmlpath.MustCompile("(//character/@id)[1]").Iter(node).Limit(3)
+	c.Assert(ids(iter), HasLen, 0)
+	c.Assert(iter.Err(), Equals, xmlpath.ErrLimitExceeded)
+	iter = xmlpath.MustCompile("(//book)[last()]/character/@id").Iter(node).Limit(3)
+	c.Assert(ids(iter), DeepEquals, []string{"Barney", "Spark", "Snuffy"})
+	c.Assert(iter.Err(), IsNil)
+	iter = xmlpath.MustCompile("(//book)/character/@id").Iter(node).Limit(5)
+	c.Assert(ids(iter), DeepEquals, []string{"PP", "Snoopy", "Schroeder", "Lucy", "Barney"})
+	c.Assert(iter.Err(), Equals, xmlpath.ErrLimitExceeded)
+}
+
+func (s *BasicSuite) TestCursor(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+
+	// page returns up to n nodes following the place marked by token,
+	// and the token marking the place after them.
+	page := func(path *xmlpath.Path, token string, n int) (ids []string, next string) {
+		iter := path.IterWithVars(node, xmlpath.Vars{"min": 1})
+		if token != "" {
+			cursor, err := xmlpath.ParseCursor(token)
+			c.Assert(err, IsNil)
+			c.Assert(iter.Seek(cursor), IsNil)
+		}
+		for len(ids) < n && iter.Next() {
+			c.Assert(iter.Match().Position > 0, Equals, true)
+			ids = append(ids, iter.Node().String())
+		}
+		return ids, iter.Cursor().String()
+	}
+	for _, path := range []string{
+		"//character/@id",
+		"/library/book/character[position() > $min][last()]/@id",
+		"//book//*[@id][1]/@id",
+		"//*[@id]/@id | //isbn",
+		"(//character)[position() > 2]/@id",
+		"//character/@id[. != 'Lucy'][position() < 10]",
+	} {
+		c.Logf("Path: %s", path)
+		p := xmlpath.MustCompile(path)
+		want, _ := page(p, "", 100)
+		c.Assert(want, Not(HasLen), 0)
+		var got []string
+		token := ""
+		for i := 0; i < 10; i++ {
+			ids, next := page(p, token, 2)
+			got = append(got, ids...)
+			token = next
+		}
+		c.Assert(got, DeepEquals, want)
+	}
+
+	// Positions go on from the place marked.
+	path := xmlpath.MustCompile("//character/@id")
+	iter := path.Iter(node)
+	iter.Next()
+	iter.Next()
+	cursor := iter.Cursor()
+	iter = path.Iter(node)
+	c.Assert(iter.Seek(cursor), IsNil)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Match().Position, Equals, 3)
+	c.Assert(iter.Node().String(), Equals, "Schroeder")
+
+	// Cursors only fit iterations over the same path and document.
+	c.Assert(xmlpath.MustCompile("//character/name").Iter(node).Seek(cursor), Equals, xmlpath.ErrCursorMismatch)
+	other, err := xmlpath.Parse(strings.NewReader(`<a><character id="x"/></a>`))
+	c.Assert(err, IsNil)
+	c.Assert(path.Iter(other).Seek(cursor), Equals, xmlpath.ErrCursorMismatch)
+	_, err = xmlpath.ParseCursor("not a cursor!")
+	c.Assert(err, ErrorMatches, "xmlpath: invalid cursor")
+	_, err = xmlpath.ParseCursor("")
+	c.Assert(err, ErrorMatches, "xmlpath: invalid cursor")
+	token := cursor.String()
+	cursor, err = xmlpath.ParseCursor(token[:len(token)-4])
+	c.Assert(err, IsNil)
+	c.Assert(path.Iter(node).Seek(cursor), ErrorMatches, "xmlpath: invalid cursor")
+
+	// Tokens come from clients, so forged ones must fail cleanly.
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	c.Assert(err, IsNil)
+	var fields []int64
+	for len(data) > 0 {
+		v, n := binary.Varint(data)
+		fields = append(fields, v)
+		data = data[n:]
+	}
+	forge := func(change func(fields []int64) []int64) error {
+		var b []byte
+		for _, v := range change(append([]int64(nil), fields...)) {
+			b = binary.AppendVarint(b, v)
 		}
+		cursor, err := xmlpath.ParseCursor(base64.RawURLEncoding.EncodeToString(b))
 		c.Assert(err, IsNil)
-		switch want := test.result.(type) {
-		case string:
-			got, ok := path.String(node)
-			c.Assert(ok, Equals, true, cmt)
-			c.Assert(got, Equals, want, cmt)
-			c.Assert(path.Exists(node), Equals, true, cmt)
-			iter := path.Iter(node)
-			iter.Next()
-			node := iter.Node()
-			c.Assert(node.String(), Equals, want, cmt)
-			c.Assert(string(node.Bytes()), Equals, want, cmt)
-		case []string:
-			var alls []string
-			var allb []string
+		return path.Iter(node).Seek(cursor)
+	}
+	c.Assert(forge(func(f []int64) []int64 { return f }), IsNil)
+	c.Assert(forge(func(f []int64) []int64 { f[4] = -5; return f }), ErrorMatches, "xmlpath: invalid cursor")
+	c.Assert(forge(func(f []int64) []int64 { f[5] = 7; return f }), ErrorMatches, "xmlpath: invalid cursor")
+	c.Assert(forge(func(f []int64) []int64 { return append(f, -5, -5) }), ErrorMatches, "xmlpath: invalid cursor")
+	c.Assert(forge(func(f []int64) []int64 { return f[:len(f)-1] }), ErrorMatches, "xmlpath: invalid cursor")
+
+	// The state recorded must be one the path may reach.
+	c.Assert(forge(func(f []int64) []int64 { f[len(f)-2] += 2; return f }), Equals, xmlpath.ErrCursorMismatch)
+	c.Assert(forge(func(f []int64) []int64 { f[len(f)-4] = 1; return f }), Equals, xmlpath.ErrCursorMismatch)
+	for i := 6; i < len(fields); i++ {
+		for _, v := range []int64{-5, -1, 0, 1, fields[i] - 1, fields[i] + 1, 1 << 40} {
 			iter := path.Iter(node)
-			for iter.Next() {
-				alls = append(alls, iter.Node().String())
-				allb = append(allb, string(iter.Node().Bytes()))
+			var b []byte
+			for j, f := range fields {
+				if j == i {
+					f = v
+				}
+				b = binary.AppendVarint(b, f)
 			}
-			c.Assert(alls, DeepEquals, want, cmt)
-			c.Assert(allb, DeepEquals, want, cmt)
-			s, sok := path.String(node)
-			b, bok := path.Bytes(node)
-			if len(want) == 0 {
-				c.Assert(sok, Equals, false, cmt)
-				c.Assert(bok, Equals, false, cmt)
-				c.Assert(s, Equals, "")
-				c.Assert(b, IsNil)
-			} else {
-				c.Assert(sok, Equals, true, cmt)
-				c.Assert(bok, Equals, true, cmt)
-				c.Assert(s, Equals, alls[0], cmt)
-				c.Assert(string(b), Equals, alls[0], cmt)
-				c.Assert(path.Exists(node), Equals, true, cmt)
+			cursor, err := xmlpath.ParseCursor(base64.RawURLEncoding.EncodeToString(b))
+			c.Assert(err, IsNil)
+			if iter.Seek(cursor) == nil {
+				for iter.Next() {
+				}
 			}
-		case exists:
-			wantb := bool(want)
-			ok := path.Exists(node)
-			c.Assert(ok, Equals, wantb, cmt)
-			_, ok = path.String(node)
-			c.Assert(ok, Equals, wantb, cmt)
 		}
 	}
+
+	// Resuming a location path restores its state rather than
+	// finding the nodes before the place marked again.
+	cursor, err = xmlpath.ParseCursor(token)
+	c.Assert(err, IsNil)
+	found := 0
+	iter = path.Iter(node).Filter(func(*xmlpath.Node) bool { found++; return true })
+	c.Assert(iter.Seek(cursor), IsNil)
+	c.Assert(found, Equals, 0)
+	c.Assert(iter.Next(), Equals, true)
+	c.Assert(iter.Node().String(), Equals, "Schroeder")
+	c.Assert(found, Equals, 1)
+
+	// Iterations that are over stay over.
+	iter = path.Iter(node)
+	for iter.Next() {
+	}
+	cursor = iter.Cursor()
+	iter = path.Iter(node)
+	c.Assert(iter.Seek(cursor), IsNil)
+	c.Assert(iter.Next(), Equals, false)
+}
+
+func (s *BasicSuite) TestPathTimeout(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	iter := xmlpath.MustCompile("//character/@id").WithTimeout(time.Hour).Iter(node)
+	n := 0
+	for iter.Next() {
+		n++
+	}
+	c.Assert(n, Equals, 7)
+	c.Assert(iter.Err(), IsNil)
+
+	doc := "<list>" + strings.Repeat("<item><name>text</name></item>", 1000) + "</list>"
+	node, err = xmlpath.Parse(strings.NewReader(doc))
+	c.Assert(err, IsNil)
+	count := func(iter *xmlpath.Iter) int {
+		n := 0
+		for iter.Next() {
+			n++
+		}
+		return n
+	}
+	for _, path := range []string{"//item/name", "//item[name='other']", "//item | //name", "(//item)[last()]", "//list[count(item) > 0]//name"} {
+		c.Logf("Path: %s", path)
+		p := xmlpath.MustCompile(path)
+		iter := p.WithTimeout(time.Nanosecond).Iter(node)
+		c.Assert(count(iter) < 1000, Equals, true)
+		c.Assert(iter.Err(), Equals, xmlpath.ErrTimeout)
+		c.Assert(iter.Next(), Equals, false)
+
+		// The original path is left without a timeout.
+		iter = p.Iter(node)
+		count(iter)
+		c.Assert(iter.Err(), IsNil)
+	}
+
+	// Alternatives of coalesced paths are bound by the timeout as well.
+	path := xmlpath.Coalesce(xmlpath.MustCompile("//missing"), xmlpath.MustCompile("//name"))
+	iter = path.WithTimeout(time.Nanosecond).Iter(node)
+	c.Assert(count(iter), Equals, 0)
+	c.Assert(iter.Err(), Equals, xmlpath.ErrTimeout)
+	c.Assert(path.Exists(node), Equals, true)
+	c.Assert(path.WithTimeout(time.Nanosecond).Exists(node), Equals, false)
+}
+
+func (s *BasicSuite) TestMapReduce(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	years := xmlpath.Map(xmlpath.MustCompile("//character/born"), node, func(node *xmlpath.Node) string {
+		return node.String()[:4]
+	})
+	c.Assert(years, DeepEquals, []string{"1966", "1950", "1951", "1952", "1919", "1922", "1934"})
+	c.Assert(xmlpath.Map(xmlpath.MustCompile("//nope"), node, (*xmlpath.Node).String), HasLen, 0)
+
+	longest := xmlpath.Reduce(xmlpath.MustCompile("//character/name"), node, "", func(longest string, node *xmlpath.Node) string {
+		if name := node.String(); len(name) > len(longest) {
+			return name
+		}
+		return longest
+	})
+	c.Assert(longest, Equals, "Peppermint Patty")
+	count := xmlpath.Reduce(xmlpath.MustCompile("//nope"), node, 42, func(n int, node *xmlpath.Node) int { return n + 1 })
+	c.Assert(count, Equals, 42)
+}
+
+func (s *BasicSuite) TestCoalesce(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	strings := func(path *xmlpath.Path, context *xmlpath.Node) []string {
+		return xmlpath.Map(path, context, (*xmlpath.Node).String)
+	}
+
+	path := xmlpath.Coalesce(
+		xmlpath.MustCompile("//book/subtitle"),
+		xmlpath.MustCompile("//character[@id='Lucy']/name"),
+		xmlpath.MustCompile("//character/name"),
+	)
+	c.Assert(strings(path, node), DeepEquals, []string{"Lucy"})
+	name, ok := path.String(node)
+	c.Assert(ok, Equals, true)
+	c.Assert(name, Equals, "Lucy")
+
+	// Paths are evaluated anew for each context.
+	path = xmlpath.Coalesce(xmlpath.MustCompile("character[@id='Lucy']/@id"), xmlpath.MustCompile("character/@id"))
+	var ids []string
+	iter := xmlpath.MustCompile("/library/book").Iter(node)
+	for iter.Next() {
+		ids = append(ids, strings(path, iter.Node())...)
+	}
+	c.Assert(ids, DeepEquals, []string{"Lucy", "Barney", "Spark", "Snuffy"})
+
+	path = xmlpath.Coalesce(xmlpath.MustCompile("//nope"), xmlpath.MustCompile("/library/nope"))
+	c.Assert(path.Exists(node), Equals, false)
+	c.Assert(strings(path, node), HasLen, 0)
+	c.Assert(xmlpath.Coalesce().Exists(node), Equals, false)
+
+	// Coalesced paths may match nodes as patterns too.
+	iter = xmlpath.MustCompile("//character[@id='Spark']").Iter(node)
+	c.Assert(iter.Next(), Equals, true)
+	path = xmlpath.Coalesce(xmlpath.MustCompile("character[@id='Lucy']"), xmlpath.MustCompile("book/character[2]"))
+	c.Assert(path.Matches(iter.Node()), Equals, true)
+}
+
+func (s *BasicSuite) TestInterner(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(libraryXml))
+	c.Assert(err, IsNil)
+	var in xmlpath.Interner
+	c.Assert(in.Strings(xmlpath.MustCompile("//@lang | //author/@id | //author/name"), node), DeepEquals,
+		[]string{"en", "CMS", "Charles M Schulz", "en", "CMS", "Charles M Schulz"})
+	c.Assert(in.Len(), Equals, 3)
+	value, ok := in.First(xmlpath.MustCompile("//title"), node)
+	c.Assert(ok, Equals, true)
+	c.Assert(value, Equals, "Being a Dog Is a Full-Time Job")
+	_, ok = in.First(xmlpath.MustCompile("//nope"), node)
+	c.Assert(ok, Equals, false)
+	c.Assert(in.Len(), Equals, 4)
+
+	// Repeated values are not allocated again.
+	var nodes []*xmlpath.Node
+	iter := xmlpath.MustCompile("//author/name | //author/name/text() | //author/@id").Iter(node)
+	for iter.Next() {
+		nodes = append(nodes, iter.Node())
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		for _, node := range nodes {
+			in.String(node)
+		}
+	})
+	c.Assert(allocs, Equals, 0.0)
+
+	// The text mode of the path is followed.
+	root, err := xmlpath.ParseHTML(strings.NewReader(`<p id="a">Buy <b>now</b><script>x()</script></p>`))
+	c.Assert(err, IsNil)
+	value, ok = in.First((&xmlpath.CompileOptions{ShallowText: true}).MustCompile("//p"), root)
+	c.Assert(ok, Equals, true)
+	c.Assert(value, Equals, "Buy ")
+	c.Assert(in.Strings((&xmlpath.CompileOptions{HTMLText: true}).MustCompile("//p | //p/@id"), root), DeepEquals, []string{"Buy now", "a"})
 }
 
 type cerror string
@@ -167,8 +3375,23 @@ var libraryTable = []struct {
 	{"/library/book/title/@lang", "en"},
 	{"/library/book/@available/parent::node()/@id", "b0836217462"},
 	{"/library/book/attribute::*", []string{"b0836217462", "true", "b0883556316", "true"}},
+	{"/library/book/@*", []string{"b0836217462", "true", "b0883556316", "true"}},
+	{"//*[@*]/@id", []string{"b0836217462", "CMS", "PP", "Snoopy", "Schroeder", "Lucy", "b0883556316", "CMS", "Barney", "Spark", "Snuffy"}},
+	{"//book/isbn[not(@*)]", []string{"0836217462", "0883556316"}},
+	{"//book[@*]/character[@* = 'Lucy']/name", "Lucy"},
 	{"/library/book/attribute::text()", cerror(`: text() cannot succeed on axis "attribute"`)},
 
+	// Attributes on the descendant axis.
+	{"//@id", []string{"b0836217462", "CMS", "PP", "Snoopy", "Schroeder", "Lucy", "b0883556316", "CMS", "Barney", "Spark", "Snuffy"}},
+	{"//@id[1]", []string{"b0836217462", "CMS", "PP", "Snoopy", "Schroeder", "Lucy", "b0883556316", "CMS", "Barney", "Spark", "Snuffy"}},
+	{"/library/book[1]//@id", []string{"b0836217462", "CMS", "PP", "Snoopy", "Schroeder", "Lucy"}},
+	{"/library/book/character//@id", []string{"PP", "Snoopy", "Schroeder", "Lucy", "Barney", "Spark", "Snuffy"}},
+	{"//@lang", []string{"en", "en"}},
+	{"//@available/../@id", []string{"b0836217462", "b0883556316"}},
+	{"//@id[.='CMS']/../name", []string{"Charles M Schulz", "Charles M Schulz"}},
+	{"//isbn//@id", exists(false)},
+	{"//@id//@id", exists(false)},
+
 	// The self axis.
 	{"/library/book/isbn/./self::node()", "0836217462"},
 
@@ -179,10 +3402,20 @@ var libraryTable = []struct {
 	{"/descendant::isbn", []string{"0836217462", "0883556316"}},
 
 	// The descendant-or-self axis.
+	{"//*[@id='PP']/name", "Peppermint Patty"},
+	{"//*[@id='CMS']/name", []string{"Charles M Schulz", "Charles M Schulz"}},
+	{"//book//*[@lang]", []string{"Being a Dog Is a Full-Time Job", "Barney Google and Snuffy Smith"}},
 	{"/library/book/isbn/descendant-or-self::isbn", "0836217462"},
 	{"/library//isbn", []string{"0836217462", "0883556316"}},
 	{"//isbn", []string{"0836217462", "0883556316"}},
 	{"/descendant-or-self::node()/child::book/child::*", "0836217462"},
+	{"/library//book//name", []string{"Charles M Schulz", "Peppermint Patty", "Snoopy", "Schroeder", "Lucy", "Charles M Schulz", "Barney Google", "Spark Plug", "Snuffy Smith"}},
+	{"/library//book[2]//character//name", []string{"Barney Google", "Spark Plug", "Snuffy Smith"}},
+	{"/library//character[1]//name", []string{"Peppermint Patty", "Barney Google"}},
+	{"/library/descendant-or-self::node()/title", []string{"Being a Dog Is a Full-Time Job", "Barney Google and Snuffy Smith"}},
+	{"descendant-or-self::node()/isbn", []string{"0836217462", "0883556316"}},
+	{"/library/book/descendant-or-self::node()/i", "Google"},
+	{"/library/book//node()//i", "Google"},
 
 	// The parent axis.
 	{"/library/book/isbn/../isbn/parent::node()//title", "Being a Dog Is a Full-Time Job"},
@@ -191,10 +3424,35 @@ var libraryTable = []struct {
 	{"/library/book/isbn/ancestor::book/title", "Being a Dog Is a Full-Time Job"},
 	{"/library/book/ancestor::book/title", exists(false)},
 
+	{"//born/ancestor::*[@id='Snoopy']/name", "Snoopy"},
+	{"//born/ancestor::book[@id='b0883556316']/isbn", []string{"0883556316"}},
+	{"//name[.='Lucy']/ancestor::*[1]/@id", "Lucy"},
+	{"//name[.='Lucy']/ancestor::*[2]/@id", "b0836217462"},
+	{"//name[.='Lucy']/ancestor::*[position()<=2]/@id", []string{"Lucy", "b0836217462"}},
+	{"//name[.='Lucy']/ancestor::*[contains(isbn, '0836')]/@available", "true"},
+	{"//name[.='Lucy']/ancestor::*[not(@id)]", exists(true)},
+
+	// Positions on reverse axes count from the nearest node, and
+	// the root node is not an element.
+	{"//name[.='Lucy']/ancestor::*[last()]/book[2]/@id", "b0883556316"},
+	{"//name[.='Lucy']/ancestor::*[last()-1]/@id", "b0836217462"},
+	{"//name[.='Lucy']/ancestor::*[@id][last()]/@id", "b0836217462"},
+	{"//name[.='Lucy']/ancestor::node()[last()]/library/book[1]/@id", "b0836217462"},
+	{"//character[@id='Lucy']/preceding::character[1]/@id", "Schroeder"},
+	{"//character[@id='Lucy']/preceding::character[last()]/@id", "PP"},
+	{"//character[@id='Lucy']/preceding::*[@id][position()=last()-1]/@id", "PP"},
+	{"/library/parent::*", exists(false)},
+	{"/library/parent::node()/library/book[1]/@id", "b0836217462"},
+	{"/self::*", exists(false)},
+
 	// The ancestor-or-self axis.
 	{"/library/book/isbn/ancestor-or-self::book/title", "Being a Dog Is a Full-Time Job"},
 	{"/library/book/ancestor-or-self::book/title", "Being a Dog Is a Full-Time Job"},
 
+	{"//name[.='Lucy']/ancestor-or-self::*[1]", "Lucy"},
+	{"//character[@id='Lucy']/ancestor-or-self::*[@id]/@id", []string{"Lucy", "b0836217462"}},
+	{"//character[@id='Lucy']/@id/ancestor-or-self::node()[1]", "Lucy"},
+
 	// The following axis.
 	// The first author name must not be included, as it's within the context
 	// node (author) rather than following it. These queries exercise de-duping
@@ -205,6 +3463,13 @@ var libraryTable = []struct {
 	// The following-sibling axis.
 	{"/library/book/quote/following-sibling::node()/name", []string{"Charles M Schulz", "Peppermint Patty", "Snoopy", "Schroeder", "Lucy"}},
 
+	{"/library/book/isbn/following-sibling::*[1]", "Being a Dog Is a Full-Time Job"},
+	{"/library/book/author/following-sibling::character[2]/@id", []string{"Snoopy", "Spark"}},
+	{"/library/book/character[@id='Lucy']/following-sibling::*", exists(false)},
+	{"/library/book/@id/following-sibling::node()", exists(false)},
+	{"/library/following-sibling::*", exists(false)},
+	{"/following-sibling::node()", exists(false)},
+
 	// The preceding axis.
 	{"/library/book/author/born/preceding::name", []string{"Charles M Schulz", "Charles M Schulz", "Lucy", "Schroeder", "Snoopy", "Peppermint Patty"}},
 	{"/library/book/author/born/preceding::author/name", []string{"Charles M Schulz"}},
@@ -214,15 +3479,28 @@ var libraryTable = []struct {
 	{"/library/book/author/born/preceding-sibling::name", []string{"Charles M Schulz", "Charles M Schulz"}},
 	{"/library/book/author/born/preceding::author/name", []string{"Charles M Schulz"}},
 
+	{"/library/book/title/preceding-sibling::*", []string{"0836217462", "0883556316"}},
+	{"/library/book/character[@id='Lucy']/preceding-sibling::character[1]/@id", "Schroeder"},
+	{"/library/book/character[@id='Lucy']/preceding-sibling::character/@id", []string{"Schroeder", "Snoopy", "PP"}},
+	{"/library/book/isbn/preceding-sibling::*", exists(false)},
+	{"/library/book/@id/preceding-sibling::node()", exists(false)},
+	{"/preceding-sibling::node()", exists(false)},
+
 	// Comments.
 	{"/library/comment()", []string{" Great book. ", " Another great book. "}},
 	{"//self::comment()", []string{" Great book. ", " Another great book. "}},
+	{"/library/comment()[contains(., 'Another')]", []string{" Another great book. "}},
+	{"/library/comment()[starts-with(., ' Great')]", []string{" Great book. "}},
+	{"/library/comment()[normalize-space() = 'Great book.']", []string{" Great book. "}},
+	{"/library/comment()[2]", []string{" Another great book. "}},
 	{`comment("")`, cerror(`: comment() has no arguments`)},
 
 	// Processing instructions.
 	{`/library/book/author/processing-instruction()`, `"go rocks"`},
 	{`/library/book/author/processing-instruction("echo")`, `"go rocks"`},
 	{`/library//processing-instruction("echo")`, `"go rocks"`},
+	{`/library//processing-instruction()[contains(., 'rocks')]`, `"go rocks"`},
+	{`/library//processing-instruction()[starts-with(., '"go')]`, `"go rocks"`},
 	{`/library/book/author/processing-instruction("foo")`, exists(false)},
 	{`/library/book/author/processing-instruction(")`, cerror(`: missing '"'`)},
 
@@ -244,24 +3522,129 @@ var libraryTable = []struct {
 	{"library/book[1]/character[position()<2]/@id", []string{"PP"}},
 	{"library/book[1]/character[position()<=2]/@id", []string{"PP", "Snoopy"}},
 	{"library/book[1]/character[position()<1]/@id", exists(false)},
+	{"library/book[1]/character[position()>=2 and position()<=3]/@id", []string{"Snoopy", "Schroeder"}},
+	{"library/book[1]/character[position()>1 and position()<4]/name", []string{"Snoopy", "Schroeder"}},
+	{"library/book/character[position()<=2 or @id='Lucy']/@id", []string{"PP", "Snoopy", "Lucy", "Barney", "Spark"}},
+	{"library/book/character[position()=1 or position()=3]/@id", []string{"PP", "Schroeder", "Barney", "Snuffy"}},
+	{"library/book/character[position()<3 and position()>=3]/@id", exists(false)},
+	{"library/book/character[not(position()<=2)]/@id", []string{"Schroeder", "Lucy", "Snuffy"}},
+	{"library/book/character[position() >= 2 and position() <= 3]/@id", []string{"Snoopy", "Schroeder", "Spark", "Snuffy"}},
+	{"library/book/character[2 <= position() and 3 >= position()]/@id", []string{"Snoopy", "Schroeder", "Spark", "Snuffy"}},
+	{"library/book/character[position() > 1 and position() < 3]/@id", []string{"Snoopy", "Spark"}},
+	{"library/book/character[position() >= 3 and position() <= 10]/@id", []string{"Schroeder", "Lucy", "Snuffy"}},
+	{"library/book/character[position() >= 3 and position() <= 2]/@id", exists(false)},
+	{"library/book[1]/character[position() >= 2 and position() <= last() - 1]/@id", []string{"Snoopy", "Schroeder"}},
+	{"(//character)[position() >= 4 and position() <= 5]/@id", []string{"Lucy", "Barney"}},
+	{"library/book[0 = position()]/isbn", cerror(": positions start at 1")},
+	{"//book['Being a Dog Is a Full-Time Job' = title]/@id", "b0836217462"},
 	{"library/book[position()=0]/isbn", cerror(": positions start at 1")},
-	{"library/book[position()=-1]/isbn", cerror(": position() not followed by number")},
-	{"library/book[position()=d]/isbn", cerror(": position() not followed by number")},
-	{"library/book[position()!3]/isbn", cerror(": position() not followed by operator")},
+	{"library/book[position()=-1]/isbn", exists(false)},
+	{"library/book[position()=d]/isbn", exists(false)},
+	{"library/book[position()!3]/isbn", cerror(": unexpected '!'")},
+	{"library/book/character[last()]/@id", []string{"Lucy", "Snuffy"}},
+	{"library/book/character[last() - 1]/@id", []string{"Schroeder", "Spark"}},
+	{"library/book/character[position() > 1 and position() < last()]/@id", []string{"Snoopy", "Schroeder", "Spark"}},
+	{"library/book/character[position() = last() - 3]/@id", "PP"},
+	{"library/book/character[last()-2]/@id", []string{"Snoopy", "Barney"}},
+	{"library/book/character[last()-3]/@id", "PP"},
+	{"library/book/character[last()-4]/@id", exists(false)},
+	{"library/book/character[last()+1]/@id", exists(false)},
+	{"library/book/character[last()-0.5]/@id", exists(false)},
+	{"library/book/character[-1 + last()]/@id", []string{"Schroeder", "Spark"}},
+	{"library/book/character[position() >= last() - 1]/@id", []string{"Schroeder", "Lucy", "Spark", "Snuffy"}},
+	{"library/book/character[@id != 'Lucy'][last()-1]/@id", []string{"Snoopy", "Spark"}},
+	{"(//character)[last()-1]/@id", "Spark"},
+	{"id('Lucy Snoopy')/name", []string{"Snoopy", "Lucy"}},
+	{"id('b0883556316')//character[1]/@id", "Barney"},
+	{"//book[id('Lucy')/.. = .]/@id", "b0836217462"},
+	{"library/book[last()]/@id", "b0883556316"},
+	{"library/book[1]/character[last()]/preceding-sibling::character[last()]/@id", "PP"},
+	{"//character[last()]/@id", []string{"Lucy", "Snuffy"}},
+	{"library/book[character[last()]/@id = 'Lucy']/@id", "b0836217462"},
+	{"//character[@id = //book[2]/character/@id]/@id", []string{"Barney", "Spark", "Snuffy"}},
+	{"//book[character/@id = //book[1]/character/@id]/@id", "b0836217462"},
+	{"//book[//book[1]/character/@id = character/@id]/@id", "b0836217462"},
+	{"//book[character/@id != 'Lucy']/@id", []string{"b0836217462", "b0883556316"}},
+	{"//book[not(character/@id = 'Lucy')]/@id", "b0883556316"},
+	{"//book[author/@id != //book/author/@id]", exists(false)},
+	{"//book[character/@id != character/@id]/@id", []string{"b0836217462", "b0883556316"}},
+	{"//book[isbn > //book/isbn]/@id", "b0883556316"},
+	{"//book[isbn <= //book[1]/isbn]/@id", "b0836217462"},
+	{"//book[character/@id = //missing]", exists(false)},
+	{"//book[character/@id != //missing]", exists(false)},
+	{"//book[missing = false()]/@id", []string{"b0836217462", "b0883556316"}},
+	{"//book[character/@id = true()]/@id", []string{"b0836217462", "b0883556316"}},
 	{"//title[contains(.,'ney Google and')]", "Barney Google and Snuffy Smith"},
 	{"//@id[contains(.,'0836')]", "b0836217462"},
 	{"//*[contains(born,'1922')]/name", "Charles M Schulz"},
+	{"//book[contains(character[2]/name, 'Snoop')]/@id", "b0836217462"},
+	{"//book[starts-with(author/name, 'Charles')]/@id", []string{"b0836217462", "b0883556316"}},
+	{"//book[substring-before(character[@id='Barney']/born, '-') = '1919']/@id", "b0883556316"},
+	{"//character[string-length(./name) > 10]/@id", []string{"PP", "Barney", "Snuffy"}},
+	{"//book[normalize-space(character[last()]/qualification) = 'bossy, crabby and selfish']/@id", "b0836217462"},
+	{"//character[contains(../author/name, 'Schulz')][1]/@id", []string{"PP", "Barney"}},
 	{"library/book[not(@id)]", exists(false)},
 	{"library/book[not(@foo) and @id='b0883556316']/isbn", []string{"0883556316"}},
 	{"library/book[not(@id='b0883556316')]/isbn", []string{"0836217462"}},
 	{"library/book/character[not(@id='Snoopy' and ./born='1950-10-04')]", exists(true)},
 	{"library/book/character[@id='Snoopy' and ./born='1950-10-04' or not(@id='Lucy') and ./born='1952-03-03']/born", []string{"1950-10-04"}},
 	{"library/book[@id='b0836217462']/character[not(@id='Snoopy' and ./born='1950-10-04' or @id='Lucy' and ./born='1952-03-03')]/born", []string{"1966-08-22", "1951-05-30"}},
+	{"//title[not(@lang)]", exists(false)},
+	{"//book[not(character[@id='Lucy'])]/@id", "b0883556316"},
+	{"//character[not(contains(., 'and'))]/@id", []string{"Snoopy", "Schroeder", "Spark"}},
+	{"//character[not(contains(qualification, 'eyed'))]/@id", []string{"PP", "Snoopy", "Schroeder", "Lucy", "Snuffy"}},
+	{"//character[not(starts-with(name, 'S'))]/@id", []string{"PP", "Lucy", "Barney"}},
+	{"//character[not(not(starts-with(name, 'S')))]/@id", []string{"Snoopy", "Schroeder", "Spark", "Snuffy"}},
 	{"//character[starts-with(@id, 'Snoo')]/name", "Snoopy"},
 	{"//character[starts-with(@id, 'Snoopy ')]/name", exists(false)},
 	{"//character[starts-with(@id, 'noopy')]/name", exists(false)},
 	{"//title[starts-with(.,'Barney Goo')]", "Barney Google and Snuffy Smith"},
 	{"//title[starts-with(., 'noopy')]", exists(false)},
+	{"//character[normalize-space(qualification)='bold, brash and tomboyish']/@id", "PP"},
+	{"//author[normalize-space()='Charles M Schulz 1922-11-26 2000-02-12']/@id", []string{"CMS", "CMS"}},
+	{"//author[normalize-space(.) = 'Charles M Schulz 1922-11-26 2000-02-12 ']", exists(false)},
+	{"//title[normalize-space(.)='Barney Google and Snuffy Smith']/@lang", "en"},
+	{"//book[normalize-space(quote)]/@id", []string{"b0836217462"}},
+	{"//book[normalize-space(quote)!='']/@id", []string{"b0836217462"}},
+	{"//book[normalize-space(isbn)!='0836217462']/@id", []string{"b0883556316"}},
+	{"//book[normalize-space(@id]", cerror(": normalize-space() missing ')'")},
+
+	// Filter expressions.
+	{"(//character)[3]/@id", "Schroeder"},
+	{"//character[3]/@id", []string{"Schroeder", "Snuffy"}},
+	{"(//character)[last()]/@id", "Snuffy"},
+	{"(//character/@id)[2]", "Snoopy"},
+	{"(//character)[position() > 5]/@id", []string{"Spark", "Snuffy"}},
+	{"(//character)[position() > 1][1]/@id", "Snoopy"},
+	{"(//character[@id='Lucy'] | //character[@id='Barney'])[last()]/@id", "Barney"},
+	{"(//character[@id='Barney'] | //character[@id='Lucy'])[1]/@id", "Lucy"},
+	{"(//character)[@id='Spark']/@id", "Spark"},
+	{"(//character[@id='Lucy']/ancestor::*)[last()]/@id", "b0836217462"},
+	{"//character[@id='Lucy']/ancestor::*[1]/@id", "b0836217462"},
+	{"(//character[@id='Lucy']/preceding-sibling::character)[1]/@id", "PP"},
+	{"(//book)[2]//character[1]/@id", "Barney"},
+	{"( //book ) [ 2 ] / isbn", "0883556316"},
+	{"(//book)/isbn", []string{"0836217462", "0883556316"}},
+	{"(//book)[1]/isbn | (//book)[2]/@id", []string{"0836217462", "b0883556316"}},
+	{"//book[(character)[last()]/@id = 'Lucy']/@id", "b0836217462"},
+	{"(//character)[9]", exists(false)},
+	{"(//book", cerror(`: expected ')'`)},
+	{"(//book)[1", cerror(`: expected ']'`)},
+
+	// Chained predicates.
+	{"/library/book/character[2][1]/@id", []string{"Snoopy", "Spark"}},
+	{"/library/book/character[2][2]/@id", exists(false)},
+	{"//character[@id != 'PP'][1]/@id", []string{"Snoopy", "Barney"}},
+	{"//character[1][@id = 'PP']/name", "Peppermint Patty"},
+	{"/library/book/character[position() > 1][position() < 3]/@id", []string{"Snoopy", "Schroeder", "Spark", "Snuffy"}},
+	{"//character[@id != 'Lucy'][position() <= 2][not(@id = 'PP')]/@id", []string{"Snoopy", "Barney", "Spark"}},
+	{"//character[position() <= 3][last()]/@id", []string{"Schroeder", "Snuffy"}},
+	{"/library/book/character[position() != last()][last()]/@id", []string{"Schroeder", "Spark"}},
+	{"/library/book/character[last()][@id = 'Lucy']/@id", []string{"Lucy"}},
+	{"//character[@id = 'Lucy']/preceding-sibling::character[@id != 'Snoopy'][1]/@id", "Schroeder"},
+	{"//book[character[@id = 'Spark'][1]][1]/@id", "b0883556316"},
+	{"//character[@id != 'PP'] [1] /@id", []string{"Snoopy", "Barney"}},
+	{"//character[1][", cerror(`:15: missing name`)},
 
 	// Multiple predicates.
 	{"library/book/character[@id='Snoopy' and ./born='1950-10-04']/born", []string{"1950-10-04"}},
@@ -270,9 +3653,173 @@ var libraryTable = []struct {
 	{"library/book/character[@id='Snoopy' or @id='Lucy' and @id='NOPE']/born", []string{"1950-10-04"}},
 	{"library/book/character[@id='Snoopy' and @id='NOPE' or @id='Lucy']/born", []string{"1952-03-03"}},
 	{"library/book/character[(@id='Snoopy' or @id='Lucy') and (./born='1950-10-04' or ./born='1952-03-03')]/born", []string{"1950-10-04", "1952-03-03"}},
+	{"library/book[@id and @available]/isbn", []string{"0836217462", "0883556316"}},
+	{"library/book[quote and @id]/isbn", []string{"0836217462"}},
+	{"library/book/character[@id and not(@nope) and position()=1]/name", []string{"Peppermint Patty", "Barney Google"}},
+	{"library/book/character[@nope or @id='Lucy']/name", []string{"Lucy"}},
+	{"library/book/character[@id='Snoopy'or@id='Lucy']/name", []string{"Snoopy", "Lucy"}},
+	{"library/book/character[name and@id='Spark']/name", []string{"Spark Plug"}},
+	{"library/book/character[born and(@id='Spark')]/name", []string{"Spark Plug"}},
+	{"library/book[order]", exists(false)},
+
+	// Comparisons.
+	{"library/book[isbn > 850000000]/@id", "b0883556316"},
+	{"library/book[isbn < '0850000000']/@id", "b0836217462"},
+	{"library/book[isbn >= 836217462]/@id", []string{"b0836217462", "b0883556316"}},
+	{"library/book[isbn<=836217462.0]/@id", "b0836217462"},
+	{"library/book[isbn = 836217462]/@id", "b0836217462"},
+	{"library/book[isbn != 836217462]/@id", "b0883556316"},
+	{"library/book[isbn > -1.5 and not(isbn > 850000000)]/@id", "b0836217462"},
+	{"library/book/character[born > 0 or born <= 0]", exists(false)},
+	{"library/book/character[born != 0]/@id", []string{"PP", "Snoopy", "Schroeder", "Lucy", "Barney", "Spark", "Snuffy"}},
+	{"library/book[isbn > nope]", exists(false)},
+
+	// Substrings.
+	{"//character[substring-before(born, '-') = '1950']/@id", "Snoopy"},
+	{"//character[substring-after(born, '-') = '01-01']/@id", []string{"Barney", "Snuffy"}},
+	{"//character[substring(@id, 1, 2) = 'Sn']/@id", []string{"Snoopy", "Snuffy"}},
+	{"//character[substring(born, 6, 2) > 6]/@id", []string{"PP", "Snoopy", "Spark"}},
+	{"//character[substring(@id)]", cerror(": wrong number of arguments for substring()")},
+
+	// String lengths.
+	{"//character[string-length(@id) = 6]/@id", []string{"Snoopy", "Barney", "Snuffy"}},
+	{"//character/qualification[string-length(.) > 50]/../@id", []string{"Barney", "Spark", "Snuffy"}},
+	{"//character/name[string-length() < 5]", "Lucy"},
+	{"//character[string-length(@id, name)]", cerror(": wrong number of arguments for string-length()")},
+
+	// Translation.
+	{"//character[translate(@id, 'ABCDEFGHIJKLMNOPQRSTUVWXYZ', 'abcdefghijklmnopqrstuvwxyz') = 'pp']/name", "Peppermint Patty"},
+	{"//character[translate(born, '-', '') = '19521303']", exists(false)},
+	{"//character[translate(born, '-', '') = '19520303']/@id", "Lucy"},
+	{"//character[translate(@id, 'S', '')='nuffy']/@id", "Snuffy"},
+	{"//character[translate(@id, 'S')]", cerror(": wrong number of arguments for translate()")},
+
+	// Case conversion.
+	{"//book/title[lower-case(.) = 'barney google and snuffy smith']/@lang", "en"},
+	{"//book[upper-case(@id) = 'B0836217462']/@id", "b0836217462"},
+	{"//character[lower-case(@id) = 'lucy']/@id", "Lucy"},
+	{"//character[upper-case(name) = 'BARNEY GOOGLE']/@id", "Barney"},
+	{"//character[lower-case()]", cerror(": wrong number of arguments for lower-case()")},
+
+	// Concatenation.
+	{"//character[concat(@id, ' ', born) = 'Lucy 1952-03-03']/name", "Lucy"},
+	{"//book[concat(isbn, '-', title/i) = '0883556316-Google']/@id", "b0883556316"},
+	{"//character[concat(substring(born, 1, 4), substring(born, 6, 2), substring(born, 9)) = '19500104']", exists(false)},
+	{"//character[concat(substring(born, 1, 4), substring(born, 6, 2), substring(born, 9)) = '19501004']/@id", "Snoopy"},
+	{"//character[concat(@id)]", cerror(": wrong number of arguments for concat()")},
+
+	// Numeric functions.
+	{"//character[number(substring(born, 1, 4)) < 1930]/@id", []string{"Barney", "Spark"}},
+	{"//book[round(isbn div 100000000) = 9]/@id", "b0883556316"},
+	{"//book[floor(isbn div 100000000) = 8]/@id", []string{"b0836217462", "b0883556316"}},
+	{"//book[ceiling(isbn div 100000000) = 9]/@id", []string{"b0836217462", "b0883556316"}},
+	{"/library[sum(book/isbn) > 1700000000]", exists(true)},
+	{"/library[sum(book/@id) > 0]", exists(false)},
+	{"//book[sum(character/@nope) = 0]/@id", []string{"b0836217462", "b0883556316"}},
+	{"//book[sum('1') > 0]", cerror(": sum() requires a node set")},
+	{"//book[round()]", cerror(": wrong number of arguments for round()")},
+
+	// Booleans.
+	{"//book[boolean(@available) = true()]/@id", []string{"b0836217462", "b0883556316"}},
+	{"//book[boolean(@nope) = true()]", exists(false)},
+	{"//book[@nope = false()]/@id", []string{"b0836217462", "b0883556316"}},
+	{"//book[true()]/@id", []string{"b0836217462", "b0883556316"}},
+	{"//book[false()]", exists(false)},
+	{"//book[boolean(character[@id='Lucy'])]/@id", "b0836217462"},
+	{"//book[true(1)]", cerror(": wrong number of arguments for true()")},
+
+	// Identifiers.
+	{"//book[count(id(character/@id)) = 3]/@id", "b0883556316"},
+	{"//book[id('Lucy')]/@id", []string{"b0836217462", "b0883556316"}},
+	{"//book[id('Nope')]", exists(false)},
+	{"//character[id(@id) = 'Snoopy1950-10-04extroverted beagle']", exists(false)},
+	{"//book[id()]", cerror(": wrong number of arguments for id()")},
+
+	// Names.
+	{"//*[local-name() = 'isbn']", []string{"0836217462", "0883556316"}},
+	{"//book/*[name() = 'title']/@lang", []string{"en", "en"}},
+	{"//book/@*[local-name() = 'available']/../@id", []string{"b0836217462", "b0883556316"}},
+	{"//*[namespace-uri() != '']", exists(false)},
+	{"//book[local-name(character) = 'character']/@id", []string{"b0836217462", "b0883556316"}},
+	{"//book[name(nope) = '']/@id", []string{"b0836217462", "b0883556316"}},
+	{"//book[name('x')]", cerror(": name() requires a node set")},
+
+	// Regular expressions.
+	{"//book[matches(isbn, '^08[0-9]+2$')]/@id", "b0836217462"},
+	{"//character[matches(@id, 'lu', 'i')]/@id", "Lucy"},
+	{"//character[matches(@id, 'lu')]", exists(false)},
+	{"//character[matches(born, '^19[0-9]{2}-(10|03)')]/@id", []string{"Snoopy", "Lucy"}},
+	{"//character[matches(concat(@id, born), concat('^S.*19', '[0-9]'))]/@id", []string{"Snoopy", "Schroeder", "Spark", "Snuffy"}},
+	{"//character[matches(@id, '(')]", cerror(": matches() has invalid pattern: error parsing regexp: missing closing )")},
+	{"//character[matches(@id, 'x', 'q')]", cerror(": matches() has unsupported flag 'q'")},
+	{"//character[matches(@id)]", cerror(": wrong number of arguments for matches()")},
+
+	// Replacements.
+	{"//character[replace(born, '([0-9]+)-([0-9]+)-([0-9]+)', '$3/$2/$1') = '04/10/1950']/@id", "Snoopy"},
+	{"//character[replace(@id, 'l', 'L', 'i') = 'LucyL']", exists(false)},
+	{"//character[replace(@id, 'L', 'l') = 'lucy']/@id", "Lucy"},
+	{"//character[replace(@id, 'x?', '')]", cerror(": replace() pattern matches the empty string")},
+	{"//character[replace(@id, 'x', '$')]", cerror(`: replace() has invalid replacement "$"`)},
+	{"//character[replace(@id, 'x')]", cerror(": wrong number of arguments for replace()")},
+
+	// Tokens.
+	{"//character[tokenize(qualification, ',? (and )?') = 'crabby']/@id", "Lucy"},
+	{"//character[count(tokenize(qualification)) = 4]/@id", []string{"PP", "Lucy"}},
+	{"//character[tokenize(born, '-', 'q')]", cerror(": tokenize() has unsupported flag 'q'")},
+	{"//character[tokenize(born, '-?')]", cerror(": tokenize() pattern matches the empty string")},
+	{"//book[string-join(character/@id, ',') = 'Barney,Spark,Snuffy']/@id", "b0883556316"},
+	{"//book[string-join(tokenize(isbn, '3'), '-') = '08-6217462']/@id", "b0836217462"},
+	{"//book[string-join('a', 'b')]", cerror(": string-join() requires a node set")},
+
+	// Counting.
+	{"library/book[count(character) > 3]/@id", "b0836217462"},
+	{"library/book[count(character) = 3]/@id", "b0883556316"},
+	{"library/book[count(character[@id = 'Lucy']) = 0]/@id", "b0883556316"},
+	{"library/book[count(nope)]/@id", exists(false)},
+	{"library/book[count(*) = count(../book[1]/*)]/@id", "b0836217462"},
+	{"library/book[count()]", cerror(": wrong number of arguments for count()")},
+	{"library/book[count('a') > 1]", cerror(": count() requires a node set")},
+
+	// Arithmetic.
+	{"library/book/character[position() mod 2 = 0]/@id", []string{"Snoopy", "Lucy", "Spark"}},
+	{"library/book/character[(position() + 1) div 2 = 2]/@id", []string{"Schroeder", "Snuffy"}},
+	{"library/book/character[1 + 1]/@id", []string{"Snoopy", "Spark"}},
+	{"library/book/character[3-1]/@id", []string{"Snoopy", "Spark"}},
+	{"library/book[isbn div 1000000000 < 0.85]/@id", "b0836217462"},
+	{"library/book[isbn - 836217462 = 0]/@id", "b0836217462"},
+	{"library/book[isbn * 2 > 1700000000]/@id", "b0883556316"},
+	{"library/book[-isbn < -850000000]/@id", "b0883556316"},
+	{"library/book[(isbn > 850000000) = (1 = 1)]/@id", "b0883556316"},
+	{"library/book/character[born = ../author/born]", exists(false)},
+	{"library/book[isbn +]", cerror(": missing name")},
+	{"library/book[foo(1)]", cerror(": unsupported expression: foo()")},
+	{"library/book[not(@id, @id)]", cerror(": wrong number of arguments for not()")},
+
+	// Nested predicates.
+	{"//book[author[@id='CMS']]/title", []string{"Being a Dog Is a Full-Time Job", "Barney Google and Snuffy Smith"}},
+	{"//book[character[@id='Lucy']]/isbn", "0836217462"},
+	{"//book[character[born[contains(., '1966')]]/name = 'Peppermint Patty']/isbn", "0836217462"},
+	{"//book[character[position() = 2 and @id = 'Snoopy']]/@id", "b0836217462"},
+	{"//book[character[name[.='Lucy'] or name[.='Spark Plug']]]/@id", []string{"b0836217462", "b0883556316"}},
+	{"//book[character[not(born[.='1950-10-04'])]/@id = 'Snoopy']", exists(false)},
+	{"//book[character[@id='Lucy']/born > 1900]", exists(false)},
+	{"//book[character[@id='Lucy'", cerror(": expected ']'")},
+
+	// Unions.
+	{"//isbn | //title", []string{"0836217462", "Being a Dog Is a Full-Time Job", "0883556316", "Barney Google and Snuffy Smith"}},
+	{"/library/book[1]/title|/library/book[1]/isbn", []string{"0836217462", "Being a Dog Is a Full-Time Job"}},
+	{"//name[.='Lucy'] | //name[.='Snoopy'] | //name[.='Lucy']", []string{"Snoopy", "Lucy"}},
+	{"/library/book/author/born/preceding::name | //isbn", []string{"0836217462", "Charles M Schulz", "Peppermint Patty", "Snoopy", "Schroeder", "Lucy", "0883556316", "Charles M Schulz"}},
+	{"library/book[1]/isbn | /library/book[2]/isbn", []string{"0836217462", "0883556316"}},
+	{"/library/book[quote | author/dead[.='none']]/isbn", []string{"0836217462"}},
+	{"/library/book[nope | nada]", exists(false)},
+	{"//nope | //nada", exists(false)},
 
 	// Bogus expressions.
 	{"/foo)", cerror(`compiling xml path "/foo)":4: unexpected ')'`)},
+	{"//foo |", cerror(`compiling xml path "//foo |":7: missing name`)},
+	{"foo | | bar", cerror(`compiling xml path "foo | | bar":6: missing name`)},
+	{"foo|bar)", cerror(`compiling xml path "foo|bar)":7: unexpected ')'`)},
 	{"/foo[", cerror(`compiling xml path "/foo[":5: missing name`)},
 	{"/foo[@id)]", cerror(`compiling xml path "/foo[@id)]":9: unexpected ')'`)},
 	{"/foo[(@id]", cerror(`compiling xml path "/foo[(@id]":9: expected ')'`)},
@@ -284,6 +3831,123 @@ var libraryTable = []struct {
 	{"library/book[isbn='083621746']", exists(false)},
 }
 
+var exprTable = []struct {
+	expr   string
+	result interface{}
+}{
+	{"matches('a.b', 'A.B', 'is')", true},
+	{"replace('a1b22', '[0-9]+', '<$0>')", "a<1>b<22>"},
+	{"replace('abc', 'B', '\\$\\\\', 'i')", "a$\\c"},
+	{"replace('price: 10', '([a-z]+): ([0-9]+)', '$2$1')", "10price"},
+	{"replace('abc', concat('b', ''), concat('$', '0$0'))", "abbc"},
+	{"replace('abc', concat('x', '?'), 'y')", "abc"},
+	{"count(tokenize(''))", 0.0},
+	{"count(tokenize(' a  b ', ' +'))", 4.0},
+	{"string-join(tokenize(' a  b ', ' +'), '|')", "|a|b|"},
+	{"string-join(tokenize(concat('a,', 'b'), concat(',', '')))", "ab"},
+	{"count(tokenize('ab', concat('x', '?')))", 0.0},
+	{"upper-case('étoile ß')", "ÉTOILE ß"},
+	{"lower-case('ÀÉÎ Ω')", "àéî ω"},
+	{"matches('a\nb', 'a.b')", false},
+	{"matches('ab', concat('(', 'b'))", false},
+	{"1 + 2 * 3", 7.0},
+	{"(1 + 2) * 3", 9.0},
+	{"1 - 2 - 3", -4.0},
+	{"3 - -1", 4.0},
+	{"7 mod 3", 1.0},
+	{"-7 mod 3", -1.0},
+	{"7 div 2", 3.5},
+	{"position() + last()", 2.0},
+	{"count(//character)", 7.0},
+	{"count((//character)[position() < 4])", 3.0},
+	{"concat((//character/@id)[last()], '')", "Snuffy"},
+	{"count((//book)[2]/character)", 3.0},
+	{"name(/library)", "library"},
+	{"local-name(/library/book/@*)", "id"},
+	{"name(/library/comment())", ""},
+	{"count(id('PP Nope Snoopy PP'))", 2.0},
+	{"count(id(/library/book/character/@id))", 7.0},
+	{"count(id('b0883556316')/@nope)", 0.0},
+	{"concat(id('b0883556316')/character[2]/name, '')", "Spark Plug"},
+	{"count(id('PP Lucy')[2]/preceding-sibling::character)", 3.0},
+	{"id('PP') = 'x'", false},
+	{"count(id('PP')/name) = 1", true},
+	{"true()", true},
+	{"false()", false},
+	{"boolean(0)", false},
+	{"boolean(0 div 0)", false},
+	{"boolean(-1)", true},
+	{"boolean('')", false},
+	{"boolean('false')", true},
+	{"boolean(/library/book)", true},
+	{"boolean(/library/nope)", false},
+	{"true() = 1", true},
+	{"false() = ''", true},
+	{"number('12')", 12.0},
+	{"number(' 3.5 ')", 3.5},
+	{"number('-.5')", -0.5},
+	{"number('abc')", "NaN"},
+	{"number('1e3')", "NaN"},
+	{"number('-')", "NaN"},
+	{"number(1 = 1)", 1.0},
+	{"number(/library/book/isbn)", 836217462.0},
+	{"sum(/library/book/isbn)", 1719773778.0},
+	{"sum(/library/book/character/born)", "NaN"},
+	{"sum(/library/nope)", 0.0},
+	{"floor(-1.5)", -2.0},
+	{"floor('x')", "NaN"},
+	{"ceiling(-1.5)", "-1"},
+	{"ceiling(1.2)", 2.0},
+	{"round(2.5)", 3.0},
+	{"round(-2.5)", -2.0},
+	{"round(-0.2)", "0"},
+	{"round(0 div 0)", "NaN"},
+	{"round(1 div 0)", "Infinity"},
+	{"concat('a', 'b')", "ab"},
+	{"concat('a', 1, ' ', 1 = 1, ' ', /library/book/isbn)", "a1 true 0836217462"},
+	{"translate('bar', 'abc', 'ABC')", "BAr"},
+	{"translate('--aaa--', 'abc-', 'ABC')", "AAA"},
+	{"translate('aab', 'aa', 'xy')", "xxb"},
+	{"translate('héllo', 'é', 'e')", "hello"},
+	{"string-length('héllo')", 5.0},
+	{"string-length('')", 0.0},
+	{"string-length(/library/book/isbn)", 10.0},
+	{"substring('12345', 2, 3)", "234"},
+	{"substring('12345', 2)", "2345"},
+	{"substring('12345', 1.5, 2.6)", "234"},
+	{"substring('12345', 0, 3)", "12"},
+	{"substring('12345', 0 div 0, 3)", ""},
+	{"substring('12345', 1, 0 div 0)", ""},
+	{"substring('12345', -42, 1 div 0)", "12345"},
+	{"substring('12345', -1 div 0, 1 div 0)", ""},
+	{"substring('héllo', 2, 2)", "él"},
+	{"substring-before('1999/04/01', '/')", "1999"},
+	{"substring-before('1999/04/01', 'x')", ""},
+	{"substring-before('1999/04/01', '')", ""},
+	{"substring-after('1999/04/01', '/')", "04/01"},
+	{"substring-after('1999/04/01', '19')", "99/04/01"},
+	{"substring-after('1999/04/01', 'x')", ""},
+	{"substring-after('1999/04/01', '')", "1999/04/01"},
+	{"count(/library/book[1]/character) * 10", 40.0},
+	{"/library/book/isbn * 2", 1672434924.0},
+	{"/library/book[2]/isbn - /library/book[1]/isbn", 47338854.0},
+	{"1 div 0", "Infinity"},
+	{"0 div 0", "NaN"},
+	{"1 div 4", "0.25"},
+	{"1000000 * 1000000", "1000000000000"},
+	{"-0", "0"},
+	{"/library/book/title", "Being a Dog Is a Full-Time Job"},
+	{"normalize-space(/library/book/character/qualification)", "bold, brash and tomboyish"},
+	{"2 > 1", true},
+	{"'abc' = 'abc' and 1 != 2", true},
+	{"/library/book/isbn = 883556316", true},
+	{"not(/library/nope)", true},
+	{"/library/book/isbn > 900000000", false},
+	{"", cerror(": empty expression")},
+	{"1 +", cerror(": missing name")},
+	{"1 2", cerror(": unexpected '2'")},
+}
+
 var libraryXml = []byte(`
 <?xml version="1.0"?> 
 <library>
@@ -402,6 +4066,65 @@ func (s *BasicSuite) BenchmarkSimplePathExists(c *C) {
 	c.Assert(exists, Equals, true)
 }
 
+// largeXml holds many small records, for measuring how the cost of
+// parsing and of walking trees grows with their size.
+var largeXml = func() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("<library>")
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&buf, `<book id="b%d" available="true"><isbn>%d</isbn><title>Title %d</title>`+
+			`<author><name>Name %d</name><born>19%02d</born></author><!-- note --></book>`, i, i, i, i, i%100)
+	}
+	buf.WriteString("</library>")
+	return buf.Bytes()
+}()
+
+func (s *BasicSuite) BenchmarkParseLarge(c *C) {
+	for i := 0; i < c.N; i++ {
+		_, err := xmlpath.Parse(bytes.NewBuffer(largeXml))
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *BasicSuite) BenchmarkLargePathString(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(largeXml))
+	c.Assert(err, IsNil)
+	path := xmlpath.MustCompile("//book[author/name = 'Name 1999']/title")
+	var str string
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		str, _ = path.String(node)
+	}
+	c.StopTimer()
+	c.Assert(str, Equals, "Title 1999")
+}
+
+func (s *BasicSuite) BenchmarkLargePathFollowing(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(largeXml))
+	c.Assert(err, IsNil)
+	path := xmlpath.MustCompile("/library/book[1]/following::born[. = '1999']")
+	var exists bool
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		exists = path.Exists(node)
+	}
+	c.StopTimer()
+	c.Assert(exists, Equals, true)
+}
+
+func (s *BasicSuite) BenchmarkLargeExprCount(c *C) {
+	node, err := xmlpath.Parse(bytes.NewBuffer(largeXml))
+	c.Assert(err, IsNil)
+	expr := xmlpath.MustCompileExpr("count(//@*) + count(//text())")
+	var n float64
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		n = expr.Number(node)
+	}
+	c.StopTimer()
+	c.Assert(n, Equals, 12000.0)
+}
+
 var instancesXml = []byte(`
   <DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2011-12-15/">
   <requestId>98e3c9a4-848c-4d6d-8e8a-b1bdEXAMPLE</requestId>
@@ -0,0 +1,200 @@
+package xmlpath
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+)
+
+// binaryMagic starts the binary form of documents, followed by the
+// version of the format.
+const binaryMagic = "xmlpath\x00"
+
+const binaryVersion = 1
+
+// MarshalBinary encodes the document holding node, or the element
+// node and its content if it's not the root node, into a compact
+// binary form that LoadBinary turns back into a tree much faster than
+// the original document could be parsed again.
+func (node *Node) MarshalBinary() ([]byte, error) {
+	var from, to int
+	switch {
+	case node.kind == StartNode && node.up == nil:
+		from, to = node.pos+1, node.end
+	case node.kind == StartNode:
+		from, to = node.pos, node.end+1
+	default:
+		return nil, fmt.Errorf("xmlpath: cannot marshal node of kind %d", node.kind)
+	}
+
+	// Names are repeated a lot, so they're kept once in a table
+	// and referenced by index.
+	names := make(map[string]int)
+	var table []string
+	name := func(s string) int {
+		i, ok := names[s]
+		if !ok {
+			i = len(table)
+			names[s] = i
+			table = append(table, s)
+		}
+		return i
+	}
+	name("")
+
+	body := make([]byte, 0, 8*(to-from))
+	putString := func(s string) {
+		body = binary.AppendUvarint(body, uint64(len(s)))
+		body = append(body, s...)
+	}
+	for i := from; i < to; i++ {
+		n := node.nodes[i]
+		body = append(body, byte(n.kind))
+		switch n.kind {
+		case StartNode, AttrNode, NamespaceNode, ProcInstNode:
+			body = binary.AppendUvarint(body, uint64(name(n.name.Space)))
+			body = binary.AppendUvarint(body, uint64(name(n.name.Local)))
+		}
+		switch n.kind {
+		case AttrNode, NamespaceNode:
+			putString(n.attr)
+		case TextNode, CommentNode, ProcInstNode:
+			body = binary.AppendUvarint(body, uint64(len(n.text)))
+			body = append(body, n.text...)
+		}
+	}
+
+	data := make([]byte, 0, len(binaryMagic)+16+len(body))
+	data = append(data, binaryMagic...)
+	data = append(data, binaryVersion)
+	data = binary.AppendUvarint(data, uint64(to-from+2))
+	data = binary.AppendUvarint(data, uint64(len(table)))
+	for _, s := range table {
+		data = binary.AppendUvarint(data, uint64(len(s)))
+		data = append(data, s...)
+	}
+	return append(data, body...), nil
+}
+
+var errBinaryTruncated = errors.New("xmlpath: invalid binary document: truncated data")
+
+// LoadBinary returns the root node of a document encoded by
+// Node.MarshalBinary.
+//
+// The text content of the returned tree refers to data rather than
+// being copied out of it, so data may come straight from a memory
+// mapped file and the tree be queried without loading all of it.
+// The content of data must not be changed while the tree is in use.
+func LoadBinary(data []byte) (*Node, error) {
+	if len(data) < len(binaryMagic)+1 || string(data[:len(binaryMagic)]) != binaryMagic {
+		return nil, errors.New("xmlpath: invalid binary document: bad header")
+	}
+	if v := data[len(binaryMagic)]; v != binaryVersion {
+		return nil, fmt.Errorf("xmlpath: unsupported binary document version %d", v)
+	}
+	d := binaryDecoder{data: data, i: len(binaryMagic) + 1}
+	count := d.uvarint()
+	size := d.uvarint()
+	// Every node and name takes at least one byte, which bounds
+	// allocations done on behalf of corrupted data.
+	if d.err != nil || count < 2 || count > uint64(len(data)) || size > uint64(len(data)) {
+		return nil, errBinaryTruncated
+	}
+	table := make([]string, size)
+	for i := range table {
+		table[i] = string(d.bytes())
+	}
+	name := func() xml.Name {
+		space, local := d.uvarint(), d.uvarint()
+		if space >= size || local >= size {
+			if d.err == nil {
+				d.err = errors.New("xmlpath: invalid binary document: bad name reference")
+			}
+			return xml.Name{}
+		}
+		return xml.Name{Space: table[space], Local: table[local]}
+	}
+
+	nodes := make([]Node, 1, count)
+	nodes[0].kind = StartNode
+	for uint64(len(nodes)) < count-1 && d.err == nil {
+		var n Node
+		n.kind = NodeKind(d.byte())
+		switch n.kind {
+		case StartNode, AttrNode, NamespaceNode, ProcInstNode:
+			n.name = name()
+		case EndNode, TextNode, CommentNode:
+		default:
+			if d.err == nil {
+				d.err = fmt.Errorf("xmlpath: invalid binary document: bad node kind %d", n.kind)
+			}
+		}
+		switch n.kind {
+		case AttrNode, NamespaceNode:
+			n.attr = string(d.bytes())
+		case TextNode, CommentNode, ProcInstNode:
+			n.text = d.bytes()
+		}
+		nodes = append(nodes, n)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if d.i != len(data) {
+		return nil, errors.New("xmlpath: invalid binary document: trailing data")
+	}
+	nodes = append(nodes, Node{kind: EndNode})
+	root, err := link(nodes)
+	if err != nil || root != &nodes[0] || root.end != len(nodes)-1 {
+		return nil, errors.New("xmlpath: invalid binary document: unbalanced elements")
+	}
+	return root, nil
+}
+
+type binaryDecoder struct {
+	data []byte
+	i    int
+	err  error
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data[d.i:])
+	if n <= 0 {
+		d.err = errBinaryTruncated
+		return 0
+	}
+	d.i += n
+	return v
+}
+
+func (d *binaryDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if d.i >= len(d.data) {
+		d.err = errBinaryTruncated
+		return 0
+	}
+	d.i++
+	return d.data[d.i-1]
+}
+
+// bytes returns a length-prefixed byte sequence, referring to
+// the decoded data and limited in capacity to its own length.
+func (d *binaryDecoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.data)-d.i) {
+		d.err = errBinaryTruncated
+		return nil
+	}
+	b := d.data[d.i : d.i+int(n) : d.i+int(n)]
+	d.i += int(n)
+	return b
+}
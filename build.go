@@ -0,0 +1,76 @@
+package xmlpath
+
+import (
+	"encoding/xml"
+)
+
+// builder assembles a new tree in the same contiguous layout produced
+// by the parsers, so that transformations of a tree may produce a new
+// one. Text is shared with the nodes it's copied from rather than
+// duplicated.
+type builder struct {
+	nodes []Node
+	depth int
+}
+
+func newBuilder() *builder {
+	return &builder{nodes: []Node{{kind: StartNode}}}
+}
+
+// start opens a new element. Attributes for it must be added
+// before anything else.
+func (b *builder) start(name xml.Name) {
+	b.nodes = append(b.nodes, Node{kind: StartNode, name: name})
+	b.depth++
+}
+
+func (b *builder) attr(name xml.Name, value string) {
+	b.nodes = append(b.nodes, Node{kind: AttrNode, name: name, attr: value})
+}
+
+// namespace adds a namespace declaration to the last element opened,
+// which must come after its attributes.
+func (b *builder) namespace(prefix, uri string) {
+	b.nodes = append(b.nodes, Node{kind: NamespaceNode, name: xml.Name{Local: prefix}, attr: uri})
+}
+
+// end closes the last element opened.
+func (b *builder) end() {
+	b.nodes = append(b.nodes, Node{kind: EndNode})
+	b.depth--
+}
+
+// leaf adds a text, comment, or processing instruction node.
+func (b *builder) leaf(kind NodeKind, name xml.Name, text []byte) {
+	b.nodes = append(b.nodes, Node{kind: kind, name: name, text: text})
+}
+
+// copy adds node and everything within it. Copying the root node of
+// a tree copies its content only, as the builder has a root of its own.
+func (b *builder) copy(node *Node) {
+	from, to := node.pos, node.end
+	if node.kind == StartNode {
+		to++
+		if node.up == nil {
+			from, to = from+1, to-1
+		}
+	}
+	for i := from; i < to; i++ {
+		n := node.nodes[i]
+		b.nodes = append(b.nodes, Node{kind: n.kind, name: n.name, attr: n.attr, text: n.text})
+	}
+}
+
+// finish closes any elements left open and the root node, and
+// returns the root of the new tree.
+func (b *builder) finish() *Node {
+	for b.depth > 0 {
+		b.end()
+	}
+	b.nodes = append(b.nodes, Node{kind: EndNode})
+	root, err := link(b.nodes)
+	if err != nil {
+		panic("internal error: builder produced a broken tree: " + err.Error())
+	}
+	return root
+}
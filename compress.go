@@ -0,0 +1,129 @@
+package xmlpath
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// ErrTooLarge is returned when reading from a Decompress reader would
+// produce more data than the configured limit.
+var ErrTooLarge = errors.New("xmlpath: decompressed document too large")
+
+var (
+	decodersMu sync.RWMutex
+	decoders   = make(map[string]func(io.Reader) (io.Reader, error))
+)
+
+// RegisterDecoder makes a decoder for the given content encoding available
+// to Decompress, replacing any previous decoder for it. Encodings gzip and
+// deflate are built in. There's no built in support for Brotli ("br"), but
+// a third party implementation may be plugged in, for example:
+//
+//     xmlpath.RegisterDecoder("br", func(r io.Reader) (io.Reader, error) {
+//             return brotli.NewReader(r), nil
+//     })
+//
+func RegisterDecoder(encoding string, decoder func(io.Reader) (io.Reader, error)) {
+	decodersMu.Lock()
+	decoders[strings.ToLower(encoding)] = decoder
+	decodersMu.Unlock()
+}
+
+// Decompress returns a reader that decompresses the data read from r
+// according to encoding, which has the format of an HTTP Content-Encoding
+// header value ("gzip", "deflate", etc). If encoding is empty, the
+// data is sniffed and gzip or zlib streams are decompressed, while any
+// other data is returned unchanged. The "identity" encoding returns the
+// data unchanged without sniffing it. Other encodings, Brotli ("br")
+// included, fail unless a decoder was registered for them by the caller
+// via RegisterDecoder.
+//
+// If limit is positive, reading more than limit decompressed bytes
+// fails with ErrTooLarge, guarding against decompression bombs.
+//
+// For example:
+//
+//     r, err := xmlpath.Decompress(resp.Body, resp.Header.Get("Content-Encoding"), 64<<20)
+//     if err != nil {
+//             return err
+//     }
+//     root, err := xmlpath.Parse(r)
+//
+func Decompress(r io.Reader, encoding string, limit int64) (io.Reader, error) {
+	dr, err := decompress(r, strings.ToLower(strings.TrimSpace(encoding)))
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 {
+		dr = &limitedReader{dr, limit}
+	}
+	return dr, nil
+}
+
+func decompress(r io.Reader, encoding string) (io.Reader, error) {
+	switch encoding {
+	case "identity":
+		return r, nil
+	case "":
+		br := bufio.NewReader(r)
+		head, _ := br.Peek(2)
+		if len(head) == 2 && head[0] == 0x1f && head[1] == 0x8b {
+			return gzip.NewReader(br)
+		}
+		if len(head) == 2 && isZlibHeader(head) {
+			return zlib.NewReader(br)
+		}
+		return br, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// Per HTTP this is a zlib stream, but raw deflate data is
+		// often sent instead.
+		br := bufio.NewReader(r)
+		head, _ := br.Peek(2)
+		if len(head) == 2 && isZlibHeader(head) {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	}
+	decodersMu.RLock()
+	decoder, ok := decoders[encoding]
+	decodersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("xmlpath: unsupported content encoding %q", encoding)
+	}
+	return decoder(r)
+}
+
+// isZlibHeader returns whether head holds a valid zlib stream header
+// using the deflate method.
+func isZlibHeader(head []byte) bool {
+	return head[0]&0x0f == 8 && head[0]>>4 <= 7 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0
+}
+
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (n int, err error) {
+	if l.n < 0 {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err = l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n + int(l.n), ErrTooLarge
+	}
+	return n, err
+}
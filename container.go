@@ -0,0 +1,141 @@
+package xmlpath
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Container provides access to the xml documents stored as parts of a
+// zip container, as done by Office Open XML (docx, xlsx, pptx), EPUB and
+// OpenDocument files.
+type Container struct {
+	zr    *zip.Reader
+	close func() error
+}
+
+// OpenContainer returns a Container reading the zip data of the given
+// size from r.
+func OpenContainer(r io.ReaderAt, size int64) (*Container, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return &Container{zr: zr}, nil
+}
+
+// OpenContainerFile opens the named zip file as a Container.
+// The Container must be closed after use.
+func OpenContainerFile(name string) (*Container, error) {
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Container{zr: &zr.Reader, close: zr.Close}, nil
+}
+
+// Close closes the underlying file if the container was opened with
+// OpenContainerFile, and does nothing otherwise.
+func (c *Container) Close() error {
+	if c.close != nil {
+		return c.close()
+	}
+	return nil
+}
+
+// Parts returns the names of all parts in the container, in the
+// order they're stored. Directory entries are not included.
+func (c *Container) Parts() []string {
+	var names []string
+	for _, f := range c.zr.File {
+		if !strings.HasSuffix(f.Name, "/") {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+// Open opens the named part for reading. A leading slash in name,
+// as found in OPC part names, is ignored.
+func (c *Container) Open(name string) (io.ReadCloser, error) {
+	name = strings.TrimPrefix(name, "/")
+	for _, f := range c.zr.File {
+		if f.Name == name {
+			return f.Open()
+		}
+	}
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+}
+
+// Parse parses the named part as an xml document and returns its root node.
+func (c *Container) Parse(name string) (*Node, error) {
+	rc, err := c.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	node, err := Parse(rc)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", name, err)
+	}
+	return node, nil
+}
+
+// Relationship is an Open Packaging Conventions relationship between a
+// source part and a target, as used by Office Open XML documents.
+type Relationship struct {
+	ID   string
+	Type string
+
+	// Target is the name of the target part within the container,
+	// already resolved against the source part, or the target URI
+	// as found if External is true.
+	Target   string
+	External bool
+}
+
+var (
+	relationshipPath = MustCompile("/Relationships/Relationship")
+	relIdPath        = MustCompile("@Id")
+	relTypePath      = MustCompile("@Type")
+	relTargetPath    = MustCompile("@Target")
+	relModePath      = MustCompile("@TargetMode")
+)
+
+// Relationships returns the relationships having the named part as their
+// source, or the package relationships if part is empty. For example, the
+// main document of a docx file is found via the package relationships,
+// and its images via the relationships of "word/document.xml".
+// A part without relationships has none, and no error is returned.
+func (c *Container) Relationships(part string) ([]Relationship, error) {
+	part = strings.TrimPrefix(part, "/")
+	dir, file := path.Split(part)
+	node, err := c.Parse(dir + "_rels/" + file + ".rels")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rels []Relationship
+	iter := relationshipPath.Iter(node)
+	for iter.Next() {
+		n := iter.Node()
+		var rel Relationship
+		rel.ID, _ = relIdPath.String(n)
+		rel.Type, _ = relTypePath.String(n)
+		rel.Target, _ = relTargetPath.String(n)
+		if mode, _ := relModePath.String(n); mode == "External" {
+			rel.External = true
+		} else if strings.HasPrefix(rel.Target, "/") {
+			rel.Target = rel.Target[1:]
+		} else {
+			rel.Target = path.Join(dir, rel.Target)
+		}
+		rels = append(rels, rel)
+	}
+	return rels, nil
+}
@@ -0,0 +1,365 @@
+package xmlpath
+
+import (
+	"math"
+)
+
+// NameStats holds statistics about a tree along with the number of its
+// elements and attributes by local name, as returned by Node.NameStats,
+// for estimating the cost of evaluating paths on it.
+type NameStats struct {
+	Stats
+
+	// ElementsByName and AttrsByName hold the number of elements
+	// and attributes by local name.
+	ElementsByName map[string]int
+	AttrsByName    map[string]int
+
+	// children and descendants hold the number of nodes within the
+	// elements of each name, other than attributes and namespaces,
+	// counting those right within them and all of them respectively,
+	// and childElements the number of elements of each name right
+	// within the elements of each name. parents holds the number of
+	// nodes holding elements of each name right within them. The node
+	// the statistics were taken from is counted under an empty name,
+	// as the context node of the paths estimated.
+	children      map[string]int
+	descendants   map[string]int
+	childElements map[[2]string]int
+	parents       map[string]int
+}
+
+// NameStats returns statistics about the subtree rooted at node, which
+// cover the whole document when node is a root node.
+func (node *Node) NameStats() *NameStats {
+	s := &NameStats{
+		Stats:          node.Stats(),
+		ElementsByName: make(map[string]int),
+		AttrsByName:    make(map[string]int),
+		children:       make(map[string]int),
+		descendants:    make(map[string]int),
+		childElements:  make(map[[2]string]int),
+		parents:        make(map[string]int),
+	}
+	name := func(n *Node) string {
+		if n == node {
+			return ""
+		}
+		return n.name.Local
+	}
+	// content[i] is the number of nodes before node.pos+i other than
+	// attributes, namespaces, and the end of elements.
+	content := make([]int, node.end-node.pos+1)
+	// lastParent holds the position plus one of the last node found
+	// holding elements of each name.
+	lastParent := make(map[string]int)
+	for i := node.pos; i < node.end; i++ {
+		n := node.nodes[i]
+		content[i-node.pos+1] = content[i-node.pos]
+		switch n.kind {
+		case AttrNode:
+			s.AttrsByName[n.name.Local]++
+			continue
+		case NamespaceNode, EndNode:
+			continue
+		}
+		content[i-node.pos+1]++
+		if n.kind == StartNode && n.up != nil {
+			s.ElementsByName[n.name.Local]++
+		}
+		if n != node {
+			s.children[name(n.up)]++
+			if n.kind == StartNode {
+				s.childElements[[2]string{name(n.up), n.name.Local}]++
+				if lastParent[n.name.Local] != n.up.pos+1 {
+					lastParent[n.name.Local] = n.up.pos + 1
+					s.parents[n.name.Local]++
+				}
+			}
+		}
+	}
+	for i := node.pos; i < node.end; i++ {
+		if n := node.nodes[i]; n.kind == StartNode {
+			s.descendants[name(n)] += content[n.end-node.pos] - content[i-node.pos+1]
+		}
+	}
+	return s
+}
+
+// EstimateCost estimates how many nodes evaluating p on the document
+// with root node doc visits, based on the statistics of the document,
+// so that services evaluating user supplied paths may reject or
+// deprioritize expensive ones before running them. See
+// NameStats.EstimateCost for details.
+func (p *Path) EstimateCost(doc *Node) int {
+	return doc.NameStats().EstimateCost(p)
+}
+
+// EstimateCost estimates how many nodes evaluating p on the root node
+// of the document s was taken from visits. The estimate is meant for
+// comparing paths rather than for predicting evaluation times, and errs
+// on the high side: nodes are taken to satisfy every predicate not
+// involving positions, and scans over the descendants of many nodes to
+// cover as much of the document as nesting allows. Paths scanning large
+// parts of the document for each of many nodes, as in //a[//b = .],
+// stand out with costs many times the number of nodes in the document.
+// Each call to document() costs as much as scanning a large document,
+// as it may fetch and parse one.
+//
+// Computing statistics takes a pass over the document, so services
+// estimating several paths for a document should take them once:
+//
+//	stats := root.NameStats()
+//	if stats.EstimateCost(path) > 50*stats.Nodes() {
+//		return errTooExpensive
+//	}
+func (s *NameStats) EstimateCost(p *Path) int {
+	cost, _ := s.pathCost(p, 1, "", true)
+	if cost >= float64(maxCost) {
+		return maxCost
+	}
+	return int(cost)
+}
+
+// maxCost is the largest cost reported, as costs may grow beyond
+// what an int holds.
+const maxCost = int(^uint(0) >> 1)
+
+// documentCost is the cost taken for each call to document(), which
+// may fetch and parse a whole other document.
+const documentCost = 1 << 20
+
+// pathCost returns the estimated number of nodes visited by evaluating
+// p on the given number of context nodes, and the number of nodes it
+// selects. When named is set, the context nodes are all elements with
+// the given name, or the node the statistics were taken from if name
+// is empty.
+func (s *NameStats) pathCost(p *Path, contexts float64, name string, named bool) (cost, selected float64) {
+	switch {
+	case p.call != nil:
+		// Functions returning nodes are taken to return one for
+		// each context node, as document() does when given one URL.
+		return contexts * s.predCost(p.call, name, named), contexts
+	case p.group != nil:
+		cost, selected = s.pathCost(p.group, contexts, name, named)
+		for _, pred := range p.filter {
+			cost += selected * s.predCost(pred, "", false)
+			if positional(pred) {
+				selected = math.Min(selected, contexts)
+			}
+		}
+		if p.rest != nil {
+			restCost, restSelected := s.pathCost(p.rest, selected, "", false)
+			cost += restCost
+			selected = restSelected
+		}
+		return cost, selected
+	case p.union != nil || p.coalesce != nil:
+		alts := p.union
+		if p.coalesce != nil {
+			alts = p.coalesce
+		}
+		for _, alt := range alts {
+			altCost, altSelected := s.pathCost(alt, contexts, name, named)
+			cost += altCost
+			selected += altSelected
+		}
+		return cost, math.Min(selected, float64(s.Nodes()+1))
+	}
+	selected = contexts
+	for i := range p.steps {
+		step := &p.steps[i]
+		if step.root {
+			selected = 1
+			name, named = "", true
+		}
+		from := selected
+		visited, found := s.stepCost(step, from, name, named)
+		if step.maxpos > 0 && found > from*float64(step.maxpos) {
+			// The axis is only traversed up to the last position
+			// that may satisfy the predicate.
+			ratio := from * float64(step.maxpos) / found
+			visited *= ratio
+			found *= ratio
+		}
+		cost += visited
+		selected = found
+		if step.axis != "self" {
+			name, named = step.name, elementTest(step)
+		}
+		if step.pred == nil {
+			continue
+		}
+		for _, pred := range append([]predicate{step.pred}, step.chain...) {
+			cost += selected * s.predCost(pred, name, named)
+			if positional(pred) {
+				// About one node is left for each context node, or
+				// for each node holding the children selected.
+				keep := from
+				if step.axis == "child" && elementTest(step) {
+					keep = math.Min(keep, float64(s.parents[step.name]))
+				}
+				selected = math.Min(selected, keep*math.Max(float64(step.maxpos), 1))
+			}
+		}
+	}
+	return cost, selected
+}
+
+// stepCost returns the estimated number of nodes visited by step from
+// the given number of context nodes, described as in pathCost, and the
+// number of nodes it selects.
+func (s *NameStats) stepCost(step *pathStep, contexts float64, name string, named bool) (visited, selected float64) {
+	total := float64(s.Nodes() + 1)
+	content := total - float64(s.Attrs+s.Namespaces)
+	attrs := float64(s.Attrs)
+	elements := math.Max(float64(s.Elements), 1)
+	depth := float64(s.Depth + 1)
+
+	// per holds the number of context nodes for averaging the counts
+	// of the elements named name.
+	per := math.Max(float64(s.ElementsByName[name]), 1)
+	if name == "" {
+		per = 1
+	}
+
+	var each float64
+	switch step.axis {
+	case "self", "parent":
+		each = 1
+	case "child", "following-sibling", "preceding-sibling":
+		if named && step.axis == "child" {
+			each = float64(s.children[name]) / per
+		} else {
+			each = (content - 1) / elements
+		}
+	case "ancestor", "ancestor-or-self":
+		each = depth
+	case "attribute":
+		each = attrs / elements
+	case "namespace":
+		each = float64(s.Namespaces) / elements
+	case "descendant", "descendant-or-self", "descendant-attribute":
+		each = total
+		if named {
+			each = float64(s.descendants[name])/per + 1
+		}
+		if step.axis == "descendant-attribute" {
+			each *= (content + attrs) / content
+		}
+	default:
+		// The following and preceding axes.
+		each = total
+	}
+	visited = contexts * each
+	if !named && (step.axis == "descendant" || step.axis == "descendant-or-self") {
+		// Each node is found once from each of its ancestors at most.
+		visited = math.Min(visited, total*depth)
+	}
+
+	// matching is the number of nodes in the document passing the
+	// node test, out of the pool of nodes of the kinds visited.
+	var matching float64
+	pool := content
+	switch {
+	case step.axis == "namespace":
+		matching = float64(s.Namespaces)
+		pool = math.Max(matching, 1)
+	case step.kind == AttrNode || step.axis == "attribute" || step.axis == "descendant-attribute":
+		matching = float64(s.AttrsByName[step.name])
+		if step.name == "*" {
+			matching = attrs
+		}
+		pool = math.Max(attrs, 1)
+		if step.axis == "descendant-attribute" {
+			pool = content + attrs
+		}
+	case step.kind == TextNode:
+		matching = float64(s.Texts)
+	case step.kind == CommentNode:
+		matching = float64(s.Comments)
+	case step.kind == ProcInstNode:
+		matching = float64(s.ProcInsts)
+	case step.name != "*":
+		matching = float64(s.ElementsByName[step.name])
+	case step.kind == StartNode:
+		matching = float64(s.Elements)
+	default:
+		matching = content
+	}
+	if named && step.axis == "child" && elementTest(step) {
+		selected = contexts * float64(s.childElements[[2]string{name, step.name}]) / per
+	} else {
+		// Nodes are taken to be spread evenly over those visited.
+		selected = visited * matching / pool
+	}
+	// No node is selected twice.
+	return visited, math.Min(selected, matching)
+}
+
+// elementTest returns whether step selects elements by name.
+func elementTest(step *pathStep) bool {
+	switch step.axis {
+	case "attribute", "descendant-attribute", "namespace":
+		return false
+	}
+	return (step.kind == AnyNode || step.kind == StartNode) && step.name != "*"
+}
+
+// predCost returns the estimated number of nodes visited by testing
+// pred on a single node.
+func (s *NameStats) predCost(pred predicate, name string, named bool) float64 {
+	pathCost := func(p *Path) float64 {
+		cost, _ := s.pathCost(p, 1, name, named)
+		return 1 + cost
+	}
+	switch pred := pred.(type) {
+	case equalsPredicate:
+		return pathCost(pred.path)
+	case notequalsPredicate:
+		return pathCost(pred.path)
+	case containsPredicate:
+		return pathCost(pred.path)
+	case startsWithPredicate:
+		return pathCost(pred.path)
+	case comparePredicate:
+		return pathCost(pred.path)
+	case normalizedEqualsPredicate:
+		return pathCost(pred.path)
+	case normalizedNotequalsPredicate:
+		return pathCost(pred.path)
+	case pathExpr:
+		return pathCost(pred.path)
+	case notPredicate:
+		return 1 + s.predCost(pred.uniSub, name, named)
+	case andPredicate:
+		return 1 + s.predsCost(pred.sub, name, named)
+	case orPredicate:
+		return 1 + s.predsCost(pred.sub, name, named)
+	case numberPredicate:
+		return 1 + s.predCost(pred.sub, name, named)
+	case negExpr:
+		return 1 + s.predCost(pred.sub, name, named)
+	case arithExpr:
+		return 1 + s.predCost(pred.left, name, named) + s.predCost(pred.right, name, named)
+	case compareExpr:
+		return 1 + s.predCost(pred.left, name, named) + s.predCost(pred.right, name, named)
+	case regexpExpr:
+		return 1 + s.predCost(pred.sub, name, named)
+	case callExpr:
+		cost := 1 + s.predsCost(pred.args, name, named)
+		if pred.name == "document" {
+			cost += documentCost
+		}
+		return cost
+	}
+	return 1
+}
+
+func (s *NameStats) predsCost(preds []predicate, name string, named bool) float64 {
+	var cost float64
+	for _, pred := range preds {
+		cost += s.predCost(pred, name, named)
+	}
+	return cost
+}
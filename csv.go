@@ -0,0 +1,79 @@
+package xmlpath
+
+import (
+	"encoding/csv"
+	"io"
+)
+
+// CSVExport writes the rows selected by a path as comma or tab separated
+// values, with a column for each of a set of paths evaluated on every
+// row, as commonly done at the end of extraction jobs.
+//
+// For example:
+//
+//	export := &xmlpath.CSVExport{
+//		Rows: xmlpath.MustCompile("//product"),
+//		Columns: []xmlpath.CSVColumn{
+//			{Name: "sku", Path: xmlpath.MustCompile("@sku")},
+//			{Name: "price", Path: xmlpath.MustCompile("price")},
+//		},
+//	}
+//	n, err := export.Write(os.Stdout, root)
+type CSVExport struct {
+	// Rows selects the nodes written as rows.
+	Rows *Path
+
+	// Columns define the values written for each row.
+	Columns []CSVColumn
+
+	// Comma is the field delimiter, such as '\t' for tab separated
+	// values. If zero, ',' is used.
+	Comma rune
+
+	// NoHeader disables writing the names of the columns as the
+	// first record.
+	NoHeader bool
+}
+
+// CSVColumn is a column of a CSVExport.
+type CSVColumn struct {
+	// Name is written in the header record.
+	Name string
+
+	// Path is evaluated with each row as the context node, and the
+	// string value of the first node it selects is written as the
+	// value of the column, or an empty string if it selects none.
+	Path *Path
+}
+
+// Write writes the rows selected by e.Rows on context into w as they're
+// found, and returns the number of rows written, not counting the header.
+func (e *CSVExport) Write(w io.Writer, context *Node) (int, error) {
+	cw := csv.NewWriter(w)
+	if e.Comma != 0 {
+		cw.Comma = e.Comma
+	}
+	record := make([]string, len(e.Columns))
+	if !e.NoHeader {
+		for i, col := range e.Columns {
+			record[i] = col.Name
+		}
+		if err := cw.Write(record); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	iter := e.Rows.Iter(context)
+	for iter.Next() {
+		row := iter.Node()
+		for i, col := range e.Columns {
+			record[i], _ = col.Path.String(row)
+		}
+		if err := cw.Write(record); err != nil {
+			return n, err
+		}
+		n++
+	}
+	cw.Flush()
+	return n, cw.Error()
+}
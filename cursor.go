@@ -0,0 +1,420 @@
+package xmlpath
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+)
+
+// Cursor marks a place within the iteration over a node set, as
+// returned by Iter.Cursor, so that iteration may be paused after some
+// nodes and resumed later via Iter.Seek, possibly by another process
+// holding the same document, as needed by paginated APIs:
+//
+//	iter := path.Iter(root)
+//	if token != "" {
+//		cursor, err := xmlpath.ParseCursor(token)
+//		if err == nil {
+//			err = iter.Seek(cursor)
+//		}
+//		if err != nil {
+//			return nil, "", err
+//		}
+//	}
+//	for len(page) < pageSize && iter.Next() {
+//		page = append(page, iter.Node())
+//	}
+//	return page, iter.Cursor().String(), nil
+//
+// Cursors for single location paths record the node reached by each
+// step along with its position, which Seek checks against the document
+// before going on from there, so that resuming takes no longer than
+// moving forward would, and forged cursors can't lead iteration astray.
+// Unions, groups and paths whose nodes must be deduplicated are instead
+// evaluated again up to the place marked.
+type Cursor struct {
+	data []byte
+}
+
+// ErrCursorMismatch is returned by Iter.Seek when the cursor given
+// was taken from an iterator over a different path, context node,
+// or document.
+var ErrCursorMismatch = errors.New("xmlpath: cursor taken from a different iteration")
+
+var errInvalidCursor = errors.New("xmlpath: invalid cursor")
+
+const cursorVersion = 1
+
+// String returns the cursor in a compact textual form, safe for use
+// in URLs, which ParseCursor turns back into the cursor.
+func (c Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString(c.data)
+}
+
+// ParseCursor returns the cursor in the textual form returned by
+// Cursor.String.
+func ParseCursor(s string) (Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, errInvalidCursor
+	}
+	r := cursorReader{data: data}
+	if r.int() != cursorVersion || r.err != nil {
+		return Cursor{}, errInvalidCursor
+	}
+	return Cursor{data}, nil
+}
+
+// Cursor returns a cursor marking the current place of iter, so that
+// an iterator over the same path and context node moved to it via Seek
+// goes on with the nodes following the current one.
+func (iter *Iter) Cursor() Cursor {
+	var b []byte
+	b = binary.AppendVarint(b, cursorVersion)
+	b = binary.AppendVarint(b, iter.hash())
+	b = binary.AppendVarint(b, int64(len(iter.context.nodes)))
+	b = binary.AppendVarint(b, int64(iter.context.pos))
+	b = binary.AppendVarint(b, int64(iter.count))
+	node := iter.current()
+	switch {
+	case iter.union != nil || iter.seen != nil || iter.err != nil || iter.count == 0:
+		var last int64
+		if node != nil {
+			last = int64(node.pos) + 1
+		}
+		b = binary.AppendVarint(b, cursorReplay)
+		b = binary.AppendVarint(b, last)
+	case node == nil:
+		b = binary.AppendVarint(b, cursorDone)
+	default:
+		b = binary.AppendVarint(b, cursorState)
+		for i := range iter.state {
+			s := &iter.state[i]
+			b = binary.AppendVarint(b, cursorNode(s.node))
+			b = binary.AppendVarint(b, int64(s.pos))
+			for _, pos := range s.chainPos {
+				b = binary.AppendVarint(b, int64(pos))
+			}
+		}
+	}
+	return Cursor{b}
+}
+
+// Kinds of place recorded in a cursor. Iterating over a single location
+// path holds the node and position reached by each of its steps, which
+// cursorState cursors record so that Seek may restore them. Unions,
+// groups and deduplicated paths are instead evaluated again up to the
+// place marked by cursorReplay cursors.
+const (
+	cursorReplay = iota
+	cursorState
+	cursorDone
+)
+
+// cursorNode returns how node is recorded in a cursor: its position
+// plus one, or -1 for the namespace node binding the xml prefix, which
+// is not part of the node slice.
+func cursorNode(node *Node) int64 {
+	if node.implicit() {
+		return -1
+	}
+	return int64(node.pos) + 1
+}
+
+// Seek moves iter to the place marked by cursor, as returned by
+// Iter.Cursor for an iterator over the same path and context node in
+// the same document, with the same filter and variables, if any. The
+// following call to Next then returns the node following the one that
+// was current when the cursor was taken, and positions reported by
+// Match go on from there. Seek must be called before iterating, and
+// returns ErrCursorMismatch if the cursor doesn't fit iter.
+func (iter *Iter) Seek(cursor Cursor) error {
+	r := cursorReader{data: cursor.data}
+	if r.int() != cursorVersion {
+		return errInvalidCursor
+	}
+	if r.int64() != iter.hash() || r.int() != len(iter.context.nodes) || r.int() != iter.context.pos {
+		if r.err != nil {
+			return errInvalidCursor
+		}
+		return ErrCursorMismatch
+	}
+	count := r.int()
+	kind := r.int()
+	if r.err != nil || count < 0 {
+		return errInvalidCursor
+	}
+	switch kind {
+	case cursorReplay:
+		return iter.replay(&r, count)
+	case cursorState:
+		if iter.union != nil || iter.seen != nil || count == 0 {
+			return ErrCursorMismatch
+		}
+		for i := range iter.state {
+			if err := iter.restore(&r, i); err != nil {
+				return err
+			}
+		}
+		if len(r.data) > 0 {
+			return errInvalidCursor
+		}
+	case cursorDone:
+		if iter.union != nil || iter.seen != nil {
+			return ErrCursorMismatch
+		}
+		if len(r.data) > 0 {
+			return errInvalidCursor
+		}
+		iter.state[0].node = nil
+	default:
+		return errInvalidCursor
+	}
+	iter.count = count
+	return nil
+}
+
+// replay moves iter to the place marked by a cursorReplay cursor,
+// by iterating until count nodes were found.
+func (iter *Iter) replay(r *cursorReader, count int) error {
+	last := r.int()
+	if r.err != nil || len(r.data) > 0 || last < 0 || last > len(iter.context.nodes) || count == 0 && last != 0 {
+		return errInvalidCursor
+	}
+	for iter.count < count && iter.Next() {
+	}
+	if iter.err != nil {
+		return nil
+	}
+	if iter.count < count || last != 0 && iter.current().pos+1 != last {
+		return ErrCursorMismatch
+	}
+	return nil
+}
+
+// restore sets the state of the i-th step of iter as read from r,
+// after checking that it's one the step may reach: the node must be
+// selected by the step from the node of the previous one, and satisfy
+// its predicates at the positions recorded.
+func (iter *Iter) restore(r *cursorReader, i int) error {
+	s := &iter.state[i]
+	from := iter.context
+	if i > 0 {
+		from = iter.state[i-1].node
+	}
+	s.init(from)
+	ref := r.int()
+	pos := r.int()
+	for j := range s.step.chain {
+		if s.chainPos == nil {
+			s.chainPos = make([]int, len(s.step.chain))
+			s.chainSize = make([]int, len(s.step.chain))
+		}
+		s.chainPos[j] = r.int()
+		if s.chainPos[j] < 1 || s.chainPos[j] > pos {
+			return ErrCursorMismatch
+		}
+	}
+	if r.err != nil {
+		return errInvalidCursor
+	}
+	base := from
+	if s.step.root {
+		for base.up != nil {
+			base = base.up
+		}
+	}
+	var node *Node
+	switch {
+	case ref == -1 && base.kind == StartNode && base.up != nil:
+		node = base.xmlNamespace()
+	case ref >= 1 && ref <= len(from.nodes):
+		node = from.nodes[ref-1]
+	}
+	if node == nil || pos < 1 || s.step.maxpos < 0 || s.step.maxpos > 0 && pos > s.step.maxpos || !s.step.match(node) {
+		return ErrCursorMismatch
+	}
+	if !s.resume(base, node) {
+		s.init(from)
+		return ErrCursorMismatch
+	}
+	s.node = node
+	s.pos = pos
+	if s.step.pred != nil {
+		ok := s.test(s.step.pred, pos)
+		for j, pred := range s.step.chain {
+			if !ok {
+				break
+			}
+			s.level = j + 1
+			ok = s.test(pred, s.chainPos[j])
+			s.level = 0
+		}
+		if !ok {
+			s.init(from)
+			return ErrCursorMismatch
+		}
+	}
+	return nil
+}
+
+// resume sets idx and aux as they'd be once the step, starting from
+// base, has just selected node, and returns whether node is selected
+// by the step from base at all.
+func (s *pathStepState) resume(base, node *Node) bool {
+	switch s.step.axis {
+	case "self":
+		s.idx = 1
+		return node == base
+	case "parent":
+		s.idx = 1
+		return node == base.up
+	case "ancestor", "ancestor-or-self":
+		s.idx = 1
+		up := base
+		if s.step.axis == "ancestor" {
+			up = base.up
+		}
+		for ; up != nil; up = up.up {
+			if up == node {
+				return true
+			}
+		}
+	case "child", "following-sibling":
+		if node.up == nil || node.up != base && (s.step.axis == "child" || node.up != base.up) {
+			return false
+		}
+		down := node.up.down
+		seen := s.step.axis == "child"
+		for i, n := range down {
+			if n == base {
+				seen = true
+			} else if n == node {
+				s.idx = i + 1
+				return seen
+			}
+		}
+	case "preceding-sibling":
+		if node.up == nil || node.up != base.up {
+			return false
+		}
+		down := node.up.down
+		for i, n := range down {
+			if n == node {
+				s.aux = 1
+				s.idx = i - 1
+			} else if n == base {
+				return s.aux == 1
+			}
+		}
+	case "descendant", "descendant-or-self", "following":
+		if node.kind == AttrNode || node.kind == NamespaceNode || node.kind == EndNode {
+			return false
+		}
+		s.idx = node.pos + 1
+		s.aux = base.end
+		if s.step.axis == "following" {
+			return node.pos >= base.end
+		}
+		return node.pos > base.pos && node.pos < base.end || node == base && s.step.axis == "descendant-or-self"
+	case "preceding":
+		if node.kind == AttrNode || node.kind == NamespaceNode || node.kind == EndNode || node.pos >= base.pos {
+			return false
+		}
+		s.idx = node.pos - 1
+		up := base
+		for up.up != nil && up.up.pos > node.pos {
+			up = up.up
+		}
+		s.aux = up.pos
+		return node != up.up
+	case "attribute", "descendant-attribute":
+		if node.kind != AttrNode || base.kind != StartNode {
+			return false
+		}
+		s.idx = node.pos + 1
+		s.aux = base.end
+		if s.step.axis == "attribute" {
+			return node.up == base
+		}
+		return node.pos > base.pos && node.pos < base.end
+	case "namespace":
+		if base.kind != StartNode || base.up == nil {
+			return false
+		}
+		s.aux = base.pos
+		if node.implicit() {
+			s.idx = -1
+			return node == base.xmlNamespace()
+		}
+		s.idx = node.pos + 1
+		if node.kind != NamespaceNode || node.attr == "" {
+			return false
+		}
+		for up := base; up != nil; up = up.up {
+			if up == node.up {
+				return !redeclared(base, node)
+			}
+		}
+	}
+	return false
+}
+
+// current returns the current node of iter, or nil if there's none
+// as iteration didn't start or is over.
+func (iter *Iter) current() *Node {
+	if iter.union != nil {
+		if iter.index == 0 || iter.index > len(iter.matches) {
+			return nil
+		}
+		return iter.matches[iter.index-1].Node
+	}
+	state := &iter.state[len(iter.state)-1]
+	if state.pos == 0 {
+		return nil
+	}
+	return state.node
+}
+
+// hash returns a hash of the path iter iterates over, for telling
+// apart cursors taken from iterators over other paths.
+func (iter *Iter) hash() int64 {
+	h := fnv.New32a()
+	if iter.union != nil {
+		h.Write([]byte(iter.union.path))
+	}
+	for i := range iter.state {
+		step := iter.state[i].step
+		if step.root {
+			h.Write([]byte{'/'})
+		}
+		h.Write([]byte(step.axis))
+		h.Write([]byte{':'})
+		h.Write([]byte(step.text))
+		h.Write([]byte{0})
+	}
+	return int64(h.Sum32())
+}
+
+// cursorReader reads the integers encoded in a cursor, with err set
+// once any of them is missing.
+type cursorReader struct {
+	data []byte
+	err  error
+}
+
+func (r *cursorReader) int64() int64 {
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errInvalidCursor
+		r.data = nil
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *cursorReader) int() int {
+	return int(r.int64())
+}
@@ -0,0 +1,151 @@
+package xmlpath
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// Debug logs what happens while documents are parsed and evaluated
+// through its methods, so that problems with specific documents may
+// be diagnosed in production without custom builds. Records are logged
+// at the debug level, so they're only emitted when the handler of the
+// logger is enabled for that level.
+//
+// Debug is configured per call, so that, for example, every record
+// may identify the document at hand:
+//
+//     debug := &xmlpath.Debug{Logger: logger.With("url", url), SlowEval: 100 * time.Millisecond}
+//     root, err := debug.Parse(r)
+//     if err != nil {
+//             return err
+//     }
+//     items := debug.Find(path, root)
+//
+type Debug struct {
+	// Logger receives the records. If nil, slog.Default() is used.
+	Logger *slog.Logger
+
+	// SlowEval, when positive, is the duration above which
+	// evaluations are logged. Evaluations aren't logged otherwise.
+	SlowEval time.Duration
+}
+
+func (d *Debug) log(msg string, attrs ...slog.Attr) {
+	logger := d.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.LogAttrs(context.Background(), slog.LevelDebug, msg, attrs...)
+}
+
+// Parse works like the Parse function, logging when parsing starts
+// and how it ends.
+func (d *Debug) Parse(r io.Reader) (*Node, error) {
+	return d.parse("xml", r, Parse)
+}
+
+// ParseHTML works like the ParseHTML function, logging when parsing
+// starts and how it ends.
+func (d *Debug) ParseHTML(r io.Reader) (*Node, error) {
+	return d.parse("html", r, ParseHTML)
+}
+
+func (d *Debug) parse(mode string, r io.Reader, parse func(io.Reader) (*Node, error)) (*Node, error) {
+	d.log("xmlpath: parse started", slog.String("mode", mode))
+	start := time.Now()
+	cr := &countingReader{r: r}
+	node, err := parse(cr)
+	elapsed := time.Since(start)
+	if err != nil {
+		d.log("xmlpath: parse failed",
+			slog.String("mode", mode),
+			slog.Int64("bytes", cr.n),
+			slog.Duration("elapsed", elapsed),
+			slog.Any("error", err))
+		return nil, err
+	}
+	d.log("xmlpath: parse finished",
+		slog.String("mode", mode),
+		slog.Int64("bytes", cr.n),
+		slog.Int("nodes", len(node.nodes)),
+		slog.Duration("elapsed", elapsed))
+	return node, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// Decompress works like the Decompress function, logging when
+// reading fails for going over limit.
+func (d *Debug) Decompress(r io.Reader, encoding string, limit int64) (io.Reader, error) {
+	dr, err := Decompress(r, encoding, limit)
+	if err != nil {
+		return nil, err
+	}
+	return &limitLogReader{r: dr, debug: d, encoding: encoding, limit: limit}, nil
+}
+
+type limitLogReader struct {
+	r        io.Reader
+	debug    *Debug
+	encoding string
+	limit    int64
+	logged   bool
+}
+
+func (lr *limitLogReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	if errors.Is(err, ErrTooLarge) && !lr.logged {
+		lr.logged = true
+		lr.debug.log("xmlpath: size limit exceeded",
+			slog.String("encoding", lr.encoding),
+			slog.Int64("limit", lr.limit))
+	}
+	return n, err
+}
+
+// Find returns all nodes selected by path from context, logging the
+// evaluation if it takes longer than SlowEval.
+func (d *Debug) Find(path *Path, context *Node) []*Node {
+	start := time.Now()
+	var nodes []*Node
+	iter := path.Iter(context)
+	for iter.Next() {
+		nodes = append(nodes, iter.Node())
+	}
+	d.slow(path.path, start, slog.Int("nodes", len(nodes)))
+	return nodes
+}
+
+// Evaluate works like Expr.Evaluate, logging the evaluation if it
+// takes longer than SlowEval.
+func (d *Debug) Evaluate(e *Expr, context *Node) interface{} {
+	start := time.Now()
+	result := e.Evaluate(context)
+	d.slow(e.expr, start)
+	return result
+}
+
+func (d *Debug) slow(expr string, start time.Time, attrs ...slog.Attr) {
+	elapsed := time.Since(start)
+	if d.SlowEval <= 0 || elapsed < d.SlowEval {
+		return
+	}
+	attrs = append([]slog.Attr{
+		slog.String("expr", expr),
+		slog.Duration("elapsed", elapsed),
+		slog.Duration("threshold", d.SlowEval),
+	}, attrs...)
+	d.log("xmlpath: slow evaluation", attrs...)
+}
@@ -0,0 +1,545 @@
+package xmlpath
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+)
+
+// AttrDefaults holds the attributes that elements have unless they set
+// them, by element name, as declared by a schema or DTD. See ParseOptions.
+type AttrDefaults map[xml.Name][]xml.Attr
+
+const xsdNamespace = "http://www.w3.org/2001/XMLSchema"
+
+// SchemaDefaults returns the attributes declared with a default or fixed
+// value in the XML Schema with root node schema, by the name of the
+// elements declared to have them, for use with ParseOptions.Defaults.
+//
+// Attributes are found in the complex types of elements, whether
+// declared within the element or referenced by name, along with the
+// types they extend or restrict and the attribute groups they reference,
+// as long as they're declared in the same schema. Declarations from
+// other schemas, whether included or imported, are left out.
+func SchemaDefaults(schema *Node) AttrDefaults {
+	var root *Node
+	for _, n := range append([]*Node{schema}, schema.down...) {
+		if n.kind == StartNode && n.name == (xml.Name{Space: xsdNamespace, Local: "schema"}) {
+			root = n
+			break
+		}
+	}
+	if root == nil {
+		return nil
+	}
+	s := schemaDefaults{
+		root:      root,
+		tns:       schemaAttr(root, "targetNamespace"),
+		elemForm:  schemaAttr(root, "elementFormDefault"),
+		attrForm:  schemaAttr(root, "attributeFormDefault"),
+		named:     make(map[string]*Node),
+		defaults:  make(AttrDefaults),
+		expanding: make(map[*Node]bool),
+	}
+	for _, n := range root.down {
+		if n.kind == StartNode && n.name.Space == xsdNamespace {
+			switch n.name.Local {
+			case "complexType", "attributeGroup", "attribute":
+				s.named[n.name.Local+" "+schemaAttr(n, "name")] = n
+			}
+		}
+	}
+	s.elements(root)
+	return s.defaults
+}
+
+type schemaDefaults struct {
+	root      *Node
+	tns       string
+	elemForm  string
+	attrForm  string
+	named     map[string]*Node
+	defaults  AttrDefaults
+	expanding map[*Node]bool
+}
+
+// elements adds the attribute defaults of the elements declared
+// within node.
+func (s *schemaDefaults) elements(node *Node) {
+	for _, n := range node.down {
+		if n.kind != StartNode || n.name.Space != xsdNamespace {
+			continue
+		}
+		if n.name.Local == "element" && schemaAttr(n, "name") != "" {
+			name := xml.Name{Local: schemaAttr(n, "name")}
+			if node == s.root || s.qualified(n, s.elemForm) {
+				name.Space = s.tns
+			}
+			var attrs []xml.Attr
+			if typ := s.named["complexType "+localName(schemaAttr(n, "type"))]; typ != nil {
+				attrs = s.attrs(typ, attrs)
+			}
+			attrs = s.attrs(n, attrs)
+			s.add(name, attrs)
+		}
+		s.elements(n)
+	}
+}
+
+func (s *schemaDefaults) add(elem xml.Name, attrs []xml.Attr) {
+	for _, attr := range attrs {
+		if !hasAttr(s.defaults[elem], attr.Name) {
+			s.defaults[elem] = append(s.defaults[elem], attr)
+		}
+	}
+}
+
+// attrs appends the attribute defaults declared within the type
+// definition node, without descending into nested elements.
+func (s *schemaDefaults) attrs(node *Node, attrs []xml.Attr) []xml.Attr {
+	if s.expanding[node] {
+		return attrs
+	}
+	s.expanding[node] = true
+	defer delete(s.expanding, node)
+	for _, n := range node.down {
+		if n.kind != StartNode || n.name.Space != xsdNamespace {
+			continue
+		}
+		switch n.name.Local {
+		case "element":
+			continue
+		case "attribute":
+			decl := n
+			name := xml.Name{Local: schemaAttr(n, "name")}
+			if ref := schemaAttr(n, "ref"); ref != "" {
+				decl = s.named["attribute "+localName(ref)]
+				if decl == nil {
+					continue
+				}
+				name = xml.Name{Space: s.tns, Local: localName(ref)}
+			} else if s.qualified(n, s.attrForm) {
+				name.Space = s.tns
+			}
+			value, ok := n.attrValue("default")
+			if !ok {
+				value, ok = n.attrValue("fixed")
+			}
+			if !ok && decl != n {
+				value, ok = decl.attrValue("default")
+				if !ok {
+					value, ok = decl.attrValue("fixed")
+				}
+			}
+			if ok && name.Local != "" && !hasAttr(attrs, name) {
+				attrs = append(attrs, xml.Attr{Name: name, Value: value})
+			}
+			continue
+		case "attributeGroup":
+			if group := s.named["attributeGroup "+localName(schemaAttr(n, "ref"))]; group != nil {
+				attrs = s.attrs(group, attrs)
+			}
+			continue
+		case "extension", "restriction":
+			if base := s.named["complexType "+localName(schemaAttr(n, "base"))]; base != nil {
+				attrs = s.attrs(base, attrs)
+			}
+		}
+		attrs = s.attrs(n, attrs)
+	}
+	return attrs
+}
+
+// qualified returns whether the local element or attribute declared
+// by decl is qualified by the target namespace, given the default form
+// declared by the schema.
+func (s *schemaDefaults) qualified(decl *Node, form string) bool {
+	if f, ok := decl.attrValue("form"); ok {
+		form = f
+	}
+	return form == "qualified"
+}
+
+// schemaAttr returns the value of the attribute of node with the
+// given name, or an empty string if there's none.
+func schemaAttr(node *Node, name string) string {
+	value, _ := node.attrValue(name)
+	return value
+}
+
+// localName returns the local part of the qualified name qname.
+func localName(qname string) string {
+	return qname[strings.IndexByte(qname, ':')+1:]
+}
+
+func hasAttr(attrs []xml.Attr, name xml.Name) bool {
+	for _, attr := range attrs {
+		if attr.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// dtdAttr holds the default value of an attribute declared in a DTD,
+// with the names of the element and attribute as written, qualified
+// by a prefix or not, as DTDs are not aware of namespaces.
+type dtdAttr struct {
+	elem, name, value string
+}
+
+// dtdDefaults holds the attribute defaults declared in DTDs, by the
+// local name of their element.
+type dtdDefaults map[string][]dtdAttr
+
+// parseDoctype adds the attribute defaults declared in the internal
+// subset of the DOCTYPE declaration dir, if that's what it is.
+func (defaults dtdDefaults) parseDoctype(dir xml.Directive) {
+	s := string(dir)
+	if !strings.HasPrefix(s, "DOCTYPE") {
+		return
+	}
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			if end := strings.LastIndexByte(s, ']'); end > i {
+				defaults.parse(s[i+1 : end])
+			}
+			return
+		}
+	}
+}
+
+// parse adds the attribute defaults declared in the markup declarations
+// of dtd, except for the attributes declared before. Parameter entities
+// are not expanded, and declarations relying on them are skipped.
+func (defaults dtdDefaults) parse(dtd string) {
+	p := dtdParser{s: dtd}
+	for p.i < len(p.s) {
+		switch {
+		case p.skip("<!--"):
+			p.skipPast("-->")
+		case p.skip("<?"):
+			p.skipPast("?>")
+		case p.skip("<!["):
+			p.skipSpaces()
+			if p.name() == "IGNORE" {
+				p.skipPast("]]>")
+			} else {
+				p.skipPast("[")
+			}
+		case p.skip("]]>"):
+		case p.skip("<!ATTLIST"):
+			defaults.parseAttlist(&p)
+		case p.skip("<!"):
+			p.skipDecl()
+		default:
+			p.i++
+		}
+	}
+}
+
+// parseAttlist parses the attribute list declaration following p.
+func (defaults dtdDefaults) parseAttlist(p *dtdParser) {
+	p.skipSpaces()
+	elem := p.name()
+	for {
+		p.skipSpaces()
+		if elem == "" || p.i >= len(p.s) || p.s[p.i] != '>' && !isDTDNameByte(p.s[p.i]) {
+			p.skipDecl()
+			return
+		}
+		if p.skip(">") {
+			return
+		}
+		name := p.name()
+		p.skipSpaces()
+		typ := p.name()
+		if typ == "NOTATION" {
+			p.skipSpaces()
+		}
+		if typ == "" || typ == "NOTATION" {
+			if !p.skip("(") {
+				p.skipDecl()
+				return
+			}
+			p.skipPast(")")
+		}
+		p.skipSpaces()
+		if p.skip("#") {
+			switch p.name() {
+			case "REQUIRED", "IMPLIED":
+				continue
+			case "FIXED":
+				p.skipSpaces()
+			default:
+				p.skipDecl()
+				return
+			}
+		}
+		value, ok := p.quoted()
+		if !ok {
+			p.skipDecl()
+			return
+		}
+		defaults.add(elem, name, normalizeDefault(value, typ == "CDATA"))
+	}
+}
+
+func (defaults dtdDefaults) add(elem, name, value string) {
+	local := localName(elem)
+	for _, attr := range defaults[local] {
+		if attr.elem == elem && attr.name == name {
+			return
+		}
+	}
+	defaults[local] = append(defaults[local], dtdAttr{elem, name, value})
+}
+
+// normalizeDefault normalizes the default value of an attribute, as
+// done by XML parsers for the values of all attributes, expanding
+// character references and the predefined entities, and collapsing
+// spaces unless the attribute is of type CDATA.
+func normalizeDefault(value string, cdata bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == '\t' || c == '\n' || c == '\r' {
+			c = ' '
+		}
+		if c == '&' {
+			if end := strings.IndexByte(value[i:], ';'); end > 0 {
+				if s, ok := expandReference(value[i+1 : i+end]); ok {
+					b.WriteString(s)
+					i += end
+					continue
+				}
+			}
+		}
+		b.WriteByte(c)
+	}
+	if cdata {
+		return b.String()
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// expandReference returns the text referenced by the character or
+// predefined entity reference ref, given without '&' and ';'.
+func expandReference(ref string) (string, bool) {
+	switch ref {
+	case "lt":
+		return "<", true
+	case "gt":
+		return ">", true
+	case "amp":
+		return "&", true
+	case "apos":
+		return "'", true
+	case "quot":
+		return `"`, true
+	}
+	if !strings.HasPrefix(ref, "#") {
+		return "", false
+	}
+	var n uint64
+	var err error
+	if strings.HasPrefix(ref, "#x") {
+		n, err = strconv.ParseUint(ref[2:], 16, 32)
+	} else {
+		n, err = strconv.ParseUint(ref[1:], 10, 32)
+	}
+	if err != nil {
+		return "", false
+	}
+	return string(rune(n)), true
+}
+
+type dtdParser struct {
+	s string
+	i int
+}
+
+func (p *dtdParser) skip(prefix string) bool {
+	if strings.HasPrefix(p.s[p.i:], prefix) {
+		p.i += len(prefix)
+		return true
+	}
+	return false
+}
+
+func (p *dtdParser) skipPast(end string) {
+	if j := strings.Index(p.s[p.i:], end); j >= 0 {
+		p.i += j + len(end)
+	} else {
+		p.i = len(p.s)
+	}
+}
+
+func (p *dtdParser) skipSpaces() {
+	for p.i < len(p.s) && isXMLSpace(rune(p.s[p.i])) {
+		p.i++
+	}
+}
+
+// skipDecl skips the rest of a markup declaration, up to the
+// '>' closing it outside of quoted literals.
+func (p *dtdParser) skipDecl() {
+	for p.i < len(p.s) {
+		c := p.s[p.i]
+		p.i++
+		switch c {
+		case '>':
+			return
+		case '"', '\'':
+			p.skipPast(string(c))
+		}
+	}
+}
+
+func (p *dtdParser) name() string {
+	start := p.i
+	for p.i < len(p.s) && isDTDNameByte(p.s[p.i]) {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+func (p *dtdParser) quoted() (string, bool) {
+	if p.i >= len(p.s) || p.s[p.i] != '"' && p.s[p.i] != '\'' {
+		return "", false
+	}
+	quote := p.s[p.i]
+	end := strings.IndexByte(p.s[p.i+1:], quote)
+	if end < 0 {
+		return "", false
+	}
+	value := p.s[p.i+1 : p.i+1+end]
+	p.i += end + 2
+	return value, true
+}
+
+// isDTDNameByte returns whether c may be part of a name. Bytes of
+// multi-byte characters are all taken as such.
+func isDTDNameByte(c byte) bool {
+	return c >= 0x80 || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == ':' || c == '-' || c == '.'
+}
+
+// defaulter adds the attributes elements lack from their defaults,
+// as elements are decoded.
+type defaulter struct {
+	dtd      dtdDefaults
+	defaults AttrDefaults
+
+	// scope holds the namespace prefixes in scope, with the most
+	// recent declarations last, and declared the number of them
+	// declared by each element being decoded.
+	scope    []xml.Attr
+	declared []int
+}
+
+func newDefaulter(opts *ParseOptions) *defaulter {
+	d := &defaulter{dtd: make(dtdDefaults), defaults: opts.Defaults}
+	if opts.DTD != "" {
+		d.dtd.parse(opts.DTD)
+	}
+	return d
+}
+
+// doctype adds the defaults declared by the DOCTYPE declaration dir,
+// which take precedence over the ones known before.
+func (d *defaulter) doctype(dir xml.Directive) {
+	internal := make(dtdDefaults)
+	internal.parseDoctype(dir)
+	for _, attrs := range d.dtd {
+		for _, attr := range attrs {
+			internal.add(attr.elem, attr.name, attr.value)
+		}
+	}
+	d.dtd = internal
+}
+
+// start appends to nodes the attribute nodes of the defaults of the
+// element started by t that it lacks.
+func (d *defaulter) start(nodes []Node, t xml.StartElement) []Node {
+	declared := 0
+	for _, attr := range t.Attr {
+		if prefix, ok := namespacePrefix(attr.Name); ok {
+			d.scope = append(d.scope, xml.Attr{Name: xml.Name{Local: prefix}, Value: attr.Value})
+			declared++
+		}
+	}
+	d.declared = append(d.declared, declared)
+
+	add := func(name xml.Name, value string) {
+		for _, attr := range t.Attr {
+			if attr.Name == name {
+				return
+			}
+		}
+		for i := len(nodes) - 1; nodes[i].kind == AttrNode; i-- {
+			if nodes[i].name == name {
+				return
+			}
+		}
+		nodes = append(nodes, Node{kind: AttrNode, name: name, attr: value})
+	}
+	for _, attr := range d.defaults[t.Name] {
+		add(attr.Name, attr.Value)
+	}
+	for _, attr := range d.dtd[t.Name.Local] {
+		if d.resolve(attr.elem, true) != t.Name {
+			continue
+		}
+		if _, ok := namespacePrefix(d.split(attr.name)); ok {
+			// Namespace declarations are left alone, as they
+			// would change the names of elements decoded already.
+			continue
+		}
+		add(d.resolve(attr.name, false), attr.value)
+	}
+	return nodes
+}
+
+// end leaves the scope of the last element started.
+func (d *defaulter) end() {
+	if n := len(d.declared); n > 0 {
+		d.scope = d.scope[:len(d.scope)-d.declared[n-1]]
+		d.declared = d.declared[:n-1]
+	}
+}
+
+func (d *defaulter) split(qname string) xml.Name {
+	if i := strings.IndexByte(qname, ':'); i >= 0 {
+		return xml.Name{Space: qname[:i], Local: qname[i+1:]}
+	}
+	return xml.Name{Local: qname}
+}
+
+// resolve returns the name of an element or attribute named qname,
+// translating its prefix as done by xml.Decoder.
+func (d *defaulter) resolve(qname string, elem bool) xml.Name {
+	name := d.split(qname)
+	if name.Space == "" && !elem {
+		return name
+	}
+	if name.Space == "xml" {
+		name.Space = xmlNamespace
+		return name
+	}
+	for i := len(d.scope) - 1; i >= 0; i-- {
+		if d.scope[i].Name.Local == name.Space {
+			name.Space = d.scope[i].Value
+			return name
+		}
+	}
+	return name
+}
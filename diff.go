@@ -0,0 +1,133 @@
+package xmlpath
+
+import (
+	"math"
+)
+
+// ChangeKind is the kind of a change found by RowExtractor.Diff.
+type ChangeKind int
+
+const (
+	ValueAdded ChangeKind = iota
+	ValueRemoved
+	ValueChanged
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ValueAdded:
+		return "added"
+	case ValueRemoved:
+		return "removed"
+	case ValueChanged:
+		return "changed"
+	}
+	return "unknown"
+}
+
+// Change is a difference found by RowExtractor.Diff in the value of
+// a column of a row between two versions of a document.
+type Change struct {
+	Kind ChangeKind
+
+	// Key is the value of the key column of the row changed.
+	Key string
+
+	// Column is the index of the column changed, and Name its name.
+	Column int
+	Name   string
+
+	// Old and New are the values of the column in each version, as
+	// returned by Row.Value, with nil standing for a missing value.
+	Old, New interface{}
+}
+
+// Diff extracts rows from two versions of a document, matching them up
+// by the string value of the column with index key, and returns the
+// values that were added, removed, or changed in each column, as needed
+// by tools monitoring pages or feeds for changes.
+//
+// Values of rows found only in after are all reported as added, and
+// those of rows found only in before as removed. Rows sharing a key are
+// matched up in document order. Changes are reported for the rows of
+// after in document order, followed by those for the removed rows.
+//
+// For example, with rows keyed by the product name in column 0:
+//
+//	for _, c := range x.Diff(yesterday, today, 0) {
+//		if c.Kind == xmlpath.ValueChanged && c.Name == "price" {
+//			fmt.Printf("%s now costs %v (was %v)\n", c.Key, c.New, c.Old)
+//		}
+//	}
+func (x *RowExtractor) Diff(before, after *Node, key int) []Change {
+	oldRows := x.diffRows(before, key)
+	byKey := make(map[string][]int)
+	for i, row := range oldRows {
+		byKey[row.key] = append(byKey[row.key], i)
+	}
+	matched := make([]bool, len(oldRows))
+	missing := make([]interface{}, len(x.Columns))
+
+	var changes []Change
+	for _, row := range x.diffRows(after, key) {
+		old := missing
+		if indexes := byKey[row.key]; len(indexes) > 0 {
+			old = oldRows[indexes[0]].values
+			matched[indexes[0]] = true
+			byKey[row.key] = indexes[1:]
+		}
+		changes = x.appendChanges(changes, row.key, old, row.values)
+	}
+	for i, row := range oldRows {
+		if !matched[i] {
+			changes = x.appendChanges(changes, row.key, row.values, missing)
+		}
+	}
+	return changes
+}
+
+type diffRow struct {
+	key    string
+	values []interface{}
+}
+
+func (x *RowExtractor) diffRows(context *Node, key int) []diffRow {
+	var rows []diffRow
+	x.Extract(context, func(row *Row) error {
+		values := make([]interface{}, row.Len())
+		for i := range values {
+			values[i] = row.Value(i)
+		}
+		rows = append(rows, diffRow{row.String(key), values})
+		return nil
+	})
+	return rows
+}
+
+func (x *RowExtractor) appendChanges(changes []Change, key string, old, new []interface{}) []Change {
+	for i := range x.Columns {
+		change := Change{Key: key, Column: i, Name: x.Columns[i].Name, Old: old[i], New: new[i]}
+		switch {
+		case sameValue(old[i], new[i]):
+			continue
+		case old[i] == nil:
+			change.Kind = ValueAdded
+		case new[i] == nil:
+			change.Kind = ValueRemoved
+		default:
+			change.Kind = ValueChanged
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// sameValue returns whether a and b are equal values of a column,
+// taking NaN numbers as equal to each other.
+func sameValue(a, b interface{}) bool {
+	if fa, ok := a.(float64); ok && math.IsNaN(fa) {
+		fb, ok := b.(float64)
+		return ok && math.IsNaN(fb)
+	}
+	return a == b
+}
@@ -14,10 +14,64 @@
 //
 //     - All axes are supported ("child", "following-sibling", etc)
 //     - All abbreviated forms are supported (".", "//", etc)
-//     - All node types except for namespace are supported
-//     - Predicates may be [N], [path], [not(predicate)], [path=literal], [contains(path, literal) or [starts-with(@path, literal)]]
-//     - Predicates may be joined with "or", "and", and parenthesis
-//     - Richer expressions and namespaces are not supported
+//     - All node types are supported, with namespace nodes being shared
+//       by all elements in the scope of the declaration producing them,
+//       and the one for the xml prefix being implicitly declared by the
+//       top-level element holding them
+//     - Namespace declarations such as xmlns="..." and xmlns:p="..." are
+//       found on the namespace axis only, so @* and attribute::* don't
+//       select them
+//     - processing-instruction() may be given the target of the
+//       instructions selected, as in /processing-instruction('xml-stylesheet')
+//     - Predicates may be expressions made of paths, literal strings, numbers,
+//       parenthesis, the operators "or", "and", "=", "!=", "<", "<=", ">", ">=",
+//       "+", "-", "*", "div" and "mod", and the functions position(), last(),
+//       count(), id(), sum(), number(), floor(), ceiling(), round(), boolean(),
+//       true(), false(), not(), concat(), contains(), starts-with(),
+//       substring(), substring-before(), substring-after(), string-length(),
+//       translate(), lower-case(), upper-case(), normalize-space(), name(),
+//       local-name(), namespace-uri(), lang(), matches(), replace(),
+//       tokenize() and string-join(), along with document() in paths
+//       compiled with a loader set via CompileOptions
+//     - Values are compared and converted as defined by XPath, and a number
+//       as a predicate selects the node at that position, as in [N], [last()]
+//       or [last()-1] for the one before the last
+//     - Comparisons involving paths hold when they hold for any of the
+//       nodes selected, so //order[item/@sku = //blocked/sku] selects the
+//       orders with any blocked item, and != holds when any pair of values
+//       differ, so not(a = b) is what checks that no value is shared
+//     - Ranges of positions, as in [position() >= 2 and position() <= 5],
+//       select a slice of the nodes, with axes traversed no further than
+//       the last position in the range
+//     - Positions on the ancestor, ancestor-or-self, preceding and
+//       preceding-sibling axes count from the node nearest to the context
+//       node, so ancestor::div[1] is the innermost enclosing div
+//     - id() finds elements by their "id" or "xml:id" attributes, or by the
+//       attributes given to Node.IndexIDs, as no DTD is read
+//     - matches(), replace() and tokenize() take a regular expression in
+//       the syntax of the regexp package, and optionally the flags "i", "s"
+//       and "m", as in //a[matches(@href, '^https?://', 'i')]
+//     - tokenize() returns its tokens as text nodes, as XPath 1.0 has no
+//       sequences of strings, so they may be compared or passed to count()
+//       and string-join() as in //div[tokenize(@class, '\s+') = 'menu']
+//     - Variables such as $uid may be referenced in predicates, with their
+//       values provided via Path.IterWithVars
+//     - Paths within predicates may have predicates of their own, as in
+//       //book[author[@lang='en']]/title
+//     - Steps may have several predicates, each filtering the nodes left
+//       by the ones before it, with positions counted anew among them, as
+//       in //item[@type='book'][position()<=3][not(@hidden)]
+//     - Paths may be joined with "|", with nodes returned in document order
+//     - Parenthesized paths may be filtered by predicates applying to
+//       all the nodes they select, in document order, and followed by
+//       further steps, as in (//h2)[3] or (//a | //b)[last()]/@href,
+//       and so may calls to id() and document(), as in id('intro')/title
+//     - Namespace prefixes in names are only supported in paths compiled
+//       by CompileWithNamespaces, which binds them to namespace URIs
+//     - Names without a prefix match by local name, whatever the namespace,
+//       unless a default namespace is set via CompileOptions
+//     - Wildcards match any name in a namespace, as in svg:*, or a local
+//       name in any namespace, as in *:title
 //
 // For example, assuming the following document:
 //
@@ -73,4 +127,10 @@
 //             fmt.Println("Found:", value)
 //     }
 //
+// Expressions evaluating into numbers, strings or booleans rather than
+// nodes may be compiled with CompileExpr, and evaluated likewise:
+//
+//     total := xmlpath.MustCompileExpr("/order/total - /order/discount")
+//     fmt.Println("Due:", total.Number(root))
+//
 package xmlpath
@@ -0,0 +1,136 @@
+package xmlpath
+
+import (
+	"context"
+	"fmt"
+)
+
+// DocumentSet holds several parsed documents, each under the name it's
+// known by, such as the URL or file it was loaded from. Paths evaluated
+// over the set report the document each match comes from, which eases
+// auditing or aggregating data spread across many files.
+//
+// For example:
+//
+//	var set xmlpath.DocumentSet
+//	err := set.Load(ctx, nil, feedURLs...)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	iter := set.Iter(xmlpath.MustCompile("//item[not(pubDate)]"))
+//	for iter.Next() {
+//		fmt.Println("Undated item in", iter.Source())
+//	}
+type DocumentSet struct {
+	names []string
+	roots []*Node
+}
+
+// Add adds the document with the given root node to the set, under
+// the given name. Names are only reported back and need not be unique.
+func (s *DocumentSet) Add(name string, root *Node) {
+	s.names = append(s.names, name)
+	s.roots = append(s.roots, root)
+}
+
+// Load loads the documents at the given URLs with loader, or with
+// DefaultLoader if loader is nil, and adds them to the set named by
+// their URL. Loading stops at the first document that fails to load,
+// with the documents loaded before it left in the set.
+func (s *DocumentSet) Load(ctx context.Context, loader DocumentLoader, urls ...string) error {
+	if loader == nil {
+		loader = DefaultLoader
+	}
+	for _, url := range urls {
+		root, err := loader.Load(ctx, url)
+		if err != nil {
+			return fmt.Errorf("xmlpath: loading %s: %w", url, err)
+		}
+		s.Add(url, root)
+	}
+	return nil
+}
+
+// Len returns the number of documents in the set.
+func (s *DocumentSet) Len() int {
+	return len(s.roots)
+}
+
+// Name returns the name of the i-th document added to the set.
+func (s *DocumentSet) Name(i int) string {
+	return s.names[i]
+}
+
+// Root returns the root node of the i-th document added to the set.
+func (s *DocumentSet) Root(i int) *Node {
+	return s.roots[i]
+}
+
+// Iter returns an iterator over the nodes selected by path in each
+// document of the set, taken in turn in the order they were added,
+// with the document's root node as context.
+func (s *DocumentSet) Iter(path *Path) *SetIter {
+	return &SetIter{set: s, path: path, doc: -1}
+}
+
+// SetIter iterates over the nodes selected by a path in the documents
+// of a DocumentSet.
+type SetIter struct {
+	set  *DocumentSet
+	path *Path
+	doc  int
+	iter *Iter
+	err  error
+}
+
+// Next iterates to the next node selected, in this document or in
+// the ones that follow, and returns whether there is one. Iteration
+// stops at the first document whose iteration fails, as reported by Err.
+func (iter *SetIter) Next() bool {
+	if iter.err != nil {
+		return false
+	}
+	for {
+		if iter.iter != nil {
+			if iter.iter.Next() {
+				return true
+			}
+			if err := iter.iter.Err(); err != nil {
+				iter.err = err
+				return false
+			}
+		}
+		if iter.doc+1 >= iter.set.Len() {
+			iter.iter = nil
+			return false
+		}
+		iter.doc++
+		iter.iter = iter.path.Iter(iter.set.roots[iter.doc])
+	}
+}
+
+// Err returns the error that stopped iteration, as reported by Iter.Err
+// for the document being iterated over then, such as ErrTimeout for paths
+// with a timeout set via Path.WithTimeout, or nil if iteration didn't
+// fail. The document is the one reported by Source and Index.
+func (iter *SetIter) Err() error {
+	return iter.err
+}
+
+// Node returns the current node. Must only be called after
+// Next returns true.
+func (iter *SetIter) Node() *Node {
+	return iter.iter.Node()
+}
+
+// Source returns the name of the document holding the current node.
+// Must only be called after Next returns true.
+func (iter *SetIter) Source() string {
+	return iter.set.names[iter.doc]
+}
+
+// Index returns the position in the set of the document holding
+// the current node. Must only be called after Next returns true.
+func (iter *SetIter) Index() int {
+	return iter.doc
+}
@@ -0,0 +1,246 @@
+package xmlpath
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"sync"
+	"unicode/utf8"
+)
+
+// Document is a long-lived session over an xml document being edited,
+// providing what's needed for building language servers and similar
+// editor integrations on top of this package: the document is updated
+// with the edits made to its text, and queried in terms of positions
+// within that text.
+//
+// While the text is not well formed, as commonly happens halfway through
+// typing, Err reports the problem and queries are answered from the last
+// version of the text that was well formed, with locations referring to
+// that version.
+//
+// A Document is safe for concurrent use.
+type Document struct {
+	mu      sync.RWMutex
+	version int
+	text    []byte
+	source  *Source
+	err     error
+}
+
+// A TextEdit replaces the bytes within Span with Text.
+type TextEdit struct {
+	Span Span
+	Text string
+}
+
+// NodeInfo describes a node of a document, as shown to users when
+// hovering over it or when listing query results.
+type NodeInfo struct {
+	Location
+
+	Kind NodeKind
+	Name xml.Name
+
+	// Value is the string value of the node.
+	Value string
+}
+
+// OpenDocument returns a Document with the given version and text,
+// which must not be changed afterwards. A text that is not well formed
+// is accepted, with the problem reported by Err.
+func OpenDocument(version int, text []byte) *Document {
+	d := &Document{version: version, text: text}
+	d.source, d.err = ParseSource(text)
+	return d
+}
+
+// Version returns the version of the document, as set by the last
+// call to OpenDocument or Update.
+func (d *Document) Version() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.version
+}
+
+// Text returns the current text of the document, which must not be
+// changed.
+func (d *Document) Text() []byte {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.text
+}
+
+// Err returns a *SourceError describing why the current text of the
+// document is not well formed, or nil if it is.
+func (d *Document) Err() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.err
+}
+
+// Update applies the given edits to the text of the document in order,
+// each one with a span relative to the text resulting from the previous
+// ones, and sets the version of the document. An error is returned, and
+// the document is left unchanged, only if some edit is out of bounds.
+func (d *Document) Update(version int, edits ...TextEdit) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	text := d.text
+	for _, edit := range edits {
+		if edit.Span.Start < 0 || edit.Span.End < edit.Span.Start || edit.Span.End > len(text) {
+			return fmt.Errorf("xmlpath: edit range %d-%d is out of bounds", edit.Span.Start, edit.Span.End)
+		}
+		next := make([]byte, 0, len(text)-(edit.Span.End-edit.Span.Start)+len(edit.Text))
+		next = append(next, text[:edit.Span.Start]...)
+		next = append(next, edit.Text...)
+		text = append(next, text[edit.Span.End:]...)
+	}
+	d.version = version
+	if len(edits) == 0 {
+		return nil
+	}
+	d.text = text
+
+	// A single edit to a well formed text may be handled by parsing
+	// just the affected region.
+	if len(edits) == 1 && d.err == nil && d.source != nil {
+		edit := edits[0]
+		if err := d.source.Edit(edit.Span.Start, edit.Span.End, []byte(edit.Text)); err != nil {
+			d.err = err
+		}
+		return nil
+	}
+	source, err := ParseSource(text)
+	if err != nil {
+		d.err = err
+		return nil
+	}
+	d.source, d.err = source, nil
+	return nil
+}
+
+// Offset returns the byte offset in the current text of the document
+// at the given position, and whether the position is within the text.
+func (d *Document) Offset(pos Position) (offset int, ok bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return positionOffset(d.text, pos)
+}
+
+// positionOffset returns the byte offset of pos within text.
+func positionOffset(text []byte, pos Position) (offset int, ok bool) {
+	if pos.Line < 1 || pos.Column < 1 {
+		return 0, false
+	}
+	for line := 1; line < pos.Line; line++ {
+		i := bytes.IndexByte(text[offset:], '\n')
+		if i < 0 {
+			return 0, false
+		}
+		offset += i + 1
+	}
+	for column := 1; column < pos.Column; column++ {
+		if offset == len(text) || text[offset] == '\n' {
+			return 0, false
+		}
+		_, size := utf8.DecodeRune(text[offset:])
+		offset += size
+	}
+	return offset, true
+}
+
+// Query returns information about the nodes matched by path on the
+// root node of the document.
+func (d *Document) Query(path string) ([]NodeInfo, error) {
+	p, err := Compile(path)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.source == nil {
+		return nil, nil
+	}
+	var infos []NodeInfo
+	iter := p.Iter(d.source.Root())
+	for iter.Next() {
+		infos = append(infos, d.info(iter.Node()))
+	}
+	return infos, nil
+}
+
+// Hover returns information about the innermost node at the given
+// position, which may be an element, an attribute, or some text,
+// comment, or processing instruction, and whether there's one.
+func (d *Document) Hover(pos Position) (info NodeInfo, ok bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	node := d.nodeAt(pos)
+	if node == nil {
+		return NodeInfo{}, false
+	}
+	return d.info(node), true
+}
+
+// PathAt returns the path selecting the innermost element or attribute
+// at the given position, and whether there's one.
+func (d *Document) PathAt(pos Position) (path string, ok bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	node := d.nodeAt(pos)
+	if node == nil {
+		return "", false
+	}
+	return nodePath(node), true
+}
+
+func (d *Document) info(node *Node) NodeInfo {
+	return NodeInfo{
+		Location: d.source.Locate(node),
+		Kind:     node.kind,
+		Name:     node.name,
+		Value:    node.String(),
+	}
+}
+
+// nodeAt returns the innermost node at pos in the tree of the last
+// well formed version of the document, or nil if there's none.
+func (d *Document) nodeAt(pos Position) *Node {
+	if d.source == nil {
+		return nil
+	}
+	offset, ok := positionOffset(d.source.Bytes(), pos)
+	if !ok {
+		return nil
+	}
+	within := func(node *Node) bool {
+		span := d.source.Span(node)
+		return span.Start <= offset && offset < span.End
+	}
+	var found *Node
+	node := d.source.Root()
+Down:
+	for {
+		for i := node.pos + 1; i < node.end; i++ {
+			attr := node.nodes[i]
+			if attr.kind != AttrNode && attr.kind != NamespaceNode {
+				break
+			}
+			if within(attr) {
+				return attr
+			}
+		}
+		for _, down := range node.down {
+			if within(down) {
+				found = down
+				if down.kind != StartNode {
+					return found
+				}
+				node = down
+				continue Down
+			}
+		}
+		return found
+	}
+}
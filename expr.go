@@ -0,0 +1,1382 @@
+package xmlpath
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Expr is a compiled expression that can be evaluated on a context node.
+// Unlike a Path, which always selects nodes, an expression such as
+// "count(//item) * 2" may evaluate into a number, a string or a boolean.
+// A single Expr can be evaluated concurrently on any number of context
+// nodes.
+type Expr struct {
+	expr string
+	e    predicate
+}
+
+// MustCompileExpr returns the compiled expression, and panics if
+// there are any errors.
+func MustCompileExpr(expr string) *Expr {
+	e, err := CompileExpr(expr)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// CompileExpr returns the compiled expression.
+func CompileExpr(expr string) (*Expr, error) {
+	c := pathCompiler{path: expr}
+	if strings.TrimSpace(expr) == "" {
+		return nil, c.errorf("empty expression")
+	}
+	e, err := c.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if c.i < len(c.path) {
+		return nil, c.errorf("unexpected %q", c.path[c.i])
+	}
+	return &Expr{expr, e}, nil
+}
+
+// Evaluate returns the result of evaluating e on the given context node,
+// which is a float64, a string, a bool or a []*Node.
+func (e *Expr) Evaluate(context *Node) interface{} {
+	ctx := exprContext{node: context, pos: 1}
+	v := ctx.eval(e.e)
+	switch v.kind {
+	case numberValue:
+		return v.num
+	case stringValue:
+		return v.str
+	case boolValue:
+		return v.boolean
+	}
+	return v.nodes
+}
+
+// Number returns the result of evaluating e on the given context node,
+// converted into a number as done by the XPath number() function.
+func (e *Expr) Number(context *Node) float64 {
+	ctx := exprContext{node: context, pos: 1}
+	return ctx.eval(e.e).number()
+}
+
+// String returns the result of evaluating e on the given context node,
+// converted into a string as done by the XPath string() function.
+func (e *Expr) String(context *Node) string {
+	ctx := exprContext{node: context, pos: 1}
+	return ctx.eval(e.e).string()
+}
+
+// Bool returns the result of evaluating e on the given context node,
+// converted into a boolean as done by the XPath boolean() function.
+func (e *Expr) Bool(context *Node) bool {
+	ctx := exprContext{node: context, pos: 1}
+	return ctx.test(e.e)
+}
+
+// The expression types below complement the predicate types of
+// paths, which are used in their place whenever possible as they
+// are evaluated faster and without allocations.
+
+type literalExpr string
+
+type numberExpr float64
+
+// varExpr references a variable by name.
+type varExpr string
+
+// pathExpr selects nodes via a path, and is true within a
+// predicate if the path matches any node.
+type pathExpr struct {
+	path *Path
+}
+
+type negExpr struct {
+	sub predicate
+}
+
+type arithExpr struct {
+	operator    string
+	left, right predicate
+}
+
+type compareExpr struct {
+	operator    string
+	left, right predicate
+}
+
+type callExpr struct {
+	name string
+	fn   *exprFunc
+	args []predicate
+}
+
+// regexpExpr holds a call to matches(), tokenize() or replace() with
+// a literal pattern, compiled once along with the expression, and for
+// replace() a literal replacement, converted into the regexp syntax.
+type regexpExpr struct {
+	name string
+	sub  predicate
+	re   *regexp.Regexp
+	repl string
+}
+
+// numberPredicate holds a step predicate that may evaluate into a
+// number, which is only true at the context position of that number.
+type numberPredicate struct {
+	sub predicate
+}
+
+func (literalExpr) predicate()     {}
+func (numberExpr) predicate()      {}
+func (varExpr) predicate()         {}
+func (pathExpr) predicate()        {}
+func (negExpr) predicate()         {}
+func (arithExpr) predicate()       {}
+func (compareExpr) predicate()     {}
+func (callExpr) predicate()        {}
+func (regexpExpr) predicate()      {}
+func (numberPredicate) predicate() {}
+
+type exprFunc struct {
+	minArgs, maxArgs int
+
+	// contextArg is set when a missing argument defaults to
+	// the context node.
+	contextArg bool
+
+	// nodeSetArg is set when the argument must be a node set.
+	nodeSetArg bool
+
+	// kind is the kind of value the function returns.
+	kind valueKind
+
+	call func(ctx *exprContext, args []value) value
+}
+
+var exprFuncs = map[string]*exprFunc{
+	"position": {
+		kind: numberValue,
+		call: func(ctx *exprContext, args []value) value {
+			return numberVal(float64(ctx.pos))
+		},
+	},
+	"last": {
+		kind: numberValue,
+		call: func(ctx *exprContext, args []value) value {
+			return numberVal(float64(ctx.size()))
+		},
+	},
+	"id": {
+		minArgs: 1, maxArgs: 1, kind: nodeSetValue,
+		call: func(ctx *exprContext, args []value) value {
+			return value{kind: nodeSetValue, nodes: elementsByIDs(ctx.node, args[0])}
+		},
+	},
+	"local-name": {
+		maxArgs: 1, contextArg: true, nodeSetArg: true, kind: stringValue,
+		call: func(ctx *exprContext, args []value) value {
+			node := args[0].first()
+			if node == nil {
+				return stringVal("")
+			}
+			return stringVal(node.name.Local)
+		},
+	},
+	"namespace-uri": {
+		maxArgs: 1, contextArg: true, nodeSetArg: true, kind: stringValue,
+		call: func(ctx *exprContext, args []value) value {
+			node := args[0].first()
+			if node == nil || node.kind == NamespaceNode {
+				return stringVal("")
+			}
+			return stringVal(node.name.Space)
+		},
+	},
+	"name": {
+		maxArgs: 1, contextArg: true, nodeSetArg: true, kind: stringValue,
+		call: func(ctx *exprContext, args []value) value {
+			node := args[0].first()
+			switch {
+			case node == nil:
+				return stringVal("")
+			case node.kind == StartNode && node.up != nil:
+				return stringVal(qualifiedName(node, node))
+			case node.kind == AttrNode:
+				return stringVal(qualifiedName(node.up, node))
+			}
+			return stringVal(node.name.Local)
+		},
+	},
+	"count": {
+		minArgs: 1, maxArgs: 1, nodeSetArg: true, kind: numberValue,
+		call: func(ctx *exprContext, args []value) value {
+			return numberVal(float64(len(args[0].nodes)))
+		},
+	},
+	"sum": {
+		minArgs: 1, maxArgs: 1, nodeSetArg: true, kind: numberValue,
+		call: func(ctx *exprContext, args []value) value {
+			sum := 0.0
+			for _, node := range args[0].nodes {
+				sum += parseNumber(args[0].nodeString(node))
+			}
+			return numberVal(sum)
+		},
+	},
+	"number": {
+		maxArgs: 1, contextArg: true, kind: numberValue,
+		call: func(ctx *exprContext, args []value) value {
+			return numberVal(args[0].number())
+		},
+	},
+	"floor": {
+		minArgs: 1, maxArgs: 1, kind: numberValue,
+		call: func(ctx *exprContext, args []value) value {
+			return numberVal(math.Floor(args[0].number()))
+		},
+	},
+	"ceiling": {
+		minArgs: 1, maxArgs: 1, kind: numberValue,
+		call: func(ctx *exprContext, args []value) value {
+			return numberVal(math.Ceil(args[0].number()))
+		},
+	},
+	"replace": {
+		minArgs: 3, maxArgs: 4, kind: stringValue,
+		call: func(ctx *exprContext, args []value) value {
+			flags := ""
+			if len(args) > 3 {
+				flags = args[3].string()
+			}
+			re, err := compileRegexp(args[1].string(), flags)
+			if err != nil || re.MatchString("") {
+				return stringVal(args[0].string())
+			}
+			repl, err := replacement(args[2].string())
+			if err != nil {
+				return stringVal(args[0].string())
+			}
+			return stringVal(re.ReplaceAllString(args[0].string(), repl))
+		},
+	},
+	"round": {
+		minArgs: 1, maxArgs: 1, kind: numberValue,
+		call: func(ctx *exprContext, args []value) value {
+			return numberVal(round(args[0].number()))
+		},
+	},
+	"boolean": {
+		minArgs: 1, maxArgs: 1, kind: boolValue,
+		call: func(ctx *exprContext, args []value) value {
+			return boolVal(args[0].bool())
+		},
+	},
+	"true": {
+		kind: boolValue,
+		call: func(ctx *exprContext, args []value) value {
+			return boolVal(true)
+		},
+	},
+	"false": {
+		kind: boolValue,
+		call: func(ctx *exprContext, args []value) value {
+			return boolVal(false)
+		},
+	},
+	"lang": {
+		minArgs: 1, maxArgs: 1, kind: boolValue,
+		call: func(ctx *exprContext, args []value) value {
+			lang, ok := nodeLang(ctx.node)
+			want := args[0].string()
+			return boolVal(ok && (strings.EqualFold(lang, want) ||
+				len(lang) > len(want) && lang[len(want)] == '-' && strings.EqualFold(lang[:len(want)], want)))
+		},
+	},
+	"matches": {
+		minArgs: 2, maxArgs: 3, kind: boolValue,
+		call: func(ctx *exprContext, args []value) value {
+			flags := ""
+			if len(args) > 2 {
+				flags = args[2].string()
+			}
+			re, err := compileRegexp(args[1].string(), flags)
+			return boolVal(err == nil && re.MatchString(args[0].string()))
+		},
+	},
+	"not": {
+		minArgs: 1, maxArgs: 1, kind: boolValue,
+		call: func(ctx *exprContext, args []value) value {
+			return boolVal(!args[0].bool())
+		},
+	},
+	"concat": {
+		minArgs: 2, maxArgs: -1, kind: stringValue,
+		call: func(ctx *exprContext, args []value) value {
+			var b strings.Builder
+			for _, arg := range args {
+				b.WriteString(arg.string())
+			}
+			return stringVal(b.String())
+		},
+	},
+	"contains": {
+		minArgs: 2, maxArgs: 2, kind: boolValue,
+		call: func(ctx *exprContext, args []value) value {
+			return boolVal(strings.Contains(args[0].string(), args[1].string()))
+		},
+	},
+	"starts-with": {
+		minArgs: 2, maxArgs: 2, kind: boolValue,
+		call: func(ctx *exprContext, args []value) value {
+			return boolVal(strings.HasPrefix(args[0].string(), args[1].string()))
+		},
+	},
+	"substring": {
+		minArgs: 2, maxArgs: 3, kind: stringValue,
+		call: func(ctx *exprContext, args []value) value {
+			// Characters are selected by position, with positions
+			// rounded as done by round().
+			start := round(args[1].number())
+			end := math.Inf(1)
+			if len(args) == 3 {
+				end = start + round(args[2].number())
+			}
+			var b strings.Builder
+			pos := 0.0
+			for _, r := range args[0].string() {
+				pos++
+				if pos >= start && pos < end {
+					b.WriteRune(r)
+				}
+			}
+			return stringVal(b.String())
+		},
+	},
+	"substring-before": {
+		minArgs: 2, maxArgs: 2, kind: stringValue,
+		call: func(ctx *exprContext, args []value) value {
+			before, _, found := strings.Cut(args[0].string(), args[1].string())
+			if !found {
+				return stringVal("")
+			}
+			return stringVal(before)
+		},
+	},
+	"substring-after": {
+		minArgs: 2, maxArgs: 2, kind: stringValue,
+		call: func(ctx *exprContext, args []value) value {
+			_, after, _ := strings.Cut(args[0].string(), args[1].string())
+			return stringVal(after)
+		},
+	},
+	"string-length": {
+		maxArgs: 1, contextArg: true, kind: numberValue,
+		call: func(ctx *exprContext, args []value) value {
+			return numberVal(float64(utf8.RuneCountInString(args[0].string())))
+		},
+	},
+	"lower-case": {
+		minArgs: 1, maxArgs: 1, kind: stringValue,
+		call: func(ctx *exprContext, args []value) value {
+			return stringVal(strings.ToLower(args[0].string()))
+		},
+	},
+	"upper-case": {
+		minArgs: 1, maxArgs: 1, kind: stringValue,
+		call: func(ctx *exprContext, args []value) value {
+			return stringVal(strings.ToUpper(args[0].string()))
+		},
+	},
+	"tokenize": {
+		minArgs: 1, maxArgs: 3, kind: nodeSetValue,
+		call: func(ctx *exprContext, args []value) value {
+			if len(args) == 1 {
+				return tokens(strings.Fields(args[0].string()))
+			}
+			flags := ""
+			if len(args) > 2 {
+				flags = args[2].string()
+			}
+			re, err := compileRegexp(args[1].string(), flags)
+			if err != nil || re.MatchString("") {
+				return value{kind: nodeSetValue}
+			}
+			return tokenize(args[0].string(), re)
+		},
+	},
+	"string-join": {
+		minArgs: 1, maxArgs: 2, nodeSetArg: true, kind: stringValue,
+		call: func(ctx *exprContext, args []value) value {
+			sep := ""
+			if len(args) > 1 {
+				sep = args[1].string()
+			}
+			var b strings.Builder
+			for i, node := range args[0].nodes {
+				if i > 0 {
+					b.WriteString(sep)
+				}
+				b.WriteString(args[0].nodeString(node))
+			}
+			return stringVal(b.String())
+		},
+	},
+	"translate": {
+		minArgs: 3, maxArgs: 3, kind: stringValue,
+		call: func(ctx *exprContext, args []value) value {
+			from, to := []rune(args[1].string()), []rune(args[2].string())
+			var b strings.Builder
+		Chars:
+			for _, r := range args[0].string() {
+				for i, f := range from {
+					if r == f {
+						// Characters without a replacement are removed.
+						if i < len(to) {
+							b.WriteRune(to[i])
+						}
+						continue Chars
+					}
+				}
+				b.WriteRune(r)
+			}
+			return stringVal(b.String())
+		},
+	},
+	"normalize-space": {
+		maxArgs: 1, contextArg: true, kind: stringValue,
+		call: func(ctx *exprContext, args []value) value {
+			return stringVal(strings.Join(strings.FieldsFunc(args[0].string(), isXMLSpace), " "))
+		},
+	},
+}
+
+// nodeLang returns the language of node as declared by the xml:lang
+// attribute of the nearest element holding it among node and its
+// ancestors, and whether there's one.
+func nodeLang(node *Node) (lang string, ok bool) {
+	for ; node != nil; node = node.up {
+		for i := node.pos + 1; node.kind == StartNode && i < node.end && node.nodes[i].kind == AttrNode; i++ {
+			if attr := node.nodes[i]; attr.name.Space == xmlNamespace && attr.name.Local == "lang" {
+				return attr.attr, true
+			}
+		}
+	}
+	return "", false
+}
+
+// compileRegexp compiles the regular expression used by matches() and
+// tokenize(), with flags made of "i" for case-insensitive matching, "s"
+// for "." to match new lines, and "m" for "^" and "$" to match at new lines.
+func compileRegexp(pattern, flags string) (*regexp.Regexp, error) {
+	for _, f := range flags {
+		if f != 'i' && f != 's' && f != 'm' {
+			return nil, fmt.Errorf("has unsupported flag %q", f)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("has invalid pattern: %v", err)
+	}
+	return re, nil
+}
+
+// replacement converts the replacement string of replace(), where $N
+// stands for the Nth group matched and "\\" and "\$" escape a backslash and
+// a dollar sign, into the syntax of Regexp.Expand.
+func replacement(repl string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(repl); i++ {
+		switch ch := repl[i]; ch {
+		case '\\':
+			if i+1 == len(repl) || repl[i+1] != '\\' && repl[i+1] != '$' {
+				return "", fmt.Errorf("has invalid replacement %q", repl)
+			}
+			i++
+			if repl[i] == '$' {
+				b.WriteString("$$")
+			} else {
+				b.WriteByte('\\')
+			}
+		case '$':
+			j := i + 1
+			for j < len(repl) && repl[j] >= '0' && repl[j] <= '9' {
+				j++
+			}
+			if j == i+1 {
+				return "", fmt.Errorf("has invalid replacement %q", repl)
+			}
+			b.WriteString("${" + repl[i+1:j] + "}")
+			i = j - 1
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String(), nil
+}
+
+// tokenize returns the parts of s separated by matches of re, which
+// must not match the empty string, with none for an empty s.
+func tokenize(s string, re *regexp.Regexp) value {
+	if s == "" {
+		return value{kind: nodeSetValue}
+	}
+	return tokens(re.Split(s, -1))
+}
+
+// tokens returns a node set holding a text node for each of parts,
+// as XPath 1.0 lacks sequences of strings. The nodes are the content
+// of a tree of their own.
+func tokens(parts []string) value {
+	b := newBuilder()
+	for _, part := range parts {
+		b.leaf(TextNode, xml.Name{}, []byte(part))
+	}
+	return value{kind: nodeSetValue, nodes: b.finish().down}
+}
+
+// round rounds f to the closest integer, and halfway values towards
+// positive infinity, as done by the XPath round() function.
+func round(f float64) float64 {
+	if f < 0 && f >= -0.5 {
+		return math.Copysign(0, -1)
+	}
+	return math.Floor(f + 0.5)
+}
+
+// parseExpr parses an expression as found in predicates.
+func (c *pathCompiler) parseExpr() (predicate, error) {
+	return c.parseOr()
+}
+
+func (c *pathCompiler) parseOr() (predicate, error) {
+	e, err := c.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	if !c.skipOperator("or") {
+		return e, nil
+	}
+	or := orPredicate{[]predicate{e}}
+	for {
+		e, err := c.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or.sub = append(or.sub, e)
+		if !c.skipOperator("or") {
+			return or, nil
+		}
+	}
+}
+
+func (c *pathCompiler) parseAnd() (predicate, error) {
+	e, err := c.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	if !c.skipOperator("and") {
+		return e, nil
+	}
+	and := andPredicate{[]predicate{e}}
+	for {
+		e, err := c.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		and.sub = append(and.sub, e)
+		if !c.skipOperator("and") {
+			return and, nil
+		}
+	}
+}
+
+// parseComparison parses equality and relational expressions, the
+// latter binding tighter than the former.
+func (c *pathCompiler) parseComparison() (predicate, error) {
+	e, err := c.parseRelational()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var operator string
+		if c.skipString("!=") {
+			operator = "!="
+		} else if c.skipByte('=') {
+			operator = "="
+		} else {
+			return e, nil
+		}
+		c.skipSpaces()
+		right, err := c.parseRelational()
+		if err != nil {
+			return nil, err
+		}
+		if e, err = c.compare(operator, e, right); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *pathCompiler) parseRelational() (predicate, error) {
+	e, err := c.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var operator string
+		switch {
+		case c.skipString("<="):
+			operator = "<="
+		case c.skipString(">="):
+			operator = ">="
+		case c.skipByte('<'):
+			operator = "<"
+		case c.skipByte('>'):
+			operator = ">"
+		default:
+			return e, nil
+		}
+		c.skipSpaces()
+		right, err := c.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		if e, err = c.compare(operator, e, right); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// compare returns the comparison of left and right, using the
+// predicate types dedicated to the most common comparisons.
+func (c *pathCompiler) compare(operator string, left, right predicate) (predicate, error) {
+	switch left.(type) {
+	case literalExpr, numberExpr:
+		switch right.(type) {
+		case pathExpr, callExpr:
+			// Turn "5 >= position()" into "position() <= 5", and
+			// likewise for paths, as comparisons with a node set
+			// or a number hold either way round.
+			return c.compare(mirrorOperator(operator), right, left)
+		}
+	}
+	switch l := left.(type) {
+	case pathExpr:
+		if c.text != deepText {
+			// The dedicated predicates take the whole text of elements.
+			break
+		}
+		switch r := right.(type) {
+		case literalExpr:
+			switch operator {
+			case "=":
+				return equalsPredicate{l.path, string(r)}, nil
+			case "!=":
+				return notequalsPredicate{l.path, string(r)}, nil
+			}
+			// Strings are compared by order as numbers.
+			return comparePredicate{l.path, operator, parseNumber(string(r))}, nil
+		case numberExpr:
+			return comparePredicate{l.path, operator, float64(r)}, nil
+		}
+	case callExpr:
+		switch r := right.(type) {
+		case numberExpr:
+			if l.name == "position" && r >= 0 && r == numberExpr(int(r)) {
+				return positionComparison(operator, int(r), c)
+			}
+		case literalExpr:
+			if l.name != "normalize-space" || c.text != deepText {
+				break
+			}
+			path, ok := l.args[0].(pathExpr)
+			if !ok {
+				break
+			}
+			switch operator {
+			case "=":
+				return normalizedEqualsPredicate{path.path, string(r)}, nil
+			case "!=":
+				return normalizedNotequalsPredicate{path.path, string(r)}, nil
+			}
+		}
+	}
+	return compareExpr{operator, left, right}, nil
+}
+
+// mirrorOperator returns the operator comparing right and left
+// as operator compares left and right.
+func mirrorOperator(operator string) string {
+	switch operator {
+	case "<":
+		return ">"
+	case "<=":
+		return ">="
+	case ">":
+		return "<"
+	case ">=":
+		return "<="
+	}
+	return operator
+}
+
+// positionComparison returns the predicate comparing the context
+// position against pos, which must be a position in the node set.
+func positionComparison(operator string, pos int, c *pathCompiler) (predicate, error) {
+	if pos == 0 {
+		return nil, c.errorf("positions start at 1")
+	}
+	var operatorFunc positionFunc
+	max := 0
+	switch operator {
+	case "=":
+		operatorFunc = equalPosition
+		max = pos
+	case "!=":
+		operatorFunc = notequalPosition
+	case "<=":
+		operatorFunc = smallerequalPosition
+		max = pos
+	case ">=":
+		operatorFunc = largerequalPosition
+	case "<":
+		operatorFunc = smallerPosition
+		max = pos - 1
+		if max == 0 {
+			// Can't ever succeed.
+			max = -1
+		}
+	case ">":
+		operatorFunc = largerPosition
+	}
+	return positionPredicate{pos: pos, operator: operatorFunc, max: max}, nil
+}
+
+func (c *pathCompiler) parseAdditive() (predicate, error) {
+	e, err := c.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var operator string
+		switch {
+		case c.skipByte('+'):
+			operator = "+"
+		case c.skipByte('-'):
+			operator = "-"
+		default:
+			return e, nil
+		}
+		c.skipSpaces()
+		right, err := c.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		e = arithExpr{operator, e, right}
+	}
+}
+
+func (c *pathCompiler) parseMultiplicative() (predicate, error) {
+	e, err := c.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var operator string
+		switch {
+		case c.skipByte('*'):
+			operator = "*"
+			c.skipSpaces()
+		case c.skipOperator("div"):
+			operator = "div"
+		case c.skipOperator("mod"):
+			operator = "mod"
+		default:
+			return e, nil
+		}
+		right, err := c.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		e = arithExpr{operator, e, right}
+	}
+}
+
+func (c *pathCompiler) parseUnary() (predicate, error) {
+	c.skipSpaces()
+	if !c.skipByte('-') {
+		return c.parsePrimary()
+	}
+	e, err := c.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if n, ok := e.(numberExpr); ok {
+		return -n, nil
+	}
+	return negExpr{e}, nil
+}
+
+// parsePrimary parses a parenthesized expression, a literal, a number,
+// a function call or a path, followed by any spaces.
+func (c *pathCompiler) parsePrimary() (e predicate, err error) {
+	if start := c.i; c.skipByte('(') {
+		c.skipSpaces()
+		if e, err = c.parseExpr(); err != nil {
+			return nil, err
+		}
+		if !c.skipByte(')') {
+			return nil, c.errorf("expected ')'")
+		}
+		c.skipSpaces()
+		if pe, ok := e.(pathExpr); ok && (c.peekByte('[') || c.peekByte('/')) {
+			path, err := c.parseFilter(pe.path, start)
+			if err != nil {
+				return nil, err
+			}
+			c.skipSpaces()
+			return pathExpr{path}, nil
+		}
+		return e, nil
+	}
+	if literal, err := c.parseLiteral(); err != errNoLiteral {
+		if err != nil {
+			return nil, c.errorf("%v", err)
+		}
+		c.skipSpaces()
+		return literalExpr(literal), nil
+	}
+	if c.peekDigit() || c.peekByte('.') && c.i+1 < len(c.path) && isDigit(c.path[c.i+1]) {
+		number, ok := c.parseNumber()
+		if !ok {
+			return nil, c.errorf("invalid number")
+		}
+		c.skipSpaces()
+		return numberExpr(number), nil
+	}
+
+	if c.skipByte('$') {
+		mark := c.i
+		if !c.skipName() || c.path[mark:c.i] == "*" {
+			return nil, c.errorf("missing variable name")
+		}
+		name := c.path[mark:c.i]
+		c.skipSpaces()
+		return varExpr(name), nil
+	}
+
+	mark := c.i
+	if c.skipName() {
+		name := c.path[mark:c.i]
+		c.skipSpaces()
+		if c.peekByte('(') && !isNodeType(name) {
+			call, err := c.parseCall(name)
+			if err != nil || kindOf(call) != nodeSetValue || !c.peekByte('[') && !c.peekByte('/') {
+				return call, err
+			}
+			path, err := c.parseCallFilter(call, mark)
+			if err != nil {
+				return nil, err
+			}
+			c.skipSpaces()
+			return pathExpr{path}, nil
+		}
+	}
+	c.i = mark
+	path, err := c.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	c.skipSpaces()
+	return pathExpr{path}, nil
+}
+
+func isNodeType(name string) bool {
+	switch name {
+	case "node", "text", "comment", "processing-instruction":
+		return true
+	}
+	return false
+}
+
+// parseCall parses the arguments of the named function, with the
+// compiler positioned at the opening parenthesis.
+func (c *pathCompiler) parseCall(name string) (predicate, error) {
+	fn, ok := exprFuncs[name]
+	if name == "document" {
+		if c.loader == nil {
+			return nil, c.errorf("document() requires a loader set via CompileOptions.Loader")
+		}
+		fn, ok = documentFunc(c.loader, c.baseURL), true
+	}
+	if !ok {
+		return nil, c.errorf("unsupported expression: %s()", name)
+	}
+	c.skipByte('(')
+	c.skipSpaces()
+	var args []predicate
+	if !c.peekByte(')') {
+		for {
+			arg, err := c.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if !c.skipByte(',') {
+				break
+			}
+		}
+	}
+	if !c.skipByte(')') {
+		return nil, c.errorf("%s() missing ')'", name)
+	}
+	c.skipSpaces()
+	if len(args) == 0 && fn.contextArg {
+		args = []predicate{pathExpr{selfPath}}
+		if c.text != deepText {
+			args = []predicate{pathExpr{&Path{path: ".", steps: selfPath.steps, text: c.text}}}
+		}
+	}
+	if len(args) < fn.minArgs || fn.maxArgs >= 0 && len(args) > fn.maxArgs {
+		return nil, c.errorf("wrong number of arguments for %s()", name)
+	}
+
+	if fn.nodeSetArg && len(args) > 0 {
+		if kind := kindOf(args[0]); kind != nodeSetValue && kind != anyValue {
+			return nil, c.errorf("%s() requires a node set", name)
+		}
+	}
+
+	// Use the dedicated predicates when possible.
+	switch name {
+	case "not":
+		return notPredicate{args[0]}, nil
+	case "matches", "tokenize", "replace":
+		if len(args) < 2 {
+			break
+		}
+		var literals []string
+		for _, arg := range args[1:] {
+			if literal, ok := arg.(literalExpr); ok {
+				literals = append(literals, string(literal))
+			}
+		}
+		if len(literals) < len(args)-1 {
+			break
+		}
+		pattern, repl, flags := literals[0], "", ""
+		rest := literals[1:]
+		if name == "replace" {
+			repl, rest = rest[0], rest[1:]
+		}
+		if len(rest) > 0 {
+			flags = rest[0]
+		}
+		re, err := compileRegexp(pattern, flags)
+		if err != nil {
+			return nil, c.errorf("%s() %v", name, err)
+		}
+		if name != "matches" && re.MatchString("") {
+			return nil, c.errorf("%s() pattern matches the empty string", name)
+		}
+		expand, err := replacement(repl)
+		if err != nil {
+			return nil, c.errorf("replace() %v", err)
+		}
+		return regexpExpr{name, args[0], re, expand}, nil
+	case "contains", "starts-with":
+		if c.text != deepText {
+			break
+		}
+		path, ok := args[0].(pathExpr)
+		value, isLiteral := args[1].(literalExpr)
+		if ok && isLiteral && name == "contains" {
+			return containsPredicate{path.path, string(value)}, nil
+		}
+		if ok && isLiteral {
+			return startsWithPredicate{path.path, string(value)}, nil
+		}
+	}
+	return callExpr{name, fn, args}, nil
+}
+
+// stepPredicate returns pred as used for selecting nodes in a path step,
+// where a number stands for the position of the node to select.
+func (c *pathCompiler) stepPredicate(pred predicate) (predicate, error) {
+	if n, ok := pred.(numberExpr); ok && n == numberExpr(int(n)) {
+		if n < 0 {
+			return nil, c.errorf("positions must be positive")
+		}
+		return positionComparison("=", int(n), c)
+	}
+	switch kindOf(pred) {
+	case numberValue, anyValue:
+		return numberPredicate{pred}, nil
+	}
+	return pred, nil
+}
+
+// kindOf returns the kind of value e evaluates into, or anyValue
+// if that's only known once it's evaluated.
+func kindOf(e predicate) valueKind {
+	switch e := e.(type) {
+	case literalExpr:
+		return stringValue
+	case numberExpr, negExpr, arithExpr:
+		return numberValue
+	case pathExpr:
+		return nodeSetValue
+	case varExpr:
+		return anyValue
+	case callExpr:
+		return e.fn.kind
+	case regexpExpr:
+		return exprFuncs[e.name].kind
+	}
+	return boolValue
+}
+
+type valueKind int
+
+const (
+	nodeSetValue valueKind = iota
+	numberValue
+	stringValue
+	boolValue
+	anyValue
+)
+
+// value is the result of evaluating an expression.
+type value struct {
+	kind    valueKind
+	nodes   []*Node
+	num     float64
+	str     string
+	boolean bool
+
+	// text is how the string value of elements in nodes is taken.
+	text textMode
+}
+
+func numberVal(f float64) value { return value{kind: numberValue, num: f} }
+func stringVal(s string) value  { return value{kind: stringValue, str: s} }
+func boolVal(b bool) value      { return value{kind: boolValue, boolean: b} }
+
+func (v value) bool() bool {
+	switch v.kind {
+	case numberValue:
+		return v.num != 0 && !math.IsNaN(v.num)
+	case stringValue:
+		return v.str != ""
+	case boolValue:
+		return v.boolean
+	}
+	return len(v.nodes) > 0
+}
+
+func (v value) number() float64 {
+	switch v.kind {
+	case numberValue:
+		return v.num
+	case boolValue:
+		if v.boolean {
+			return 1
+		}
+		return 0
+	}
+	return parseNumber(v.string())
+}
+
+func (v value) string() string {
+	switch v.kind {
+	case numberValue:
+		return formatNumber(v.num)
+	case stringValue:
+		return v.str
+	case boolValue:
+		return strconv.FormatBool(v.boolean)
+	}
+	if first := v.first(); first != nil {
+		return v.nodeString(first)
+	}
+	return ""
+}
+
+// nodeString returns the string value of node, one of the nodes in v.
+func (v value) nodeString(node *Node) string {
+	return node.textString(v.text)
+}
+
+// first returns the first node in document order within a node set.
+func (v value) first() *Node {
+	var first *Node
+	for _, node := range v.nodes {
+		if first == nil || node.pos < first.pos {
+			first = node
+		}
+	}
+	return first
+}
+
+// varValue returns v, the value of the named variable, as a value.
+func varValue(name string, v interface{}) value {
+	switch v := v.(type) {
+	case string:
+		return stringVal(v)
+	case bool:
+		return boolVal(v)
+	case float64:
+		return numberVal(v)
+	case float32:
+		return numberVal(float64(v))
+	case int:
+		return numberVal(float64(v))
+	case int8:
+		return numberVal(float64(v))
+	case int16:
+		return numberVal(float64(v))
+	case int32:
+		return numberVal(float64(v))
+	case int64:
+		return numberVal(float64(v))
+	case uint:
+		return numberVal(float64(v))
+	case uint8:
+		return numberVal(float64(v))
+	case uint16:
+		return numberVal(float64(v))
+	case uint32:
+		return numberVal(float64(v))
+	case uint64:
+		return numberVal(float64(v))
+	case *Node:
+		return value{kind: nodeSetValue, nodes: []*Node{v}}
+	case []*Node:
+		return value{kind: nodeSetValue, nodes: v}
+	}
+	panic(fmt.Sprintf("xmlpath: unsupported type %T for variable $%s", v, name))
+}
+
+// formatNumber formats f as done by the XPath string() function,
+// which never uses exponents.
+func formatNumber(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case f == 0:
+		return "0"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// exprContext holds the context in which expressions are evaluated.
+type exprContext struct {
+	node *Node
+	pos  int
+
+	// state is the step whose predicate is being evaluated, if any,
+	// and provides the context size on demand.
+	state *pathStepState
+
+	// last, when not zero, is the context size for predicates of
+	// filter expressions, which have no step.
+	last int
+
+	// vars holds the values of variables by name.
+	vars map[string]value
+
+	// deadline, if set, is when evaluation must be over, and err, if
+	// set, is where the first error found while evaluating is reported,
+	// such as a document failing to load in document().
+	deadline time.Time
+	err      *error
+}
+
+// iter returns an iterator over the nodes p matches on the context
+// node, failing past the deadline of ctx.
+func (ctx *exprContext) iter(p *Path) *Iter {
+	return p.iterUntil(ctx.node, ctx.vars, ctx.deadline)
+}
+
+// fail reports err, unless nil or not the first error found.
+func (ctx *exprContext) fail(err error) {
+	if err != nil && ctx.err != nil && *ctx.err == nil {
+		*ctx.err = err
+	}
+}
+
+// size returns the context size, as returned by last().
+func (ctx *exprContext) size() int {
+	if ctx.last > 0 {
+		return ctx.last
+	}
+	if ctx.state == nil {
+		return 1
+	}
+	return ctx.state.contextSize()
+}
+
+// test evaluates pred and returns its result converted into a boolean.
+func (ctx *exprContext) test(pred predicate) bool {
+	switch pred := pred.(type) {
+	case positionPredicate:
+		return pred.operator(pred.pos, ctx.pos)
+	case pathExpr:
+		return pred.path.any(ctx, func(*Node) bool { return true })
+	case equalsPredicate:
+		return pred.path.any(ctx, func(node *Node) bool { return node.equals(pred.value) })
+	case notequalsPredicate:
+		return pred.path.any(ctx, func(node *Node) bool { return !node.equals(pred.value) })
+	case containsPredicate:
+		return pred.path.any(ctx, func(node *Node) bool { return node.contains(pred.value) })
+	case startsWithPredicate:
+		return pred.path.any(ctx, func(node *Node) bool { return node.startsWith(pred.value) })
+	case comparePredicate:
+		return pred.path.any(ctx, func(node *Node) bool { return compareNumbers(pred.operator, node.number(), pred.value) })
+	case normalizedEqualsPredicate:
+		iter := ctx.iter(pred.path)
+		ok := iter.Next() && iter.Node().normalizedEquals(pred.value)
+		ctx.fail(iter.err)
+		return ok
+	case normalizedNotequalsPredicate:
+		iter := ctx.iter(pred.path)
+		ok := iter.Next() && !iter.Node().normalizedEquals(pred.value)
+		ctx.fail(iter.err)
+		return ok
+	case notPredicate:
+		return !ctx.test(pred.uniSub)
+	case andPredicate:
+		for _, sub := range pred.sub {
+			if !ctx.test(sub) {
+				return false
+			}
+		}
+		return true
+	case orPredicate:
+		for _, sub := range pred.sub {
+			if ctx.test(sub) {
+				return true
+			}
+		}
+		return false
+	case compareExpr:
+		return compareValues(pred.operator, ctx.eval(pred.left), ctx.eval(pred.right))
+	case regexpExpr:
+		if pred.name == "matches" {
+			return pred.re.MatchString(ctx.eval(pred.sub).string())
+		}
+	case numberPredicate:
+		v := ctx.eval(pred.sub)
+		if v.kind == numberValue {
+			return v.num == float64(ctx.pos)
+		}
+		return v.bool()
+	}
+	return ctx.eval(pred).bool()
+}
+
+// eval evaluates e and returns its result.
+func (ctx *exprContext) eval(e predicate) value {
+	switch e := e.(type) {
+	case literalExpr:
+		return stringVal(string(e))
+	case numberExpr:
+		return numberVal(float64(e))
+	case varExpr:
+		if v, ok := ctx.vars[string(e)]; ok {
+			return v
+		}
+		return value{kind: nodeSetValue}
+	case pathExpr:
+		var nodes []*Node
+		iter := ctx.iter(e.path)
+		for iter.Next() {
+			nodes = append(nodes, iter.Node())
+		}
+		ctx.fail(iter.err)
+		return value{kind: nodeSetValue, nodes: nodes, text: e.path.text}
+	case negExpr:
+		return numberVal(-ctx.eval(e.sub).number())
+	case arithExpr:
+		l, r := ctx.eval(e.left).number(), ctx.eval(e.right).number()
+		switch e.operator {
+		case "+":
+			return numberVal(l + r)
+		case "-":
+			return numberVal(l - r)
+		case "*":
+			return numberVal(l * r)
+		case "div":
+			return numberVal(l / r)
+		case "mod":
+			return numberVal(math.Mod(l, r))
+		}
+		panic("internal error: unknown operator " + e.operator)
+	case regexpExpr:
+		switch e.name {
+		case "tokenize":
+			return tokenize(ctx.eval(e.sub).string(), e.re)
+		case "replace":
+			return stringVal(e.re.ReplaceAllString(ctx.eval(e.sub).string(), e.repl))
+		}
+	case callExpr:
+		args := make([]value, len(e.args))
+		for i, arg := range e.args {
+			args[i] = ctx.eval(arg)
+		}
+		return e.fn.call(ctx, args)
+	}
+	return boolVal(ctx.test(e))
+}
+
+// compareValues compares l and r as per the XPath rules, under which
+// a node set satisfies a comparison if any of its nodes do.
+func compareValues(operator string, l, r value) bool {
+	if l.kind == nodeSetValue || r.kind == nodeSetValue {
+		if l.kind == boolValue || r.kind == boolValue {
+			return compareValues(operator, boolVal(l.bool()), boolVal(r.bool()))
+		}
+		if l.kind == nodeSetValue {
+			for _, node := range l.nodes {
+				if compareValues(operator, stringVal(l.nodeString(node)), r) {
+					return true
+				}
+			}
+			return false
+		}
+		for _, node := range r.nodes {
+			if compareValues(operator, l, stringVal(r.nodeString(node))) {
+				return true
+			}
+		}
+		return false
+	}
+	if operator == "=" || operator == "!=" {
+		switch {
+		case l.kind == boolValue || r.kind == boolValue:
+			return (l.bool() == r.bool()) == (operator == "=")
+		case l.kind == numberValue || r.kind == numberValue:
+			return compareNumbers(operator, l.number(), r.number())
+		}
+		return (l.string() == r.string()) == (operator == "=")
+	}
+	return compareNumbers(operator, l.number(), r.number())
+}
@@ -0,0 +1,169 @@
+package xmlpath
+
+import (
+	"encoding/binary"
+	"hash"
+	"sort"
+	"strings"
+)
+
+// HashOptions tune which aspects of a subtree are disregarded by Node.Hash.
+type HashOptions struct {
+	// IgnoreComments and IgnoreProcInsts drop comments and
+	// processing instructions respectively.
+	IgnoreComments  bool
+	IgnoreProcInsts bool
+
+	// IgnoreWhitespace drops text made only of whitespace, and
+	// normalizes any other text as done by normalize-space().
+	IgnoreWhitespace bool
+
+	// IgnoreNamespaces compares element and attribute names by
+	// their local part alone.
+	IgnoreNamespaces bool
+
+	// IgnoreAttrs lists the local names of attributes to drop, such
+	// as those holding timestamps or session identifiers.
+	IgnoreAttrs []string
+}
+
+// Hash writes into h a canonical form of the subtree rooted at node and
+// returns h.Sum(nil), so that subtrees with the same structure and content
+// hash to the same value. Attribute order, the prefixes used for namespaces
+// and how text happens to be split by CDATA sections don't affect the
+// outcome, and opts may disregard further aspects. Text split by comments
+// hashes as a single piece only when IgnoreComments drops them. A nil opts
+// disregards nothing else.
+//
+// For example, comparing fingerprints of a record between two crawls:
+//
+//     sum := record.Hash(sha256.New(), &xmlpath.HashOptions{IgnoreWhitespace: true})
+//     if !bytes.Equal(sum, previous) {
+//             // The record changed.
+//     }
+//
+func (node *Node) Hash(h hash.Hash, opts *HashOptions) []byte {
+	if opts == nil {
+		opts = &HashOptions{}
+	}
+	hs := hashing{h: h, opts: opts}
+	hs.node(node)
+	hs.flushText()
+	return h.Sum(nil)
+}
+
+type hashing struct {
+	h    hash.Hash
+	opts *HashOptions
+	text []byte
+	buf  []byte
+}
+
+// Tags identifying each token of the canonical form.
+const (
+	hashStart byte = iota + 1
+	hashEnd
+	hashAttr
+	hashText
+	hashComment
+	hashProcInst
+)
+
+func (hs *hashing) token(tag byte, fields ...string) {
+	hs.buf = append(hs.buf[:0], tag)
+	for _, field := range fields {
+		hs.buf = binary.AppendUvarint(hs.buf, uint64(len(field)))
+		hs.buf = append(hs.buf, field...)
+	}
+	hs.h.Write(hs.buf)
+}
+
+func (hs *hashing) name(node *Node) (space, local string) {
+	if hs.opts.IgnoreNamespaces {
+		return "", node.name.Local
+	}
+	return node.name.Space, node.name.Local
+}
+
+func (hs *hashing) node(node *Node) {
+	switch node.kind {
+	case StartNode:
+		if node.up != nil {
+			hs.element(node)
+			return
+		}
+		for _, down := range node.down {
+			hs.node(down)
+		}
+	case TextNode:
+		hs.text = append(hs.text, node.text...)
+	case CommentNode:
+		if !hs.opts.IgnoreComments {
+			hs.flushText()
+			hs.token(hashComment, string(node.text))
+		}
+	case ProcInstNode:
+		if !hs.opts.IgnoreProcInsts {
+			hs.flushText()
+			hs.token(hashProcInst, node.name.Local, string(node.text))
+		}
+	case AttrNode:
+		space, local := hs.name(node)
+		hs.token(hashAttr, space, local, node.attr)
+	case NamespaceNode:
+		hs.token(hashAttr, "xmlns", node.name.Local, node.attr)
+	}
+}
+
+func (hs *hashing) element(node *Node) {
+	hs.flushText()
+	space, local := hs.name(node)
+	hs.token(hashStart, space, local)
+
+	var attrs []*Node
+	for i := node.pos + 1; i < node.end && node.nodes[i].kind == AttrNode; i++ {
+		attr := node.nodes[i]
+		if !hs.ignoreAttr(attr) {
+			attrs = append(attrs, attr)
+		}
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		si, li := hs.name(attrs[i])
+		sj, lj := hs.name(attrs[j])
+		return si < sj || si == sj && li < lj
+	})
+	for _, attr := range attrs {
+		hs.node(attr)
+	}
+
+	for _, down := range node.down {
+		hs.node(down)
+	}
+	hs.flushText()
+	hs.token(hashEnd)
+}
+
+func (hs *hashing) ignoreAttr(attr *Node) bool {
+	for _, name := range hs.opts.IgnoreAttrs {
+		if attr.name.Local == name {
+			return true
+		}
+	}
+	return false
+}
+
+// flushText hashes the text accumulated from adjacent text nodes.
+func (hs *hashing) flushText() {
+	text := string(hs.text)
+	hs.text = hs.text[:0]
+	if hs.opts.IgnoreWhitespace {
+		text = strings.Join(strings.FieldsFunc(text, isXMLSpace), " ")
+	}
+	if text != "" {
+		hs.token(hashText, text)
+	}
+}
+
+func isXMLSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
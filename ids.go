@@ -0,0 +1,174 @@
+package xmlpath
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// defaultIDAttrs holds the names of the attributes indexed by default
+// for the id() function, given that documents rarely come with a DTD
+// declaring which attributes are of type ID.
+var defaultIDAttrs = []xml.Name{{Local: "id"}, {Space: xmlNamespace, Local: "id"}}
+
+// idIndex maps identifiers to the elements holding them in one of
+// the attributes named in attrs.
+type idIndex struct {
+	attrs []xml.Name
+	ids   map[string]*Node
+}
+
+func newIDIndex(nodes []*Node, attrs []xml.Name) *idIndex {
+	index := &idIndex{attrs: attrs}
+	for i := range nodes {
+		node := nodes[i]
+		if node.kind != AttrNode {
+			continue
+		}
+		for _, attr := range attrs {
+			if node.name == attr {
+				if index.ids == nil {
+					index.ids = make(map[string]*Node)
+				}
+				// The first element with a given identifier wins.
+				if _, ok := index.ids[node.attr]; !ok {
+					index.ids[node.attr] = node.up
+				}
+				break
+			}
+		}
+	}
+	return index
+}
+
+// IndexIDs changes the attributes that identify elements within the
+// tree node belongs to, as used by the id() function and ElementByID,
+// into the ones with the given names. Trees index attributes named "id"
+// and "xml:id" by default. Elements in namespaces are identified by
+// unqualified attributes as usual, so the name of such attributes must
+// have an empty Space. IndexIDs must not be called while the tree is
+// used concurrently.
+func (node *Node) IndexIDs(attrs ...xml.Name) {
+	root := node.nodes[0]
+	root.doc.ids = newIDIndex(root.nodes, append([]xml.Name(nil), attrs...))
+}
+
+// ElementByID returns the element identified by id within the tree
+// node belongs to, or nil if there's none. See Node.IndexIDs for the
+// attributes holding identifiers.
+func (node *Node) ElementByID(id string) *Node {
+	return node.nodes[0].doc.ids.ids[id]
+}
+
+// ResolveIDREF returns the elements referenced by the attribute of
+// node with the given name, holding one identifier or several separated
+// by whitespace, as attributes of type IDREF and IDREFS do. Elements are
+// returned in the order they're referenced, and identifiers held by no
+// element are left out, as reported by CheckIDREFs. ResolveIDREF returns
+// nil if node has no such attribute. See Node.IndexIDs for the attributes
+// holding identifiers.
+func (node *Node) ResolveIDREF(name xml.Name) []*Node {
+	var nodes []*Node
+	for i := node.pos + 1; i < node.end && node.nodes[i].kind == AttrNode; i++ {
+		if attr := node.nodes[i]; attr.name == name {
+			seen := make(map[*Node]bool)
+			for _, id := range strings.FieldsFunc(attr.attr, isXMLSpace) {
+				if elem := node.ElementByID(id); elem != nil && !seen[elem] {
+					seen[elem] = true
+					nodes = append(nodes, elem)
+				}
+			}
+			break
+		}
+	}
+	return nodes
+}
+
+// IDREFError reports a reference to an identifier held by no element
+// in the document, as found by CheckIDREFs.
+type IDREFError struct {
+	// Location locates the attribute holding the reference. Its Path
+	// is always set, while its Span and positions are only set by
+	// Source.CheckIDREFs, as other trees don't know where their nodes
+	// come from.
+	Location
+
+	// Attr is the attribute holding the reference, and ID the
+	// identifier referenced.
+	Attr *Node
+	ID   string
+}
+
+func (e *IDREFError) Error() string {
+	if e.Start.Line == 0 {
+		return fmt.Sprintf("xmlpath: %s: no element with id %q", e.Path, e.ID)
+	}
+	return fmt.Sprintf("xmlpath: line %d, column %d: %s: no element with id %q", e.Start.Line, e.Start.Column, e.Path, e.ID)
+}
+
+// CheckIDREFs checks the referential integrity of the tree node belongs
+// to, returning an error for every identifier referenced by attributes
+// with the given names that no element holds, in document order. Such
+// attributes hold one identifier or several separated by whitespace, as
+// described in ResolveIDREF. For example, the links between DocBook
+// elements may be checked with:
+//
+//	errs := root.CheckIDREFs(xml.Name{Local: "linkend"}, xml.Name{Local: "endterm"})
+func (node *Node) CheckIDREFs(attrs ...xml.Name) []*IDREFError {
+	return checkIDREFs(node.nodes[0], attrs, func(attr *Node) Location {
+		return Location{Path: nodePath(attr)}
+	})
+}
+
+// CheckIDREFs checks the referential integrity of the current tree as
+// done by Node.CheckIDREFs, locating each problem within the document.
+func (s *Source) CheckIDREFs(attrs ...xml.Name) []*IDREFError {
+	return checkIDREFs(s.root, attrs, s.Locate)
+}
+
+func checkIDREFs(root *Node, attrs []xml.Name, locate func(attr *Node) Location) []*IDREFError {
+	var errs []*IDREFError
+	for i := range root.nodes {
+		attr := root.nodes[i]
+		if attr.kind != AttrNode {
+			continue
+		}
+		for _, name := range attrs {
+			if attr.name != name {
+				continue
+			}
+			for _, id := range strings.FieldsFunc(attr.attr, isXMLSpace) {
+				if root.ElementByID(id) == nil {
+					errs = append(errs, &IDREFError{Location: locate(attr), Attr: attr, ID: id})
+				}
+			}
+			break
+		}
+	}
+	return errs
+}
+
+// elementsByIDs returns the elements identified by any of the
+// whitespace separated identifiers in v, or in the string values
+// of its nodes, in document order.
+func elementsByIDs(context *Node, v value) []*Node {
+	var ids []string
+	if v.kind == nodeSetValue {
+		for _, node := range v.nodes {
+			ids = append(ids, strings.FieldsFunc(v.nodeString(node), isXMLSpace)...)
+		}
+	} else {
+		ids = strings.FieldsFunc(v.string(), isXMLSpace)
+	}
+	var nodes []*Node
+	seen := make(map[*Node]bool)
+	for _, id := range ids {
+		if node := context.ElementByID(id); node != nil && !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].pos < nodes[j].pos })
+	return nodes
+}
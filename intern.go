@@ -0,0 +1,96 @@
+package xmlpath
+
+// Interner returns the string values of nodes sharing a single copy of
+// each distinct value, so that extracting values that repeat heavily,
+// such as enumerations or country codes, doesn't allocate a new string
+// for each node. The zero value is ready to use.
+//
+// An Interner keeps every distinct value it returns, so it's meant to
+// be used for the duration of a bulk extraction, or for values taken
+// from a small set. It's not safe for concurrent use.
+//
+// For example:
+//
+//	var in xmlpath.Interner
+//	iter := xmlpath.MustCompile("//order").Iter(root)
+//	for iter.Next() {
+//		status, _ := in.First(statusPath, iter.Node())
+//		...
+//	}
+type Interner struct {
+	values map[string]string
+	buf    []byte
+}
+
+// String returns the string value of node, as returned by Node.String.
+func (in *Interner) String(node *Node) string {
+	switch node.kind {
+	case AttrNode, NamespaceNode:
+		if s, ok := in.values[node.attr]; ok {
+			return s
+		}
+		return in.store(node.attr)
+	case StartNode:
+		in.buf = in.buf[:0]
+		for i := node.pos; i < node.end; i++ {
+			if node.nodes[i].kind == TextNode {
+				in.buf = append(in.buf, node.nodes[i].text...)
+			}
+		}
+		return in.intern(in.buf)
+	}
+	return in.intern(node.text)
+}
+
+// First returns the string value of the first node matched by path
+// on the given context, as returned by Path.String.
+func (in *Interner) First(path *Path, context *Node) (s string, ok bool) {
+	iter := path.Iter(context)
+	if iter.Next() {
+		return in.text(iter.Node(), path.text), true
+	}
+	return "", false
+}
+
+// Strings returns the string values of all nodes matched by path on
+// the given context, in iteration order, taken as Path.String does.
+func (in *Interner) Strings(path *Path, context *Node) []string {
+	var values []string
+	iter := path.Iter(context)
+	for iter.Next() {
+		values = append(values, in.text(iter.Node(), path.text))
+	}
+	return values
+}
+
+// text returns the string value of node in the given text mode.
+func (in *Interner) text(node *Node, mode textMode) string {
+	if node.kind != StartNode || mode == deepText {
+		return in.String(node)
+	}
+	s := node.textString(mode)
+	if v, ok := in.values[s]; ok {
+		return v
+	}
+	return in.store(s)
+}
+
+// Len returns the number of distinct values held by in.
+func (in *Interner) Len() int {
+	return len(in.values)
+}
+
+func (in *Interner) intern(b []byte) string {
+	if s, ok := in.values[string(b)]; ok {
+		return s
+	}
+	return in.store(string(b))
+}
+
+func (in *Interner) store(s string) string {
+	if in.values == nil {
+		in.values = make(map[string]string)
+	}
+	in.values[s] = s
+	return s
+}
@@ -0,0 +1,457 @@
+package xmlpath
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A DocumentLoader loads the document at a URL and returns its root node.
+// It is used by ParseURL, by the document() function of paths compiled
+// with CompileOptions.Loader, and by Node.ResolveXIncludes, and allows
+// replacing how documents are fetched, for example to serve them from a
+// local archive in tests.
+type DocumentLoader interface {
+	Load(ctx context.Context, url string) (*Node, error)
+}
+
+// DefaultLoader is the DocumentLoader used by ParseURL.
+var DefaultLoader DocumentLoader = &HTTPLoader{}
+
+// ParseURL loads the document at url via DefaultLoader and returns
+// its root node.
+func ParseURL(url string) (*Node, error) {
+	return DefaultLoader.Load(context.Background(), url)
+}
+
+// ErrDisallowed is returned by an HTTPLoader respecting robots.txt
+// when asked to load a URL that the site disallows crawling.
+var ErrDisallowed = errors.New("xmlpath: URL disallowed by robots.txt")
+
+// HTTPLoader is a DocumentLoader fetching documents over HTTP, with
+// options for using it responsibly in crawlers. Documents are parsed
+// as XML or HTML depending on their content type, as done by ParseAny.
+// An HTTPLoader is safe for concurrent use, and its fields must not be
+// changed once it's in use.
+type HTTPLoader struct {
+	// Client is used for the requests made.
+	// If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// UserAgent is sent in the User-Agent header of requests, and
+	// selects the robots.txt rules that apply.
+	UserAgent string
+
+	// MinInterval is the minimum time between the start of two
+	// requests to the same host. A larger Crawl-delay in robots.txt
+	// takes precedence when robots.txt is respected.
+	MinInterval time.Duration
+
+	// RespectRobots causes the robots.txt file of each host to be
+	// fetched and obeyed, with disallowed URLs failing to load with
+	// ErrDisallowed.
+	RespectRobots bool
+
+	// CacheTTL is how long loaded documents are kept in memory and
+	// returned again for the same URL without being fetched anew.
+	// Caching is disabled if zero and Revalidate is unset. Cached
+	// documents are returned as new copies of the tree first parsed,
+	// so changes made to one of them are not seen by later callers.
+	CacheTTL time.Duration
+
+	// Revalidate causes documents served with an ETag or Last-Modified
+	// header to be kept in memory past CacheTTL. Loading them again makes
+	// a conditional request, and when the server reports the document
+	// as unchanged a copy of the tree previously parsed is returned
+	// without the document being fetched or parsed anew. This suits scrapers polling the same URLs,
+	// but note that one tree is kept for every such URL loaded.
+	Revalidate bool
+
+	// MaxSize limits the size of fetched documents after being
+	// decompressed, as done by Decompress. No limit is enforced if zero.
+	MaxSize int64
+
+	mu    sync.Mutex
+	hosts map[string]*loaderHost
+	cache map[string]loaderEntry
+}
+
+type loaderHost struct {
+	mu     sync.Mutex
+	next   time.Time
+	robots *robotsRules
+}
+
+type loaderEntry struct {
+	node    *Node
+	expires time.Time
+
+	// etag and modified hold the ETag and Last-Modified headers
+	// the document was served with, for revalidating it.
+	etag     string
+	modified string
+}
+
+// Load fetches and parses the document at the given URL.
+func (l *HTTPLoader) Load(ctx context.Context, rawurl string) (*Node, error) {
+	node, shared, err := l.load(ctx, rawurl)
+	if shared {
+		node = copyTree(node)
+	}
+	return node, err
+}
+
+// load works like Load, with shared set when the tree returned is the
+// one cached, which must be copied before being handed to callers that
+// may change it. The document() function reads the trees it gets only,
+// and so is given the cached ones as they are.
+func (l *HTTPLoader) load(ctx context.Context, rawurl string) (node *Node, shared bool, err error) {
+	entry, fresh := l.cached(rawurl)
+	if fresh {
+		return entry.node, true, nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, false, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, false, fmt.Errorf("xmlpath: unsupported URL scheme in %q", rawurl)
+	}
+	if err := l.admit(ctx, u); err != nil {
+		return nil, false, err
+	}
+	resp, err := l.get(ctx, u.String(), entry)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		l.store(rawurl, *entry)
+		return entry.node, true, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("xmlpath: fetching %s: %s", rawurl, resp.Status)
+	}
+	r, err := Decompress(resp.Body, resp.Header.Get("Content-Encoding"), l.MaxSize)
+	if err != nil {
+		return nil, false, err
+	}
+	node, _, err = ParseAny(r, resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, false, err
+	}
+	if l.caching() {
+		l.store(rawurl, loaderEntry{
+			node:     node,
+			etag:     resp.Header.Get("ETag"),
+			modified: resp.Header.Get("Last-Modified"),
+		})
+		return node, true, nil
+	}
+	return node, false, nil
+}
+
+// copyTree returns a copy of the tree with the given root node. Trees
+// are cached as loaded and handed out as copies, so that callers may
+// change the trees they get, as done by Node.ScrubText, without that
+// affecting the trees loaded later.
+func copyTree(root *Node) *Node {
+	b := newBuilder()
+	b.copy(root)
+	copied := b.finish()
+	copied.doc.ids = newIDIndex(copied.nodes, root.doc.ids.attrs)
+	return copied
+}
+
+func (l *HTTPLoader) caching() bool {
+	return l.CacheTTL > 0 || l.Revalidate
+}
+
+// admit checks u against the robots.txt rules of its host if those
+// are respected, and waits until the host may be requested again.
+func (l *HTTPLoader) admit(ctx context.Context, u *url.URL) error {
+	host := l.host(u)
+	host.mu.Lock()
+	defer host.mu.Unlock()
+
+	interval := l.MinInterval
+	if l.RespectRobots {
+		if host.robots == nil {
+			if err := l.wait(ctx, host, interval); err != nil {
+				return err
+			}
+			robots, err := l.fetchRobots(ctx, u)
+			if err != nil {
+				return err
+			}
+			host.robots = robots
+		}
+		if !host.robots.allowed(u.EscapedPath() + querySuffix(u)) {
+			return ErrDisallowed
+		}
+		if host.robots.delay > interval {
+			interval = host.robots.delay
+		}
+	}
+	return l.wait(ctx, host, interval)
+}
+
+func querySuffix(u *url.URL) string {
+	if u.RawQuery == "" {
+		return ""
+	}
+	return "?" + u.RawQuery
+}
+
+// get requests url, conditionally on it having changed since
+// entry was loaded if entry is not nil.
+func (l *HTTPLoader) get(ctx context.Context, url string, entry *loaderEntry) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if l.UserAgent != "" {
+		req.Header.Set("User-Agent", l.UserAgent)
+	}
+	if entry != nil {
+		if entry.etag != "" {
+			req.Header.Set("If-None-Match", entry.etag)
+		}
+		if entry.modified != "" {
+			req.Header.Set("If-Modified-Since", entry.modified)
+		}
+	}
+	client := l.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// wait blocks until a request to host may be made, and reserves
+// that slot for the caller, which must hold host.mu.
+func (l *HTTPLoader) wait(ctx context.Context, host *loaderHost, interval time.Duration) error {
+	now := time.Now()
+	if d := host.next.Sub(now); d > 0 {
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		now = time.Now()
+	}
+	host.next = now.Add(interval)
+	return nil
+}
+
+func (l *HTTPLoader) host(u *url.URL) *loaderHost {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := u.Scheme + "://" + u.Host
+	host := l.hosts[key]
+	if host == nil {
+		if l.hosts == nil {
+			l.hosts = make(map[string]*loaderHost)
+		}
+		host = &loaderHost{}
+		l.hosts[key] = host
+	}
+	return host
+}
+
+// cached returns the entry cached for url, if any, and whether it may
+// be used without being revalidated first.
+func (l *HTTPLoader) cached(url string) (entry *loaderEntry, fresh bool) {
+	if !l.caching() {
+		return nil, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.cache[url]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	if !l.keep(&e, now) {
+		delete(l.cache, url)
+		return nil, false
+	}
+	return &e, now.Before(e.expires)
+}
+
+// keep returns whether entry is still worth caching at time now.
+func (l *HTTPLoader) keep(entry *loaderEntry, now time.Time) bool {
+	return now.Before(entry.expires) || l.Revalidate && (entry.etag != "" || entry.modified != "")
+}
+
+func (l *HTTPLoader) store(url string, entry loaderEntry) {
+	if !l.caching() {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	entry.expires = now.Add(l.CacheTTL)
+	for key, e := range l.cache {
+		if !l.keep(&e, now) {
+			delete(l.cache, key)
+		}
+	}
+	if !l.keep(&entry, now) {
+		return
+	}
+	if l.cache == nil {
+		l.cache = make(map[string]loaderEntry)
+	}
+	l.cache[url] = entry
+}
+
+// fetchRobots fetches and parses the robots.txt file for the host of u.
+// As per RFC 9309, a missing file allows everything, while a file that
+// can't be obtained due to server or network errors disallows everything.
+// An error is only returned if ctx is done before the file is obtained.
+func (l *HTTPLoader) fetchRobots(ctx context.Context, u *url.URL) (*robotsRules, error) {
+	disallowAll := &robotsRules{rules: []robotsRule{{path: "/"}}}
+	resp, err := l.get(ctx, u.Scheme+"://"+u.Host+"/robots.txt", nil)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return disallowAll, nil
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 500:
+		return disallowAll, nil
+	case resp.StatusCode != http.StatusOK:
+		return &robotsRules{}, nil
+	}
+	return parseRobots(io.LimitReader(resp.Body, 500<<10), l.UserAgent), nil
+}
+
+type robotsRules struct {
+	rules []robotsRule
+	delay time.Duration
+}
+
+type robotsRule struct {
+	path  string
+	allow bool
+}
+
+// parseRobots parses a robots.txt file and returns the rules in the
+// group that best matches userAgent, or in the "*" group if none do.
+func parseRobots(r io.Reader, userAgent string) *robotsRules {
+	product := strings.ToLower(userAgent)
+	if i := strings.IndexAny(product, "/ "); i >= 0 {
+		product = product[:i]
+	}
+	var own, star robotsRules
+	var ownFound bool
+	var current []*robotsRules
+	inAgents := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:colon]))
+		value := strings.TrimSpace(line[colon+1:])
+		if key == "user-agent" {
+			if !inAgents {
+				current = current[:0]
+				inAgents = true
+			}
+			agent := strings.ToLower(value)
+			if agent == "*" {
+				current = append(current, &star)
+			} else if product != "" && agent == product {
+				current = append(current, &own)
+				ownFound = true
+			}
+			continue
+		}
+		inAgents = false
+		for _, group := range current {
+			switch key {
+			case "allow", "disallow":
+				if value != "" {
+					group.rules = append(group.rules, robotsRule{path: value, allow: key == "allow"})
+				}
+			case "crawl-delay":
+				if secs, err := strconv.ParseFloat(value, 64); err == nil && secs > 0 {
+					group.delay = time.Duration(secs * float64(time.Second))
+				}
+			}
+		}
+	}
+	if ownFound {
+		return &own
+	}
+	return &star
+}
+
+// allowed returns whether path may be fetched. The rule with the
+// longest matching path wins, and allow rules win ties.
+func (r *robotsRules) allowed(path string) bool {
+	if path == "" {
+		path = "/"
+	}
+	best := -1
+	allow := true
+	for _, rule := range r.rules {
+		if !robotsMatch(rule.path, path) {
+			continue
+		}
+		if n := len(rule.path); n > best || n == best && rule.allow {
+			best = n
+			allow = rule.allow
+		}
+	}
+	return allow
+}
+
+// robotsMatch returns whether path matches pattern, where * matches
+// any sequence of characters and a trailing $ anchors the match at
+// the end of path.
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	if len(parts) == 1 {
+		return !anchored || rest == ""
+	}
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+	last := parts[len(parts)-1]
+	if anchored {
+		return strings.HasSuffix(rest, last)
+	}
+	return strings.Contains(rest, last)
+}
@@ -0,0 +1,391 @@
+package xmlpath
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Markdown converts the HTML content within node into Markdown text.
+// Headings, paragraphs, emphasis, links, images, inline code and
+// preformatted blocks, block quotes, ordered and unordered lists,
+// and tables (in the GitHub flavor) are converted, while the content of
+// any other element is kept as plain text. Scripts, styles and similar
+// elements are dropped along with comments and processing instructions.
+//
+// The node is typically one obtained via ParseHTML, or an element
+// within such a tree selected by a path, as in:
+//
+//     path := xmlpath.MustCompile("//article")
+//     iter := path.Iter(root)
+//     for iter.Next() {
+//             fmt.Println(iter.Node().Markdown())
+//     }
+//
+func (node *Node) Markdown() string {
+	switch node.kind {
+	case StartNode:
+		if node.up == nil {
+			return strings.Join(markdownBlocks(node.down), "\n\n")
+		}
+		return strings.Join(markdownBlocks([]*Node{node}), "\n\n")
+	case TextNode:
+		return markdownParagraph(markdownEscape(collapseSpace(string(node.text))))
+	}
+	return ""
+}
+
+var markdownSkip = map[string]bool{
+	"head": true, "script": true, "style": true, "template": true,
+	"noscript": true, "iframe": true, "object": true, "svg": true,
+}
+
+var markdownBlock = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"body": true, "caption": true, "dd": true, "details": true, "div": true,
+	"dl": true, "dt": true, "fieldset": true, "figcaption": true, "figure": true,
+	"footer": true, "form": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "header": true, "hgroup": true, "hr": true, "html": true,
+	"li": true, "main": true, "nav": true, "ol": true, "p": true, "pre": true,
+	"section": true, "summary": true, "table": true, "tbody": true, "td": true,
+	"tfoot": true, "th": true, "thead": true, "tr": true, "ul": true,
+}
+
+// markdownBlocks renders nodes as a sequence of Markdown blocks, with
+// runs of inline content between block elements turned into paragraphs.
+func markdownBlocks(nodes []*Node) []string {
+	var blocks []string
+	var inline []string
+	flush := func() {
+		if p := markdownParagraph(strings.Join(inline, "")); p != "" {
+			blocks = append(blocks, p)
+		}
+		inline = inline[:0]
+	}
+	for _, node := range nodes {
+		if node.kind != StartNode || !markdownBlock[node.name.Local] {
+			inline = append(inline, markdownInline(node))
+			continue
+		}
+		flush()
+		if block := markdownBlockElement(node); block != "" {
+			blocks = append(blocks, block)
+		}
+	}
+	flush()
+	return blocks
+}
+
+func markdownBlockElement(node *Node) string {
+	switch name := node.name.Local; name {
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		text := markdownLine(markdownInlines(node.down))
+		if text == "" {
+			return ""
+		}
+		return strings.Repeat("#", int(name[1]-'0')) + " " + text
+	case "hr":
+		return "---"
+	case "pre":
+		return markdownFence(node)
+	case "blockquote":
+		content := strings.Join(markdownBlocks(node.down), "\n\n")
+		if content == "" {
+			return ""
+		}
+		return markdownIndent(content, "> ", "> ")
+	case "ul", "ol":
+		return markdownList(node)
+	case "table":
+		return markdownTable(node)
+	}
+	return strings.Join(markdownBlocks(node.down), "\n\n")
+}
+
+func markdownList(node *Node) string {
+	ordered := node.name.Local == "ol"
+	n := 1
+	if start, ok := node.attrValue("start"); ok {
+		if i, err := strconv.Atoi(strings.TrimSpace(start)); err == nil {
+			n = i
+		}
+	}
+	var items []string
+	for _, li := range node.down {
+		if li.kind != StartNode {
+			continue
+		}
+		marker := "- "
+		if ordered {
+			marker = strconv.Itoa(n) + ". "
+			n++
+		}
+		var content string
+		if li.name.Local == "li" {
+			content = strings.Join(markdownBlocks(li.down), "\n")
+		} else {
+			content = strings.Join(markdownBlocks([]*Node{li}), "\n")
+		}
+		items = append(items, markdownIndent(content, marker, strings.Repeat(" ", len(marker))))
+	}
+	return strings.Join(items, "\n")
+}
+
+func markdownTable(node *Node) string {
+	var rows [][]string
+	columns := 0
+	var collect func(node *Node)
+	collect = func(node *Node) {
+		for _, down := range node.down {
+			if down.kind != StartNode {
+				continue
+			}
+			switch down.name.Local {
+			case "thead", "tbody", "tfoot":
+				collect(down)
+			case "tr":
+				var row []string
+				for _, cell := range down.down {
+					if cell.kind == StartNode && (cell.name.Local == "th" || cell.name.Local == "td") {
+						text := markdownLine(markdownInlines(cell.down))
+						row = append(row, strings.Replace(text, "|", `\|`, -1))
+					}
+				}
+				if len(row) > columns {
+					columns = len(row)
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+	collect(node)
+	if columns == 0 {
+		return ""
+	}
+	var lines []string
+	line := func(row []string) string {
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		return "| " + strings.Join(row, " | ") + " |"
+	}
+	lines = append(lines, line(rows[0]))
+	sep := make([]string, columns)
+	for i := range sep {
+		sep[i] = "---"
+	}
+	lines = append(lines, line(sep))
+	for _, row := range rows[1:] {
+		lines = append(lines, line(row))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// markdownFence renders a pre element as a fenced code block, taking
+// its language from a "language-" or "lang-" class in it or in the
+// code element within it, as commonly used by syntax highlighters.
+func markdownFence(node *Node) string {
+	text := strings.TrimSuffix(node.String(), "\n")
+	lang := markdownLang(node)
+	for _, down := range node.down {
+		if down.kind == StartNode && down.name.Local == "code" && lang == "" {
+			lang = markdownLang(down)
+		}
+	}
+	fence := "```"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	return fence + lang + "\n" + text + "\n" + fence
+}
+
+func markdownLang(node *Node) string {
+	class, _ := node.attrValue("class")
+	for _, field := range strings.Fields(class) {
+		for _, prefix := range []string{"language-", "lang-"} {
+			if strings.HasPrefix(field, prefix) {
+				return field[len(prefix):]
+			}
+		}
+	}
+	return ""
+}
+
+func markdownInlines(nodes []*Node) string {
+	var buf []string
+	for _, node := range nodes {
+		buf = append(buf, markdownInline(node))
+	}
+	return strings.Join(buf, "")
+}
+
+func markdownInline(node *Node) string {
+	switch node.kind {
+	case TextNode:
+		return markdownEscape(collapseSpace(string(node.text)))
+	case StartNode:
+	default:
+		return ""
+	}
+	name := node.name.Local
+	if markdownSkip[name] {
+		return ""
+	}
+	switch name {
+	case "br":
+		return "\\\n"
+	case "strong", "b":
+		return markdownWrap("**", markdownInlines(node.down))
+	case "em", "i":
+		return markdownWrap("*", markdownInlines(node.down))
+	case "del", "s", "strike":
+		return markdownWrap("~~", markdownInlines(node.down))
+	case "code", "kbd", "samp", "tt":
+		return markdownCode(collapseSpace(node.String()))
+	case "a":
+		text := markdownInlines(node.down)
+		href, ok := node.attrValue("href")
+		if !ok {
+			return text
+		}
+		if strings.TrimSpace(text) == "" {
+			text = markdownEscape(href)
+		}
+		return "[" + text + "](" + markdownURL(href, node) + ")"
+	case "img":
+		src, ok := node.attrValue("src")
+		if !ok {
+			return ""
+		}
+		alt, _ := node.attrValue("alt")
+		return "![" + markdownEscape(collapseSpace(alt)) + "](" + markdownURL(src, node) + ")"
+	}
+	if markdownBlock[name] {
+		// Block content within inline content, as in a div within
+		// a link, can't be represented. Keep it apart by spaces.
+		return " " + markdownInlines(node.down) + " "
+	}
+	return markdownInlines(node.down)
+}
+
+// markdownWrap surrounds text with delim, moving any leading and
+// trailing spaces out of it so that the delimiters are recognized.
+func markdownWrap(delim, text string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+	i := strings.Index(text, trimmed)
+	return text[:i] + delim + trimmed + delim + text[i+len(trimmed):]
+}
+
+func markdownCode(text string) string {
+	if text == "" {
+		return ""
+	}
+	fence := "`"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	if text[0] == '`' || text[len(text)-1] == '`' {
+		text = " " + text + " "
+	}
+	return fence + text + fence
+}
+
+func markdownURL(url string, node *Node) string {
+	url = strings.TrimSpace(url)
+	if strings.ContainsAny(url, " ()<>") {
+		url = "<" + strings.Replace(strings.Replace(url, "<", "%3C", -1), ">", "%3E", -1) + ">"
+	}
+	if title, ok := node.attrValue("title"); ok && title != "" {
+		url += ` "` + strings.Replace(collapseSpace(title), `"`, `\"`, -1) + `"`
+	}
+	return url
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `[`, `\[`, `]`, `\]`, `<`, `\<`,
+)
+
+func markdownEscape(text string) string {
+	return markdownEscaper.Replace(text)
+}
+
+// markdownParagraph trims inline content into a paragraph, escaping
+// a leading character that would otherwise turn it into another block.
+func markdownParagraph(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		line = strings.Join(strings.Fields(line), " ")
+		if line != "" {
+			switch line[0] {
+			case '#', '>', '-', '+', '=':
+				line = `\` + line
+			default:
+				if j := strings.IndexFunc(line, func(r rune) bool { return r < '0' || r > '9' }); j > 0 && (line[j] == '.' || line[j] == ')') {
+					line = line[:j] + `\` + line[j:]
+				}
+			}
+		}
+		lines[i] = line
+	}
+	text = strings.TrimSpace(strings.Join(lines, "\n"))
+	return strings.TrimSuffix(text, "\\")
+}
+
+// markdownLine joins inline content into a single line.
+func markdownLine(text string) string {
+	return strings.Join(strings.Fields(strings.Replace(text, "\\\n", " ", -1)), " ")
+}
+
+// markdownIndent prefixes the first line of text with first, and
+// any further non-empty lines with rest.
+func markdownIndent(text, first, rest string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		switch {
+		case i == 0:
+			lines[i] = first + line
+		case line != "":
+			lines[i] = rest + line
+		case rest == "> ":
+			lines[i] = ">"
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func collapseSpace(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		if s != "" {
+			return " "
+		}
+		return ""
+	}
+	result := strings.Join(fields, " ")
+	if isSpace(s[0]) {
+		result = " " + result
+	}
+	if isSpace(s[len(s)-1]) {
+		result += " "
+	}
+	return result
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func (node *Node) attrValue(name string) (string, bool) {
+	for i := node.pos + 1; i < node.end; i++ {
+		attr := node.nodes[i]
+		if attr.kind != AttrNode {
+			break
+		}
+		if attr.name.Local == name {
+			return attr.attr, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,91 @@
+package xmlpath
+
+import (
+	"encoding/xml"
+)
+
+// Merge returns a new tree holding an element with the given name and,
+// within it, a copy of each of nodes, or of their content for root
+// nodes, as needed when assembling batch payloads out of separate
+// documents. The trees the nodes belong to are not modified.
+//
+// Namespaces are reconciled so that each copy keeps the names it had.
+// Prefixes bound to the same namespace by all copies using them are
+// declared once in the new element, while other declarations in scope
+// of each copy are kept in its top element. When name is in a namespace,
+// that's the default namespace of the new element, and is undeclared
+// in the copies that don't have a default namespace of their own.
+//
+// For example:
+//
+//	batch := xmlpath.Merge(xml.Name{Space: "urn:batch", Local: "batch"}, order1, order2)
+func Merge(name xml.Name, nodes ...*Node) *Node {
+	var parts []*Node
+	for _, node := range nodes {
+		if node.kind == StartNode && node.up == nil {
+			parts = append(parts, node.down...)
+		} else {
+			parts = append(parts, node)
+		}
+	}
+
+	// Find out the prefixes that may be declared in the new element.
+	var prefixes []string
+	shared := make(map[string]string)
+	conflict := make(map[string]bool)
+	scopes := make([][]*Node, len(parts))
+	for i, part := range parts {
+		if part.kind != StartNode {
+			continue
+		}
+		scopes[i] = part.scopeNamespaces()
+		for _, ns := range scopes[i] {
+			prefix := ns.name.Local
+			if uri, ok := shared[prefix]; !ok {
+				shared[prefix] = ns.attr
+				prefixes = append(prefixes, prefix)
+			} else if uri != ns.attr {
+				conflict[prefix] = true
+			}
+		}
+	}
+
+	b := newBuilder()
+	b.start(name)
+	if name.Space != "" {
+		b.namespace("", name.Space)
+	}
+	for _, prefix := range prefixes {
+		if prefix != "" && !conflict[prefix] {
+			b.namespace(prefix, shared[prefix])
+		}
+	}
+	for i, part := range parts {
+		if part.kind != StartNode {
+			b.copy(part)
+			continue
+		}
+		b.start(part.name)
+		for j := part.pos + 1; j < part.end && part.nodes[j].kind == AttrNode; j++ {
+			b.attr(part.nodes[j].name, part.nodes[j].attr)
+		}
+		hasDefault := false
+		for _, ns := range scopes[i] {
+			prefix := ns.name.Local
+			if prefix == "" {
+				hasDefault = true
+			} else if !conflict[prefix] {
+				continue
+			}
+			b.namespace(prefix, ns.attr)
+		}
+		if name.Space != "" && !hasDefault {
+			b.namespace("", "")
+		}
+		for _, down := range part.down {
+			b.copy(down)
+		}
+		b.end()
+	}
+	return b.finish()
+}
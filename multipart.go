@@ -0,0 +1,122 @@
+package xmlpath
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"strings"
+)
+
+const xopNamespace = "http://www.w3.org/2004/08/xop/include"
+
+// Attachment is a MIME part of a multipart/related message other
+// than its root part.
+type Attachment struct {
+	ContentID   string
+	ContentType string
+	Data        []byte
+}
+
+// ParseMultipartRelated parses a multipart/related message such as a
+// MTOM-encoded SOAP message, given its body and the value of its
+// Content-Type header, and returns the root node of its root part along
+// with the remaining parts, keyed by content id without angle brackets.
+//
+// Each xop:Include element in the root part that references a part by
+// its "cid:" URI is replaced by the base64 encoding of the referenced
+// part data, so the resulting tree reads as if the message had not been
+// optimized. If inline is false, the xop:Include elements are left in
+// place instead, and the referenced data may be looked up in the
+// returned attachments.
+func ParseMultipartRelated(r io.Reader, contentType string, inline bool) (*Node, map[string]*Attachment, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mediaType != "multipart/related" {
+		return nil, nil, fmt.Errorf("expected multipart/related content, got %q", mediaType)
+	}
+	start := strings.Trim(params["start"], "<>")
+
+	var root []byte
+	attachments := make(map[string]*Attachment)
+	mr := multipart.NewReader(r, params["boundary"])
+	for i := 0; ; i++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		id := strings.Trim(part.Header.Get("Content-Id"), "<>")
+		if root == nil && (start == "" && i == 0 || start != "" && id == start) {
+			root = data
+			continue
+		}
+		attachments[id] = &Attachment{
+			ContentID:   id,
+			ContentType: part.Header.Get("Content-Type"),
+			Data:        data,
+		}
+	}
+	if root == nil {
+		return nil, nil, fmt.Errorf("multipart/related message has no root part")
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(root))
+	if !inline {
+		node, err := ParseDecoder(d)
+		return node, attachments, err
+	}
+	node, err := ParseDecoder(xml.NewTokenDecoder(&xopReader{d: d, attachments: attachments}))
+	return node, attachments, err
+}
+
+// xopReader replaces xop:Include elements in the token stream
+// by the base64 encoding of the attachment they refer to.
+type xopReader struct {
+	d           *xml.Decoder
+	attachments map[string]*Attachment
+}
+
+func (x *xopReader) Token() (xml.Token, error) {
+	t, err := x.d.Token()
+	if err != nil {
+		return nil, err
+	}
+	start, ok := t.(xml.StartElement)
+	if !ok || start.Name.Space != xopNamespace || start.Name.Local != "Include" {
+		return t, nil
+	}
+	var href string
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "href" {
+			href = attr.Value
+		}
+	}
+	if err := x.d.Skip(); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(href, "cid:") {
+		return nil, fmt.Errorf("xop:Include has unsupported href %q", href)
+	}
+	id, err := url.PathUnescape(href[4:])
+	if err != nil {
+		return nil, fmt.Errorf("xop:Include has invalid href %q", href)
+	}
+	attachment, ok := x.attachments[id]
+	if !ok {
+		return nil, fmt.Errorf("xop:Include references missing part %q", id)
+	}
+	return xml.CharData(base64.StdEncoding.EncodeToString(attachment.Data)), nil
+}
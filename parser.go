@@ -1,9 +1,14 @@
 package xmlpath
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/xml"
 	"golang.org/x/net/html"
 	"io"
+	"math"
+	"mime"
+	"strconv"
 	"strings"
 )
 
@@ -12,6 +17,7 @@ import (
 //
 //     - An element in the xml document (<body>)
 //     - An attribute of an element in the xml document (href="...")
+//     - A namespace declaration in the xml document (xmlns:p="...")
 //     - A comment in the xml document (<!--...-->)
 //     - A processing instruction in the xml document (<?...?>)
 //     - Some text within the xml document
@@ -22,12 +28,27 @@ type Node struct {
 	attr string
 	text []byte
 
-	nodes []Node
+	nodes []*Node
 	pos   int
 	end   int
 
 	up   *Node
 	down []*Node
+
+	// doc holds what's kept for the whole tree, set on root nodes only.
+	doc *document
+}
+
+// document holds what's kept for a whole tree rather than for each of
+// its nodes, referenced by the root node.
+type document struct {
+	// ids is the index used by id().
+	ids *idIndex
+
+	// xmlns holds the namespace nodes binding the xml prefix, which all
+	// elements have in scope, one for each top-level element, as if
+	// declared by it.
+	xmlns []*Node
 }
 
 type NodeKind int
@@ -40,6 +61,7 @@ const (
 	TextNode
 	CommentNode
 	ProcInstNode
+	NamespaceNode
 )
 
 // Kind returns the type of node as NodeKind
@@ -62,11 +84,12 @@ func (node *Node) Name() xml.Name {
 //     - For element nodes, the concatenation of all text nodes within the element.
 //     - For text nodes, the text itself.
 //     - For attribute nodes, the attribute value.
+//     - For namespace nodes, the namespace URI.
 //     - For comment nodes, the text within the comment delimiters.
 //     - For processing instruction nodes, the content of the instruction.
 //
 func (node *Node) String() string {
-	if node.kind == AttrNode {
+	if node.kind == AttrNode || node.kind == NamespaceNode {
 		return node.attr
 	}
 	return string(node.Bytes())
@@ -75,7 +98,7 @@ func (node *Node) String() string {
 // Bytes returns the string value of node as a byte slice.
 // See Node.String for a description of what the string value of a node is.
 func (node *Node) Bytes() []byte {
-	if node.kind == AttrNode {
+	if node.kind == AttrNode || node.kind == NamespaceNode {
 		return []byte(node.attr)
 	}
 	if node.kind != StartNode {
@@ -96,10 +119,58 @@ func (node *Node) Bytes() []byte {
 	return text
 }
 
+// textMode is how the string value of elements is taken.
+type textMode int
+
+const (
+	// deepText takes all text within elements, as in XPath.
+	deepText textMode = iota
+
+	// shallowText takes the text of their own text children only.
+	shallowText
+
+	// htmlText leaves out the text within script, style, and
+	// template elements inside them.
+	htmlText
+)
+
+// textString returns the string value of node, taken for elements
+// as defined by mode.
+func (node *Node) textString(mode textMode) string {
+	if node.kind != StartNode || mode == deepText {
+		return node.String()
+	}
+	var b strings.Builder
+	if mode == shallowText {
+		for _, down := range node.down {
+			if down.kind == TextNode {
+				b.Write(down.text)
+			}
+		}
+		return b.String()
+	}
+	for i := node.pos + 1; i < node.end; i++ {
+		n := node.nodes[i]
+		switch {
+		case n.kind == TextNode:
+			b.Write(n.text)
+		case n.kind == StartNode && (n.name.Space == "" || n.name.Space == xhtmlNamespace) && isScriptElement(n.name.Local):
+			i = n.end
+		}
+	}
+	return b.String()
+}
+
+const xhtmlNamespace = "http://www.w3.org/1999/xhtml"
+
+func isScriptElement(name string) bool {
+	return name == "script" || name == "style" || name == "template"
+}
+
 // equals returns whether the string value of node is equal to s,
 // without allocating memory.
 func (node *Node) equals(s string) bool {
-	if node.kind == AttrNode {
+	if node.kind == AttrNode || node.kind == NamespaceNode {
 		return s == node.attr
 	}
 	if node.kind != StartNode {
@@ -136,12 +207,14 @@ func (node *Node) contains(s string) (ok bool) {
 	if len(s) == 0 {
 		return true
 	}
-	if node.kind == AttrNode {
+	if node.kind == AttrNode || node.kind == NamespaceNode {
 		return strings.Contains(node.attr, s)
 	}
+	// Comments and processing instructions hold their own text.
+	leaf := node.kind != StartNode
 	s0 := s[0]
 	for i := node.pos; i < node.end; i++ {
-		if node.nodes[i].kind == TextNode {
+		if leaf || node.nodes[i].kind == TextNode {
 			text := node.nodes[i].text
 		NextTry:
 			for ci, c := range text {
@@ -177,17 +250,78 @@ func (node *Node) contains(s string) (ok bool) {
 	return false
 }
 
+// normalizedEquals returns whether the string value of node is equal
+// to s once leading and trailing whitespace is stripped and inner
+// sequences of whitespace are collapsed into a single space, as done
+// by normalize-space(). It does not allocate memory.
+func (node *Node) normalizedEquals(s string) bool {
+	n := normalizer{s: s}
+	if node.kind == AttrNode || node.kind == NamespaceNode {
+		for i := 0; i < len(node.attr); i++ {
+			n.feed(node.attr[i])
+		}
+	} else if node.kind != StartNode {
+		for _, c := range node.text {
+			n.feed(c)
+		}
+	} else {
+		for i := node.pos; i < node.end && !n.failed; i++ {
+			if node.nodes[i].kind == TextNode {
+				for _, c := range node.nodes[i].text {
+					n.feed(c)
+				}
+			}
+		}
+	}
+	return !n.failed && n.si == len(s)
+}
+
+// normalizer compares a stream of bytes against s while collapsing
+// whitespace as done by normalize-space().
+type normalizer struct {
+	s       string
+	si      int
+	space   bool
+	started bool
+	failed  bool
+}
+
+func (n *normalizer) feed(c byte) {
+	if n.failed {
+		return
+	}
+	if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+		n.space = n.started
+		return
+	}
+	if n.space {
+		if n.si >= len(n.s) || n.s[n.si] != ' ' {
+			n.failed = true
+			return
+		}
+		n.si++
+		n.space = false
+	}
+	n.started = true
+	if n.si >= len(n.s) || n.s[n.si] != c {
+		n.failed = true
+		return
+	}
+	n.si++
+}
+
 // startswith returns whether the string value of node has prefix s
 func (node *Node) startsWith(s string) (ok bool) {
 	if len(s) == 0 {
 		return true
 	}
-	if node.kind == AttrNode {
+	if node.kind == AttrNode || node.kind == NamespaceNode {
 		return strings.HasPrefix(node.attr, s)
 	}
+	leaf := node.kind != StartNode
 	si := 0
 	for i := node.pos; i < node.end; i++ {
-		if node.nodes[i].kind != TextNode {
+		if !leaf && node.nodes[i].kind != TextNode {
 			continue
 		}
 		for _, c := range node.nodes[i].text {
@@ -203,6 +337,29 @@ func (node *Node) startsWith(s string) (ok bool) {
 	return false
 }
 
+// number returns the string value of node converted into a number,
+// or NaN if it doesn't hold one.
+func (node *Node) number() float64 {
+	return parseNumber(node.String())
+}
+
+// parseNumber converts s into a number as done by XPath, which
+// accepts only an optional minus sign followed by digits with an
+// optional fractional part, surrounded by optional whitespace.
+// Anything else, including exponents and infinities, is NaN.
+func parseNumber(s string) float64 {
+	s = strings.Trim(s, " \t\r\n")
+	digits := strings.TrimPrefix(s, "-")
+	if digits == "" || digits == "." || strings.Trim(digits, "0123456789.") != "" || strings.Count(digits, ".") > 1 {
+		return math.NaN()
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return v
+}
+
 // Parse reads an xml document from r, parses it, and returns its root node.
 func Parse(r io.Reader) (*Node, error) {
 	return ParseDecoder(xml.NewDecoder(r))
@@ -211,37 +368,154 @@ func Parse(r io.Reader) (*Node, error) {
 // ParseDecoder parses the xml document being decoded by d and returns
 // its root node.
 func ParseDecoder(d *xml.Decoder) (*Node, error) {
+	return parseDecoder(d, nil)
+}
+
+// ParseElement parses the element started by start, which must be the
+// last token read from d, and returns a root node holding that element
+// alone. Once ParseElement returns, d is positioned after the end of
+// the element.
+//
+// ParseElement allows processing large documents one record at a
+// time, by reading tokens from d until the start of a record is found
+// and then handing the rest of the record to ParseElement.
+func ParseElement(d *xml.Decoder, start xml.StartElement) (*Node, error) {
+	return parseDecoder(d, &start)
+}
+
+// ParseOptions tune how XML documents are parsed.
+type ParseOptions struct {
+	// DTDDefaults adds to elements the attributes declared with a
+	// default or fixed value in the internal subset of the DOCTYPE
+	// declaration of the document, when they lack them, so that paths
+	// see the same attributes as with a validating parser. Defaults
+	// declaring namespaces, such as xmlns attributes, are not added.
+	DTDDefaults bool
+
+	// DTD holds further markup declarations to take attribute
+	// defaults from, such as the content of the external DTD of
+	// documents, which is not read otherwise. Declarations in the
+	// internal subset take precedence, as in validating parsers.
+	DTD string
+
+	// Defaults holds further attributes added to the elements lacking
+	// them, such as the ones returned by SchemaDefaults.
+	Defaults AttrDefaults
+}
+
+// Parse reads an XML document from r, parses it with the options in o,
+// and returns its root node.
+func (o *ParseOptions) Parse(r io.Reader) (*Node, error) {
+	return o.ParseDecoder(xml.NewDecoder(r))
+}
+
+// ParseDecoder parses the XML document read from d with the options
+// in o, and returns its root node.
+func (o *ParseOptions) ParseDecoder(d *xml.Decoder) (*Node, error) {
+	var defaults *defaulter
+	if o.DTDDefaults || o.DTD != "" || len(o.Defaults) > 0 {
+		defaults = newDefaulter(o)
+	}
+	nodes, err := decodeNodes(d, nil, nil, defaults)
+	if err != nil {
+		return nil, err
+	}
+	return link(nodes)
+}
+
+// namespacePrefix returns the prefix declared by an attribute with
+// the given name, and whether it's a namespace declaration at all.
+// The default namespace is declared with an empty prefix.
+func namespacePrefix(name xml.Name) (prefix string, ok bool) {
+	if name.Space == "xmlns" {
+		return name.Local, true
+	}
+	return "", name.Space == "" && name.Local == "xmlns"
+}
+
+func parseDecoder(d *xml.Decoder, start *xml.StartElement) (*Node, error) {
+	nodes, err := decodeNodes(d, start, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return link(nodes)
+}
+
+// decodeNodes reads the nodes of a tree from d, in the layout expected
+// by link. If spans is not nil, the offsets of the tokens read for each
+// node are appended to it as well. If defaults is not nil, elements get
+// the default attributes they lack from it. On errors, the nodes read so
+// far are returned along with the error.
+func decodeNodes(d *xml.Decoder, start *xml.StartElement, spans *[]Span, defaults *defaulter) ([]Node, error) {
 	var nodes []Node
 	var text []byte
 
 	// The root node.
 	nodes = append(nodes, Node{kind: StartNode})
+	offset := int(d.InputOffset())
+	if spans != nil {
+		*spans = append(*spans, Span{0, 0})
+	}
 
+	var first xml.Token
+	if start != nil {
+		first = *start
+	}
+	depth := 0
 	for {
-		t, err := d.Token()
+		var t xml.Token
+		var err error
+		if first != nil {
+			t, first = first, nil
+		} else {
+			t, err = d.Token()
+		}
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, err
+			return nodes, err
 		}
+		n := len(nodes)
 		switch t := t.(type) {
 		case xml.EndElement:
 			nodes = append(nodes, Node{
 				kind: EndNode,
 			})
+			depth--
+			if defaults != nil {
+				defaults.end()
+			}
 		case xml.StartElement:
+			depth++
 			nodes = append(nodes, Node{
 				kind: StartNode,
 				name: t.Name,
 			})
 			for _, attr := range t.Attr {
+				if _, ok := namespacePrefix(attr.Name); ok {
+					continue
+				}
 				nodes = append(nodes, Node{
 					kind: AttrNode,
 					name: attr.Name,
 					attr: attr.Value,
 				})
 			}
+			if defaults != nil {
+				nodes = defaults.start(nodes, t)
+			}
+			// Namespace declarations follow the attributes, so that
+			// attribute lookups may stop at the first non-attribute.
+			for _, attr := range t.Attr {
+				if prefix, ok := namespacePrefix(attr.Name); ok {
+					nodes = append(nodes, Node{
+						kind: NamespaceNode,
+						name: xml.Name{Local: prefix},
+						attr: attr.Value,
+					})
+				}
+			}
 		case xml.CharData:
 			texti := len(text)
 			text = append(text, t...)
@@ -264,56 +538,29 @@ func ParseDecoder(d *xml.Decoder) (*Node, error) {
 				name: xml.Name{Local: t.Target},
 				text: text[texti : texti+len(t.Inst)],
 			})
+		case xml.Directive:
+			if defaults != nil {
+				defaults.doctype(t)
+			}
+		}
+		if spans != nil {
+			span := Span{offset, int(d.InputOffset())}
+			for i := n; i < len(nodes); i++ {
+				*spans = append(*spans, span)
+			}
+			offset = span.End
+		}
+		if start != nil && depth == 0 {
+			break
 		}
 	}
 
 	// Close the root node.
 	nodes = append(nodes, Node{kind: EndNode})
-
-	stack := make([]*Node, 0, len(nodes))
-	downs := make([]*Node, len(nodes))
-	downCount := 0
-
-	for pos := range nodes {
-
-		switch nodes[pos].kind {
-
-		case StartNode, AttrNode, TextNode, CommentNode, ProcInstNode:
-			node := &nodes[pos]
-			node.nodes = nodes
-			node.pos = pos
-			if len(stack) > 0 {
-				node.up = stack[len(stack)-1]
-			}
-			if node.kind == StartNode {
-				stack = append(stack, node)
-			} else {
-				node.end = pos + 1
-			}
-
-		case EndNode:
-			node := stack[len(stack)-1]
-			node.end = pos
-			stack = stack[:len(stack)-1]
-
-			// Compute downs. Doing that here is what enables the
-			// use of a slice of a contiguous pre-allocated block.
-			node.down = downs[downCount:downCount]
-			for i := node.pos + 1; i < node.end; i++ {
-				if nodes[i].up == node {
-					switch nodes[i].kind {
-					case StartNode, TextNode, CommentNode, ProcInstNode:
-						node.down = append(node.down, &nodes[i])
-						downCount++
-					}
-				}
-			}
-			if len(stack) == 0 {
-				return node, nil
-			}
-		}
+	if spans != nil {
+		*spans = append(*spans, Span{offset, offset})
 	}
-	return nil, io.EOF
+	return nodes, nil
 }
 
 // ParseHTML reads an HTML document from r, parses it using a proper HTML
@@ -324,11 +571,66 @@ func ParseDecoder(d *xml.Decoder) (*Node, error) {
 // putting the content inside proper <html> and <body> tags, if the
 // provided text misses them.
 func ParseHTML(r io.Reader) (*Node, error) {
+	return parseHTML(r, &HTMLOptions{})
+}
+
+// HTMLOptions tune how HTML documents are parsed.
+type HTMLOptions struct {
+	// Templates selects how the content of template elements
+	// makes it into the tree.
+	Templates TemplateMode
+}
+
+// TemplateMode selects how the content of template elements, which
+// browsers keep aside from the document, makes it into the tree.
+type TemplateMode int
+
+const (
+	// IncludeTemplates keeps the content of template elements
+	// as their children, as done by ParseHTML.
+	IncludeTemplates TemplateMode = iota
+
+	// SkipTemplates leaves the content of template elements out,
+	// so that paths only reach what the document renders.
+	SkipTemplates
+
+	// ShadowRootTemplates moves the content of templates declaring
+	// shadow roots via the shadowrootmode attribute into the element
+	// hosting them, in place of the template, as browsers render it,
+	// and leaves the content of other templates out. Scrapers of sites
+	// made of web components may then reach into components as if
+	// they were part of the document.
+	ShadowRootTemplates
+)
+
+// Parse works like ParseHTML, parsing the document as set in o.
+func (o *HTMLOptions) Parse(r io.Reader) (*Node, error) {
+	return parseHTML(r, o)
+}
+
+// isTemplate returns whether n is an HTML template element, and
+// whether it declares a shadow root.
+func isTemplate(n *html.Node) (template, shadowRoot bool) {
+	if n.Type != html.ElementNode || n.Data != "template" || n.Namespace != "" {
+		return false, false
+	}
+	for _, attr := range n.Attr {
+		if attr.Namespace == "" && (attr.Key == "shadowrootmode" || attr.Key == "shadowroot") {
+			return true, true
+		}
+	}
+	return true, false
+}
+
+func parseHTML(r io.Reader, opts *HTMLOptions) (*Node, error) {
 	ns, err := html.ParseFragment(r, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	// unwrapped holds the templates replaced by their content.
+	var unwrapped map[*html.Node]bool
+
 	var nodes []Node
 	var text []byte
 
@@ -338,9 +640,23 @@ func ParseHTML(r io.Reader) (*Node, error) {
 	nodes = append(nodes, Node{kind: StartNode})
 
 	for n != nil {
+		descend := n.FirstChild != nil
+		if template, shadowRoot := isTemplate(n); template && opts.Templates != IncludeTemplates {
+			descend = descend && shadowRoot && opts.Templates == ShadowRootTemplates
+			if descend {
+				if unwrapped == nil {
+					unwrapped = make(map[*html.Node]bool)
+				}
+				unwrapped[n] = true
+			}
+		}
+
 		switch n.Type {
 		case html.DocumentNode:
 		case html.ElementNode:
+			if unwrapped[n] {
+				break
+			}
 			nodes = append(nodes, Node{
 				kind: StartNode,
 				name: xml.Name{Local: n.Data, Space: n.Namespace},
@@ -368,13 +684,13 @@ func ParseHTML(r io.Reader) (*Node, error) {
 			})
 		}
 
-		if n.FirstChild != nil {
+		if descend {
 			n = n.FirstChild
 			continue
 		}
 
 		for n != nil {
-			if n.Type == html.ElementNode {
+			if n.Type == html.ElementNode && !unwrapped[n] {
 				nodes = append(nodes, Node{kind: EndNode})
 			}
 			if n.NextSibling != nil {
@@ -388,18 +704,144 @@ func ParseHTML(r io.Reader) (*Node, error) {
 	// Close the root node.
 	nodes = append(nodes, Node{kind: EndNode})
 
+	return link(nodes)
+}
+
+// ParseMode reports how a document was parsed by ParseAny.
+type ParseMode int
+
+const (
+	XMLMode ParseMode = iota
+	HTMLMode
+)
+
+func (m ParseMode) String() string {
+	if m == HTMLMode {
+		return "html"
+	}
+	return "xml"
+}
+
+// sniffLen is how much of the document ParseAny inspects.
+const sniffLen = 1024
+
+// ParseAny reads a document from r that may be either xml or HTML,
+// parses it with Parse or ParseHTML accordingly, and returns its root
+// node along with the mode that was chosen.
+//
+// The decision is made by looking at the start of the document: an xml
+// declaration selects xml, and an HTML doctype selects HTML. Otherwise
+// contentTypeHint, typically the Content-Type header of an HTTP response
+// and possibly empty, is used if it names an HTML or xml media type.
+// Failing that, documents whose first element is html, head, or body are
+// parsed as HTML, and everything else as xml. Elements such as title or
+// a found further in are no hint, as RSS and Atom feeds have them too.
+func ParseAny(r io.Reader, contentTypeHint string) (*Node, ParseMode, error) {
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, XMLMode, err
+	}
+	if bytes.HasPrefix(head, utf8BOM) {
+		br.Discard(len(utf8BOM))
+		head = head[len(utf8BOM):]
+	}
+	mode := sniffMode(head, contentTypeHint)
+	var node *Node
+	if mode == HTMLMode {
+		node, err = ParseHTML(br)
+	} else {
+		node, err = Parse(br)
+	}
+	return node, mode, err
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// htmlRoots holds the names of the elements that, when found first in a
+// document, reveal it as HTML.
+var htmlRoots = map[string]bool{"html": true, "head": true, "body": true}
+
+func sniffMode(head []byte, contentTypeHint string) ParseMode {
+	head = bytes.TrimLeft(head, " \t\r\n")
+	lower := bytes.ToLower(head)
+	switch {
+	case bytes.HasPrefix(lower, []byte("<?xml")):
+		return XMLMode
+	case bytes.HasPrefix(lower, []byte("<!doctype html")):
+		return HTMLMode
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentTypeHint); err == nil {
+		switch {
+		case mediaType == "text/html":
+			return HTMLMode
+		case strings.HasSuffix(mediaType, "/xml") || strings.HasSuffix(mediaType, "+xml"):
+			return XMLMode
+		}
+	}
+	if htmlRoots[firstElement(lower)] {
+		return HTMLMode
+	}
+	return XMLMode
+}
+
+// firstElement returns the name of the first element started in head,
+// past any comments, processing instructions, and doctype, or an empty
+// string if there's none.
+func firstElement(head []byte) string {
+	for {
+		head = bytes.TrimLeft(head, " \t\r\n")
+		var end []byte
+		switch {
+		case bytes.HasPrefix(head, []byte("<!--")):
+			end = []byte("-->")
+		case bytes.HasPrefix(head, []byte("<?")):
+			end = []byte("?>")
+		case bytes.HasPrefix(head, []byte("<!")):
+			end = []byte(">")
+		case bytes.HasPrefix(head, []byte("<")):
+			name := head[1:]
+			if i := bytes.IndexAny(name, " \t\r\n/>"); i >= 0 {
+				name = name[:i]
+			}
+			return string(name)
+		default:
+			return ""
+		}
+		i := bytes.Index(head, end)
+		if i < 0 {
+			return ""
+		}
+		head = head[i+len(end):]
+	}
+}
+
+// link sets up the references between nodes, which must hold a
+// complete tree in document order, with the root node first and its
+// end node last, and returns the root node.
+func link(nodes []Node) (*Node, error) {
+	ptrs := make([]*Node, len(nodes))
+	for i := range nodes {
+		ptrs[i] = &nodes[i]
+	}
+	return linkNodes(ptrs)
+}
+
+// linkNodes is like link, but works on the node pointers directly so
+// that callers may reuse the nodes of a tree previously linked.
+func linkNodes(nodes []*Node) (*Node, error) {
 	stack := make([]*Node, 0, len(nodes))
 	downs := make([]*Node, len(nodes))
 	downCount := 0
 
-	for pos := range nodes {
+	for pos, node := range nodes {
+		node.nodes = nodes
+		node.pos = pos
 
-		switch nodes[pos].kind {
+		switch node.kind {
 
-		case StartNode, AttrNode, TextNode, CommentNode, ProcInstNode:
-			node := &nodes[pos]
-			node.nodes = nodes
-			node.pos = pos
+		case StartNode, AttrNode, TextNode, CommentNode, ProcInstNode, NamespaceNode:
+			node.up = nil
 			if len(stack) > 0 {
 				node.up = stack[len(stack)-1]
 			}
@@ -421,15 +863,88 @@ func ParseHTML(r io.Reader) (*Node, error) {
 				if nodes[i].up == node {
 					switch nodes[i].kind {
 					case StartNode, TextNode, CommentNode, ProcInstNode:
-						node.down = append(node.down, &nodes[i])
+						node.down = append(node.down, nodes[i])
 						downCount++
 					}
 				}
 			}
 			if len(stack) == 0 {
+				linkDocument(node)
 				return node, nil
 			}
 		}
 	}
 	return nil, io.EOF
 }
+
+// linkDocument sets up what's kept for the tree under root, reusing the
+// namespace nodes of top-level elements kept from a previous linking.
+//
+// Top-level elements implicitly declare the xml prefix, with the namespace
+// node for it not being part of the node slice. It takes the position of
+// the end node of its element, so that no other node shares its position,
+// and ends where the content of its element starts, so that the nodes
+// following it are the same as for the other namespace nodes of the element.
+func linkDocument(root *Node) {
+	doc := &document{ids: newIDIndex(root.nodes, defaultIDAttrs)}
+	for _, top := range root.down {
+		if top.kind != StartNode {
+			continue
+		}
+		var ns *Node
+		if root.doc != nil {
+			for _, old := range root.doc.xmlns {
+				if old.up == top {
+					ns = old
+				}
+			}
+		}
+		if ns == nil {
+			ns = &Node{kind: NamespaceNode, name: xml.Name{Local: "xml"}, attr: xmlNamespace}
+		}
+		ns.nodes = root.nodes
+		ns.pos = top.end
+		ns.end = top.namespaces()
+		for ns.end < top.end && top.nodes[ns.end].kind == NamespaceNode {
+			ns.end++
+		}
+		ns.up = top
+		doc.xmlns = append(doc.xmlns, ns)
+	}
+	root.doc = doc
+}
+
+// xmlNamespace returns the namespace node binding the xml prefix in
+// scope of elem, unless the prefix is declared explicitly.
+func (elem *Node) xmlNamespace() *Node {
+	top := elem
+	for ; top.up != nil && top.up.up != nil; top = top.up {
+	}
+	for e := elem; e != top.up; e = e.up {
+		for i := e.namespaces(); i < e.end && e.nodes[i].kind == NamespaceNode; i++ {
+			if e.nodes[i].name.Local == "xml" {
+				return nil
+			}
+		}
+	}
+	for _, ns := range elem.nodes[0].doc.xmlns {
+		if ns.up == top {
+			return ns
+		}
+	}
+	return nil
+}
+
+// implicit returns whether node is the namespace node binding the xml
+// prefix of a top-level element, which is not part of the node slice.
+func (node *Node) implicit() bool {
+	if node.kind != NamespaceNode || len(node.nodes) == 0 || node.nodes[0].doc == nil {
+		return false
+	}
+	for _, ns := range node.nodes[0].doc.xmlns {
+		if ns == node {
+			return true
+		}
+	}
+	return false
+}
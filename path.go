@@ -1,8 +1,11 @@
 package xmlpath
 
 import (
+	"errors"
 	"fmt"
-	"strconv"
+	"sort"
+	"strings"
+	"time"
 	"unicode/utf8"
 )
 
@@ -13,27 +16,352 @@ import (
 type Path struct {
 	path  string
 	steps []pathStep
+
+	// dedup is set when distinct contexts may lead to the same
+	// node, so iterators must track the nodes already seen.
+	dedup bool
+
+	// union holds the alternatives of a path made of several
+	// location paths joined by "|", in which case steps is empty.
+	union []*Path
+
+	// coalesce holds the paths given to Coalesce, in which case
+	// steps is empty.
+	coalesce []*Path
+
+	// group holds the parenthesized path of a filter expression such
+	// as "(//a)[1]/b", in which case steps is empty, filter holds the
+	// predicates applied to the nodes of group in document order, and
+	// rest the location path following them, if any.
+	group  *Path
+	filter []predicate
+	rest   *Path
+
+	// call holds a function call returning nodes, when p is the
+	// group of a filter expression such as "document('a.xml')//b",
+	// in which case steps is empty.
+	call predicate
+
+	// text is how the string value of elements is taken, as
+	// set via CompileOptions.
+	text textMode
+
+	// timeout, if positive, is the time each evaluation of the path
+	// may take, as set via WithTimeout.
+	timeout time.Duration
+}
+
+// WithTimeout returns a copy of p whose evaluations fail with ErrTimeout
+// once they've been running for longer than d, so that a pathological
+// path applied to a huge document can't stall its caller indefinitely.
+// The time is counted from the creation of each iterator, and checked
+// as steps move from node to node, so evaluations may overrun d by as
+// long as testing a single node against the predicates of a step takes.
+//
+// For example:
+//
+//	iter := path.WithTimeout(100 * time.Millisecond).Iter(root)
+//	for iter.Next() {
+//		...
+//	}
+//	if err := iter.Err(); err != nil {
+//		return err
+//	}
+//
+// Methods reporting no error, such as Exists or String, behave as if
+// no further nodes matched once the time is up.
+func (p *Path) WithTimeout(d time.Duration) *Path {
+	q := *p
+	q.timeout = d
+	return &q
+}
+
+// Coalesce returns a path selecting the nodes that the first of the
+// given paths matching any nodes matches, or no nodes if none do. The
+// paths are evaluated in order, with the remaining ones left aside
+// once one matches. This is the usual way of extracting data from
+// sites whose markup varies across versions of their pages:
+//
+//	title := xmlpath.Coalesce(
+//		xmlpath.MustCompile("//h1[@class='title']"),
+//		xmlpath.MustCompile("//meta[@property='og:title']/@content"),
+//		xmlpath.MustCompile("//title"),
+//	)
+//	s, ok := title.String(root)
+func Coalesce(paths ...*Path) *Path {
+	var text []string
+	for _, path := range paths {
+		text = append(text, path.path)
+	}
+	return &Path{
+		path:     "coalesce(" + strings.Join(text, ", ") + ")",
+		coalesce: append([]*Path{}, paths...),
+	}
 }
 
 // Iter returns an iterator that goes over the list of nodes
 // that p matches on the given context.
+//
+// Nodes are usually iterated over as they're found, in the order of
+// the axes traversed. The alternatives of a union such as "a | b" are
+// instead evaluated upfront, and their nodes merged in document order.
 func (p *Path) Iter(context *Node) *Iter {
+	return p.iter(context, nil)
+}
+
+// Vars holds the values of the variables referenced in a path, such
+// as "uid" in "//user[@id=$uid]", by name. Values may be strings,
+// numbers of any of the Go integer or floating point types, booleans,
+// or nodes, given as *Node or []*Node. Variables without a value
+// evaluate into an empty node set.
+type Vars map[string]interface{}
+
+// IterWithVars works like Iter, with the variables referenced by p
+// holding the values in vars, so that a single compiled path may be
+// reused with distinct parameters:
+//
+//	path := xmlpath.MustCompile("//user[@id=$uid]/name")
+//	iter := path.IterWithVars(root, xmlpath.Vars{"uid": uid})
+//
+// IterWithVars panics if any of the values has an unsupported type.
+func (p *Path) IterWithVars(context *Node, vars Vars) *Iter {
+	values := make(map[string]value, len(vars))
+	for name, v := range vars {
+		values[name] = varValue(name, v)
+	}
+	return p.iter(context, values)
+}
+
+func (p *Path) iter(context *Node, vars map[string]value) *Iter {
+	return p.iterUntil(context, vars, time.Time{})
+}
+
+// iterUntil works like iter, with the iterator failing with ErrTimeout
+// past the given deadline, if set, or past the timeout of p if earlier.
+func (p *Path) iterUntil(context *Node, vars map[string]value, deadline time.Time) *Iter {
+	if p.timeout > 0 {
+		if d := time.Now().Add(p.timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	if p.union != nil || p.group != nil {
+		return &Iter{context: context, union: p, vars: vars, deadline: deadline}
+	}
+	if p.coalesce != nil {
+		for _, alt := range p.coalesce {
+			iter := alt.iterUntil(context, vars, deadline)
+			if iter.Next() {
+				iter.Reset()
+				return iter
+			}
+			if iter.err == ErrTimeout {
+				return iter
+			}
+		}
+		return &Iter{context: context, union: p, vars: vars, deadline: deadline}
+	}
 	iter := Iter{
-		make([]pathStepState, len(p.steps)),
-		make([]bool, len(context.nodes)),
+		context:  context,
+		state:    make([]pathStepState, len(p.steps)),
+		vars:     vars,
+		deadline: deadline,
+	}
+	if p.dedup {
+		iter.seen = make([]bool, len(context.nodes))
 	}
 	for i := range p.steps {
 		iter.state[i].step = &p.steps[i]
+		iter.state[i].vars = vars
+		iter.state[i].deadline = deadline
 	}
 	iter.state[0].init(context)
 	return &iter
 }
 
+// unionMatches returns the nodes matched by all alternatives of the
+// union p on the given context that filter accepts, if set, in document
+// order and without repetition. If limit is positive, at most limit
+// nodes are returned, with ErrLimitExceeded reported if there were more.
+// Evaluation fails with ErrTimeout past deadline, if set. Filter
+// expressions are evaluated upfront as well, by groupMatches.
+func (p *Path) unionMatches(context *Node, vars map[string]value, filter func(*Node) bool, limit int, deadline time.Time) (matches []Match, err error) {
+	if p.group != nil {
+		return p.groupMatches(context, vars, filter, limit, deadline)
+	}
+	for _, alt := range p.union {
+		iter := alt.iterUntil(context, vars, deadline).Filter(filter).Limit(limit)
+		for iter.Next() {
+			matches = append(matches, iter.Match())
+		}
+		if iter.err == ErrTimeout {
+			return nil, ErrTimeout
+		}
+		if iter.err != nil {
+			err = iter.err
+		}
+	}
+	matches = documentOrder(matches)
+	if limit > 0 && len(matches) > limit {
+		return matches[:limit], ErrLimitExceeded
+	}
+	return matches, err
+}
+
+// documentOrder sorts matches in document order and drops repeated nodes.
+func documentOrder(matches []Match) []Match {
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Node.pos < matches[j].Node.pos
+	})
+	n := 0
+	for i := range matches {
+		if n == 0 || matches[i].Node != matches[n-1].Node {
+			matches[n] = matches[i]
+			n++
+		}
+	}
+	return matches[:n]
+}
+
+// groupMatches returns the nodes matched by the filter expression p,
+// as documented in unionMatches. All nodes of the group are found before
+// its predicates are applied, as their positions are in document order
+// whatever the axes traversed to find them.
+func (p *Path) groupMatches(context *Node, vars map[string]value, filter func(*Node) bool, limit int, deadline time.Time) (matches []Match, err error) {
+	var group []Match
+	if p.group.call != nil {
+		ctx := exprContext{node: context, pos: 1, vars: vars, deadline: deadline, err: &err}
+		for _, node := range ctx.eval(p.group.call).nodes {
+			group = append(group, Match{Node: node, Step: p.path})
+		}
+		if err != nil {
+			return nil, err
+		}
+		if limit > 0 && len(group) > limit {
+			return nil, ErrLimitExceeded
+		}
+	} else {
+		iter := p.group.iterUntil(context, vars, deadline).Limit(limit)
+		for iter.Next() {
+			group = append(group, Match{Node: iter.Node(), Step: p.path})
+		}
+		if iter.err != nil {
+			return nil, iter.err
+		}
+	}
+	group = documentOrder(group)
+	for _, pred := range p.filter {
+		size := len(group)
+		kept := group[:0]
+		for i, match := range group {
+			ctx := exprContext{node: match.Node, pos: i + 1, last: size, vars: vars, deadline: deadline, err: &err}
+			if ctx.test(pred) {
+				kept = append(kept, match)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		group = kept
+	}
+	if p.rest != nil {
+		var found []Match
+		for _, match := range group {
+			iter := p.rest.iterUntil(match.Node, vars, deadline).Limit(limit)
+			for iter.Next() {
+				found = append(found, iter.Match())
+			}
+			if iter.err != nil {
+				return nil, iter.err
+			}
+		}
+		group = documentOrder(found)
+	}
+	for _, match := range group {
+		if filter != nil && !filter(match.Node) {
+			continue
+		}
+		if limit > 0 && len(matches) == limit {
+			return matches, ErrLimitExceeded
+		}
+		matches = append(matches, match)
+	}
+	return matches, nil
+}
+
+// absolute returns whether p is an absolute path, or a union or
+// coalescence of absolute paths, so that it matches the same nodes on any context.
+func (p *Path) absolute() bool {
+	if p.call != nil {
+		return false
+	}
+	if p.group != nil {
+		return p.group.absolute()
+	}
+	alts := p.union
+	if p.coalesce != nil {
+		alts = p.coalesce
+	}
+	for _, alt := range alts {
+		if !alt.absolute() {
+			return false
+		}
+	}
+	return alts != nil || p.steps[0].root
+}
+
+// any calls f with each node matched by p on the context node of ctx,
+// until f returns true, and returns whether it did. Errors found on the
+// way are reported to ctx.
+// Paths made of a single attribute step, as commonly found in predicates,
+// are served straight from the node slice without the allocations of a
+// full Iter.
+func (p *Path) any(ctx *exprContext, f func(*Node) bool) bool {
+	context := ctx.node
+	if len(p.steps) == 1 && p.steps[0].axis == "attribute" && !p.steps[0].root && p.steps[0].pred == nil {
+		for i := context.pos + 1; i < context.end; i++ {
+			node := context.nodes[i]
+			if node.kind != AttrNode {
+				break
+			}
+			if p.steps[0].match(node) && f(node) {
+				return true
+			}
+		}
+		return false
+	}
+	iter := ctx.iter(p)
+	for iter.Next() {
+		if f(iter.Node()) {
+			return true
+		}
+	}
+	ctx.fail(iter.err)
+	return false
+}
+
 // Exists returns whether any nodes match p on the given context.
 func (p *Path) Exists(context *Node) bool {
 	return p.Iter(context).Next()
 }
 
+// Matches returns whether node is one of the nodes matched by p when p
+// is applied to node itself or to any of its ancestors. This is the
+// notion of matching used by XSLT patterns: "h2" matches every h2 element,
+// and "div[@class='note']/p" every p element within such a div.
+func (p *Path) Matches(node *Node) bool {
+	for context := node; context != nil; context = context.up {
+		ctx := exprContext{node: context, pos: 1}
+		if p.any(&ctx, func(n *Node) bool { return n == node }) {
+			return true
+		}
+		if p.absolute() {
+			// Same outcome for every context.
+			break
+		}
+	}
+	return false
+}
+
 // String returns the string value of the first node matched
 // by p on the given context.
 //
@@ -41,7 +369,7 @@ func (p *Path) Exists(context *Node) bool {
 func (p *Path) String(context *Node) (s string, ok bool) {
 	iter := p.Iter(context)
 	if iter.Next() {
-		return iter.Node().String(), true
+		return iter.Node().textString(p.text), true
 	}
 	return "", false
 }
@@ -53,20 +381,219 @@ func (p *Path) String(context *Node) (s string, ok bool) {
 func (p *Path) Bytes(node *Node) (b []byte, ok bool) {
 	iter := p.Iter(node)
 	if iter.Next() {
+		if p.text != deepText {
+			return []byte(iter.Node().textString(p.text)), true
+		}
 		return iter.Node().Bytes(), true
 	}
 	return nil, false
 }
 
+// Slice returns the nodes matched by p on the given context from
+// index i up to but not including index j, with indexes starting
+// at zero as in Go slices. Iteration stops once the node at index
+// j-1 is found, so table rows past the wanted range are never
+// evaluated. Fewer than j-i nodes are returned if the node set
+// is not large enough.
+func (p *Path) Slice(context *Node, i, j int) []*Node {
+	if i < 0 || j < i {
+		panic(fmt.Sprintf("xmlpath: invalid slice indexes %d:%d", i, j))
+	}
+	var nodes []*Node
+	iter := p.Iter(context)
+	for n := 0; n < j && iter.Next(); n++ {
+		if n >= i {
+			nodes = append(nodes, iter.Node())
+		}
+	}
+	return nodes
+}
+
 // Iter iterates over node sets.
 type Iter struct {
-	state []pathStepState
-	seen  []bool
+	context *Node
+	state   []pathStepState
+	seen    []bool
+	count   int
+
+	// union is set when iterating over a union, with matches holding
+	// all of its nodes in document order once matched is set, and
+	// index being the one after the current match. pending is the
+	// error to report once matches are over.
+	union   *Path
+	matches []Match
+	matched bool
+	pending error
+	index   int
+
+	// filter, if set, must accept nodes for them to be iterated over.
+	filter func(*Node) bool
+
+	// limit, if positive, is the number of nodes that may be iterated
+	// over before failing with ErrLimitExceeded.
+	limit int
+	err   error
+
+	// deadline, if set, is when iteration fails with ErrTimeout.
+	deadline time.Time
+
+	// vars holds the values of variables, if set via IterWithVars.
+	vars map[string]value
+}
+
+// ErrLimitExceeded is reported by Iter.Err when a path matches more
+// nodes than the limit set via Iter.Limit.
+var ErrLimitExceeded = errors.New("xmlpath: result set limit exceeded")
+
+// ErrTimeout is reported by Iter.Err when evaluating a path takes
+// longer than the timeout set via Path.WithTimeout.
+var ErrTimeout = errors.New("xmlpath: evaluation timed out")
+
+// Match holds details about a node matched by a path.
+type Match struct {
+	// Node is the matched node.
+	Node *Node
+
+	// Position is the 1-based position of Node within the node set,
+	// in iteration order.
+	Position int
+
+	// Step is the text of the location step, including any predicate,
+	// that selected Node. For example, "character[@id='PP']" in
+	// "/library/book/character[@id='PP']".
+	Step string
+}
+
+// Match returns details about the current node.
+// Must only be called after Iter.Next returns true.
+func (iter *Iter) Match() Match {
+	if iter.union != nil {
+		match := iter.matches[iter.unionIndex()]
+		match.Position = iter.count
+		return match
+	}
+	return Match{
+		Node:     iter.Node(),
+		Position: iter.count,
+		Step:     iter.state[len(iter.state)-1].step.text,
+	}
+}
+
+// Filter makes iter skip the nodes that fn returns false for, as if
+// they weren't part of the node set, and returns iter. It allows
+// refining the nodes selected by a path with Go code, such as for
+// applying regular expressions or business rules, without collecting
+// the nodes first. Positions reported by Match count accepted nodes
+// alone. Filter must be called before iterating.
+//
+// For example:
+//
+//	iter := path.Iter(root).Filter(func(node *xmlpath.Node) bool {
+//		return re.MatchString(node.String())
+//	})
+//	for iter.Next() {
+//		...
+//	}
+func (iter *Iter) Filter(fn func(*Node) bool) *Iter {
+	iter.filter = fn
+	return iter
+}
+
+// Limit makes iter stop with ErrLimitExceeded reported by Err if the
+// node set has more than n nodes, and returns iter. Once n nodes are
+// iterated over, finding another one fails rather than returning it,
+// and unions never hold more than n nodes from each alternative in
+// memory, which protects services evaluating user supplied paths from
+// materializing huge node sets. Likewise, filter expressions such as
+// "(//a)[1]" fail outright once their parenthesized path exceeds n nodes.
+// Limit must be called before iterating.
+//
+// For example:
+//
+//	iter := path.Iter(root).Limit(1000)
+//	for iter.Next() {
+//		...
+//	}
+//	if err := iter.Err(); err != nil {
+//		return err
+//	}
+func (iter *Iter) Limit(n int) *Iter {
+	iter.limit = n
+	return iter
+}
+
+// Err returns ErrLimitExceeded if iteration stopped for exceeding
+// the limit set via Limit, ErrTimeout if it stopped for exceeding the
+// timeout set via Path.WithTimeout, or nil otherwise.
+func (iter *Iter) Err() error {
+	return iter.err
+}
+
+// IterFunc returns an iterator over the nodes that p matches on the
+// given context and that fn returns true for. It's a shorthand for
+// p.Iter(context).Filter(fn).
+func (p *Path) IterFunc(context *Node, fn func(*Node) bool) *Iter {
+	return p.Iter(context).Filter(fn)
+}
+
+// Reset rewinds iter so that the following call to Next returns
+// the first node in the set again.
+func (iter *Iter) Reset() {
+	iter.err = nil
+	if iter.union != nil {
+		iter.count = 0
+		iter.index = 0
+		return
+	}
+	for i := range iter.seen {
+		iter.seen[i] = false
+	}
+	for i := range iter.state {
+		iter.state[i].init(nil)
+	}
+	iter.state[0].init(iter.context)
+	iter.count = 0
+}
+
+// Clone returns an independent copy of iter positioned at the same
+// node. Advancing either iterator does not affect the other, so Clone
+// may be used to look ahead in the node set without losing the
+// current position.
+func (iter *Iter) Clone() *Iter {
+	if iter.union != nil {
+		clone := *iter
+		return &clone
+	}
+	clone := Iter{
+		context:  iter.context,
+		state:    make([]pathStepState, len(iter.state)),
+		count:    iter.count,
+		filter:   iter.filter,
+		limit:    iter.limit,
+		err:      iter.err,
+		deadline: iter.deadline,
+		vars:     iter.vars,
+	}
+	copy(clone.state, iter.state)
+	for i := range clone.state {
+		if state := &clone.state[i]; state.chainPos != nil {
+			state.chainPos = append([]int(nil), state.chainPos...)
+			state.chainSize = append([]int(nil), state.chainSize...)
+		}
+	}
+	if iter.seen != nil {
+		clone.seen = make([]bool, len(iter.seen))
+		copy(clone.seen, iter.seen)
+	}
+	return &clone
 }
 
 // Node returns the current node.
 // Must only be called after Iter.Next returns true.
 func (iter *Iter) Node() *Node {
+	if iter.union != nil {
+		return iter.matches[iter.unionIndex()].Node
+	}
 	state := iter.state[len(iter.state)-1]
 	if state.pos == 0 {
 		panic("Iter.Node called before Iter.Next")
@@ -77,13 +604,45 @@ func (iter *Iter) Node() *Node {
 	return state.node
 }
 
+// unionIndex returns the index of the current node in iter.matches.
+func (iter *Iter) unionIndex() int {
+	if iter.index == 0 {
+		panic("Iter.Node called before Iter.Next")
+	}
+	if iter.index > len(iter.matches) {
+		panic("Iter.Node called after Iter.Next false")
+	}
+	return iter.index - 1
+}
+
 // Next iterates to the next node in the set, if any, and
 // returns whether there is a node available.
 func (iter *Iter) Next() bool {
+	if iter.err != nil {
+		return false
+	}
+	if iter.union != nil {
+		if !iter.matched {
+			iter.matches, iter.pending = iter.union.unionMatches(iter.context, iter.vars, iter.filter, iter.limit, iter.deadline)
+			iter.matched = true
+		}
+		if iter.index < len(iter.matches) {
+			iter.index++
+			iter.count++
+			return true
+		}
+		iter.index = len(iter.matches) + 1
+		iter.err = iter.pending
+		return false
+	}
 	tip := len(iter.state) - 1
 outer:
 	for {
 		for !iter.state[tip].next() {
+			if err := iter.state[tip].failure(); err != nil {
+				iter.err = err
+				return false
+			}
 			tip--
 			if tip == -1 {
 				return false
@@ -93,17 +652,30 @@ outer:
 			tip++
 			iter.state[tip].init(iter.state[tip-1].node)
 			if !iter.state[tip].next() {
+				if err := iter.state[tip].failure(); err != nil {
+					iter.err = err
+					return false
+				}
 				tip--
 				continue outer
 			}
 		}
-		if iter.seen[iter.state[tip].node.pos] {
+		if iter.seen != nil {
+			if iter.seen[iter.state[tip].node.pos] {
+				continue
+			}
+			iter.seen[iter.state[tip].node.pos] = true
+		}
+		if iter.filter != nil && !iter.filter(iter.state[tip].node) {
 			continue
 		}
-		iter.seen[iter.state[tip].node.pos] = true
+		if iter.limit > 0 && iter.count == iter.limit {
+			iter.err = ErrLimitExceeded
+			return false
+		}
+		iter.count++
 		return true
 	}
-	panic("unreachable")
 }
 
 type pathStepState struct {
@@ -112,6 +684,33 @@ type pathStepState struct {
 	pos  int
 	idx  int
 	aux  int
+
+	// from is the context node the step started from, and size
+	// the number of nodes selected by the step from it before
+	// the predicate is considered, when known.
+	from *Node
+	size int
+
+	// chainPos holds the position of the current node among those
+	// satisfying the predicates before each of the chained ones, and
+	// chainSize the number of such nodes, when known. level is set
+	// while a chained predicate is being tested, to its index plus one.
+	chainPos  []int
+	chainSize []int
+	level     int
+
+	// deadline, if set, is when the step stops finding nodes, with
+	// expired set. ticks counts the nodes considered, so that the
+	// time is only checked every so often.
+	deadline time.Time
+	ticks    int
+	expired  bool
+
+	// err holds the first error found while testing predicates,
+	// which stops the step from finding further nodes.
+	err error
+
+	vars map[string]value
 }
 
 func (s *pathStepState) init(node *Node) {
@@ -119,75 +718,112 @@ func (s *pathStepState) init(node *Node) {
 	s.pos = 0
 	s.idx = 0
 	s.aux = 0
+	s.from = node
+	s.size = 0
+	s.expired = false
+	s.err = nil
+	for i := range s.chainPos {
+		s.chainPos[i] = 0
+		s.chainSize[i] = 0
+	}
 }
 
 func (s *pathStepState) next() bool {
-	for s._next() {
+	for {
+		if s.step.maxpos != 0 && (s.step.maxpos < 0 || s.pos >= s.step.maxpos) {
+			// No further nodes can satisfy the predicate.
+			s.node = nil
+			return false
+		}
+		if !s.deadline.IsZero() {
+			if s.ticks%64 == 0 && time.Now().After(s.deadline) {
+				s.node = nil
+				s.expired = true
+				return false
+			}
+			s.ticks++
+		}
+		if !s._next() {
+			return false
+		}
 		s.pos++
-		if s.step.pred == nil || s.test(s.step.pred) {
+		ok := s.step.pred == nil || s.test(s.step.pred, s.pos) && s.chain()
+		if s.err != nil {
+			s.node = nil
+			return false
+		}
+		if ok {
 			return true
 		}
 	}
-	return false
 }
 
-func (s *pathStepState) test(pred predicate) bool {
-	switch pred := pred.(type) {
-	case positionPredicate:
-		if pred.operator(pred.pos, s.pos) {
-			return true
-		}
-	case existsPredicate:
-		if pred.path.Exists(s.node) {
-			return true
-		}
-	case equalsPredicate:
-		iter := pred.path.Iter(s.node)
-		for iter.Next() {
-			if iter.Node().equals(pred.value) {
-				return true
-			}
-		}
-	case notequalsPredicate:
-		iter := pred.path.Iter(s.node)
-		for iter.Next() {
-			if !iter.Node().equals(pred.value) {
-				return true
-			}
-		}
-	case containsPredicate:
-		iter := pred.path.Iter(s.node)
-		for iter.Next() {
-			if iter.Node().contains(pred.value) {
-				return true
-			}
-		}
-	case startsWithPredicate:
-		iter := pred.path.Iter(s.node)
-		for iter.Next() {
-			if iter.Node().startsWith(pred.value) {
-				return true
-			}
+// failure returns the error that stopped the step from finding
+// further nodes, if any.
+func (s *pathStepState) failure() error {
+	if s.expired {
+		return ErrTimeout
+	}
+	return s.err
+}
+
+func (s *pathStepState) test(pred predicate, pos int) bool {
+	ctx := exprContext{node: s.node, pos: pos, state: s, vars: s.vars, deadline: s.deadline, err: &s.err}
+	return ctx.test(pred)
+}
+
+// chain tests the current node against the predicates chained after
+// the first one, in order, each of them filtering the nodes left by
+// the ones before it, with positions taken among those nodes.
+func (s *pathStepState) chain() bool {
+	if len(s.step.chain) == 0 {
+		return true
+	}
+	if s.chainPos == nil {
+		s.chainPos = make([]int, len(s.step.chain))
+		s.chainSize = make([]int, len(s.step.chain))
+	}
+	for i, pred := range s.step.chain {
+		s.chainPos[i]++
+		s.level = i + 1
+		ok := s.test(pred, s.chainPos[i])
+		s.level = 0
+		if !ok {
+			return false
 		}
-	case notPredicate:
-		return !s.test(pred.uniSub)
-	case andPredicate:
-		for _, sub := range pred.sub {
-			if !s.test(sub) {
-				return false
+	}
+	return true
+}
+
+// contextSize returns the number of nodes selected by the step
+// before its predicate is considered, as needed by last(). While
+// a chained predicate is being tested, it's the number of nodes
+// satisfying the predicates before it instead.
+func (s *pathStepState) contextSize() int {
+	if s.level > 0 {
+		i := s.level - 1
+		if s.chainSize[i] == 0 {
+			step := *s.step
+			step.chain = step.chain[:i]
+			count := pathStepState{step: &step, vars: s.vars}
+			count.init(s.from)
+			for count.next() {
+				s.chainSize[i]++
 			}
 		}
-		return true
-	case orPredicate:
-		for _, sub := range pred.sub {
-			if s.test(sub) {
-				return true
-			}
+		return s.chainSize[i]
+	}
+	if s.size == 0 {
+		step := *s.step
+		step.pred = nil
+		step.maxpos = 0
+		count := pathStepState{step: &step}
+		count.init(s.from)
+		for count.next() {
+			s.size++
 		}
-	default:
-		panic(fmt.Sprintf("internal error: unknown predicate type: %#v", s.step.pred))
 	}
-	return false
+	return s.size
 }
 
 func (s *pathStepState) _next() bool {
@@ -255,9 +891,9 @@ func (s *pathStepState) _next() bool {
 			}
 		}
 		for s.idx < s.aux {
-			node := &s.node.nodes[s.idx]
+			node := s.node.nodes[s.idx]
 			s.idx++
-			if node.kind == AttrNode {
+			if node.kind == AttrNode || node.kind == NamespaceNode {
 				continue
 			}
 			if s.step.match(node) {
@@ -271,9 +907,9 @@ func (s *pathStepState) _next() bool {
 			s.idx = s.node.end
 		}
 		for s.idx < len(s.node.nodes) {
-			node := &s.node.nodes[s.idx]
+			node := s.node.nodes[s.idx]
 			s.idx++
-			if node.kind == AttrNode {
+			if node.kind == AttrNode || node.kind == NamespaceNode {
 				continue
 			}
 			if s.step.match(node) {
@@ -307,13 +943,18 @@ func (s *pathStepState) _next() bool {
 
 	case "preceding":
 		if s.idx == 0 {
-			s.aux = s.node.pos // Detect ancestors.
-			s.idx = s.node.pos - 1
+			from := s.node
+			if from.implicit() {
+				// Its element and the content of it aren't preceding.
+				from = from.up
+			}
+			s.aux = from.pos // Detect ancestors.
+			s.idx = from.pos - 1
 		}
 		for s.idx >= 0 {
-			node := &s.node.nodes[s.idx]
+			node := s.node.nodes[s.idx]
 			s.idx--
-			if node.kind == AttrNode {
+			if node.kind == AttrNode || node.kind == NamespaceNode {
 				continue
 			}
 			if node == s.node.nodes[s.aux].up {
@@ -332,17 +973,18 @@ func (s *pathStepState) _next() bool {
 			down = s.node.up.down
 			if s.aux == 0 {
 				s.aux = 1
-				for s.idx < len(down) {
-					node := down[s.idx]
-					s.idx++
-					if node == s.node {
-						s.idx--
-						break
-					}
+				i := 0
+				for i < len(down) && down[i] != s.node {
+					i++
+				}
+				// Attributes are not found, and have no siblings.
+				s.idx = i - 1
+				if i == len(down) {
+					s.idx = -1
 				}
 			}
 		}
-		for s.idx >= 0 {
+		for s.idx >= 0 && s.idx < len(down) {
 			node := down[s.idx]
 			s.idx--
 			if s.step.match(node) {
@@ -351,13 +993,74 @@ func (s *pathStepState) _next() bool {
 			}
 		}
 
+	case "descendant-attribute":
+		if s.idx == 0 {
+			if s.node.kind != StartNode {
+				break
+			}
+			s.idx = s.node.pos + 1
+			s.aux = s.node.end
+		}
+		for s.idx < s.aux {
+			node := s.node.nodes[s.idx]
+			s.idx++
+			if node.kind == AttrNode && s.step.match(node) {
+				s.node = node
+				return true
+			}
+		}
+
+	case "namespace":
+		// Namespace nodes are those declared by the element or its
+		// ancestors and not redeclared in between, except for
+		// undeclarations, followed by the one for the xml prefix
+		// unless declared explicitly. Once past the first call, the
+		// element being scanned is the one holding the last node
+		// checked, and idx is negative when done.
+		var elem *Node
+		if s.idx == 0 {
+			if s.node.kind != StartNode || s.node.up == nil {
+				break
+			}
+			elem = s.node
+			s.aux = elem.pos
+			s.idx = elem.namespaces()
+		} else if s.idx > 0 {
+			elem = s.node.nodes[s.idx-1].up
+		}
+		for elem != nil {
+			for s.idx < elem.end {
+				node := elem.nodes[s.idx]
+				if node.kind != NamespaceNode {
+					break
+				}
+				s.idx++
+				if node.attr != "" && s.step.match(node) && !redeclared(node.nodes[s.aux], node) {
+					s.node = node
+					return true
+				}
+			}
+			elem = elem.up
+			if elem != nil {
+				s.idx = elem.namespaces()
+			}
+		}
+		if s.idx > 0 {
+			s.idx = -1
+			ns := s.node.nodes[s.aux].xmlNamespace()
+			if ns != nil && s.step.match(ns) {
+				s.node = ns
+				return true
+			}
+		}
+
 	case "attribute":
 		if s.idx == 0 {
 			s.idx = s.node.pos + 1
 			s.aux = s.node.end
 		}
 		for s.idx < s.aux {
-			node := &s.node.nodes[s.idx]
+			node := s.node.nodes[s.idx]
 			s.idx++
 			if node.kind != AttrNode {
 				break
@@ -374,13 +1077,35 @@ func (s *pathStepState) _next() bool {
 	return false
 }
 
+// namespaces returns the position of the first namespace node
+// of node, if any, or of whatever follows its attributes.
+func (node *Node) namespaces() int {
+	i := node.pos + 1
+	for i < node.end && node.nodes[i].kind == AttrNode {
+		i++
+	}
+	return i
+}
+
+// redeclared returns whether the prefix declared by ns is declared
+// again by elem or its ancestors below the element declaring ns.
+func redeclared(elem, ns *Node) bool {
+	for ; elem != ns.up; elem = elem.up {
+		for i := elem.namespaces(); i < elem.end && elem.nodes[i].kind == NamespaceNode; i++ {
+			if elem.nodes[i].name.Local == ns.name.Local {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type positionPredicate struct {
 	pos      int
 	operator positionFunc
-}
 
-type existsPredicate struct {
-	path *Path
+	// max is the last position satisfying the predicate, if bounded.
+	max int
 }
 
 type equalsPredicate struct {
@@ -402,6 +1127,24 @@ type startsWithPredicate struct {
 	value string
 }
 
+// comparePredicate compares the nodes in path as numbers
+// against value, succeeding if any of them satisfies operator.
+type comparePredicate struct {
+	path     *Path
+	operator string
+	value    float64
+}
+
+type normalizedEqualsPredicate struct {
+	path  *Path
+	value string
+}
+
+type normalizedNotequalsPredicate struct {
+	path  *Path
+	value string
+}
+
 type notPredicate struct {
 	uniSub predicate
 }
@@ -419,15 +1162,17 @@ type predicate interface {
 	predicate()
 }
 
-func (positionPredicate) predicate()   {}
-func (existsPredicate) predicate()     {}
-func (equalsPredicate) predicate()     {}
-func (notequalsPredicate) predicate()  {}
-func (containsPredicate) predicate()   {}
-func (startsWithPredicate) predicate() {}
-func (notPredicate) predicate()        {}
-func (andPredicate) predicate()        {}
-func (orPredicate) predicate()         {}
+func (positionPredicate) predicate()            {}
+func (equalsPredicate) predicate()              {}
+func (notequalsPredicate) predicate()           {}
+func (containsPredicate) predicate()            {}
+func (startsWithPredicate) predicate()          {}
+func (comparePredicate) predicate()             {}
+func (normalizedEqualsPredicate) predicate()    {}
+func (normalizedNotequalsPredicate) predicate() {}
+func (notPredicate) predicate()                 {}
+func (andPredicate) predicate()                 {}
+func (orPredicate) predicate()                  {}
 
 // positionFunc is a type interface for all position comparison operators
 type positionFunc func(wanted, current int) bool
@@ -439,18 +1184,152 @@ func smallerPosition(wanted, current int) bool      { return current < wanted }
 func largerequalPosition(wanted, current int) bool  { return current >= wanted }
 func smallerequalPosition(wanted, current int) bool { return current <= wanted }
 
+// compareNumbers returns whether a and b satisfy the comparison
+// operator. As per IEEE 754, comparisons involving NaN only hold
+// for "!=".
+func compareNumbers(operator string, a, b float64) bool {
+	switch operator {
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	panic("internal error: unknown operator " + operator)
+}
+
 type pathStep struct {
+	text string
 	root bool
 	axis string
 	name string
 	kind NodeKind
 	pred predicate
+
+	// chain holds the predicates following the first one, as in
+	// "a[@b][1]", which is held in pred.
+	chain []predicate
+
+	// space is the namespace URI nodes must be in when the name
+	// was qualified by a prefix, as flagged by qualified, while
+	// anySpace is set for names qualified by the "*" wildcard.
+	space     string
+	qualified bool
+	anySpace  bool
+
+	// maxpos, when not zero, is the last position that may
+	// satisfy pred, so iteration over the axis can stop there.
+	maxpos int
+}
+
+// isDescendantOrSelfNode returns whether step is a plain
+// descendant-or-self::node() step, as produced by "//".
+func (step *pathStep) isDescendantOrSelfNode() bool {
+	return step.axis == "descendant-or-self" && step.name == "*" && step.kind == AnyNode && step.pred == nil
+}
+
+// positional returns whether the nodes selected by step may depend
+// on their position, due to any of its predicates.
+func (step *pathStep) positional() bool {
+	if positional(step.pred) {
+		return true
+	}
+	for _, pred := range step.chain {
+		if positional(pred) {
+			return true
+		}
+	}
+	return false
 }
 
+// positional returns whether the outcome of pred may depend on the
+// position of the node being tested.
+func positional(pred predicate) bool {
+	switch pred := pred.(type) {
+	case positionPredicate:
+		return true
+	case notPredicate:
+		return positional(pred.uniSub)
+	case andPredicate:
+		for _, sub := range pred.sub {
+			if positional(sub) {
+				return true
+			}
+		}
+	case orPredicate:
+		for _, sub := range pred.sub {
+			if positional(sub) {
+				return true
+			}
+		}
+	case numberPredicate:
+		return true
+	case negExpr:
+		return positional(pred.sub)
+	case arithExpr:
+		return positional(pred.left) || positional(pred.right)
+	case compareExpr:
+		return positional(pred.left) || positional(pred.right)
+	case regexpExpr:
+		return positional(pred.sub)
+	case callExpr:
+		if pred.name == "position" || pred.name == "last" {
+			return true
+		}
+		for _, arg := range pred.args {
+			if positional(arg) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maxPosition returns the last position that may satisfy pred,
+// zero if there's no such bound, or -1 if no position does.
+func maxPosition(pred predicate) int {
+	switch pred := pred.(type) {
+	case positionPredicate:
+		return pred.max
+	case andPredicate:
+		max := 0
+		for _, sub := range pred.sub {
+			if m := maxPosition(sub); m != 0 && (max == 0 || m < max) {
+				max = m
+			}
+		}
+		return max
+	case orPredicate:
+		max := -1
+		for _, sub := range pred.sub {
+			m := maxPosition(sub)
+			if m == 0 {
+				return 0
+			}
+			if m > max {
+				max = m
+			}
+		}
+		return max
+	}
+	return 0
+}
+
+// match returns whether node passes the node test of step. The root
+// node is not an element, so element tests such as * never match it.
 func (step *pathStep) match(node *Node) bool {
 	return node.kind != EndNode &&
 		(step.kind == AnyNode || step.kind == node.kind) &&
-		(step.name == "*" || node.name.Local == step.name)
+		(step.kind != StartNode || node.name.Local != "") &&
+		(step.name == "*" || node.name.Local == step.name) &&
+		(!step.qualified || node.name.Space == step.space)
 }
 
 // MustCompile returns the compiled path, and panics if
@@ -465,7 +1344,110 @@ func MustCompile(path string) *Path {
 
 // Compile returns the compiled path.
 func Compile(path string) (*Path, error) {
-	c := pathCompiler{path, 0}
+	return compile(path, CompileOptions{})
+}
+
+// CompileOptions tune how paths are compiled.
+type CompileOptions struct {
+	// Namespaces, if set, binds the prefixes accepted in names to
+	// namespace URIs, as done by CompileWithNamespaces.
+	Namespaces map[string]string
+
+	// DefaultNamespace, if set, is the namespace URI of elements
+	// named without a prefix, so that paths such as //entry/title
+	// match elements in the default namespace of Atom documents
+	// alone. Otherwise names without a prefix match elements by
+	// their local name, whatever their namespace. Names of
+	// attributes are never affected.
+	DefaultNamespace string
+
+	// ShallowText makes the string value of elements the text of
+	// their own text children only, rather than all text within them,
+	// wherever the path takes it: in comparisons and function arguments
+	// within predicates, and in the results of Path.String and
+	// Path.Bytes. With it, //div[. = 'x'] matches <div>x<p>y</p></div>.
+	ShallowText bool
+
+	// HTMLText makes the string value of elements leave out the text
+	// within the script, style and template elements inside them, as
+	// commonly wanted for trees parsed by ParseHTML, so that predicates
+	// such as contains(., 'keyword') don't match scripts. It's taken
+	// wherever ShallowText would be, and has no effect along with it,
+	// as the text of elements inside others is then left out anyway.
+	HTMLText bool
+
+	// Loader, if set, enables the document() function, which returns
+	// the root nodes of the documents at the URLs given to it, loaded
+	// via Loader, with relative URLs resolved against BaseURL. Paths
+	// may then select nodes from other documents, as in
+	// //item[@sku = document('blocked.xml')//sku]. Documents are loaded
+	// within the timeout of the path, if set, and the first one failing
+	// to load stops evaluation, with the error reported by Iter.Err.
+	// Documents are loaded anew whenever document() is evaluated, so
+	// loaders caching documents suit paths evaluating it on many context
+	// nodes. An HTTPLoader with CacheTTL set hands document() the trees
+	// it caches rather than copies of them, so the nodes selected from
+	// those must not be changed. document() is not available otherwise,
+	// as paths from untrusted sources could fetch any URL.
+	Loader  DocumentLoader
+	BaseURL string
+}
+
+// Compile returns the path compiled with the options in o.
+func (o *CompileOptions) Compile(path string) (*Path, error) {
+	return compile(path, *o)
+}
+
+// MustCompile returns the path compiled with the options in o,
+// and panics if there are any errors.
+func (o *CompileOptions) MustCompile(path string) *Path {
+	e, err := o.Compile(path)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// MustCompileWithNamespaces returns the compiled path, and panics if
+// there are any errors.
+func MustCompileWithNamespaces(path string, namespaces map[string]string) *Path {
+	e, err := CompileWithNamespaces(path, namespaces)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// CompileWithNamespaces returns the compiled path, with names in it
+// qualified by the prefixes in namespaces matching the nodes in the
+// namespace URI each prefix is bound to, whatever prefix the document
+// uses for it. For example:
+//
+//	atom := map[string]string{"a": "http://www.w3.org/2005/Atom"}
+//	titles := xmlpath.MustCompileWithNamespaces("//a:entry/a:title", atom)
+//
+// Names without a prefix match nodes in any namespace, as in paths
+// compiled by Compile.
+func CompileWithNamespaces(path string, namespaces map[string]string) (*Path, error) {
+	if namespaces == nil {
+		namespaces = map[string]string{}
+	}
+	return compile(path, CompileOptions{Namespaces: namespaces})
+}
+
+func compile(path string, opts CompileOptions) (*Path, error) {
+	c := pathCompiler{
+		path:             path,
+		namespaces:       opts.Namespaces,
+		defaultNamespace: opts.DefaultNamespace,
+		loader:           opts.Loader,
+		baseURL:          opts.BaseURL,
+	}
+	if opts.ShallowText {
+		c.text = shallowText
+	} else if opts.HTMLText {
+		c.text = htmlText
+	}
 	if path == "" {
 		return nil, c.errorf("empty path")
 	}
@@ -473,32 +1455,170 @@ func Compile(path string) (*Path, error) {
 	if err != nil {
 		return nil, err
 	}
+	if c.i < len(c.path) {
+		return nil, c.errorf("unexpected %q", c.path[c.i])
+	}
 	return p, nil
 }
 
 type pathCompiler struct {
 	path string
 	i    int
+
+	// namespaces binds prefixes to namespace URIs, if prefixes
+	// are accepted in names, and defaultNamespace is the namespace
+	// of elements named without a prefix, if any.
+	namespaces       map[string]string
+	defaultNamespace string
+
+	// text is how the string value of elements is taken.
+	text textMode
+
+	// loader loads the documents referenced by document(), with
+	// relative URLs resolved against baseURL.
+	loader  DocumentLoader
+	baseURL string
+}
+
+// CompileError is returned when compiling an invalid path or
+// expression, and locates the problem within it.
+type CompileError struct {
+	// Path is the text compiled, and Offset the byte offset within
+	// it where the problem was found.
+	Path   string
+	Offset int
+
+	// Msg describes the problem, such as "missing name".
+	Msg string
+}
+
+func (e *CompileError) Error() string {
+	return fmt.Sprintf("compiling xml path %q:%d: %s", e.Path, e.Offset, e.Msg)
 }
 
 func (c *pathCompiler) errorf(format string, args ...interface{}) error {
-	return fmt.Errorf("compiling xml path %q:%d: %s", c.path, c.i, fmt.Sprintf(format, args...))
+	return &CompileError{Path: c.path, Offset: c.i, Msg: fmt.Sprintf(format, args...)}
 }
 
-func (c *pathCompiler) parsePath() (path *Path, err error) {
+// parsePath parses a location path, or a union of location
+// paths joined by "|".
+func (c *pathCompiler) parsePath() (*Path, error) {
+	start := c.i
+	path, err := c.parsePathExpr()
+	if err != nil {
+		return nil, err
+	}
+	c.skipSpaces()
+	if !c.peekByte('|') {
+		return path, nil
+	}
+	union := &Path{union: []*Path{path}, text: c.text}
+	for c.skipByte('|') {
+		path, err := c.parsePathExpr()
+		if err != nil {
+			return nil, err
+		}
+		union.union = append(union.union, path)
+		c.skipSpaces()
+	}
+	union.path = strings.TrimSpace(c.path[start:c.i])
+	return union, nil
+}
+
+// parsePathExpr parses a location path, or a filter expression made of
+// a parenthesized path followed by predicates or location steps.
+func (c *pathCompiler) parsePathExpr() (*Path, error) {
+	c.skipSpaces()
+	start := c.i
+	if c.skipName() {
+		name := c.path[start:c.i]
+		c.skipSpaces()
+		if c.peekByte('(') && !isNodeType(name) {
+			call, err := c.parseCall(name)
+			if err != nil {
+				return nil, err
+			}
+			return c.parseCallFilter(call, start)
+		}
+		c.i = start
+	}
+	if !c.peekByte('(') {
+		return c.parseLocationPath(false)
+	}
+	c.skipByte('(')
+	c.skipSpaces()
+	group, err := c.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	if !c.skipByte(')') {
+		return nil, c.errorf("expected ')'")
+	}
+	return c.parseFilter(group, start)
+}
+
+// parseFilter parses the predicates and location steps following
+// group, a parenthesized path starting at offset start.
+func (c *pathCompiler) parseFilter(group *Path, start int) (*Path, error) {
+	c.skipSpaces()
+	p := &Path{group: group, text: c.text}
+	for c.skipByte('[') {
+		pred, err := c.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if pred, err = c.stepPredicate(pred); err != nil {
+			return nil, err
+		}
+		if !c.skipByte(']') {
+			return nil, c.errorf("expected ']'")
+		}
+		c.skipSpaces()
+		p.filter = append(p.filter, pred)
+	}
+	if c.skipByte('/') {
+		rest, err := c.parseLocationPath(true)
+		if err != nil {
+			return nil, err
+		}
+		p.rest = rest
+	}
+	if p.filter == nil && p.rest == nil && group.call == nil {
+		return group, nil
+	}
+	p.path = strings.TrimSpace(c.path[start:c.i])
+	return p, nil
+}
+
+// parseCallFilter parses the predicates and location steps following
+// call, a call to a function starting at offset start, as in id('a')/b.
+func (c *pathCompiler) parseCallFilter(call predicate, start int) (*Path, error) {
+	text := strings.TrimSpace(c.path[start:c.i])
+	if kindOf(call) != nodeSetValue {
+		c.i = start
+		return nil, c.errorf("%s does not select nodes", text)
+	}
+	return c.parseFilter(&Path{call: call, path: text, text: c.text}, start)
+}
+
+// parseLocationPath parses a location path, which is taken as relative
+// to the context node even if it starts with "/" when relative is set,
+// as done for the steps after the first "/" in "(//a)//b".
+func (c *pathCompiler) parseLocationPath(relative bool) (path *Path, err error) {
 	var steps []pathStep
 	var start = c.i
 	for {
 		step := pathStep{axis: "child"}
 
 		c.skipSpaces()
-		if c.i == 0 && c.skipByte('/') {
+		if len(steps) == 0 && !relative && c.skipByte('/') {
 			c.skipSpaces()
 			step.root = true
-			if len(c.path) == 1 {
+			if c.i == len(c.path) || c.peekByte('|') {
 				step.name = "*"
 			}
 		}
+		stepStart := c.i
 		if c.peekByte('/') {
 			step.axis = "descendant-or-self"
 			step.name = "*"
@@ -510,10 +1630,16 @@ func (c *pathCompiler) parsePath() (path *Path, err error) {
 			step.axis = "attribute"
 			step.name = c.path[mark:c.i]
 			step.kind = AttrNode
+			if err := c.parsePrefixed(&step); err != nil {
+				return nil, err
+			}
 		} else {
 			mark := c.i
 			if c.skipName() {
 				step.name = c.path[mark:c.i]
+				if err := c.parsePrefixed(&step); err != nil {
+					return nil, err
+				}
 				c.skipSpaces()
 			}
 			if step.name == "" {
@@ -535,6 +1661,8 @@ func (c *pathCompiler) parsePath() (path *Path, err error) {
 					switch step.name {
 					case "attribute":
 						step.kind = AttrNode
+					case "namespace":
+						step.kind = NamespaceNode
 					case "self", "child", "parent":
 					case "descendant", "descendant-or-self":
 					case "ancestor", "ancestor-or-self":
@@ -550,9 +1678,15 @@ func (c *pathCompiler) parsePath() (path *Path, err error) {
 						return nil, c.errorf("missing name")
 					}
 					step.name = c.path[mark:c.i]
+					if err := c.parsePrefixed(&step); err != nil {
+						return nil, err
+					}
 
 					c.skipSpaces()
 				}
+				if (step.qualified || step.anySpace) && c.peekByte('(') {
+					return nil, c.errorf("unexpected '('")
+				}
 				if c.skipByte('(') {
 					c.skipSpaces()
 					conflict := step.kind != AnyNode
@@ -593,197 +1727,72 @@ func (c *pathCompiler) parsePath() (path *Path, err error) {
 				}
 			}
 		}
-		if c.skipByte('[') {
-			c.skipSpaces()
-			type state struct {
-				sub []predicate
-				and bool
-				not bool
-			}
-			var stack []state
-			var sub []predicate
-			var and bool
-		NextPred:
-			if c.skipByte('(') {
-				stack = append(stack, state{sub: sub, and: and})
-				sub = nil
-				and = false
-			}
-			var next predicate
-			if pos, ok := c.parseInt(); ok {
-				if pos == 0 {
-					return nil, c.errorf("positions start at 1")
-				}
-				next = positionPredicate{pos: pos, operator: equalPosition}
-			} else if c.skipString("position()") {
-				c.skipSpaces()
-				if operator, ok := c.parseOperator(); !ok {
-					return nil, c.errorf("position() not followed by operator")
-				} else {
-					var operatorFunc positionFunc
-					switch operator {
-					case "=":
-						operatorFunc = equalPosition
-					case "!=":
-						operatorFunc = notequalPosition
-					case "<=":
-						operatorFunc = smallerequalPosition
-					case ">=":
-						operatorFunc = largerequalPosition
-					case "<":
-						operatorFunc = smallerPosition
-					case ">":
-						operatorFunc = largerPosition
-					}
-
-					c.skipSpaces()
-					if pos, ok := c.parseInt(); !ok {
-						return nil, c.errorf("position() not followed by number")
-					} else {
-						if pos == 0 {
-							return nil, c.errorf("positions start at 1")
-						}
-						next = positionPredicate{pos: pos, operator: operatorFunc}
-					}
-				}
-			} else if c.skipString("contains(") {
-				path, err := c.parsePath()
-				if err != nil {
-					return nil, err
-				}
-				c.skipSpaces()
-				if !c.skipByte(',') {
-					return nil, c.errorf("contains() expected ',' followed by a literal string")
-				}
-				c.skipSpaces()
-				value, err := c.parseLiteral()
-				if err != nil {
-					return nil, err
-				}
-				c.skipSpaces()
-				if !c.skipByte(')') {
-					return nil, c.errorf("contains() missing ')'")
-				}
-				next = containsPredicate{path, value}
-			} else if c.skipString("starts-with(") {
-				path, err := c.parsePath()
-				if err != nil {
-					return nil, err
-				}
-				c.skipSpaces()
-				if !c.skipByte(',') {
-					return nil, c.errorf("starts-with() expected ',' followed by a literal string")
-				}
-				c.skipSpaces()
-				value, err := c.parseLiteral()
-				if err != nil {
-					return nil, err
-				}
-				c.skipSpaces()
-				if !c.skipByte(')') {
-					return nil, c.errorf("starts-with() missing ')'")
-				}
-				next = startsWithPredicate{path, value}
-			} else if c.skipString("not(") {
-				stack = append(stack, state{sub: sub, and: and, not: true})
-				sub = nil
-				and = false
-				goto NextPred
-			} else {
-				path, err := c.parsePath()
-				if err != nil {
-					return nil, err
-				}
-				if path.path[0] == '-' {
-					if _, err = strconv.Atoi(path.path); err == nil {
-						return nil, c.errorf("positions must be positive")
-					}
-				}
-				c.skipSpaces()
-				if c.skipByte('=') {
-					c.skipSpaces()
-					value, err := c.parseLiteral()
-					if err != nil {
-						return nil, c.errorf("%v", err)
-					}
-					next = equalsPredicate{path, value}
-				} else if c.skipString("!=") {
-					c.skipSpaces()
-					value, err := c.parseLiteral()
-					if err != nil {
-						return nil, c.errorf("%v", err)
-					}
-					next = notequalsPredicate{path, value}
-				} else {
-					next = existsPredicate{path}
-				}
+		for c.skipByte('[') {
+			pred, err := c.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if pred, err = c.stepPredicate(pred); err != nil {
+				return nil, err
 			}
-		HandleNext:
-			if and {
-				p := sub[len(sub)-1].(andPredicate)
-				p.sub = append(p.sub, next)
-				sub[len(sub)-1] = p
+			if step.pred == nil {
+				step.pred = pred
+				step.maxpos = maxPosition(pred)
 			} else {
-				sub = append(sub, next)
-			}
-			if c.skipSpaces() {
-				mark := c.i
-				if c.skipString("and") && c.skipSpaces() {
-					if !and {
-						and = true
-						sub[len(sub)-1] = andPredicate{[]predicate{sub[len(sub)-1]}}
-					}
-					goto NextPred
-				} else if c.skipString("or") && c.skipSpaces() {
-					and = false
-					goto NextPred
-				} else {
-					c.i = mark
-				}
+				step.chain = append(step.chain, pred)
 			}
-			if c.skipByte(')') {
-				if len(stack) == 0 {
+			if !c.skipByte(']') {
+				if c.skipByte(')') {
 					return nil, c.errorf("unexpected ')'")
 				}
-				if len(sub) == 1 {
-					next = sub[0]
-				} else {
-					next = orPredicate{sub}
-				}
-				s := stack[len(stack)-1]
-				stack = stack[:len(stack)-1]
-				sub = s.sub
-				and = s.and
-				if s.not {
-					next = notPredicate{next}
+				if c.i < len(c.path) {
+					return nil, c.errorf("unexpected %q", c.path[c.i])
 				}
-				goto HandleNext
-			}
-			if len(stack) > 0 {
-				return nil, c.errorf("expected ')'")
-			}
-			if len(sub) == 1 {
-				step.pred = sub[0]
-			} else {
-				step.pred = orPredicate{sub}
-			}
-			if !c.skipByte(']') {
 				return nil, c.errorf("expected ']'")
 			}
 			c.skipSpaces()
 		}
+		step.text = strings.TrimSpace(c.path[stepStart:c.i])
+		if c.defaultNamespace != "" && !step.qualified && !step.anySpace && step.kind == AnyNode && step.name != "*" && step.axis != "attribute" && step.axis != "namespace" {
+			step.space = c.defaultNamespace
+			step.qualified = true
+		}
+		if n := len(steps); n > 0 && step.axis == "attribute" && steps[n-1].isDescendantOrSelfNode() && !step.positional() {
+			// Turn "//@name" into a single scan over the subtree
+			// rather than an attribute lookup on every node in it.
+			step.root = steps[n-1].root
+			step.axis = "descendant-attribute"
+			steps = steps[:n-1]
+		} else if n > 0 && step.axis == "child" && steps[n-1].isDescendantOrSelfNode() && !step.positional() {
+			// Likewise, "//name" is the same as descendant::name
+			// when positions are not involved.
+			step.root = steps[n-1].root
+			step.axis = "descendant"
+			steps = steps[:n-1]
+		}
 		steps = append(steps, step)
 		//fmt.Printf("step: %#v\n", step)
 		if !c.skipByte('/') {
-			if (start == 0 || start == c.i) && c.i < len(c.path) {
+			if start == c.i && c.i < len(c.path) {
 				return nil, c.errorf("unexpected %q", c.path[c.i])
 			}
-			return &Path{steps: steps, path: c.path[start:c.i]}, nil
+			p := &Path{steps: steps, path: c.path[start:c.i], text: c.text}
+			for i := 1; i < len(steps); i++ {
+				switch steps[i].axis {
+				case "self", "child", "attribute":
+				default:
+					p.dedup = true
+				}
+			}
+			return p, nil
 		}
 	}
-	panic("unreachable")
 }
 
+// selfPath is the path used when a function argument defaults
+// to the context node.
+var selfPath = &Path{path: ".", steps: []pathStep{{axis: "self", name: "*"}}}
+
 var errNoLiteral = fmt.Errorf("expected a literal string")
 
 func (c *pathCompiler) parseLiteral() (string, error) {
@@ -804,41 +1813,22 @@ func (c *pathCompiler) parseLiteral() (string, error) {
 	return "", errNoLiteral
 }
 
-func (c *pathCompiler) parseInt() (v int, ok bool) {
+// parseNumber parses a number with an optional sign and fractional part.
+func (c *pathCompiler) parseNumber() (v float64, ok bool) {
 	mark := c.i
-	for c.i < len(c.path) && c.path[c.i] >= '0' && c.path[c.i] <= '9' {
-		v *= 10
-		v += int(c.path[c.i]) - '0'
+	c.skipByte('-')
+	digits := c.i
+	for c.i < len(c.path) && (isDigit(c.path[c.i]) || c.path[c.i] == '.') {
 		c.i++
 	}
-	if c.i == mark {
+	v = parseNumber(c.path[mark:c.i])
+	if c.i == digits || v != v {
+		c.i = mark
 		return 0, false
 	}
 	return v, true
 }
 
-func (c *pathCompiler) parseOperator() (v string, ok bool) {
-	if c.skipString("=") {
-		return "=", true
-	}
-	if c.skipString("!=") {
-		return "!=", true
-	}
-	if c.skipString(">=") {
-		return ">=", true
-	}
-	if c.skipString(">") {
-		return ">", true
-	}
-	if c.skipString("<=") {
-		return "<=", true
-	}
-	if c.skipString("<") {
-		return "<", true
-	}
-	return "", false
-}
-
 func (c *pathCompiler) skipByte(b byte) bool {
 	if c.i < len(c.path) && c.path[c.i] == b {
 		c.i++
@@ -861,6 +1851,10 @@ func (c *pathCompiler) peekByte(b byte) bool {
 	return c.i < len(c.path) && c.path[c.i] == b
 }
 
+func (c *pathCompiler) peekDigit() bool {
+	return c.i < len(c.path) && isDigit(c.path[c.i])
+}
+
 func (c *pathCompiler) skipSpaces() bool {
 	mark := c.i
 	for c.i < len(c.path) {
@@ -880,6 +1874,56 @@ func (c *pathCompiler) skipString(s string) bool {
 	return false
 }
 
+// skipOperator skips the named operator and any spaces following it,
+// if the operator is not just the start of a longer name.
+func (c *pathCompiler) skipOperator(op string) bool {
+	end := c.i + len(op)
+	if !strings.HasPrefix(c.path[c.i:], op) || end < len(c.path) && (c.path[end] >= utf8.RuneSelf || isNameByte(c.path[end])) {
+		return false
+	}
+	c.i = end
+	c.skipSpaces()
+	return true
+}
+
+// parsePrefixed parses the local part of a name qualified by the
+// prefix held in step.name, if the compiler is positioned at a colon
+// that doesn't start an axis separator, and either namespaces are
+// accepted or the prefix is "*" for any namespace.
+func (c *pathCompiler) parsePrefixed(step *pathStep) error {
+	if !c.peekByte(':') || c.i+1 < len(c.path) && c.path[c.i+1] == ':' {
+		return nil
+	}
+	prefix := step.name
+	if prefix == "*" {
+		// Any namespace, even with a default one.
+		c.i++
+		mark := c.i
+		if !c.skipName() {
+			return c.errorf("missing name after %q", prefix+":")
+		}
+		step.name = c.path[mark:c.i]
+		step.anySpace = true
+		return nil
+	}
+	if c.namespaces == nil {
+		return nil
+	}
+	uri, ok := c.namespaces[prefix]
+	if !ok {
+		return c.errorf("unknown namespace prefix %q", prefix)
+	}
+	c.i++
+	mark := c.i
+	if !c.skipName() {
+		return c.errorf("missing name after %q", prefix+":")
+	}
+	step.name = c.path[mark:c.i]
+	step.space = uri
+	step.qualified = true
+	return nil
+}
+
 func (c *pathCompiler) skipName() bool {
 	if c.i >= len(c.path) {
 		return false
@@ -895,6 +1939,10 @@ func (c *pathCompiler) skipName() bool {
 	return c.i > start
 }
 
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
 func isNameByte(c byte) bool {
 	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '_' || c == '.' || c == '-'
 }
@@ -0,0 +1,145 @@
+package xmlpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// PathConfig holds named path expressions along with the namespace
+// bindings shared by all of them, as commonly kept in configuration
+// files by applications with many selectors. It's read from JSON by
+// LoadPaths, and may be decoded from YAML by applications using a YAML
+// package, which would read a file such as:
+//
+//	namespaces:
+//	  a: http://www.w3.org/2005/Atom
+//	paths:
+//	  title: /a:feed/a:title
+//	  links: //a:entry/a:link/@href
+type PathConfig struct {
+	// Namespaces binds the prefixes accepted in the paths to
+	// namespace URIs, and DefaultNamespace is the namespace URI of
+	// elements named without a prefix, as in CompileOptions.
+	Namespaces       map[string]string `json:"namespaces,omitempty" yaml:"namespaces,omitempty"`
+	DefaultNamespace string            `json:"defaultNamespace,omitempty" yaml:"defaultNamespace,omitempty"`
+
+	// Paths holds the path expressions by name.
+	Paths map[string]string `json:"paths" yaml:"paths"`
+}
+
+// LoadPaths reads a PathConfig in JSON format from r, such as
+//
+//	{
+//		"namespaces": {"a": "http://www.w3.org/2005/Atom"},
+//		"paths": {
+//			"title": "/a:feed/a:title",
+//			"links": "//a:entry/a:link/@href"
+//		}
+//	}
+//
+// and compiles its paths as done by PathConfig.Compile. Unknown fields
+// are rejected, so that misspelled ones are not silently ignored.
+func LoadPaths(r io.Reader) (*PathSet, error) {
+	var config PathConfig
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		return nil, fmt.Errorf("xmlpath: reading paths: %w", err)
+	}
+	return config.Compile()
+}
+
+// Compile compiles all paths in config with its namespace bindings.
+// Rather than stopping at the first path that fails to compile, it
+// returns a *PathSetError reporting every one of them, so that all
+// mistakes in a configuration may be fixed at once.
+func (config *PathConfig) Compile() (*PathSet, error) {
+	opts := CompileOptions{
+		Namespaces:       config.Namespaces,
+		DefaultNamespace: config.DefaultNamespace,
+	}
+	if opts.Namespaces == nil {
+		// Accept prefixes, if only to report them as unknown.
+		opts.Namespaces = map[string]string{}
+	}
+	set := &PathSet{paths: make(map[string]*Path, len(config.Paths))}
+	for name := range config.Paths {
+		set.names = append(set.names, name)
+	}
+	sort.Strings(set.names)
+	var serr PathSetError
+	for _, name := range set.names {
+		path, err := compile(config.Paths[name], opts)
+		if err != nil {
+			serr.Names = append(serr.Names, name)
+			serr.Errors = append(serr.Errors, err.(*CompileError))
+			continue
+		}
+		set.paths[name] = path
+	}
+	if len(serr.Names) > 0 {
+		return nil, &serr
+	}
+	return set, nil
+}
+
+// PathSetError is returned by PathConfig.Compile and LoadPaths when any
+// of the paths in a configuration fails to compile.
+type PathSetError struct {
+	// Names holds the names of the paths failing to compile, in
+	// sorted order, and Errors the error found in each of them.
+	Names  []string
+	Errors []*CompileError
+}
+
+func (e *PathSetError) Error() string {
+	var b strings.Builder
+	if len(e.Names) == 1 {
+		b.WriteString("xmlpath: 1 path failed to compile:")
+	} else {
+		fmt.Fprintf(&b, "xmlpath: %d paths failed to compile:", len(e.Names))
+	}
+	for i, name := range e.Names {
+		fmt.Fprintf(&b, "\n\t%s: %v", name, e.Errors[i])
+	}
+	return b.String()
+}
+
+// Unwrap returns the errors found in each path.
+func (e *PathSetError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// PathSet holds paths compiled together by name, as returned by
+// PathConfig.Compile and LoadPaths.
+type PathSet struct {
+	names []string
+	paths map[string]*Path
+}
+
+// Names returns the names of the paths in the set, in sorted order.
+func (s *PathSet) Names() []string {
+	return append([]string(nil), s.names...)
+}
+
+// Path returns the path with the given name, or nil if there's none.
+func (s *PathSet) Path(name string) *Path {
+	return s.paths[name]
+}
+
+// MustPath returns the path with the given name, and panics if
+// there's none, for use with names known to be in the set.
+func (s *PathSet) MustPath(name string) *Path {
+	path, ok := s.paths[name]
+	if !ok {
+		panic(fmt.Sprintf("xmlpath: no path named %q in set", name))
+	}
+	return path
+}
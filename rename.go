@@ -0,0 +1,245 @@
+package xmlpath
+
+import (
+	"encoding/xml"
+	"strconv"
+)
+
+// Renamer renames and moves elements and attributes of a tree according
+// to rules expressed as paths, as commonly needed when normalizing feeds
+// that use different vocabularies for the same data.
+//
+// For example:
+//
+//	r := &xmlpath.Renamer{Rules: []xmlpath.RenameRule{
+//		{Path: xmlpath.MustCompile("entry"), Name: xml.Name{Local: "item"}},
+//		{Path: xmlpath.MustCompile("entry/@updated"), Name: xml.Name{Local: "modified"}},
+//		{Path: xmlpath.MustCompile("entry/link/@href"), To: xmlpath.MustCompile("..")},
+//	}}
+//	normalized := r.Rename(root)
+type Renamer struct {
+	// Rules are applied to each node in order, with only the
+	// first rule selecting a node applying to it.
+	Rules []RenameRule
+}
+
+// RenameRule is a rule for renaming and moving the elements or the
+// attributes selected by Path.
+type RenameRule struct {
+	// Path selects elements and attributes in the same way
+	// as done by Path.Matches.
+	Path *Path
+
+	// Name, if its local part is not empty, replaces the name of the
+	// nodes selected, including its namespace. Namespaces are changed
+	// by setting Space to the new namespace URI, which is declared on
+	// the renamed element, or on the element holding the renamed
+	// attribute, with a new prefix when no prefix is bound to it there.
+	Name xml.Name
+
+	// To, if set, selects the element that selected attributes are
+	// moved to, with the element holding the attribute as context.
+	// For example, ".." moves attributes to the parent element.
+	// Attributes are left in place if To doesn't select an element
+	// within the tree being renamed.
+	To *Path
+}
+
+// Rename returns a new tree holding a renamed copy of node and its
+// content, or of the content alone if node is a root node.
+// The tree node belongs to is not modified.
+func (r *Renamer) Rename(node *Node) *Node {
+	root := node.nodes[0]
+	rn := renaming{
+		b:     newBuilder(),
+		rule:  make([]*RenameRule, len(root.nodes)),
+		moved: make(map[int][]*Node),
+		away:  make([]bool, len(root.nodes)),
+	}
+	for i := len(r.Rules) - 1; i >= 0; i-- {
+		rule := &r.Rules[i]
+		for pos, marked := range matchMarks(root, []*Path{rule.Path}) {
+			if marked {
+				rn.rule[pos] = rule
+			}
+		}
+	}
+	for pos, rule := range rn.rule {
+		attr := root.nodes[pos]
+		if rule == nil || rule.To == nil || attr.kind != AttrNode {
+			continue
+		}
+		if pos < node.pos || pos >= node.end {
+			continue
+		}
+		iter := rule.To.Iter(attr.up)
+		if !iter.Next() {
+			continue
+		}
+		to := iter.Node()
+		if to.kind == StartNode && to.up != nil && to != attr.up && to.pos >= node.pos && to.pos < node.end {
+			rn.moved[to.pos] = append(rn.moved[to.pos], attr)
+			rn.away[pos] = true
+		}
+	}
+	if node.up == nil {
+		for _, down := range node.down {
+			rn.walk(down)
+		}
+	} else {
+		rn.walk(node)
+	}
+	return rn.b.finish()
+}
+
+type renaming struct {
+	b *builder
+
+	// rule holds the rule applying to each node, by position.
+	rule []*RenameRule
+
+	// moved holds the attributes moved into each element, by position
+	// of the element, and away marks all moved attributes.
+	moved map[int][]*Node
+	away  []bool
+
+	// scope holds the namespaces declared in the new tree by the
+	// elements being copied, from the outermost one.
+	scope []*Node
+}
+
+func (rn *renaming) name(node *Node) xml.Name {
+	if rule := rn.rule[node.pos]; rule != nil && rule.Name.Local != "" {
+		return rule.Name
+	}
+	return node.name
+}
+
+func (rn *renaming) walk(node *Node) {
+	switch node.kind {
+	case StartNode:
+		mark := len(rn.scope)
+		for i := node.namespaces(); i < node.end && node.nodes[i].kind == NamespaceNode; i++ {
+			rn.scope = append(rn.scope, node.nodes[i])
+		}
+		var attrs []*Node
+		for i := node.pos + 1; i < node.end && node.nodes[i].kind == AttrNode; i++ {
+			if !rn.away[i] {
+				attrs = append(attrs, node.nodes[i])
+			}
+		}
+		attrs = append(attrs, rn.moved[node.pos]...)
+		rn.declare(node)
+		for _, attr := range attrs {
+			rn.declare(attr)
+		}
+		rn.b.start(rn.name(node))
+		for _, attr := range attrs {
+			rn.b.attr(rn.name(attr), attr.attr)
+		}
+		for _, ns := range rn.scope[mark:] {
+			rn.b.namespace(ns.name.Local, ns.attr)
+		}
+		for _, down := range node.down {
+			rn.walk(down)
+		}
+		rn.b.end()
+		rn.scope = rn.scope[:mark]
+	default:
+		rn.b.leaf(node.kind, node.name, node.text)
+	}
+}
+
+// declare adds to the scope a declaration of the namespace node is
+// renamed into, if any, unless a prefix is bound to it already, or
+// the default namespace is for elements.
+func (rn *renaming) declare(node *Node) {
+	rule := rn.rule[node.pos]
+	if rule == nil || rule.Name.Local == "" || rule.Name.Space == "" || rule.Name.Space == xmlNamespace {
+		return
+	}
+	for i := len(rn.scope) - 1; i >= 0; i-- {
+		ns := rn.scope[i]
+		if ns.attr == rule.Name.Space && (ns.name.Local != "" || node.kind != AttrNode) && rn.lookup(ns.name.Local) == ns {
+			return
+		}
+	}
+	prefix := "ns"
+	for n := 1; rn.lookup(prefix) != nil; n++ {
+		prefix = "ns" + strconv.Itoa(n)
+	}
+	rn.scope = append(rn.scope, &Node{kind: NamespaceNode, name: xml.Name{Local: prefix}, attr: rule.Name.Space})
+}
+
+// lookup returns the innermost declaration of prefix in scope, if any.
+func (rn *renaming) lookup(prefix string) *Node {
+	for i := len(rn.scope) - 1; i >= 0; i-- {
+		if rn.scope[i].name.Local == prefix {
+			return rn.scope[i]
+		}
+	}
+	return nil
+}
+
+// MigrateNamespace returns a new tree holding a copy of node and its
+// content, or of the content alone if node is a root node, with the
+// elements and attributes in the namespace from moved into the namespace
+// to, as needed when upgrading documents to a new version of a schema.
+// Declarations of from are changed into declarations of to, so that
+// the new tree is written out by WriteXML with the same prefixes.
+// The tree node belongs to is not modified.
+func MigrateNamespace(node *Node, from, to string) *Node {
+	m := migrating{b: newBuilder(), from: from, to: to}
+	if node.up == nil {
+		for _, down := range node.down {
+			m.walk(down, false)
+		}
+	} else {
+		m.walk(node, true)
+	}
+	return m.b.finish()
+}
+
+type migrating struct {
+	b        *builder
+	from, to string
+}
+
+func (m *migrating) name(name xml.Name) xml.Name {
+	if name.Space == m.from {
+		name.Space = m.to
+	}
+	return name
+}
+
+// walk copies node, declaring all namespaces in scope of it if top is
+// set, as it's then copied without the elements around it.
+func (m *migrating) walk(node *Node, top bool) {
+	if node.kind != StartNode {
+		m.b.leaf(node.kind, node.name, node.text)
+		return
+	}
+	m.b.start(m.name(node.name))
+	for i := node.pos + 1; i < node.end && node.nodes[i].kind == AttrNode; i++ {
+		m.b.attr(m.name(node.nodes[i].name), node.nodes[i].attr)
+	}
+	var namespaces []*Node
+	if top {
+		namespaces = node.scopeNamespaces()
+	} else {
+		for i := node.namespaces(); i < node.end && node.nodes[i].kind == NamespaceNode; i++ {
+			namespaces = append(namespaces, node.nodes[i])
+		}
+	}
+	for _, ns := range namespaces {
+		uri := ns.attr
+		if uri == m.from {
+			uri = m.to
+		}
+		m.b.namespace(ns.name.Local, uri)
+	}
+	for _, down := range node.down {
+		m.walk(down, false)
+	}
+	m.b.end()
+}
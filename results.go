@@ -0,0 +1,38 @@
+package xmlpath
+
+// Map returns the result of calling fn on each node that path matches
+// on the given context, in iteration order.
+//
+// For example, extracting the numeric identifiers of all records:
+//
+//	ids := xmlpath.Map(xmlpath.MustCompile("//record/@id"), root, func(node *xmlpath.Node) string {
+//		return strings.TrimPrefix(node.String(), "rec-")
+//	})
+func Map[T any](path *Path, context *Node, fn func(*Node) T) []T {
+	var result []T
+	iter := path.Iter(context)
+	for iter.Next() {
+		result = append(result, fn(iter.Node()))
+	}
+	return result
+}
+
+// Reduce combines the nodes that path matches on the given context
+// into a single value, by calling fn in iteration order with the value
+// accumulated so far, starting at initial, and the next node.
+//
+// For example, counting the items in each category:
+//
+//	path := xmlpath.MustCompile("//item/@category")
+//	counts := xmlpath.Reduce(path, root, map[string]int{}, func(counts map[string]int, node *xmlpath.Node) map[string]int {
+//		counts[node.String()]++
+//		return counts
+//	})
+func Reduce[T any](path *Path, context *Node, initial T, fn func(T, *Node) T) T {
+	acc := initial
+	iter := path.Iter(context)
+	for iter.Next() {
+		acc = fn(acc, iter.Node())
+	}
+	return acc
+}
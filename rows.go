@@ -0,0 +1,123 @@
+package xmlpath
+
+// RowExtractor evaluates a set of typed columns on each node selected
+// by a path, handing rows one at a time to a callback, so that large
+// documents may feed columnar writers such as Parquet encoders without
+// materializing all rows or going through an intermediate format.
+//
+// For example:
+//
+//	x := &xmlpath.RowExtractor{
+//		Rows: xmlpath.MustCompile("//trade"),
+//		Columns: []xmlpath.Column{
+//			{Name: "symbol", Expr: xmlpath.MustCompileExpr("@symbol")},
+//			{Name: "price", Expr: xmlpath.MustCompileExpr("price"), Kind: xmlpath.NumberColumn},
+//		},
+//	}
+//	n, err := x.Extract(root, func(row *xmlpath.Row) error {
+//		symbols.Append(row.String(0))
+//		prices.Append(row.Number(1))
+//		return nil
+//	})
+type RowExtractor struct {
+	// Rows selects the nodes each row is extracted from.
+	Rows *Path
+
+	// Columns define the values extracted for each row.
+	Columns []Column
+}
+
+// Column is a column of a RowExtractor.
+type Column struct {
+	// Name identifies the column for the caller's convenience.
+	Name string
+
+	// Expr is evaluated with each row as the context node.
+	Expr *Expr
+
+	// Kind is the type the result of Expr is converted into.
+	Kind ColumnKind
+}
+
+// ColumnKind is the type of the values of a column.
+type ColumnKind int
+
+const (
+	StringColumn ColumnKind = iota
+	NumberColumn
+	BoolColumn
+)
+
+// Row holds the values extracted for a row. A single Row is reused for
+// all rows of an extraction, so values must be copied out of it before
+// the callback returns if they're to be kept.
+type Row struct {
+	// Node is the node the row was extracted from.
+	Node *Node
+
+	columns []Column
+	values  []value
+}
+
+// Len returns the number of columns in the row.
+func (row *Row) Len() int {
+	return len(row.values)
+}
+
+// Null returns whether the expression of column i selected no nodes,
+// as may be recorded in nullable columns.
+func (row *Row) Null(i int) bool {
+	v := row.values[i]
+	return v.kind == nodeSetValue && len(v.nodes) == 0
+}
+
+// String returns the value of column i converted into a string.
+func (row *Row) String(i int) string {
+	return row.values[i].string()
+}
+
+// Number returns the value of column i converted into a number.
+func (row *Row) Number(i int) float64 {
+	return row.values[i].number()
+}
+
+// Bool returns the value of column i converted into a boolean.
+func (row *Row) Bool(i int) bool {
+	return row.values[i].bool()
+}
+
+// Value returns the value of column i converted according to the kind
+// of the column, as a string, float64, or bool, or nil if it's null.
+func (row *Row) Value(i int) interface{} {
+	if row.Null(i) {
+		return nil
+	}
+	switch row.columns[i].Kind {
+	case NumberColumn:
+		return row.Number(i)
+	case BoolColumn:
+		return row.Bool(i)
+	}
+	return row.String(i)
+}
+
+// Extract calls fn with each row extracted from the nodes selected by
+// x.Rows on context, in iteration order, and returns the number of rows
+// handed to fn. Extraction stops at the first error returned by fn.
+func (x *RowExtractor) Extract(context *Node, fn func(row *Row) error) (int, error) {
+	row := &Row{columns: x.Columns, values: make([]value, len(x.Columns))}
+	n := 0
+	iter := x.Rows.Iter(context)
+	for iter.Next() {
+		row.Node = iter.Node()
+		for i, col := range x.Columns {
+			ctx := exprContext{node: row.Node, pos: 1}
+			row.values[i] = ctx.eval(col.Expr.e)
+		}
+		n++
+		if err := fn(row); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,288 @@
+package xmlpath
+
+import (
+	"strings"
+)
+
+// Sanitizer removes unwanted elements and attributes from a tree,
+// according to rules expressed as paths. It is typically used to
+// clean up user supplied HTML before embedding it into a page.
+//
+// Elements and attributes are selected by the rules in the same way
+// as done by Path.Matches, so a rule such as "script" selects every
+// script element, while "a/@target" selects target attributes of
+// links only.
+//
+// For example:
+//
+//     s := &xmlpath.Sanitizer{
+//             DenyElements:  []*xmlpath.Path{xmlpath.MustCompile("form")},
+//             AllowElements: []*xmlpath.Path{xmlpath.MustCompile("p"), xmlpath.MustCompile("a"), xmlpath.MustCompile("b")},
+//             AllowAttrs:    []*xmlpath.Path{xmlpath.MustCompile("a/@href"), xmlpath.MustCompile("@title")},
+//     }
+//     clean := s.Sanitize(root)
+//
+type Sanitizer struct {
+	// DenyElements selects elements that are removed along with
+	// all of their content, such as form elements. Whatever the rules,
+	// script, style, iframe, object, embed, and base elements are always
+	// removed, as they may run scripts, load content from elsewhere, or
+	// change where the links in the page lead.
+	DenyElements []*Path
+
+	// AllowElements, if not empty, selects the only elements that are
+	// kept. Other elements not denied are replaced by their content.
+	AllowElements []*Path
+
+	// DenyAttrs selects attributes that are removed.
+	DenyAttrs []*Path
+
+	// AllowAttrs, if not empty, selects the only attributes that are kept.
+	// Whatever the rules, event handler attributes such as onclick and
+	// srcdoc attributes are always removed, and style attributes are
+	// removed unless selected by AllowAttrs, as all of them may carry
+	// scripts or otherwise take over the page.
+	AllowAttrs []*Path
+
+	// AllowSchemes holds the URL schemes accepted in attributes that
+	// hold URLs, such as href and src. Attributes holding URLs with
+	// other schemes are removed, while relative URLs are always kept.
+	// If empty, the http, https, and mailto schemes are accepted.
+	AllowSchemes []string
+
+	// KeepComments causes comments to be kept. Processing
+	// instructions are always removed.
+	KeepComments bool
+}
+
+var defaultSchemes = []string{"http", "https", "mailto"}
+
+// unsafeElements holds the names of elements that are always removed.
+var unsafeElements = map[string]bool{
+	"base":   true,
+	"embed":  true,
+	"iframe": true,
+	"object": true,
+	"script": true,
+	"style":  true,
+}
+
+// urlAttrs holds the local names of attributes that hold URLs, so that
+// href also covers xlink:href. The URLs in ping and srcset are those
+// returned by attrURLs.
+var urlAttrs = map[string]bool{
+	"action":     true,
+	"background": true,
+	"cite":       true,
+	"data":       true,
+	"formaction": true,
+	"href":       true,
+	"longdesc":   true,
+	"ping":       true,
+	"poster":     true,
+	"src":        true,
+	"srcset":     true,
+}
+
+// Sanitize returns a new tree holding a cleaned up copy of node and
+// its content, or of the content alone if node is a root node.
+// The tree node belongs to is not modified.
+func (s *Sanitizer) Sanitize(node *Node) *Node {
+	root := node.nodes[0]
+	sn := sanitizing{
+		Sanitizer:     s,
+		b:             newBuilder(),
+		denyElements:  matchMarks(root, s.DenyElements),
+		allowElements: matchMarks(root, s.AllowElements),
+		denyAttrs:     matchMarks(root, s.DenyAttrs),
+		allowAttrs:    matchMarks(root, s.AllowAttrs),
+	}
+	if node.up == nil {
+		for _, down := range node.down {
+			sn.walk(down)
+		}
+	} else {
+		sn.walk(node)
+	}
+	return sn.b.finish()
+}
+
+type sanitizing struct {
+	*Sanitizer
+	b *builder
+
+	denyElements  []bool
+	allowElements []bool
+	denyAttrs     []bool
+	allowAttrs    []bool
+}
+
+func (sn *sanitizing) walk(node *Node) {
+	switch node.kind {
+	case StartNode:
+		if sn.denyElements[node.pos] || unsafeElements[strings.ToLower(node.name.Local)] {
+			return
+		}
+		keep := len(sn.AllowElements) == 0 || sn.allowElements[node.pos]
+		if keep {
+			sn.b.start(node.name)
+			for i := node.pos + 1; i < node.end && node.nodes[i].kind == AttrNode; i++ {
+				if sn.keepAttr(node.nodes[i]) {
+					sn.b.attr(node.nodes[i].name, node.nodes[i].attr)
+				}
+			}
+		}
+		for _, down := range node.down {
+			sn.walk(down)
+		}
+		if keep {
+			sn.b.end()
+		}
+	case TextNode:
+		sn.b.leaf(TextNode, node.name, node.text)
+	case CommentNode:
+		if sn.KeepComments {
+			sn.b.leaf(CommentNode, node.name, node.text)
+		}
+	}
+}
+
+func (sn *sanitizing) keepAttr(attr *Node) bool {
+	if sn.denyAttrs[attr.pos] {
+		return false
+	}
+	if len(sn.AllowAttrs) > 0 && !sn.allowAttrs[attr.pos] {
+		return false
+	}
+	name := strings.ToLower(attr.name.Local)
+	if strings.HasPrefix(name, "on") || name == "srcdoc" {
+		// Event handlers and inline frame documents run scripts.
+		return false
+	}
+	if name == "style" && !sn.allowAttrs[attr.pos] {
+		return false
+	}
+	if urlAttrs[name] {
+		for _, url := range attrURLs(name, attr.attr) {
+			if !sn.allowURL(url) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// allowURL returns whether url is relative or has one of the
+// schemes allowed.
+func (sn *sanitizing) allowURL(url string) bool {
+	scheme, ok := urlScheme(url)
+	if !ok {
+		return true
+	}
+	schemes := sn.AllowSchemes
+	if len(schemes) == 0 {
+		schemes = defaultSchemes
+	}
+	for _, allowed := range schemes {
+		if strings.EqualFold(scheme, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// attrURLs returns the URLs held by the attribute with the given
+// local name and value: the whitespace separated ones in ping, the
+// ones leading each of the comma separated candidates in srcset, or
+// the whole value otherwise.
+func attrURLs(name, value string) []string {
+	switch name {
+	case "ping":
+		return strings.Fields(value)
+	case "srcset":
+		var urls []string
+		for _, candidate := range strings.Split(value, ",") {
+			if fields := strings.Fields(candidate); len(fields) > 0 {
+				urls = append(urls, fields[0])
+			}
+		}
+		return urls
+	}
+	return []string{value}
+}
+
+// urlScheme returns the scheme of the given URL, if it has one.
+// As done by browsers, whitespace and control characters are
+// disregarded, so that "java\tscript:" is still seen as such.
+func urlScheme(url string) (scheme string, ok bool) {
+	var buf []byte
+	for i := 0; i < len(url); i++ {
+		c := url[i]
+		switch {
+		case c <= ' ':
+			continue
+		case c == ':':
+			return string(buf), len(buf) > 0
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9', c == '+', c == '-', c == '.':
+			if len(buf) == 0 {
+				return "", false
+			}
+		default:
+			return "", false
+		}
+		buf = append(buf, c)
+	}
+	return "", false
+}
+
+// matchMarks returns which of the nodes in the tree of root are
+// matched by any of paths, as done by Path.Matches, indexed by
+// node position.
+func matchMarks(root *Node, paths []*Path) []bool {
+	marks := make([]bool, len(root.nodes))
+	for _, path := range paths {
+		markMatches(root, path, marks)
+	}
+	return marks
+}
+
+// markMatches marks the nodes in the tree of root matched by path.
+// Relative location paths are evaluated once from root as if preceded
+// by "//", which selects the nodes they select from any element, rather
+// than once from every node in the tree.
+func markMatches(root *Node, path *Path, marks []bool) {
+	mark := func(context *Node, path *Path) {
+		iter := path.Iter(context)
+		for iter.Next() {
+			marks[iter.Node().pos] = true
+		}
+	}
+	switch {
+	case path.absolute():
+		mark(root, path)
+		return
+	case path.union != nil:
+		for _, alt := range path.union {
+			markMatches(root, alt, marks)
+		}
+		return
+	case path.steps != nil:
+		anywhere := *path
+		anywhere.steps = append([]pathStep{{text: "node()", root: true, axis: "descendant-or-self", name: "*"}}, path.steps...)
+		anywhere.dedup = true
+		mark(root, &anywhere)
+		switch path.steps[0].axis {
+		case "child", "descendant", "descendant-or-self", "attribute", "descendant-attribute", "namespace":
+			// Nothing is found from attributes and namespace nodes.
+			return
+		}
+	}
+	for i := range root.nodes {
+		context := root.nodes[i]
+		if context.kind == EndNode || path.steps != nil && context.kind != AttrNode && context.kind != NamespaceNode {
+			continue
+		}
+		mark(context, path)
+	}
+}
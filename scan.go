@@ -0,0 +1,133 @@
+package xmlpath
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ErrNoRows is returned by ScanRow.Scan when the row path matches
+// no nodes.
+var ErrNoRows = errors.New("xmlpath: no rows in result set")
+
+// ScanRow is the result of Path.QueryRow.
+type ScanRow struct {
+	node   *Node
+	text   textMode
+	fields []*Path
+}
+
+// QueryRow returns the first node p matches on the given context as a
+// row whose fields are the first nodes matched by each of fields with
+// that node as context, to be copied into Go variables by Scan in the
+// manner of database/sql:
+//
+//	var name string
+//	var age int
+//	err := xmlpath.MustCompile("//user[@id='42']").QueryRow(root, namePath, agePath).Scan(&name, &age)
+//
+// With no fields, the row itself is the only field.
+func (p *Path) QueryRow(context *Node, fields ...*Path) *ScanRow {
+	row := &ScanRow{text: p.text, fields: fields}
+	iter := p.Iter(context)
+	if iter.Next() {
+		row.node = iter.Node()
+	}
+	return row
+}
+
+// Scan copies the string values of the fields of the row into the
+// values pointed at by dest, one per field, converting them into the
+// types pointed at. Supported types are string, []byte, bool, the Go
+// integer and floating point types, *Node for the node itself, and
+// types implementing encoding.TextUnmarshaler. Surrounding spaces are
+// ignored when converting into booleans and numbers. String values are
+// taken as Path.String does, following the ShallowText and HTMLText
+// options the path providing each field was compiled with.
+//
+// Scan returns ErrNoRows if the row path matched no nodes, and an
+// error if any field matched no nodes or failed to convert.
+func (r *ScanRow) Scan(dest ...interface{}) error {
+	if r.node == nil {
+		return ErrNoRows
+	}
+	fields := len(r.fields)
+	if fields == 0 {
+		fields = 1
+	}
+	if len(dest) != fields {
+		return fmt.Errorf("xmlpath: expected %d destination arguments in Scan, not %d", fields, len(dest))
+	}
+	for i, d := range dest {
+		node, mode := r.node, r.text
+		if len(r.fields) > 0 {
+			iter := r.fields[i].Iter(r.node)
+			if !iter.Next() {
+				return fmt.Errorf("xmlpath: scanning field %d: %s matched no nodes", i, r.fields[i].path)
+			}
+			node, mode = iter.Node(), r.fields[i].text
+		}
+		if err := scanNode(node, mode, d); err != nil {
+			return fmt.Errorf("xmlpath: scanning field %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func scanNode(node *Node, mode textMode, dest interface{}) error {
+	if d, ok := dest.(**Node); ok {
+		*d = node
+		return nil
+	}
+	text := node.textString(mode)
+	switch d := dest.(type) {
+	case *string:
+		*d = text
+		return nil
+	case *[]byte:
+		*d = append((*d)[:0], text...)
+		return nil
+	case encoding.TextUnmarshaler:
+		return d.UnmarshalText([]byte(text))
+	}
+	rv := reflect.ValueOf(dest)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("destination not a pointer: %T", dest)
+	}
+	v := rv.Elem()
+	s := strings.TrimSpace(text)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(text)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("converting %q to %s: %v", s, v.Type(), err)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("converting %q to %s: %v", s, v.Type(), err)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("converting %q to %s: %v", s, v.Type(), err)
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("converting %q to %s: %v", s, v.Type(), err)
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported destination type %T", dest)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package xmlpath
+
+// ScrubText replaces in place the content of every text node within
+// node by the result of calling fn with it, as done for redacting or
+// normalizing documents before they're stored or forwarded.
+//
+// If path is not nil, only text within the elements that path selects
+// is replaced, along with the attributes it selects, with nodes being
+// selected in the same way as done by Path.Matches. For example:
+//
+//	node.ScrubText(xmlpath.MustCompile("ssn | card/number | @email"), func(s string) string {
+//		return strings.Repeat("*", len(s))
+//	})
+//
+// ScrubText must not be called while the tree is used concurrently.
+func (node *Node) ScrubText(path *Path, fn func(string) string) {
+	var marks []bool
+	if path != nil {
+		marks = matchMarks(node.nodes[0], []*Path{path})
+	}
+	scrubText(node, marks == nil, marks, fn)
+}
+
+func scrubText(node *Node, within bool, marks []bool, fn func(string) string) {
+	within = within || marks[node.pos]
+	switch node.kind {
+	case StartNode:
+		for i := node.pos + 1; i < node.end && node.nodes[i].kind == AttrNode; i++ {
+			attr := node.nodes[i]
+			if marks != nil && marks[attr.pos] {
+				attr.attr = fn(attr.attr)
+			}
+		}
+		for _, down := range node.down {
+			scrubText(down, within, marks, fn)
+		}
+	case TextNode:
+		if within {
+			if text := fn(string(node.text)); text != string(node.text) {
+				node.text = []byte(text)
+			}
+		}
+	case AttrNode:
+		if within {
+			node.attr = fn(node.attr)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package xmlpath
+
+import (
+	"encoding/xml"
+	"path"
+	"regexp"
+	"sort"
+)
+
+// FindText returns the elements within the subtree rooted at node
+// whose text contains substr, in document order.
+//
+// An element is returned when one of its own text nodes contains substr,
+// or when substr only shows up across the text of several of its
+// descendants (as in "Barney <i>Google</i>") and none of its child
+// elements contains it entirely. This makes FindText a quick way of
+// locating the element holding a known phrase without compiling a path.
+func (node *Node) FindText(substr string) []*Node {
+	if node.kind != StartNode {
+		return nil
+	}
+	var found []*Node
+	node.findText(substr, &found)
+	return found
+}
+
+func (node *Node) findText(substr string, found *[]*Node) {
+	if !node.contains(substr) {
+		return
+	}
+	mark := len(*found)
+	*found = append(*found, node)
+	direct := false
+	inner := false
+	for _, down := range node.down {
+		switch down.kind {
+		case TextNode:
+			if !direct && down.contains(substr) {
+				direct = true
+			}
+		case StartNode:
+			n := len(*found)
+			down.findText(substr, found)
+			if len(*found) > n {
+				inner = true
+			}
+		}
+	}
+	if !direct && inner {
+		copy((*found)[mark:], (*found)[mark+1:])
+		*found = (*found)[:len(*found)-1]
+	}
+}
+
+// TextMatch holds a match found by Node.FindRegexp.
+type TextMatch struct {
+	// Node is the innermost element holding the whole match.
+	Node *Node
+
+	// Start and End delimit the match as a byte range within
+	// the string value of Node.
+	Start, End int
+}
+
+// FindRegexp runs re over the string value of node and returns each
+// non-empty match along with the innermost element holding it, in
+// document order. Matches may span the text of several elements, in
+// which case the element enclosing all of them is reported.
+func (node *Node) FindRegexp(re *regexp.Regexp) []TextMatch {
+	if node.kind != StartNode {
+		return nil
+	}
+	// texts[i] is the node position of the i-th text node within node,
+	// and offsets[i] where its text starts within the string value.
+	var texts, offsets []int
+	size := 0
+	for i := node.pos; i < node.end; i++ {
+		if node.nodes[i].kind == TextNode {
+			texts = append(texts, i)
+			offsets = append(offsets, size)
+			size += len(node.nodes[i].text)
+		}
+	}
+	var matches []TextMatch
+	for _, loc := range re.FindAllIndex(node.Bytes(), -1) {
+		if loc[0] == loc[1] {
+			continue
+		}
+		first := sort.Search(len(offsets), func(i int) bool { return offsets[i] > loc[0] }) - 1
+		last := sort.Search(len(offsets), func(i int) bool { return offsets[i] >= loc[1] }) - 1
+		owner := node.nodes[texts[first]].up
+		for owner.end <= texts[last] {
+			owner = owner.up
+		}
+		start := offsets[sort.Search(len(texts), func(i int) bool { return texts[i] > owner.pos })]
+		matches = append(matches, TextMatch{
+			Node:  owner,
+			Start: loc[0] - start,
+			End:   loc[1] - start,
+		})
+	}
+	return matches
+}
+
+// Attrs returns the attributes of node whose local name matches pattern,
+// in document order. The pattern syntax is the one of path.Match, so
+// "data-*" selects all HTML data attributes and "*" selects all of them.
+// The only possible error is path.ErrBadPattern.
+func (node *Node) Attrs(pattern string) ([]xml.Attr, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	var attrs []xml.Attr
+	for i := node.pos + 1; i < node.end; i++ {
+		attr := node.nodes[i]
+		if attr.kind != AttrNode {
+			break
+		}
+		if ok, _ := path.Match(pattern, attr.name.Local); ok {
+			attrs = append(attrs, xml.Attr{Name: attr.name, Value: attr.attr})
+		}
+	}
+	return attrs, nil
+}
+
+// SiblingsUntil returns the siblings following node up to, but not
+// including, the first one matched by stop (see Path.Matches), or up
+// to the last sibling if none match or stop is nil. Text, comment and
+// processing instruction siblings are included as well, so that
+// SiblingsUntil may be used to collect all the content found between
+// two headings that have no wrapping element.
+func (node *Node) SiblingsUntil(stop *Path) []*Node {
+	if node.up == nil || node.kind == AttrNode || node.kind == NamespaceNode {
+		return nil
+	}
+	down := node.up.down
+	i := 0
+	for i < len(down) && down[i] != node {
+		i++
+	}
+	var siblings []*Node
+	for i++; i < len(down); i++ {
+		if stop != nil && stop.Matches(down[i]) {
+			break
+		}
+		siblings = append(siblings, down[i])
+	}
+	return siblings
+}
+
+// Closest returns node itself or its nearest ancestor matched by path
+// (see Path.Matches), or nil if there's none. It mirrors the closest
+// method of DOM elements.
+func (node *Node) Closest(path *Path) *Node {
+	for n := node; n != nil; n = n.up {
+		if path.Matches(n) {
+			return n
+		}
+	}
+	return nil
+}
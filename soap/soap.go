@@ -0,0 +1,214 @@
+// Package soap offers helpers for inspecting SOAP 1.1 and 1.2 messages
+// parsed with the xmlpath package.
+//
+// For example:
+//
+//     env, err := soap.Parse(resp.Body)
+//     if err != nil {
+//             log.Fatal(err)
+//     }
+//     if fault := env.Fault(); fault != nil {
+//             log.Fatal(fault)
+//     }
+//     total, ok := totalPath.String(env.Payload())
+//
+package soap
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/fanirthuban/xmlpath"
+)
+
+// The envelope namespaces of the supported SOAP versions.
+const (
+	Namespace11 = "http://schemas.xmlsoap.org/soap/envelope/"
+	Namespace12 = "http://www.w3.org/2003/05/soap-envelope"
+)
+
+// Version identifies a SOAP version.
+type Version int
+
+const (
+	V11 Version = 11
+	V12 Version = 12
+)
+
+func (v Version) String() string {
+	return fmt.Sprintf("SOAP %d.%d", v/10, v%10)
+}
+
+// Envelope holds the parts of a SOAP message.
+type Envelope struct {
+	Version Version
+
+	// Root is the envelope element.
+	Root *xmlpath.Node
+
+	// Header is the header element, or nil if the message has none.
+	Header *xmlpath.Node
+
+	// Body is the body element.
+	Body *xmlpath.Node
+}
+
+var (
+	envelopePath = xmlpath.MustCompile("/Envelope")
+	headerPath   = xmlpath.MustCompile("Header")
+	bodyPath     = xmlpath.MustCompile("Body")
+	elementsPath = xmlpath.MustCompile("*")
+	faultPath    = xmlpath.MustCompile("Fault")
+)
+
+// Parse parses a SOAP message from r.
+func Parse(r io.Reader) (*Envelope, error) {
+	root, err := xmlpath.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	return FromNode(root)
+}
+
+// FromNode returns the Envelope of the SOAP message that node belongs to,
+// as obtained for example from xmlpath.ParseMultipartRelated.
+func FromNode(node *xmlpath.Node) (*Envelope, error) {
+	root := first(envelopePath, node)
+	if root == nil {
+		return nil, fmt.Errorf("soap: missing Envelope element")
+	}
+	env := &Envelope{Root: root}
+	switch root.Name().Space {
+	case Namespace11:
+		env.Version = V11
+	case Namespace12:
+		env.Version = V12
+	default:
+		return nil, fmt.Errorf("soap: unknown envelope namespace %q", root.Name().Space)
+	}
+	env.Header = env.child(headerPath, root)
+	env.Body = env.child(bodyPath, root)
+	if env.Body == nil {
+		return nil, fmt.Errorf("soap: missing Body element")
+	}
+	return env, nil
+}
+
+// Namespace returns the envelope namespace of env's SOAP version.
+func (env *Envelope) Namespace() string {
+	if env.Version == V12 {
+		return Namespace12
+	}
+	return Namespace11
+}
+
+// child returns the first element selected by path on context that
+// is in the envelope namespace.
+func (env *Envelope) child(path *xmlpath.Path, context *xmlpath.Node) *xmlpath.Node {
+	iter := path.Iter(context)
+	for iter.Next() {
+		if iter.Node().Name().Space == env.Namespace() {
+			return iter.Node()
+		}
+	}
+	return nil
+}
+
+// Payload returns the first element within the body, or nil if the
+// body is empty.
+func (env *Envelope) Payload() *xmlpath.Node {
+	return first(elementsPath, env.Body)
+}
+
+// HeaderBlocks returns the header blocks with the given namespace and
+// local name, in document order. An empty space matches any namespace.
+func (env *Envelope) HeaderBlocks(space, local string) []*xmlpath.Node {
+	if env.Header == nil {
+		return nil
+	}
+	var blocks []*xmlpath.Node
+	iter := elementsPath.Iter(env.Header)
+	for iter.Next() {
+		name := iter.Node().Name()
+		if name.Local == local && (space == "" || name.Space == space) {
+			blocks = append(blocks, iter.Node())
+		}
+	}
+	return blocks
+}
+
+// Fault holds the details of a SOAP fault.
+type Fault struct {
+	// Code is the fault code, such as "soap:Server" in SOAP 1.1 or
+	// "env:Receiver" in SOAP 1.2, with the prefix used in the message.
+	Code string
+
+	// Subcode is the first SOAP 1.2 subcode value, if any.
+	Subcode string
+
+	// Reason is the human readable explanation of the fault.
+	// For SOAP 1.2 this is the first Reason/Text element.
+	Reason string
+
+	// Actor is the faultactor of SOAP 1.1 or the Role of SOAP 1.2.
+	Actor string
+
+	// Detail is the detail element, or nil if the fault has none.
+	Detail *xmlpath.Node
+
+	// Node is the Fault element itself.
+	Node *xmlpath.Node
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("soap fault %s: %s", f.Code, f.Reason)
+}
+
+var (
+	fault11CodePath   = xmlpath.MustCompile("faultcode")
+	fault11ReasonPath = xmlpath.MustCompile("faultstring")
+	fault11ActorPath  = xmlpath.MustCompile("faultactor")
+	fault11DetailPath = xmlpath.MustCompile("detail")
+
+	fault12CodePath    = xmlpath.MustCompile("Code/Value")
+	fault12SubcodePath = xmlpath.MustCompile("Code/Subcode/Value")
+	fault12ReasonPath  = xmlpath.MustCompile("Reason/Text")
+	fault12ActorPath   = xmlpath.MustCompile("Role")
+	fault12DetailPath  = xmlpath.MustCompile("Detail")
+)
+
+// Fault returns the fault carried in the body of env, or nil if there's none.
+func (env *Envelope) Fault() *Fault {
+	node := env.child(faultPath, env.Body)
+	if node == nil {
+		return nil
+	}
+	f := &Fault{Node: node}
+	if env.Version == V11 {
+		f.Code = text(fault11CodePath, node)
+		f.Reason = text(fault11ReasonPath, node)
+		f.Actor = text(fault11ActorPath, node)
+		f.Detail = first(fault11DetailPath, node)
+	} else {
+		f.Code = text(fault12CodePath, node)
+		f.Subcode = text(fault12SubcodePath, node)
+		f.Reason = text(fault12ReasonPath, node)
+		f.Actor = text(fault12ActorPath, node)
+		f.Detail = first(fault12DetailPath, node)
+	}
+	return f
+}
+
+func text(path *xmlpath.Path, context *xmlpath.Node) string {
+	s, _ := path.String(context)
+	return strings.TrimSpace(s)
+}
+
+func first(path *xmlpath.Path, context *xmlpath.Node) *xmlpath.Node {
+	iter := path.Iter(context)
+	if iter.Next() {
+		return iter.Node()
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package soap_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fanirthuban/xmlpath"
+	"github.com/fanirthuban/xmlpath/soap"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&SoapSuite{})
+
+type SoapSuite struct{}
+
+var response11 = `<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+  <soap:Header>
+    <t:Transaction xmlns:t="urn:tx" soap:mustUnderstand="1">5</t:Transaction>
+    <s:Session xmlns:s="urn:session">abc</s:Session>
+  </soap:Header>
+  <soap:Body>
+    <m:GetPriceResponse xmlns:m="urn:prices"><m:Price>1.90</m:Price></m:GetPriceResponse>
+  </soap:Body>
+</soap:Envelope>`
+
+var fault11 = `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+  <soap:Body>
+    <soap:Fault>
+      <faultcode>soap:Server</faultcode>
+      <faultstring> Price service unavailable </faultstring>
+      <faultactor>urn:prices</faultactor>
+      <detail><code>503</code></detail>
+    </soap:Fault>
+  </soap:Body>
+</soap:Envelope>`
+
+var fault12 = `<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope">
+  <env:Body>
+    <env:Fault>
+      <env:Code>
+        <env:Value>env:Sender</env:Value>
+        <env:Subcode><env:Value>m:BadItem</env:Value></env:Subcode>
+      </env:Code>
+      <env:Reason><env:Text xml:lang="en">Unknown item</env:Text></env:Reason>
+      <env:Detail><item>42</item></env:Detail>
+    </env:Fault>
+  </env:Body>
+</env:Envelope>`
+
+func (s *SoapSuite) TestEnvelope(c *C) {
+	env, err := soap.Parse(strings.NewReader(response11))
+	c.Assert(err, IsNil)
+	c.Assert(env.Version, Equals, soap.V11)
+	c.Assert(env.Version.String(), Equals, "SOAP 1.1")
+	c.Assert(env.Namespace(), Equals, soap.Namespace11)
+	c.Assert(env.Fault(), IsNil)
+
+	payload := env.Payload()
+	c.Assert(payload.Name().Local, Equals, "GetPriceResponse")
+	price, ok := xmlpath.MustCompile("Price").String(payload)
+	c.Assert(ok, Equals, true)
+	c.Assert(price, Equals, "1.90")
+
+	blocks := env.HeaderBlocks("urn:tx", "Transaction")
+	c.Assert(blocks, HasLen, 1)
+	c.Assert(blocks[0].String(), Equals, "5")
+	c.Assert(env.HeaderBlocks("", "Session"), HasLen, 1)
+	c.Assert(env.HeaderBlocks("urn:other", "Session"), HasLen, 0)
+}
+
+func (s *SoapSuite) TestFault11(c *C) {
+	env, err := soap.Parse(strings.NewReader(fault11))
+	c.Assert(err, IsNil)
+	c.Assert(env.Header, IsNil)
+	c.Assert(env.HeaderBlocks("", "Session"), HasLen, 0)
+	fault := env.Fault()
+	c.Assert(fault, NotNil)
+	c.Assert(fault.Code, Equals, "soap:Server")
+	c.Assert(fault.Reason, Equals, "Price service unavailable")
+	c.Assert(fault.Actor, Equals, "urn:prices")
+	c.Assert(fault.Detail.String(), Equals, "503")
+	c.Assert(fault, ErrorMatches, "soap fault soap:Server: Price service unavailable")
+}
+
+func (s *SoapSuite) TestFault12(c *C) {
+	env, err := soap.Parse(strings.NewReader(fault12))
+	c.Assert(err, IsNil)
+	c.Assert(env.Version, Equals, soap.V12)
+	fault := env.Fault()
+	c.Assert(fault, NotNil)
+	c.Assert(fault.Code, Equals, "env:Sender")
+	c.Assert(fault.Subcode, Equals, "m:BadItem")
+	c.Assert(fault.Reason, Equals, "Unknown item")
+	c.Assert(fault.Detail.String(), Equals, "42")
+	c.Assert(env.Payload(), Equals, fault.Node)
+}
+
+func (s *SoapSuite) TestErrors(c *C) {
+	_, err := soap.Parse(strings.NewReader(`<Envelope><Body/></Envelope>`))
+	c.Assert(err, ErrorMatches, `soap: unknown envelope namespace ""`)
+	_, err = soap.Parse(strings.NewReader(`<other/>`))
+	c.Assert(err, ErrorMatches, `soap: missing Envelope element`)
+	_, err = soap.Parse(strings.NewReader(`<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><Body/></soap:Envelope>`))
+	c.Assert(err, ErrorMatches, `soap: missing Body element`)
+}
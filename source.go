@@ -0,0 +1,437 @@
+package xmlpath
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// A Span is a range of byte offsets within a document.
+type Span struct {
+	Start, End int
+}
+
+// Source is a tree parsed from an xml document that keeps the document
+// itself along with the position of every node within it, so that the
+// tree may be updated as the document is edited without parsing all of
+// it again, as done by editors and file watchers.
+//
+// A Source is not safe for concurrent use, and nodes obtained from it
+// must not be used while it is being edited.
+type Source struct {
+	src   []byte
+	root  *Node
+	spans []Span
+}
+
+// ParseSource parses the xml document in src and returns it as a Source.
+// If the document is not well formed, the error is a *SourceError.
+func ParseSource(src []byte) (*Source, error) {
+	root, spans, err := parseSource(src)
+	if err != nil {
+		return nil, err
+	}
+	return &Source{src, root, spans}, nil
+}
+
+func parseSource(src []byte) (*Node, []Span, error) {
+	var spans []Span
+	d := xml.NewDecoder(bytes.NewReader(src))
+	nodes, err := decodeNodes(d, nil, &spans, nil)
+	if err != nil {
+		// The failing token starts where the last one read ended.
+		span := Span{spans[len(spans)-1].End, int(d.InputOffset())}
+		return nil, nil, &SourceError{Location: locate(src, span, openPath(nodes)), Err: err}
+	}
+	setAttrSpans(src, nodes, spans)
+	root, err := link(nodes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return root, spans, nil
+}
+
+// Root returns the root node of the current tree.
+func (s *Source) Root() *Node {
+	return s.root
+}
+
+// Bytes returns the current content of the document, which must
+// not be changed.
+func (s *Source) Bytes() []byte {
+	return s.src
+}
+
+// Span returns the position within the document of node, which must be
+// part of the current tree. Elements span from the start of their start
+// tag to the end of their end tag, and attributes and namespace nodes
+// span their declaration in the start tag holding them. The namespace
+// node for the xml prefix, which is never declared, has an empty span.
+func (s *Source) Span(node *Node) Span {
+	if node.implicit() && node.nodes[0] == s.root {
+		return Span{}
+	}
+	// Nodes removed by edits keep referring to the nodes they were
+	// linked with, so their own position must be checked.
+	if node.pos >= len(s.root.nodes) || s.root.nodes[node.pos] != node {
+		panic("xmlpath: node is not part of the current source tree")
+	}
+	span := s.spans[node.pos]
+	if node.kind == StartNode {
+		span.End = s.spans[node.end].End
+	}
+	return span
+}
+
+// Edit replaces the bytes from start to end in the document with text,
+// and updates the tree to match. Only the innermost element holding
+// the edited bytes within its content is parsed again, unless the edit
+// changes the structure of the document beyond it.
+//
+// Nodes outside the reparsed element, including the element itself
+// and its ancestors, are updated in place and remain valid, although
+// their position in the document may change. When the edit doesn't
+// change the number of nodes in the document, as when editing text or
+// attribute values, the nodes within the element are kept as well.
+// Edits that need the whole document parsed again make Root return a
+// new tree, and the previous one is left as it was.
+//
+// If the edited document is not well formed, a *SourceError is
+// returned and s is left unchanged.
+func (s *Source) Edit(start, end int, text []byte) error {
+	if start < 0 || end < start || end > len(s.src) {
+		return fmt.Errorf("xmlpath: edit range %d-%d is out of bounds", start, end)
+	}
+	src := make([]byte, 0, len(s.src)-(end-start)+len(text))
+	src = append(src, s.src[:start]...)
+	src = append(src, text...)
+	src = append(src, s.src[end:]...)
+
+	if elem := s.enclosing(start, end); elem != nil && s.reparse(elem, src, len(text)-(end-start)) {
+		s.src = src
+		return nil
+	}
+	root, spans, err := parseSource(src)
+	if err != nil {
+		return err
+	}
+	s.src, s.root, s.spans = src, root, spans
+	return nil
+}
+
+// enclosing returns the innermost element holding the bytes from
+// start to end within its content, or nil if there's none.
+func (s *Source) enclosing(start, end int) *Node {
+	var found *Node
+	node := s.root
+Down:
+	for {
+		for _, down := range node.down {
+			if down.kind != StartNode {
+				continue
+			}
+			open, close := s.spans[down.pos], s.spans[down.end]
+			// Empty elements have an empty end tag, and no content.
+			if open.End <= start && end <= close.Start && close.Start < close.End {
+				found = down
+				node = down
+				continue Down
+			}
+		}
+		return found
+	}
+}
+
+// reparse parses again the content of elem from the edited document
+// in src, where it has grown by delta bytes, and replaces its nodes.
+// It returns false, leaving s unchanged, if the new content isn't well
+// formed by itself.
+func (s *Source) reparse(elem *Node, src []byte, delta int) bool {
+	open, close := s.spans[elem.pos], s.spans[elem.end]
+	content := src[open.End : close.Start+delta]
+
+	// The content is parsed within an element declaring the
+	// namespaces in scope, so that prefixes resolve as before.
+	var data bytes.Buffer
+	data.WriteString("<x")
+	scope := elem.scopeNamespaces()
+	for _, ns := range scope {
+		data.WriteString(" xmlns")
+		if ns.name.Local != "" {
+			data.WriteString(":" + ns.name.Local)
+		}
+		data.WriteString(`="`)
+		xml.EscapeText(&data, []byte(ns.attr))
+		data.WriteString(`"`)
+	}
+	data.WriteString(">")
+	head := data.Len()
+	data.Write(content)
+	data.WriteString("</x>")
+
+	var spans []Span
+	nodes, err := decodeNodes(xml.NewDecoder(bytes.NewReader(data.Bytes())), nil, &spans, nil)
+	if err != nil {
+		return false
+	}
+	setAttrSpans(data.Bytes(), nodes, spans)
+
+	// Skip the root node, the wrapping element, and its namespace
+	// nodes, and make sure the content didn't close the latter early.
+	first := 2 + len(scope)
+	last := len(nodes) - 2
+	if last < first || nodes[last].kind != EndNode {
+		return false
+	}
+	depth := 0
+	for i := first; i < last; i++ {
+		switch nodes[i].kind {
+		case StartNode:
+			depth++
+		case EndNode:
+			depth--
+		}
+		if depth < 0 {
+			return false
+		}
+	}
+	fresh, freshSpans := nodes[first:last], spans[first:last]
+	for i := range freshSpans {
+		freshSpans[i].Start += open.End - head
+		freshSpans[i].End += open.End - head
+	}
+
+	from := elem.namespaces()
+	for from < elem.end && elem.nodes[from].kind == NamespaceNode {
+		from++
+	}
+	to := elem.end
+	for i := to; i < len(s.spans); i++ {
+		s.spans[i].Start += delta
+		s.spans[i].End += delta
+	}
+
+	if len(fresh) == to-from {
+		old := elem.nodes
+		for i := range fresh {
+			n := old[from+i]
+			n.kind, n.name, n.attr, n.text = fresh[i].kind, fresh[i].name, fresh[i].attr, fresh[i].text
+		}
+		copy(s.spans[from:to], freshSpans)
+		relink(elem, from)
+		old[0].doc.ids = newIDIndex(old, old[0].doc.ids.attrs)
+		return true
+	}
+
+	// The nodes before and after the replaced ones are kept, so that
+	// references to them remain valid and only their positions change.
+	old := elem.nodes
+	size := len(old) - (to - from) + len(fresh)
+	ptrs := append(make([]*Node, 0, size), old[:from]...)
+	for i := range fresh {
+		ptrs = append(ptrs, &fresh[i])
+	}
+	ptrs = append(ptrs, old[to:]...)
+	spans = append(append(append(make([]Span, 0, size), s.spans[:from]...), freshSpans...), s.spans[to:]...)
+	ids := old[0].doc.ids.attrs
+	root, err := linkNodes(ptrs)
+	if err != nil || root != s.root {
+		panic("internal error: reparsing produced a broken tree")
+	}
+	root.doc.ids = newIDIndex(ptrs, ids)
+	s.spans = spans
+	return true
+}
+
+// relink sets up the references between the nodes within parent from
+// the given position onwards, after they were replaced in place by the
+// same number of nodes.
+func relink(parent *Node, from int) {
+	nodes := parent.nodes
+	parent.down = nil
+	stack := []*Node{parent}
+	for pos := from; pos < parent.end; pos++ {
+		node := nodes[pos]
+		up := stack[len(stack)-1]
+		if node.kind == EndNode {
+			up.end = pos
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		node.nodes = nodes
+		node.pos = pos
+		node.up = up
+		node.down = nil
+		if node.kind == StartNode {
+			stack = append(stack, node)
+		} else {
+			node.end = pos + 1
+		}
+		switch node.kind {
+		case StartNode, TextNode, CommentNode, ProcInstNode:
+			up.down = append(up.down, node)
+		}
+	}
+}
+
+// setAttrSpans narrows the spans of attribute and namespace nodes,
+// which initially span the start tag holding them, to their own
+// declaration within the tag.
+func setAttrSpans(src []byte, nodes []Node, spans []Span) {
+	for i := range nodes {
+		if nodes[i].kind != StartNode || i+1 == len(nodes) {
+			continue
+		}
+		if kind := nodes[i+1].kind; kind != AttrNode && kind != NamespaceNode {
+			continue
+		}
+		tag := spans[i]
+		var attrs, namespaces []Span
+		j := tag.Start + 1
+		for j < tag.End && !isXMLSpace(rune(src[j])) && src[j] != '/' && src[j] != '>' {
+			j++
+		}
+		for {
+			for j < tag.End && isXMLSpace(rune(src[j])) {
+				j++
+			}
+			if j >= tag.End || src[j] == '/' || src[j] == '>' {
+				break
+			}
+			start := j
+			for src[j] != '=' && !isXMLSpace(rune(src[j])) {
+				j++
+			}
+			name := string(src[start:j])
+			j += bytes.IndexAny(src[j:], `"'`)
+			j += 1 + bytes.IndexByte(src[j+1:], src[j]) + 1
+			if name == "xmlns" || strings.HasPrefix(name, "xmlns:") {
+				namespaces = append(namespaces, Span{start, j})
+			} else {
+				attrs = append(attrs, Span{start, j})
+			}
+		}
+		// Attribute nodes come first, followed by namespace nodes.
+		copy(spans[i+1:], attrs)
+		copy(spans[i+1+len(attrs):], namespaces)
+	}
+}
+
+// A Position is a location within a document as shown by editors,
+// with lines and columns counted from 1. Columns are counted in
+// characters rather than bytes.
+type Position struct {
+	Line, Column int
+}
+
+// A Location describes where a node or a problem is in a document.
+type Location struct {
+	Span       Span
+	Start, End Position
+
+	// Path selects the nearest node enclosing the location, such as
+	// "/library/book[2]/title[1]" or "/library/book[2]/@id". Elements
+	// below the document element are always indexed among the sibling
+	// elements with the same name, so that Path is unambiguous.
+	Path string
+}
+
+// SourceError is returned by ParseSource and Source.Edit for documents
+// that are not well formed, and locates the problem within the document.
+type SourceError struct {
+	Location
+
+	// Err is the error reported when decoding, usually an *xml.SyntaxError.
+	Err error
+}
+
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("xmlpath: line %d, column %d: %v", e.Start.Line, e.Start.Column, e.Err)
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// Locate returns the location of node, which must be part of the
+// current tree, so that problems found with it, for example when
+// validating the document, may be reported at the right place.
+func (s *Source) Locate(node *Node) Location {
+	return locate(s.src, s.Span(node), nodePath(node))
+}
+
+func locate(src []byte, span Span, path string) Location {
+	return Location{
+		Span:  span,
+		Start: position(src, span.Start),
+		End:   position(src, span.End),
+		Path:  path,
+	}
+}
+
+// position returns the line and column of offset within src.
+func position(src []byte, offset int) Position {
+	line := 1 + bytes.Count(src[:offset], []byte{'\n'})
+	column := 1 + utf8.RuneCount(src[bytes.LastIndexByte(src[:offset], '\n')+1:offset])
+	return Position{line, column}
+}
+
+// nodePath returns the path selecting node, or its parent element if
+// node is neither an element nor an attribute.
+func nodePath(node *Node) string {
+	switch node.kind {
+	case StartNode:
+		if node.up == nil {
+			return "/"
+		}
+		if node.up.up == nil {
+			return "/" + node.name.Local
+		}
+		index := 1
+		for _, sibling := range node.up.down {
+			if sibling == node {
+				break
+			}
+			if sibling.kind == StartNode && sibling.name.Local == node.name.Local {
+				index++
+			}
+		}
+		return fmt.Sprintf("%s/%s[%d]", nodePath(node.up), node.name.Local, index)
+	case AttrNode:
+		return nodePath(node.up) + "/@" + node.name.Local
+	}
+	return nodePath(node.up)
+}
+
+// openPath returns the path of the innermost element left open
+// within nodes, as read up to an error.
+func openPath(nodes []Node) string {
+	type open struct {
+		path   string
+		counts map[string]int
+	}
+	stack := []open{{path: ""}}
+	for i := 1; i < len(nodes); i++ {
+		switch nodes[i].kind {
+		case StartNode:
+			top := &stack[len(stack)-1]
+			path := top.path + "/" + nodes[i].name.Local
+			if len(stack) > 1 {
+				if top.counts == nil {
+					top.counts = make(map[string]int)
+				}
+				top.counts[nodes[i].name.Local]++
+				path = fmt.Sprintf("%s[%d]", path, top.counts[nodes[i].name.Local])
+			}
+			stack = append(stack, open{path: path})
+		case EndNode:
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if path := stack[len(stack)-1].path; path != "" {
+		return path
+	}
+	return "/"
+}
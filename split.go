@@ -0,0 +1,66 @@
+package xmlpath
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+const xmlDeclaration = `<?xml version="1.0" encoding="UTF-8"?>` + "\n"
+
+// Split writes each element that path matches on context as a document
+// of its own, for sharding large exports into records that may be
+// processed independently. Each record is written with an xml
+// declaration into the writer returned by create for it, which is
+// closed afterwards. Namespaces in scope of a record are declared in
+// its top element, so records remain well-formed when their prefixes
+// are declared further up in the original document.
+//
+// Split returns the number of records written, stopping at the first
+// error found.
+func Split(path *Path, context *Node, create func(i int, record *Node) (io.WriteCloser, error)) (int, error) {
+	n := 0
+	iter := path.Iter(context)
+	for iter.Next() {
+		record := iter.Node()
+		if record.kind != StartNode || record.up == nil {
+			return n, fmt.Errorf("xmlpath: split record %d is not an element", n)
+		}
+		w, err := create(n, record)
+		if err != nil {
+			return n, err
+		}
+		err = writeRecord(w, record)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func writeRecord(w io.Writer, record *Node) error {
+	if _, err := io.WriteString(w, xmlDeclaration); err != nil {
+		return err
+	}
+	if err := record.WriteXML(w, nil); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// SplitFiles works like Split, creating a file for each record named
+// after pattern formatted with the record number, starting at zero.
+//
+// For example:
+//
+//	n, err := xmlpath.SplitFiles(xmlpath.MustCompile("/export/customer"), root, "shards/customer-%06d.xml")
+func SplitFiles(path *Path, context *Node, pattern string) (int, error) {
+	return Split(path, context, func(i int, record *Node) (io.WriteCloser, error) {
+		return os.Create(fmt.Sprintf(pattern, i))
+	})
+}
@@ -0,0 +1,88 @@
+package xmlpath
+
+import (
+	"unsafe"
+)
+
+// Stats holds statistics about a tree, as returned by Node.Stats,
+// for capacity planning and for enforcing quotas on documents.
+type Stats struct {
+	// Elements, Attrs, Namespaces, Texts, Comments, and ProcInsts
+	// hold the number of nodes of each kind.
+	Elements   int
+	Attrs      int
+	Namespaces int
+	Texts      int
+	Comments   int
+	ProcInsts  int
+
+	// TextBytes holds the size of the content of texts, comments and
+	// processing instructions, and AttrBytes the size of the values
+	// of attributes and namespace declarations.
+	TextBytes int
+	AttrBytes int
+
+	// Depth is the number of elements in the longest chain of
+	// nested elements.
+	Depth int
+
+	// Memory approximates the number of bytes of memory held by
+	// the tree.
+	Memory int
+}
+
+// Nodes returns the total number of nodes.
+func (s *Stats) Nodes() int {
+	return s.Elements + s.Attrs + s.Namespaces + s.Texts + s.Comments + s.ProcInsts
+}
+
+// Stats returns statistics about the subtree rooted at node, which
+// cover the whole document when node is a root node.
+func (node *Node) Stats() Stats {
+	var s Stats
+	var nameBytes int
+	depth := 0
+	for i := node.pos; i < node.end; i++ {
+		n := node.nodes[i]
+		switch n.kind {
+		case StartNode:
+			if n.up == nil {
+				// The root node.
+				continue
+			}
+			s.Elements++
+			depth++
+			if depth > s.Depth {
+				s.Depth = depth
+			}
+		case EndNode:
+			depth--
+		case AttrNode:
+			s.Attrs++
+			s.AttrBytes += len(n.attr)
+		case NamespaceNode:
+			s.Namespaces++
+			s.AttrBytes += len(n.attr)
+		case TextNode:
+			s.Texts++
+			s.TextBytes += len(n.text)
+		case CommentNode:
+			s.Comments++
+			s.TextBytes += len(n.text)
+		case ProcInstNode:
+			s.ProcInsts++
+			s.TextBytes += len(n.text)
+		}
+		nameBytes += len(n.name.Space) + len(n.name.Local)
+	}
+
+	// Each node takes a slot in the node slice, plus one in the
+	// slice of children of the node it's in, and elements take
+	// another slot for closing them.
+	slots := s.Nodes() + s.Elements
+	if node.up == nil && node.kind == StartNode {
+		slots += 2
+	}
+	s.Memory = slots*int(unsafe.Sizeof(Node{})+unsafe.Sizeof(node)) + s.TextBytes + s.AttrBytes + nameBytes
+	return s
+}
@@ -0,0 +1,197 @@
+package xmlpath
+
+import (
+	"encoding/xml"
+)
+
+// ReplaceAll returns a new tree holding a copy of node and its content,
+// or of the content alone if node is a root node, with each node that
+// path matches on node replaced by the result of calling fn with it.
+// Nodes are replaced by a copy of the node returned, or of its content
+// if that's a root node, such as when replacing by a parsed fragment,
+// and removed if fn returns nil. Attributes may only be replaced by
+// attributes, and other nodes by anything but attributes and namespace
+// nodes. Replacements of the wrong kind are ignored, leaving the node
+// matched as it is. The tree node belongs to is not modified.
+//
+// For example, filling in placeholders of a template:
+//
+//	filled := tmpl.ReplaceAll(xmlpath.MustCompile("//placeholder[@name='body']"), func(*xmlpath.Node) *xmlpath.Node {
+//		return body
+//	})
+func (node *Node) ReplaceAll(path *Path, fn func(*Node) *Node) *Node {
+	rp := replacing{b: newBuilder(), fn: fn, marks: make([]bool, len(node.nodes))}
+	iter := path.Iter(node)
+	for iter.Next() {
+		rp.marks[iter.Node().pos] = true
+	}
+	rp.walk(node)
+	return rp.b.finish()
+}
+
+type replacing struct {
+	b     *builder
+	fn    func(*Node) *Node
+	marks []bool
+}
+
+func (rp *replacing) walk(node *Node) {
+	if rp.marks[node.pos] {
+		repl := rp.fn(node)
+		if repl == nil {
+			return
+		}
+		if repl.kind != AttrNode && repl.kind != NamespaceNode {
+			rp.b.copy(repl)
+			return
+		}
+	}
+	if node.up == nil {
+		for _, down := range node.down {
+			rp.walk(down)
+		}
+		return
+	}
+	if node.kind != StartNode {
+		rp.b.leaf(node.kind, node.name, node.text)
+		return
+	}
+	rp.b.start(node.name)
+	for i := node.pos + 1; i < node.end && (node.nodes[i].kind == AttrNode || node.nodes[i].kind == NamespaceNode); i++ {
+		attr := node.nodes[i]
+		switch {
+		case attr.kind == NamespaceNode:
+			rp.b.namespace(attr.name.Local, attr.attr)
+		case !rp.marks[i]:
+			rp.b.attr(attr.name, attr.attr)
+		default:
+			repl := rp.fn(attr)
+			switch {
+			case repl == nil:
+			case repl.kind == AttrNode:
+				rp.b.attr(repl.name, repl.attr)
+			default:
+				rp.b.attr(attr.name, attr.attr)
+			}
+		}
+	}
+	for _, down := range node.down {
+		rp.walk(down)
+	}
+	rp.b.end()
+}
+
+// Wrap returns a new tree holding a copy of node and its content, or of
+// the content alone if node is a root node, with each node that path
+// matches on node enclosed in a new element with the given name.
+// Matched attributes and root nodes are left as they are.
+// The tree node belongs to is not modified.
+//
+// For example, making tables scrollable:
+//
+//	wrapped := root.Wrap(xmlpath.MustCompile("//table"), xml.Name{Local: "div"})
+func (node *Node) Wrap(path *Path, name xml.Name) *Node {
+	w := wrapping{b: newBuilder(), marks: make([]bool, len(node.nodes)), name: name}
+	iter := path.Iter(node)
+	for iter.Next() {
+		w.marks[iter.Node().pos] = true
+	}
+	w.top(node)
+	return w.b.finish()
+}
+
+// Unwrap returns a new tree holding a copy of node and its content, or
+// of the content alone if node is a root node, with each element that
+// path matches on node replaced by its content, dropping the element and
+// its attributes. Namespaces declared by elements unwrapped are declared
+// again in the elements promoted. Matched nodes that aren't elements are
+// left as they are. The tree node belongs to is not modified.
+//
+// For example, dropping presentational markup from scraped HTML:
+//
+//	clean := root.Unwrap(xmlpath.MustCompile("//font | //span"))
+func (node *Node) Unwrap(path *Path) *Node {
+	w := wrapping{b: newBuilder(), marks: make([]bool, len(node.nodes)), unwrap: true}
+	iter := path.Iter(node)
+	for iter.Next() {
+		w.marks[iter.Node().pos] = true
+	}
+	w.top(node)
+	return w.b.finish()
+}
+
+type wrapping struct {
+	b      *builder
+	marks  []bool
+	name   xml.Name
+	unwrap bool
+}
+
+func (w *wrapping) top(node *Node) {
+	if node.up == nil {
+		for _, down := range node.down {
+			w.walk(down, nil)
+		}
+	} else {
+		w.walk(node, nil)
+	}
+}
+
+// walk copies node, declaring in it the namespaces in pending that
+// were declared by elements unwrapped around it, unless node declares
+// the same prefixes itself.
+func (w *wrapping) walk(node *Node, pending []*Node) {
+	marked := w.marks[node.pos]
+	if node.kind != StartNode {
+		if marked && !w.unwrap {
+			w.b.start(w.name)
+			w.b.leaf(node.kind, node.name, node.text)
+			w.b.end()
+		} else {
+			w.b.leaf(node.kind, node.name, node.text)
+		}
+		return
+	}
+	if marked && w.unwrap {
+		for i := node.namespaces(); i < node.end && node.nodes[i].kind == NamespaceNode; i++ {
+			pending = append(pending, node.nodes[i])
+		}
+		for _, down := range node.down {
+			w.walk(down, pending)
+		}
+		return
+	}
+	if marked {
+		w.b.start(w.name)
+	}
+	w.b.start(node.name)
+	for i := node.pos + 1; i < node.end && node.nodes[i].kind == AttrNode; i++ {
+		w.b.attr(node.nodes[i].name, node.nodes[i].attr)
+	}
+	declared := make(map[string]bool)
+	for i := node.namespaces(); i < node.end && node.nodes[i].kind == NamespaceNode; i++ {
+		w.b.namespace(node.nodes[i].name.Local, node.nodes[i].attr)
+		declared[node.nodes[i].name.Local] = true
+	}
+	// Inner declarations take precedence, but are written in the
+	// order they were made.
+	inherit := make([]bool, len(pending))
+	for i := len(pending) - 1; i >= 0; i-- {
+		if prefix := pending[i].name.Local; !declared[prefix] {
+			inherit[i] = true
+			declared[prefix] = true
+		}
+	}
+	for i, ns := range pending {
+		if inherit[i] {
+			w.b.namespace(ns.name.Local, ns.attr)
+		}
+	}
+	for _, down := range node.down {
+		w.walk(down, nil)
+	}
+	w.b.end()
+	if marked {
+		w.b.end()
+	}
+}
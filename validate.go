@@ -0,0 +1,183 @@
+package xmlpath
+
+import (
+	"fmt"
+)
+
+// ValidateTree checks the internal invariants of the tree node belongs
+// to, and returns an error describing the first violation found, if any.
+// Trees obtained from this package are always valid, so ValidateTree is
+// meant for fuzzing and property tests of the code producing and changing
+// them, where it detects corruption before it leads to wrong results or
+// to panics far from its cause.
+//
+// The invariants checked include that positions and end positions
+// of nodes match their place in the tree, that the parent and child
+// references of nodes agree with each other, that attribute and
+// namespace nodes immediately follow the element holding them, and
+// that nodes only hold the kind of content their kind allows.
+func ValidateTree(node *Node) error {
+	if node == nil || len(node.nodes) == 0 {
+		return fmt.Errorf("xmlpath: invalid tree: no nodes")
+	}
+	nodes := node.nodes
+	if !node.implicit() && (node.pos < 0 || node.pos >= len(nodes) || nodes[node.pos] != node) {
+		return fmt.Errorf("xmlpath: invalid tree: node is not at its position %d", node.pos)
+	}
+	root := nodes[0]
+	if root.kind != StartNode || root.up != nil || root.name.Local != "" {
+		return fmt.Errorf("xmlpath: invalid tree: first node is not a root node")
+	}
+	if root.end != len(nodes)-1 {
+		return fmt.Errorf("xmlpath: invalid tree: root node ends at %d, not at the last node %d", root.end, len(nodes)-1)
+	}
+
+	invalid := func(pos int, format string, args ...interface{}) error {
+		return fmt.Errorf("xmlpath: invalid tree: node %d: %s", pos, fmt.Sprintf(format, args...))
+	}
+	var stack []*Node
+	for pos := range nodes {
+		n := nodes[pos]
+		if n.kind == EndNode {
+			if len(stack) == 0 {
+				return invalid(pos, "end node closes no element")
+			}
+			elem := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if elem.end != pos {
+				return invalid(elem.pos, "element ends at %d, not at its end node %d", elem.end, pos)
+			}
+			if err := validateDown(elem, invalid); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(stack) == 0 && pos > 0 {
+			return invalid(pos, "node is outside of the root node")
+		}
+		if len(n.nodes) != len(nodes) || n.nodes[0] != nodes[0] {
+			return invalid(pos, "node belongs to a different tree")
+		}
+		if n.pos != pos {
+			return invalid(pos, "node has position %d", n.pos)
+		}
+		var up *Node
+		if len(stack) > 0 {
+			up = stack[len(stack)-1]
+		}
+		if n.up != up {
+			return invalid(pos, "node has the wrong parent")
+		}
+		if pos > 0 && n.doc != nil {
+			return invalid(pos, "document data held by a node other than the root")
+		}
+
+		switch n.kind {
+		case StartNode:
+			if pos > 0 && n.name.Local == "" {
+				return invalid(pos, "element has no name")
+			}
+			if n.end <= pos || n.end >= len(nodes) || nodes[n.end].kind != EndNode {
+				return invalid(pos, "element ends at %d, which is not an end node", n.end)
+			}
+			stack = append(stack, n)
+		case AttrNode, NamespaceNode:
+			prev := nodes[pos-1].kind
+			if prev != StartNode && prev != AttrNode && prev != NamespaceNode || n.kind == AttrNode && prev == NamespaceNode || up == nil || up.pos == 0 {
+				return invalid(pos, "%s node doesn't follow the element holding it", kindName(n.kind))
+			}
+			if n.kind == AttrNode && n.name.Local == "" {
+				return invalid(pos, "attribute has no name")
+			}
+		case TextNode, CommentNode, ProcInstNode:
+			if n.kind == ProcInstNode && n.name.Local == "" {
+				return invalid(pos, "processing instruction has no target")
+			}
+		default:
+			return invalid(pos, "node has unknown kind %d", n.kind)
+		}
+		if n.kind != StartNode && n.end != pos+1 {
+			return invalid(pos, "%s node ends at %d", kindName(n.kind), n.end)
+		}
+		if n.kind != AttrNode && n.kind != NamespaceNode && n.attr != "" {
+			return invalid(pos, "%s node has an attribute value", kindName(n.kind))
+		}
+		if n.kind != TextNode && n.kind != CommentNode && n.kind != ProcInstNode && n.text != nil {
+			return invalid(pos, "%s node has text", kindName(n.kind))
+		}
+	}
+	if len(stack) > 0 {
+		return invalid(stack[len(stack)-1].pos, "element is never closed")
+	}
+	return validateDocument(root, invalid)
+}
+
+// validateDocument checks that the data kept for the tree under root
+// agrees with the tree, with one namespace node binding the xml prefix
+// for each top-level element.
+func validateDocument(root *Node, invalid func(pos int, format string, args ...interface{}) error) error {
+	if root.doc == nil {
+		return invalid(0, "root node holds no document data")
+	}
+	i := 0
+	for _, top := range root.down {
+		if top.kind != StartNode {
+			continue
+		}
+		if i >= len(root.doc.xmlns) || root.doc.xmlns[i].up != top {
+			return invalid(top.pos, "element has no namespace node for the xml prefix")
+		}
+		ns := root.doc.xmlns[i]
+		if ns.kind != NamespaceNode || ns.name.Local != "xml" || ns.attr != xmlNamespace || len(ns.nodes) != len(root.nodes) || ns.nodes[0] != root || ns.pos != top.end {
+			return invalid(top.pos, "namespace node for the xml prefix is broken")
+		}
+		i++
+	}
+	if i != len(root.doc.xmlns) {
+		return invalid(0, "%d namespace nodes for the xml prefix, not %d", len(root.doc.xmlns), i)
+	}
+	return nil
+}
+
+// validateDown checks that the child references of elem hold its
+// elements, texts, comments and processing instructions in order.
+func validateDown(elem *Node, invalid func(pos int, format string, args ...interface{}) error) error {
+	i := 0
+	for pos := elem.pos + 1; pos < elem.end; pos++ {
+		n := elem.nodes[pos]
+		if n.up != elem {
+			continue
+		}
+		switch n.kind {
+		case StartNode, TextNode, CommentNode, ProcInstNode:
+			if i >= len(elem.down) || elem.down[i] != n {
+				return invalid(elem.pos, "child %d is not node %d", i, pos)
+			}
+			i++
+		}
+	}
+	if i != len(elem.down) {
+		return invalid(elem.pos, "element has %d children, not %d", len(elem.down), i)
+	}
+	return nil
+}
+
+func kindName(kind NodeKind) string {
+	switch kind {
+	case StartNode:
+		return "element"
+	case EndNode:
+		return "end"
+	case AttrNode:
+		return "attribute"
+	case TextNode:
+		return "text"
+	case CommentNode:
+		return "comment"
+	case ProcInstNode:
+		return "processing instruction"
+	case NamespaceNode:
+		return "namespace"
+	}
+	return "unknown"
+}
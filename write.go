@@ -0,0 +1,242 @@
+package xmlpath
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// XMLOptions tune how Node.WriteXML serializes a subtree.
+type XMLOptions struct {
+	// MaxDepth, when positive, is how many levels of descendants
+	// are written. The content of elements found deeper is replaced
+	// by a comment stating how many nodes were elided.
+	MaxDepth int
+
+	// MaxNodes, when positive, is how many elements, texts, comments,
+	// and processing instructions are written. Once it's reached, the
+	// remaining content of every open element is replaced by a comment
+	// stating how many nodes were elided.
+	MaxNodes int
+}
+
+// WriteXML writes the subtree rooted at node into w as xml text,
+// declaring the namespaces in scope of node that it needs, and
+// eliding content as requested in opts. A nil opts writes the whole
+// subtree. When node is an attribute, it's written as name="value",
+// and when it's a root node, its content is written.
+//
+// Limiting the output is useful for logging or debugging nodes
+// selected within large documents:
+//
+//     var buf bytes.Buffer
+//     err := node.WriteXML(&buf, &xmlpath.XMLOptions{MaxDepth: 2, MaxNodes: 100})
+//
+// Content that is elided is replaced by a comment such as:
+//
+//     <!-- 1523 nodes elided -->
+//
+func (node *Node) WriteXML(w io.Writer, opts *XMLOptions) error {
+	if opts == nil {
+		opts = &XMLOptions{}
+	}
+	xw := xmlWriter{w: bufio.NewWriter(w), opts: opts}
+	switch {
+	case node.kind == AttrNode || node.kind == NamespaceNode:
+		xw.attr(node)
+	case node.kind == StartNode && node.up == nil:
+		xw.content(node, 0)
+	default:
+		xw.node(node, 0)
+	}
+	return xw.w.Flush()
+}
+
+// WriteTo writes the subtree rooted at node into w as done by WriteXML
+// with no options, and returns the number of bytes written. It makes
+// Node an io.WriterTo, so large subtrees may be streamed into files or
+// connections through a small buffer, without being held in memory as
+// a whole, while metering the bytes sent.
+func (node *Node) WriteTo(w io.Writer) (int64, error) {
+	cw := countingWriter{w: w}
+	err := node.WriteXML(&cw, nil)
+	return cw.n, err
+}
+
+// countingWriter counts the bytes written into w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type xmlWriter struct {
+	w     *bufio.Writer
+	opts  *XMLOptions
+	count int
+}
+
+func (xw *xmlWriter) node(node *Node, depth int) {
+	xw.count++
+	switch node.kind {
+	case StartNode:
+		xw.element(node, depth)
+	case TextNode:
+		xw.escape(string(node.text), false)
+	case CommentNode:
+		xw.w.WriteString("<!--")
+		xw.w.Write(node.text)
+		xw.w.WriteString("-->")
+	case ProcInstNode:
+		xw.w.WriteString("<?")
+		xw.w.WriteString(node.name.Local)
+		if len(node.text) > 0 {
+			xw.w.WriteByte(' ')
+			xw.w.Write(node.text)
+		}
+		xw.w.WriteString("?>")
+	}
+}
+
+func (xw *xmlWriter) element(node *Node, depth int) {
+	name := qualifiedName(node, node)
+	xw.w.WriteByte('<')
+	xw.w.WriteString(name)
+	for i := node.pos + 1; i < node.end && node.nodes[i].kind == AttrNode; i++ {
+		xw.w.WriteByte(' ')
+		xw.attr(node.nodes[i])
+	}
+	if depth == 0 {
+		for _, ns := range node.scopeNamespaces() {
+			xw.w.WriteByte(' ')
+			xw.attr(ns)
+		}
+	} else {
+		for i := node.namespaces(); i < node.end && node.nodes[i].kind == NamespaceNode; i++ {
+			xw.w.WriteByte(' ')
+			xw.attr(node.nodes[i])
+		}
+	}
+	if len(node.down) == 0 {
+		xw.w.WriteString("/>")
+		return
+	}
+	xw.w.WriteByte('>')
+	xw.content(node, depth+1)
+	xw.w.WriteString("</")
+	xw.w.WriteString(name)
+	xw.w.WriteByte('>')
+}
+
+// content writes the nodes within elem, found at the given depth.
+func (xw *xmlWriter) content(elem *Node, depth int) {
+	for i, down := range elem.down {
+		if xw.opts.MaxDepth > 0 && depth > xw.opts.MaxDepth || xw.opts.MaxNodes > 0 && xw.count >= xw.opts.MaxNodes {
+			elided := 0
+			for _, down := range elem.down[i:] {
+				elided += down.size()
+			}
+			xw.w.WriteString("<!-- ")
+			xw.w.WriteString(strconv.Itoa(elided))
+			if elided == 1 {
+				xw.w.WriteString(" node elided -->")
+			} else {
+				xw.w.WriteString(" nodes elided -->")
+			}
+			return
+		}
+		xw.node(down, depth)
+	}
+}
+
+func (xw *xmlWriter) attr(node *Node) {
+	if node.kind == NamespaceNode {
+		xw.w.WriteString("xmlns")
+		if node.name.Local != "" {
+			xw.w.WriteByte(':')
+			xw.w.WriteString(node.name.Local)
+		}
+	} else {
+		xw.w.WriteString(qualifiedName(node.up, node))
+	}
+	xw.w.WriteString(`="`)
+	xw.escape(node.attr, true)
+	xw.w.WriteByte('"')
+}
+
+const xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+// qualifiedName returns the name of node qualified by the prefix bound
+// to its namespace in the scope of elem. Attributes are never qualified
+// by a default namespace. Names in namespaces without a prefix in scope,
+// as found in trees parsed from HTML, are left unqualified.
+func qualifiedName(elem, node *Node) string {
+	space := node.name.Space
+	if space == "" {
+		return node.name.Local
+	}
+	if space == xmlNamespace {
+		return "xml:" + node.name.Local
+	}
+	for _, ns := range elem.scopeNamespaces() {
+		if ns.attr == space && (ns.name.Local != "" || node.kind != AttrNode) {
+			if ns.name.Local == "" {
+				return node.name.Local
+			}
+			return ns.name.Local + ":" + node.name.Local
+		}
+	}
+	return node.name.Local
+}
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;", `"`, "&quot;", "\n", "&#xA;", "\t", "&#x9;")
+)
+
+func (xw *xmlWriter) escape(s string, attr bool) {
+	if attr {
+		attrEscaper.WriteString(xw.w, s)
+	} else {
+		textEscaper.WriteString(xw.w, s)
+	}
+}
+
+// size returns the number of elements, texts, comments and processing
+// instructions in the subtree rooted at node.
+func (node *Node) size() int {
+	if node.kind != StartNode {
+		return 1
+	}
+	n := 1
+	for i := node.pos + 1; i < node.end; i++ {
+		switch node.nodes[i].kind {
+		case StartNode, TextNode, CommentNode, ProcInstNode:
+			n++
+		}
+	}
+	return n
+}
+
+// scopeNamespaces returns the namespace declarations in scope of node,
+// from the nearest one outwards, leaving out those that are shadowed.
+func (node *Node) scopeNamespaces() []*Node {
+	var result []*Node
+	declared := make(map[string]bool)
+	for e := node; e.up != nil; e = e.up {
+		for i := e.namespaces(); i < e.end && e.nodes[i].kind == NamespaceNode; i++ {
+			ns := e.nodes[i]
+			if !declared[ns.name.Local] {
+				declared[ns.name.Local] = true
+				result = append(result, ns)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,258 @@
+// Package xbrl streams facts out of XBRL instance documents.
+//
+// XBRL filings are often large and made mostly of attribute-heavy fact
+// elements, so rather than parsing a whole instance into memory, Facts
+// reads it token by token and only builds xmlpath trees for the contexts,
+// units and facts of interest, one at a time.
+//
+// For example:
+//
+//     err := xbrl.Facts(file, []string{"Revenues", "NetIncomeLoss"}, func(f *xbrl.Fact) error {
+//             fmt.Println(f.Concept.Local, f.Context.Instant, f.Context.End, f.Value)
+//             return nil
+//     })
+//
+package xbrl
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/fanirthuban/xmlpath"
+)
+
+// Namespace is the namespace of XBRL instance elements.
+const Namespace = "http://www.xbrl.org/2003/instance"
+
+// Context describes the entity and period that facts refer to.
+type Context struct {
+	ID string
+
+	// Scheme and Entity are the entity identifier scheme and value.
+	Scheme string
+	Entity string
+
+	// Instant is set for contexts about a point in time, while Start
+	// and End are set for contexts about a duration. Forever is set
+	// for contexts about an unbounded duration.
+	Instant string
+	Start   string
+	End     string
+	Forever bool
+
+	// Node is the context element, through which segment and
+	// scenario dimensions may be inspected.
+	Node *xmlpath.Node
+}
+
+// Unit describes the unit of numeric facts.
+type Unit struct {
+	ID string
+
+	// Measures holds the measures of the unit, such as "iso4217:USD",
+	// or the numerator measures for units defined as a division.
+	Measures []string
+
+	// Denominator holds the denominator measures for units defined
+	// as a division, such as "xbrli:shares" in USD per share.
+	Denominator []string
+}
+
+// Fact is a value reported in an XBRL instance.
+type Fact struct {
+	Concept  xml.Name
+	ID       string
+	Value    string
+	Decimals string
+	Nil      bool
+
+	ContextRef string
+	Context    *Context
+
+	// UnitRef and Unit are only set for numeric facts.
+	UnitRef string
+	Unit    *Unit
+
+	// Node is the fact element.
+	Node *xmlpath.Node
+}
+
+var (
+	entityPath      = xmlpath.MustCompile("entity/identifier")
+	schemePath      = xmlpath.MustCompile("entity/identifier/@scheme")
+	instantPath     = xmlpath.MustCompile("period/instant")
+	startPath       = xmlpath.MustCompile("period/startDate")
+	endPath         = xmlpath.MustCompile("period/endDate")
+	foreverPath     = xmlpath.MustCompile("period/forever")
+	measurePath     = xmlpath.MustCompile("measure")
+	numeratorPath   = xmlpath.MustCompile("divide/unitNumerator/measure")
+	denominatorPath = xmlpath.MustCompile("divide/unitDenominator/measure")
+	elementPath     = xmlpath.MustCompile("*")
+)
+
+// Facts reads the XBRL instance from r and calls fn with every fact whose
+// concept local name is one of concepts, or with every fact if concepts is
+// empty. Contexts and units are resolved before fn is called. Facts are
+// reported in document order, except that facts referring to a context or
+// unit defined further down the document are held back until the end of it.
+// If fn returns an error, Facts stops and returns that error.
+func Facts(r io.Reader, concepts []string, fn func(*Fact) error) error {
+	wanted := make(map[string]bool, len(concepts))
+	for _, concept := range concepts {
+		wanted[concept] = true
+	}
+
+	contexts := make(map[string]*Context)
+	units := make(map[string]*Unit)
+	var pending []*Fact
+
+	resolve := func(f *Fact) bool {
+		f.Context = contexts[f.ContextRef]
+		if f.UnitRef != "" {
+			f.Unit = units[f.UnitRef]
+			return f.Context != nil && f.Unit != nil
+		}
+		return f.Context != nil
+	}
+
+	d := xml.NewDecoder(r)
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		start, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Space == Namespace {
+			switch start.Name.Local {
+			case "context":
+				node, err := xmlpath.ParseElement(d, start)
+				if err != nil {
+					return err
+				}
+				ctx := parseContext(node)
+				contexts[ctx.ID] = ctx
+			case "unit":
+				node, err := xmlpath.ParseElement(d, start)
+				if err != nil {
+					return err
+				}
+				unit := parseUnit(node)
+				units[unit.ID] = unit
+			}
+			continue
+		}
+		f := &Fact{Concept: start.Name}
+		for _, attr := range start.Attr {
+			switch attr.Name.Local {
+			case "contextRef":
+				f.ContextRef = attr.Value
+			case "unitRef":
+				f.UnitRef = attr.Value
+			case "decimals":
+				f.Decimals = attr.Value
+			case "id":
+				f.ID = attr.Value
+			case "nil":
+				f.Nil = attr.Value == "true"
+			}
+		}
+		if f.ContextRef == "" || len(wanted) > 0 && !wanted[start.Name.Local] {
+			// Not a fact, or not an interesting one. Tuples are
+			// descended into as their items may be of interest.
+			continue
+		}
+		node, err := xmlpath.ParseElement(d, start)
+		if err != nil {
+			return err
+		}
+		f.Node = first(elementPath, node)
+		f.Value = strings.TrimSpace(f.Node.String())
+		if !resolve(f) {
+			pending = append(pending, f)
+			continue
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	for _, f := range pending {
+		if !resolve(f) {
+			if f.Context == nil {
+				return fmt.Errorf("xbrl: fact %s refers to undefined context %q", f.Concept.Local, f.ContextRef)
+			}
+			return fmt.Errorf("xbrl: fact %s refers to undefined unit %q", f.Concept.Local, f.UnitRef)
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseContext(root *xmlpath.Node) *Context {
+	node := first(elementPath, root)
+	ctx := &Context{Node: node}
+	for _, attr := range attrs(node) {
+		if attr.Name.Local == "id" {
+			ctx.ID = attr.Value
+		}
+	}
+	ctx.Entity = text(entityPath, node)
+	ctx.Scheme = text(schemePath, node)
+	ctx.Instant = text(instantPath, node)
+	ctx.Start = text(startPath, node)
+	ctx.End = text(endPath, node)
+	ctx.Forever = foreverPath.Exists(node)
+	return ctx
+}
+
+func parseUnit(root *xmlpath.Node) *Unit {
+	node := first(elementPath, root)
+	unit := &Unit{}
+	for _, attr := range attrs(node) {
+		if attr.Name.Local == "id" {
+			unit.ID = attr.Value
+		}
+	}
+	unit.Measures = texts(measurePath, node)
+	if unit.Measures == nil {
+		unit.Measures = texts(numeratorPath, node)
+		unit.Denominator = texts(denominatorPath, node)
+	}
+	return unit
+}
+
+func attrs(node *xmlpath.Node) []xml.Attr {
+	attrs, _ := node.Attrs("*")
+	return attrs
+}
+
+func first(path *xmlpath.Path, context *xmlpath.Node) *xmlpath.Node {
+	iter := path.Iter(context)
+	if iter.Next() {
+		return iter.Node()
+	}
+	return nil
+}
+
+func text(path *xmlpath.Path, context *xmlpath.Node) string {
+	s, _ := path.String(context)
+	return strings.TrimSpace(s)
+}
+
+func texts(path *xmlpath.Path, context *xmlpath.Node) []string {
+	var result []string
+	iter := path.Iter(context)
+	for iter.Next() {
+		result = append(result, strings.TrimSpace(iter.Node().String()))
+	}
+	return result
+}
@@ -0,0 +1,104 @@
+package xbrl_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/fanirthuban/xmlpath/xbrl"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&XBRLSuite{})
+
+type XBRLSuite struct{}
+
+var instance = `<?xml version="1.0" encoding="utf-8"?>
+<xbrli:xbrl xmlns:xbrli="http://www.xbrl.org/2003/instance" xmlns:us-gaap="http://fasb.org/us-gaap/2023" xmlns:iso4217="http://www.xbrl.org/2003/iso4217" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <xbrli:context id="FY2023">
+    <xbrli:entity><xbrli:identifier scheme="http://www.sec.gov/CIK">0000320193</xbrli:identifier></xbrli:entity>
+    <xbrli:period><xbrli:startDate>2022-09-25</xbrli:startDate><xbrli:endDate>2023-09-30</xbrli:endDate></xbrli:period>
+  </xbrli:context>
+  <xbrli:unit id="USD"><xbrli:measure>iso4217:USD</xbrli:measure></xbrli:unit>
+  <us-gaap:Revenues contextRef="FY2023" unitRef="USD" decimals="-6" id="f1">383285000000</us-gaap:Revenues>
+  <us-gaap:EarningsPerShareBasic contextRef="FY2023" unitRef="USDPerShare" decimals="2">6.16</us-gaap:EarningsPerShareBasic>
+  <us-gaap:Assets contextRef="AsOf2023" unitRef="USD" decimals="-6">352583000000</us-gaap:Assets>
+  <us-gaap:Goodwill contextRef="AsOf2023" unitRef="USD" xsi:nil="true"/>
+  <us-gaap:DocumentType contextRef="FY2023">10-K</us-gaap:DocumentType>
+  <xbrli:context id="AsOf2023">
+    <xbrli:entity><xbrli:identifier scheme="http://www.sec.gov/CIK">0000320193</xbrli:identifier></xbrli:entity>
+    <xbrli:period><xbrli:instant>2023-09-30</xbrli:instant></xbrli:period>
+  </xbrli:context>
+  <xbrli:unit id="USDPerShare">
+    <xbrli:divide>
+      <xbrli:unitNumerator><xbrli:measure>iso4217:USD</xbrli:measure></xbrli:unitNumerator>
+      <xbrli:unitDenominator><xbrli:measure>xbrli:shares</xbrli:measure></xbrli:unitDenominator>
+    </xbrli:divide>
+  </xbrli:unit>
+</xbrli:xbrl>
+`
+
+func (s *XBRLSuite) TestFacts(c *C) {
+	var facts []*xbrl.Fact
+	err := xbrl.Facts(strings.NewReader(instance), nil, func(f *xbrl.Fact) error {
+		facts = append(facts, f)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	var names []string
+	for _, f := range facts {
+		names = append(names, f.Concept.Local)
+	}
+	c.Assert(names, DeepEquals, []string{"Revenues", "DocumentType", "EarningsPerShareBasic", "Assets", "Goodwill"})
+
+	revenues := facts[0]
+	c.Assert(revenues.Concept.Space, Equals, "http://fasb.org/us-gaap/2023")
+	c.Assert(revenues.Value, Equals, "383285000000")
+	c.Assert(revenues.Decimals, Equals, "-6")
+	c.Assert(revenues.ID, Equals, "f1")
+	c.Assert(revenues.Context.ID, Equals, "FY2023")
+	c.Assert(revenues.Context.Entity, Equals, "0000320193")
+	c.Assert(revenues.Context.Scheme, Equals, "http://www.sec.gov/CIK")
+	c.Assert(revenues.Context.Start, Equals, "2022-09-25")
+	c.Assert(revenues.Context.End, Equals, "2023-09-30")
+	c.Assert(revenues.Unit.Measures, DeepEquals, []string{"iso4217:USD"})
+
+	eps := facts[2]
+	c.Assert(eps.Unit.Measures, DeepEquals, []string{"iso4217:USD"})
+	c.Assert(eps.Unit.Denominator, DeepEquals, []string{"xbrli:shares"})
+
+	assets := facts[3]
+	c.Assert(assets.Context.Instant, Equals, "2023-09-30")
+
+	goodwill := facts[4]
+	c.Assert(goodwill.Nil, Equals, true)
+	c.Assert(goodwill.Value, Equals, "")
+
+	c.Assert(facts[1].Unit, IsNil)
+}
+
+func (s *XBRLSuite) TestFactsByConcept(c *C) {
+	var values []string
+	err := xbrl.Facts(strings.NewReader(instance), []string{"Assets", "Revenues"}, func(f *xbrl.Fact) error {
+		values = append(values, f.Concept.Local+"="+f.Value)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(values, DeepEquals, []string{"Revenues=383285000000", "Assets=352583000000"})
+}
+
+func (s *XBRLSuite) TestFactsErrors(c *C) {
+	stop := errors.New("stop")
+	err := xbrl.Facts(strings.NewReader(instance), nil, func(f *xbrl.Fact) error {
+		return stop
+	})
+	c.Assert(err, Equals, stop)
+
+	bad := strings.Replace(instance, `id="AsOf2023"`, `id="Other"`, 1)
+	err = xbrl.Facts(strings.NewReader(bad), []string{"Assets"}, func(f *xbrl.Fact) error { return nil })
+	c.Assert(err, ErrorMatches, `xbrl: fact Assets refers to undefined context "AsOf2023"`)
+}
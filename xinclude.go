@@ -0,0 +1,246 @@
+package xmlpath
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const xincludeNamespace = "http://www.w3.org/2001/XInclude"
+
+// documentFunc returns the document() function, loading documents via
+// loader with relative URLs resolved against baseURL, within the deadline
+// of the evaluation. See CompileOptions.Loader.
+func documentFunc(loader DocumentLoader, baseURL string) *exprFunc {
+	return &exprFunc{
+		minArgs: 1, maxArgs: 1, kind: nodeSetValue,
+		call: func(ctx *exprContext, args []value) value {
+			var urls []string
+			if args[0].kind == nodeSetValue {
+				for _, node := range args[0].nodes {
+					urls = append(urls, args[0].nodeString(node))
+				}
+			} else {
+				urls = []string{args[0].string()}
+			}
+			lctx := context.Background()
+			if !ctx.deadline.IsZero() {
+				var cancel context.CancelFunc
+				lctx, cancel = context.WithDeadline(lctx, ctx.deadline)
+				defer cancel()
+			}
+			var nodes []*Node
+			seen := make(map[*Node]bool)
+			for _, u := range urls {
+				root, err := loadDocument(lctx, loader, baseURL, strings.TrimSpace(u))
+				if err != nil {
+					ctx.fail(err)
+					return value{kind: nodeSetValue}
+				}
+				if !seen[root] {
+					seen[root] = true
+					nodes = append(nodes, root)
+				}
+			}
+			return value{kind: nodeSetValue, nodes: nodes}
+		},
+	}
+}
+
+// loadDocument loads the document at ref, resolved against base, for
+// document(). Trees cached by an HTTPLoader are shared rather than
+// copied, as document() only reads them.
+func loadDocument(ctx context.Context, loader DocumentLoader, base, ref string) (*Node, error) {
+	u, err := resolveURL(base, ref)
+	if err != nil {
+		return nil, err
+	}
+	var root *Node
+	if l, ok := loader.(*HTTPLoader); ok {
+		root, _, err = l.load(ctx, u)
+	} else {
+		root, err = loader.Load(ctx, u)
+	}
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() != nil {
+		err = ErrTimeout
+	}
+	return root, err
+}
+
+// resolveURL resolves ref against base, unless base is empty.
+func resolveURL(base, ref string) (string, error) {
+	if base == "" {
+		return ref, nil
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	r, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return b.ResolveReference(r).String(), nil
+}
+
+// ResolveXIncludes returns a new tree holding a copy of node and its
+// content, or of the content alone if node is a root node, with the
+// XInclude include elements within it replaced by the content they
+// reference. Documents are loaded via loader, or DefaultLoader if nil,
+// with relative URLs resolved against baseURL, the URL of the document
+// node belongs to, and included documents are processed in turn. The
+// tree node belongs to is not modified.
+//
+// Only XML inclusion is supported, with the xpointer attribute, if set,
+// selecting an element by identifier as done by Node.ElementByID. When
+// a document fails to load or has no such element, the content of the
+// fallback element within the include element is used, if there's one.
+// Otherwise, and for unsupported inclusions or inclusion loops, an error
+// is returned.
+func (node *Node) ResolveXIncludes(ctx context.Context, baseURL string, loader DocumentLoader) (*Node, error) {
+	if loader == nil {
+		loader = DefaultLoader
+	}
+	xi := xincluding{ctx: ctx, loader: loader, b: newBuilder()}
+	var err error
+	if node.up == nil {
+		for _, down := range node.down {
+			if err = xi.walk(down, baseURL); err != nil {
+				break
+			}
+		}
+	} else {
+		err = xi.walk(node, baseURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return xi.b.finish(), nil
+}
+
+type xincluding struct {
+	ctx    context.Context
+	loader DocumentLoader
+	b      *builder
+
+	// including holds the URLs and pointers of the inclusions being
+	// processed, for detecting loops.
+	including []string
+}
+
+func (xi *xincluding) walk(node *Node, base string) error {
+	if node.kind != StartNode {
+		xi.b.leaf(node.kind, node.name, node.text)
+		return nil
+	}
+	if node.name.Space == xincludeNamespace {
+		switch node.name.Local {
+		case "include":
+			return xi.include(node, base)
+		case "fallback":
+			return fmt.Errorf("xmlpath: %s: fallback element outside of an include element", nodePath(node))
+		}
+	}
+	xi.b.start(node.name)
+	for i := node.pos + 1; i < node.end; i++ {
+		switch attr := node.nodes[i]; attr.kind {
+		case AttrNode:
+			xi.b.attr(attr.name, attr.attr)
+			continue
+		case NamespaceNode:
+			xi.b.namespace(attr.name.Local, attr.attr)
+			continue
+		}
+		break
+	}
+	for _, down := range node.down {
+		if err := xi.walk(down, base); err != nil {
+			return err
+		}
+	}
+	xi.b.end()
+	return nil
+}
+
+// include adds the content referenced by the include element elem.
+func (xi *xincluding) include(elem *Node, base string) error {
+	href := xi.attr(elem, "href")
+	pointer := xi.attr(elem, "xpointer")
+	if parse := xi.attr(elem, "parse"); parse != "" && parse != "xml" {
+		return fmt.Errorf("xmlpath: %s: unsupported inclusion with parse=%q", nodePath(elem), parse)
+	}
+	if href == "" && pointer == "" {
+		return fmt.Errorf("xmlpath: %s: include element without href or xpointer", nodePath(elem))
+	}
+	if pointer != "" && strings.ContainsAny(pointer, "()/ ") {
+		return fmt.Errorf("xmlpath: %s: unsupported xpointer %q", nodePath(elem), pointer)
+	}
+	u := base
+	doc := elem.nodes[0]
+	if href != "" {
+		var err error
+		if u, err = resolveURL(base, href); err != nil {
+			return fmt.Errorf("xmlpath: %s: %v", nodePath(elem), err)
+		}
+	}
+	key := u + "#" + pointer
+	for _, including := range xi.including {
+		if including == key {
+			return fmt.Errorf("xmlpath: %s: inclusion loop including %s", nodePath(elem), key)
+		}
+	}
+	if href != "" {
+		var err error
+		if doc, err = xi.loader.Load(xi.ctx, u); err != nil {
+			return xi.fallback(elem, base, fmt.Errorf("xmlpath: including %s: %w", u, err))
+		}
+	}
+	target := doc
+	if pointer != "" {
+		if target = doc.ElementByID(pointer); target == nil {
+			return xi.fallback(elem, base, fmt.Errorf("xmlpath: including %s: no element with id %q", u, pointer))
+		}
+	}
+	xi.including = append(xi.including, key)
+	defer func() { xi.including = xi.including[:len(xi.including)-1] }()
+	if target.up != nil {
+		return xi.walk(target, u)
+	}
+	for _, down := range target.down {
+		if err := xi.walk(down, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fallback adds the content of the fallback element within the include
+// element elem in place of the content it failed to include with err,
+// or returns err if there's no fallback element.
+func (xi *xincluding) fallback(elem *Node, base string, err error) error {
+	for _, down := range elem.down {
+		if down.kind == StartNode && down.name == (xml.Name{Space: xincludeNamespace, Local: "fallback"}) {
+			for _, content := range down.down {
+				if err := xi.walk(content, base); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return err
+}
+
+// attr returns the value of the unqualified attribute of elem with
+// the given name, or an empty string if there's none.
+func (xi *xincluding) attr(elem *Node, name string) string {
+	for i := elem.pos + 1; i < elem.end && elem.nodes[i].kind == AttrNode; i++ {
+		if attr := elem.nodes[i]; attr.name == (xml.Name{Local: name}) {
+			return attr.attr
+		}
+	}
+	return ""
+}
@@ -0,0 +1,363 @@
+// Package xmlpathtest offers assertions for tests that check XML
+// documents, reporting mismatches in terms of paths and nodes rather
+// than as raw text differences.
+//
+// For example:
+//
+//	func TestFeed(t *testing.T) {
+//		root := render(t)
+//		xmlpathtest.AssertCount(t, root, "//entry", 3)
+//		xmlpathtest.AssertMatches(t, root, "//entry/title", "One", "Two", "Three")
+//		xmlpathtest.AssertGolden(t, root, "testdata/feed.xml")
+//	}
+//
+// Golden files are rewritten with the tree under test instead of being
+// compared with it when tests are run with the -xmlpathtest.update flag.
+package xmlpathtest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fanirthuban/xmlpath"
+)
+
+// Update causes AssertGolden to write golden files rather than
+// comparing trees with them.
+var Update = flag.Bool("xmlpathtest.update", false, "update xmlpathtest golden files")
+
+// TB is the part of testing.TB used by the assertions, which is also
+// implemented by the *C type of gopkg.in/check.v1.
+type TB interface {
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+func helper(t TB) {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+}
+
+func compile(t TB, path string) *xmlpath.Path {
+	helper(t)
+	p, err := xmlpath.Compile(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return p
+}
+
+// AssertMatches checks that path selects nodes with the string
+// values in want, in order, when applied to context.
+func AssertMatches(t TB, context *xmlpath.Node, path string, want ...string) {
+	helper(t)
+	var got []string
+	iter := compile(t, path).Iter(context)
+	for iter.Next() {
+		got = append(got, iter.Node().String())
+	}
+	if len(got) != len(want) {
+		t.Errorf("%s: got %d matches %s, want %d %s", path, len(got), quote(got), len(want), quote(want))
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%s: got matches %s, want %s", path, quote(got), quote(want))
+			return
+		}
+	}
+}
+
+// AssertCount checks that path selects want nodes when applied to context.
+func AssertCount(t TB, context *xmlpath.Node, path string, want int) {
+	helper(t)
+	got := 0
+	iter := compile(t, path).Iter(context)
+	for iter.Next() {
+		got++
+	}
+	if got != want {
+		t.Errorf("%s: got %d matches, want %d", path, got, want)
+	}
+}
+
+func quote(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = strconv.Quote(v)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// maxDiffs is how many differences are reported by the assertions.
+const maxDiffs = 10
+
+// AssertEqual checks that the trees rooted at got and want are equal,
+// as compared by Diff, and reports the differences found otherwise.
+func AssertEqual(t TB, got, want *xmlpath.Node) {
+	helper(t)
+	report(t, "", Diff(got, want))
+}
+
+// AssertGolden checks that the tree rooted at node equals the one held
+// in the golden file at filename, as compared by Diff, and reports the
+// differences found otherwise. The golden file is written with node
+// instead when the Update flag is set.
+func AssertGolden(t TB, node *xmlpath.Node, filename string) {
+	helper(t)
+	if *Update {
+		var buf bytes.Buffer
+		if err := node.WriteXML(&buf, nil); err != nil {
+			t.Fatalf("cannot write golden file: %v", err)
+		}
+		buf.WriteByte('\n')
+		if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("cannot write golden file: %v", err)
+		}
+		return
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("cannot read golden file: %v", err)
+	}
+	want, err := xmlpath.Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("cannot parse golden file %s: %v", filename, err)
+	}
+	if !isRoot(node) {
+		iter := elementPath.Iter(want)
+		if iter.Next() {
+			want = iter.Node()
+		}
+	}
+	report(t, filename+": ", Diff(node, want))
+}
+
+func report(t TB, prefix string, diffs []string) {
+	helper(t)
+	if len(diffs) == 0 {
+		return
+	}
+	var buf strings.Builder
+	buf.WriteString(prefix)
+	buf.WriteString("trees differ:")
+	for i, diff := range diffs {
+		if i == maxDiffs {
+			fmt.Fprintf(&buf, "\n\t... and %d more", len(diffs)-maxDiffs)
+			break
+		}
+		buf.WriteString("\n\t")
+		buf.WriteString(diff)
+	}
+	t.Errorf("%s", buf.String())
+}
+
+var (
+	nodesPath   = xmlpath.MustCompile("node()")
+	attrsPath   = xmlpath.MustCompile("@*")
+	elementPath = xmlpath.MustCompile("/*")
+)
+
+// Diff compares the trees rooted at got and want and returns their
+// structural differences, each described by the path of the node it's
+// found in, such as
+//
+//	/feed/entry[2]/title: got text "One", want "Two"
+//
+// Element and attribute names are compared by namespace and local name,
+// so prefixes may differ. Attributes are compared in any order, and text
+// holding only whitespace, as used for indentation, is left out.
+func Diff(got, want *xmlpath.Node) []string {
+	var d differ
+	path := ""
+	if want.Kind() == xmlpath.StartNode && !isRoot(want) {
+		path = "/" + name(want.Name())
+	}
+	d.node(got, want, path)
+	return d.diffs
+}
+
+type differ struct {
+	diffs []string
+}
+
+func (d *differ) add(path, format string, args ...interface{}) {
+	if path == "" {
+		path = "/"
+	}
+	d.diffs = append(d.diffs, path+": "+fmt.Sprintf(format, args...))
+}
+
+func isRoot(node *xmlpath.Node) bool {
+	return node.Kind() == xmlpath.StartNode && node.Name().Local == ""
+}
+
+func (d *differ) node(got, want *xmlpath.Node, path string) {
+	if got.Kind() != want.Kind() || isRoot(got) != isRoot(want) {
+		d.add(path, "got %s, want %s", describe(got), describe(want))
+		return
+	}
+	switch got.Kind() {
+	case xmlpath.StartNode:
+		if got.Name() != want.Name() {
+			d.add(path, "got element %s, want %s", name(got.Name()), name(want.Name()))
+			return
+		}
+		d.attrs(got, want, path)
+		d.content(got, want, path)
+	case xmlpath.ProcInstNode:
+		if got.Name() != want.Name() {
+			d.add(path, "got %s, want %s", describe(got), describe(want))
+		} else if got.String() != want.String() {
+			d.add(path, "got processing instruction %q, want %q", got.String(), want.String())
+		}
+	default:
+		if got.String() != want.String() {
+			d.add(path, "got %s %q, want %q", kindName(got), got.String(), want.String())
+		}
+	}
+}
+
+func (d *differ) attrs(got, want *xmlpath.Node, path string) {
+	gotAttrs := attrMap(got)
+	wantAttrs := attrMap(want)
+	var names []xml.Name
+	for n := range gotAttrs {
+		names = append(names, n)
+	}
+	for n := range wantAttrs {
+		if _, ok := gotAttrs[n]; !ok {
+			names = append(names, n)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return name(names[i]) < name(names[j]) })
+	for _, n := range names {
+		g, gok := gotAttrs[n]
+		w, wok := wantAttrs[n]
+		switch {
+		case !gok:
+			d.add(path+"/@"+name(n), "missing attribute, want %q", w)
+		case !wok:
+			d.add(path+"/@"+name(n), "unexpected attribute %q", g)
+		case g != w:
+			d.add(path+"/@"+name(n), "got %q, want %q", g, w)
+		}
+	}
+}
+
+func attrMap(elem *xmlpath.Node) map[xml.Name]string {
+	attrs := make(map[xml.Name]string)
+	iter := attrsPath.Iter(elem)
+	for iter.Next() {
+		attrs[iter.Node().Name()] = iter.Node().String()
+	}
+	return attrs
+}
+
+func (d *differ) content(got, want *xmlpath.Node, path string) {
+	gotNodes := children(got)
+	wantNodes := children(want)
+	gotPaths := childPaths(gotNodes, path)
+	wantPaths := childPaths(wantNodes, path)
+	for i := 0; i < len(gotNodes) || i < len(wantNodes); i++ {
+		switch {
+		case i >= len(wantNodes):
+			d.add(gotPaths[i], "unexpected %s", describe(gotNodes[i]))
+		case i >= len(gotNodes):
+			d.add(wantPaths[i], "missing %s", describe(wantNodes[i]))
+		default:
+			d.node(gotNodes[i], wantNodes[i], wantPaths[i])
+		}
+	}
+}
+
+// children returns the nodes within elem, leaving out text holding
+// only whitespace.
+func children(elem *xmlpath.Node) []*xmlpath.Node {
+	var nodes []*xmlpath.Node
+	iter := nodesPath.Iter(elem)
+	for iter.Next() {
+		node := iter.Node()
+		if node.Kind() == xmlpath.TextNode && strings.TrimSpace(node.String()) == "" {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// childPaths returns the paths of nodes within the element at path,
+// with a position only where siblings share the same node test.
+func childPaths(nodes []*xmlpath.Node, path string) []string {
+	tests := make([]string, len(nodes))
+	counts := make(map[string]int)
+	for i, node := range nodes {
+		switch node.Kind() {
+		case xmlpath.StartNode:
+			tests[i] = name(node.Name())
+		case xmlpath.TextNode:
+			tests[i] = "text()"
+		case xmlpath.CommentNode:
+			tests[i] = "comment()"
+		default:
+			tests[i] = "processing-instruction()"
+		}
+		counts[tests[i]]++
+	}
+	paths := make([]string, len(nodes))
+	seen := make(map[string]int)
+	for i, test := range tests {
+		seen[test]++
+		if counts[test] > 1 {
+			test += "[" + strconv.Itoa(seen[test]) + "]"
+		}
+		paths[i] = path + "/" + test
+	}
+	return paths
+}
+
+func name(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return "{" + n.Space + "}" + n.Local
+}
+
+func kindName(node *xmlpath.Node) string {
+	switch node.Kind() {
+	case xmlpath.StartNode:
+		if isRoot(node) {
+			return "root"
+		}
+		return "element"
+	case xmlpath.TextNode:
+		return "text"
+	case xmlpath.CommentNode:
+		return "comment"
+	case xmlpath.ProcInstNode:
+		return "processing instruction"
+	case xmlpath.AttrNode:
+		return "attribute"
+	}
+	return "node"
+}
+
+func describe(node *xmlpath.Node) string {
+	switch node.Kind() {
+	case xmlpath.StartNode:
+		if isRoot(node) {
+			return "root"
+		}
+		return "element " + name(node.Name())
+	case xmlpath.ProcInstNode:
+		return "processing instruction " + node.Name().Local
+	}
+	return fmt.Sprintf("%s %q", kindName(node), node.String())
+}
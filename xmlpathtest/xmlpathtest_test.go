@@ -0,0 +1,154 @@
+package xmlpathtest_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fanirthuban/xmlpath"
+	"github.com/fanirthuban/xmlpath/xmlpathtest"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&TestSuite{})
+
+type TestSuite struct{}
+
+// recorder records the failures reported by the assertions.
+type recorder struct {
+	errors []string
+	fatal  string
+}
+
+type fatalError struct{}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Fatalf(format string, args ...interface{}) {
+	r.fatal = fmt.Sprintf(format, args...)
+	panic(fatalError{})
+}
+
+func (r *recorder) run(f func()) {
+	defer func() {
+		if v := recover(); v != nil {
+			if _, ok := v.(fatalError); !ok {
+				panic(v)
+			}
+		}
+	}()
+	f()
+}
+
+var feedXml = `<feed xmlns="urn:feed" xmlns:x="urn:x">
+  <entry id="1" x:lang="en"><title>One</title></entry>
+  <entry id="2"><title>Two</title><!-- draft --></entry>
+</feed>`
+
+func parse(c *C, doc string) *xmlpath.Node {
+	root, err := xmlpath.Parse(strings.NewReader(doc))
+	c.Assert(err, IsNil)
+	return root
+}
+
+func (s *TestSuite) TestAssertMatches(c *C) {
+	root := parse(c, feedXml)
+	r := &recorder{}
+	xmlpathtest.AssertMatches(r, root, "//title", "One", "Two")
+	xmlpathtest.AssertMatches(r, root, "//missing")
+	xmlpathtest.AssertCount(r, root, "//entry", 2)
+	c.Assert(r.errors, HasLen, 0)
+
+	xmlpathtest.AssertMatches(r, root, "//title", "One", "Three")
+	xmlpathtest.AssertMatches(r, root, "//title", "One")
+	xmlpathtest.AssertCount(r, root, "//entry/@id", 3)
+	c.Assert(r.errors, DeepEquals, []string{
+		`//title: got matches ["One", "Two"], want ["One", "Three"]`,
+		`//title: got 2 matches ["One", "Two"], want 1 ["One"]`,
+		`//entry/@id: got 2 matches, want 3`,
+	})
+
+	r = &recorder{}
+	r.run(func() { xmlpathtest.AssertCount(r, root, "//entry[", 1) })
+	c.Assert(r.fatal, Matches, `compiling xml path "//entry\[".*`)
+
+	// The assertions work with gocheck too.
+	xmlpathtest.AssertCount(c, root, "//entry", 2)
+}
+
+func (s *TestSuite) TestDiff(c *C) {
+	want := parse(c, feedXml)
+	same := parse(c, `<f:feed xmlns:f="urn:feed" xmlns:y="urn:x"><f:entry y:lang="en" id="1"><f:title>One</f:title></f:entry>`+
+		`<f:entry id="2"><f:title>Two</f:title><!-- draft --></f:entry></f:feed>`)
+	c.Assert(xmlpathtest.Diff(same, want), HasLen, 0)
+
+	got := parse(c, `<feed xmlns="urn:feed">
+  <entry id="1" rel="x"><title>Uno</title></entry>
+  <entry id="3"><name>Two</name><!-- final --></entry>
+  <entry/>
+</feed>`)
+	c.Assert(xmlpathtest.Diff(got, want), DeepEquals, []string{
+		`/{urn:feed}feed/{urn:feed}entry[1]/@rel: unexpected attribute "x"`,
+		`/{urn:feed}feed/{urn:feed}entry[1]/@{urn:x}lang: missing attribute, want "en"`,
+		`/{urn:feed}feed/{urn:feed}entry[1]/{urn:feed}title/text(): got text "Uno", want "One"`,
+		`/{urn:feed}feed/{urn:feed}entry[2]/@id: got "3", want "2"`,
+		`/{urn:feed}feed/{urn:feed}entry[2]/{urn:feed}title: got element {urn:feed}name, want {urn:feed}title`,
+		`/{urn:feed}feed/{urn:feed}entry[2]/comment(): got comment " final ", want " draft "`,
+		`/{urn:feed}feed/{urn:feed}entry[3]: unexpected element {urn:feed}entry`,
+	})
+
+	r := &recorder{}
+	xmlpathtest.AssertEqual(r, got, want)
+	c.Assert(r.errors, HasLen, 1)
+	c.Assert(strings.Count(r.errors[0], "\n\t"), Equals, 7)
+
+	r = &recorder{}
+	xmlpathtest.AssertEqual(r, parse(c, `<a>`+strings.Repeat("<b/>", 12)+`</a>`), parse(c, `<a/>`))
+	c.Assert(r.errors, HasLen, 1)
+	c.Assert(strings.HasSuffix(r.errors[0], "/a/b[10]: unexpected element b\n\t... and 2 more"), Equals, true)
+}
+
+func (s *TestSuite) TestAssertGolden(c *C) {
+	root := parse(c, feedXml)
+	iter := xmlpath.MustCompile("//entry[2]").Iter(root)
+	c.Assert(iter.Next(), Equals, true)
+	entry := iter.Node()
+	dir := c.MkDir()
+	golden := filepath.Join(dir, "entry.xml")
+
+	r := &recorder{}
+	r.run(func() { xmlpathtest.AssertGolden(r, entry, golden) })
+	c.Assert(r.fatal, Matches, "cannot read golden file: .*")
+
+	*xmlpathtest.Update = true
+	r = &recorder{}
+	xmlpathtest.AssertGolden(r, entry, golden)
+	xmlpathtest.AssertGolden(r, root, filepath.Join(dir, "feed.xml"))
+	*xmlpathtest.Update = false
+	c.Assert(r.errors, HasLen, 0)
+	data, err := os.ReadFile(golden)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `<entry id="2" xmlns="urn:feed" xmlns:x="urn:x"><title>Two</title><!-- draft --></entry>`+"\n")
+
+	xmlpathtest.AssertGolden(r, entry, golden)
+	xmlpathtest.AssertGolden(r, root, filepath.Join(dir, "feed.xml"))
+	c.Assert(r.errors, HasLen, 0)
+
+	iter = xmlpath.MustCompile("//entry[1]").Iter(root)
+	c.Assert(iter.Next(), Equals, true)
+	xmlpathtest.AssertGolden(r, iter.Node(), golden)
+	c.Assert(r.errors, DeepEquals, []string{golden + `: trees differ:` +
+		"\n\t" + `/{urn:feed}entry/@id: got "1", want "2"` +
+		"\n\t" + `/{urn:feed}entry/@{urn:x}lang: unexpected attribute "en"` +
+		"\n\t" + `/{urn:feed}entry/{urn:feed}title/text(): got text "One", want "Two"` +
+		"\n\t" + `/{urn:feed}entry/comment(): missing comment " draft "`,
+	})
+}